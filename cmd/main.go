@@ -6,29 +6,107 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/grafana/flagger-k6-webhook/pkg"
+	"github.com/grafana/flagger-k6-webhook/pkg/discord"
+	"github.com/grafana/flagger-k6-webhook/pkg/grafana"
+	"github.com/grafana/flagger-k6-webhook/pkg/handlers"
+	"github.com/grafana/flagger-k6-webhook/pkg/history"
+	"github.com/grafana/flagger-k6-webhook/pkg/jsonwebhook"
 	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/grafana/flagger-k6-webhook/pkg/kubeevents"
+	"github.com/grafana/flagger-k6-webhook/pkg/pagerduty"
 	"github.com/grafana/flagger-k6-webhook/pkg/slack"
+	"github.com/grafana/flagger-k6-webhook/pkg/teams"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	defaultPort               = 8000
 	defaultMaxConcurrentTests = 1000
+	defaultSlackMaxRetries    = 3
+	defaultRejectionInterval  = 10 * time.Minute
+	defaultReadyMinAvailable  = 1
+	defaultDrainTimeout       = 0
+	defaultReadTimeout        = 30 * time.Second
+	defaultWriteTimeout       = 0
+	defaultIdleTimeout        = 2 * time.Minute
 
+	flagConfig             = "config"
 	flagCloudToken         = "cloud-token"
+	flagCloudTokenFile     = "cloud-token-file"
+	flagK6BinaryPath       = "k6-binary-path"
+	flagCloudOutputMode    = "cloud-output-mode"
+	flagCloudURLRegex      = "cloud-url-regex"
+	flagCloudCACert        = "cloud-ca-cert"
+	flagK6PlainOutput      = "k6-plain-output"
+	flagK6Nice             = "k6-nice"
+	flagK6IsolateHome      = "k6-isolate-home"
+	flagK6StartMaxRetries  = "k6-start-max-retries"
+	flagK6LogOutput        = "k6-log-output"
 	flagLogLevel           = "log-level"
+	flagLogFormat          = "log-format"
 	flagListenPort         = "listen-port"
 	flagSlackToken         = "slack-token"
+	flagSlackMaxRetries    = "slack-max-retries"
+	flagSlackConsolidated  = "slack-consolidated"
+	flagRejectionChannel   = "slack-rejection-channel"
+	flagRejectionInterval  = "slack-rejection-interval"
+	flagTeamsWebhookURL    = "teams-webhook-url"
+	flagDiscordWebhookURL  = "discord-webhook-url"
+	flagNotificationURL    = "notification-webhook-url"
+	flagPagerDutyKey       = "pagerduty-routing-key"
+	flagGrafanaURL         = "grafana-url"
+	flagGrafanaAPIKey      = "grafana-api-key"
 	flagKubernetesClient   = "kubernetes-client"
+	flagKubeconfigPath     = "kubeconfig-path"
+	flagAllowedSecretNS    = "allowed-secret-namespaces"
+	flagEmitK8sEvents      = "emit-k8s-events"
 	flagMaxConcurrentTests = "max-concurrent-tests"
+	flagQueueTimeout       = "queue-timeout"
+	flagDefaultWaitSeconds = "default-wait-seconds"
+	flagMinWaitSeconds     = "min-wait-seconds"
+	flagMaxWaitSeconds     = "max-wait-seconds"
+	flagHandlerTimeout     = "handler-timeout"
+	flagMaxAsyncDuration   = "max-async-test-duration"
+	flagTestFailureStatus  = "test-failure-status"
+	flagRejectDuplicates   = "reject-duplicate-tests"
+	flagMaxOutputBytes     = "max-output-bytes"
+	flagMaxRequestBytes    = "max-request-bytes"
+	flagScriptFetchTimeout = "script-fetch-timeout"
+	flagWebhookAuthToken   = "webhook-auth-token"
+	flagOtelEndpoint       = "otel-exporter-endpoint"
+	flagHealthCheckK6      = "health-check-k6"
+	flagReadyMinAvailable  = "ready-min-available-tests"
+	flagFailureEviction    = "failure-eviction-interval"
+	flagDrainTimeout       = "drain-timeout"
+	flagReadTimeout        = "read-timeout"
+	flagWriteTimeout       = "write-timeout"
+	flagIdleTimeout        = "idle-timeout"
+	flagEnableH2C          = "enable-h2c"
+	flagRoutePrefix        = "route-prefix"
+	flagHistoryDB          = "history-db"
+	flagStartTemplate      = "start-message-template"
+	flagSuccessTemplate    = "success-message-template"
+	flagFailureTemplate    = "failure-message-template"
 
-	kubernetesClientNone      = "none"
-	kubernetesClientInCluster = "in-cluster"
+	// Whether the log level is given by a flag or an environment variable,
+	// in which case it can't be reloaded from the config file
+	metadataLogLevelFixed = "log-level-fixed"
+
+	kubernetesClientNone       = "none"
+	kubernetesClientInCluster  = "in-cluster"
+	kubernetesClientKubeconfig = "kubeconfig"
 )
 
 func main() {
@@ -40,73 +118,628 @@ func main() {
 func run(args []string) error {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
+	return newApp().RunContext(ctx, args)
+}
+
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "flagger-k6-webhook"
 	app.Usage = "Launches k6 load testing from a flagger webhook"
 	app.Action = launchServer
+	app.Commands = []*cli.Command{
+		{
+			Name:      "replay",
+			Usage:     "Runs the test of a payload saved from a Flagger webhook once, prints the response and exits with the exit code of k6",
+			ArgsUsage: "<payload file>",
+			Action:    replay,
+		},
+	}
 
 	app.Flags = []cli.Flag{
 		&cli.StringFlag{
+			Name:    flagConfig,
+			EnvVars: []string{"CONFIG"},
+			Usage:   "Path to a YAML file setting any of the other flags, by name (ex: 'listen-port: 8000'). Flags and environment variables take precedence",
+		},
+		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    flagCloudToken,
 			EnvVars: []string{"K6_CLOUD_TOKEN"},
-		},
-		&cli.IntFlag{
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagCloudTokenFile,
+			EnvVars: []string{"K6_CLOUD_TOKEN_FILE"},
+			Usage:   fmt.Sprintf("Path to a file containing the cloud token, ex: a mounted Kubernetes secret. Can't be used with --%s", flagCloudToken),
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagK6BinaryPath,
+			EnvVars: []string{"K6_BINARY_PATH"},
+			Value:   k6.DefaultBinaryPath,
+			Usage:   "Path (or name in $PATH) of the k6 binary to run tests with",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagCloudOutputMode,
+			EnvVars: []string{"CLOUD_OUTPUT_MODE"},
+			Value:   k6.CloudOutputModeLegacy,
+			Usage:   "How results are uploaded to the cloud: 'legacy' (k6 run --out cloud) or 'run' (k6 cloud run --local-execution, for k6 v0.52+)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagCloudURLRegex,
+			EnvVars: []string{"CLOUD_URL_REGEX"},
+			Usage:   "Regex finding the cloud URL in the output of k6, ex: for self-hosted instances. The URL must be captured by a group named 'url'. Defaults to matching app.k6.io and Grafana Cloud URLs",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagCloudCACert,
+			EnvVars: []string{"CLOUD_CA_CERT"},
+			Usage:   "Path to a PEM bundle of the CAs trusted by the tests uploading their results to the cloud, in place of the system ones, ex: for self-hosted instances with internal CAs",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    flagK6PlainOutput,
+			EnvVars: []string{"K6_PLAIN_OUTPUT"},
+			Value:   true,
+			Usage:   "Run k6 with --no-color and --quiet so that its output is readable in the responses and notifications. Set to false to keep the colors and progress bars",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    flagK6Nice,
+			EnvVars: []string{"K6_NICE"},
+			Usage:   "Nice value (from -20 to 19) of the k6 processes, to keep load tests from starving the node of CPU. Only supported on Linux, negative values require the CAP_SYS_NICE capability",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    flagK6IsolateHome,
+			EnvVars: []string{"K6_ISOLATE_HOME"},
+			Usage:   "Run each test with its own temporary HOME and XDG_CONFIG_HOME, removed once k6 has exited, so that the k6 configuration (ex: a cloud login) isn't shared between tests",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    flagK6StartMaxRetries,
+			EnvVars: []string{"K6_START_MAX_RETRIES"},
+			Value:   handlers.DefaultStartMaxRetries,
+			Usage:   "Maximum number of retries of starting k6 when it fails with transient errors (ex: if it can't fork or is out of file descriptors)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagK6LogOutput,
+			EnvVars: []string{"K6_LOG_OUTPUT"},
+			Usage:   "Default --log-output of k6 (none, stdout, stderr or loki[=<settings>]) for the tests that don't set 'log_output'. A template with the name, namespace and phase of the test, ex: 'loki=<push URL>,label.canary={{.Name}}'",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
 			Name:    flagListenPort,
 			EnvVars: []string{"LISTEN_PORT"},
 			Value:   defaultPort,
-		},
-		&cli.StringFlag{
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    flagLogLevel,
 			EnvVars: []string{"LOG_LEVEL"},
 			Value:   log.InfoLevel.String(),
-		},
-		&cli.StringFlag{
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagLogFormat,
+			EnvVars: []string{"LOG_FORMAT"},
+			Value:   "text",
+			Usage:   "Format of the logs, 'text' or 'json'",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    flagSlackToken,
 			EnvVars: []string{"SLACK_TOKEN"},
-		},
-		&cli.StringFlag{
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    flagSlackMaxRetries,
+			EnvVars: []string{"SLACK_MAX_RETRIES"},
+			Value:   defaultSlackMaxRetries,
+			Usage:   "Maximum number of retries of Slack API calls failing with transient errors (rate limiting, server errors)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    flagSlackConsolidated,
+			EnvVars: []string{"SLACK_CONSOLIDATED"},
+			Usage:   "Post the messages of a test to its first Slack channel only, with a link to it in the other channels, instead of updating every channel and uploading the files to each of them",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagRejectionChannel,
+			EnvVars: []string{"SLACK_REJECTION_CHANNEL"},
+			Usage:   "Slack channel notified when requests are rejected with a 429 because the maximum number of concurrent tests is reached. Empty to disable the notifications",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagRejectionInterval,
+			EnvVars: []string{"SLACK_REJECTION_INTERVAL"},
+			Value:   defaultRejectionInterval,
+			Usage:   "Minimum interval between two notifications of rejected requests, the other rejections aren't notified",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    flagTeamsWebhookURL,
+			EnvVars: []string{"TEAMS_WEBHOOK_URL"},
+			Usage:   "Microsoft Teams incoming webhooks as '<channel>=<webhook URL>'. The channel names can then be used in 'teams_channels'",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagDiscordWebhookURL,
+			EnvVars: []string{"DISCORD_WEBHOOK_URL"},
+			Usage:   "Discord webhook URL. If set, all tests are posted to it",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagNotificationURL,
+			EnvVars: []string{"NOTIFICATION_WEBHOOK_URL"},
+			Usage:   "URL to POST JSON events to when tests start, are updated and finish. If set, all tests are posted to it",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagPagerDutyKey,
+			EnvVars: []string{"PAGERDUTY_ROUTING_KEY"},
+			Usage:   "PagerDuty Events API v2 routing key. If set, an alert is triggered when a test fails and resolved when the next test of the same canary and phase succeeds",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagGrafanaURL,
+			EnvVars: []string{"GRAFANA_URL"},
+			Usage:   "URL of a Grafana instance (ex: https://my-stack.grafana.net). If set, each test is added as an annotation spanning its duration",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagGrafanaAPIKey,
+			EnvVars: []string{"GRAFANA_API_KEY"},
+			Usage:   "API key (or service account token) allowed to write annotations to the Grafana instance",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:    flagKubernetesClient,
 			EnvVars: []string{"KUBERNETES_CLIENT"},
 			Value:   kubernetesClientNone,
-			Usage:   fmt.Sprintf("Kubernetes client to use: '%s' or '%s'", kubernetesClientInCluster, kubernetesClientNone),
-		},
-		&cli.IntFlag{
+			Usage:   fmt.Sprintf("Kubernetes client to use: '%s', '%s' (from the file given by --%s) or '%s'", kubernetesClientInCluster, kubernetesClientKubeconfig, flagKubeconfigPath, kubernetesClientNone),
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagKubeconfigPath,
+			EnvVars: []string{"KUBECONFIG_PATH"},
+			Usage:   fmt.Sprintf("Path to the kubeconfig file used when --%s is '%s', for example to read secrets from another cluster", flagKubernetesClient, kubernetesClientKubeconfig),
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:    flagAllowedSecretNS,
+			EnvVars: []string{"ALLOWED_SECRET_NAMESPACES"},
+			Usage:   "Namespaces that secrets can be read from, besides the namespace of the canary. '*' allows all namespaces",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    flagEmitK8sEvents,
+			EnvVars: []string{"EMIT_K8S_EVENTS"},
+			Usage:   fmt.Sprintf("If set, the result of each test is recorded as a Kubernetes event on its canary. Requires --%s", flagKubernetesClient),
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
 			Name:    flagMaxConcurrentTests,
 			EnvVars: []string{"MAX_CONCURRENT_TESTS"},
 			Value:   defaultMaxConcurrentTests,
-		},
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagQueueTimeout,
+			EnvVars: []string{"QUEUE_TIMEOUT"},
+			Usage:   "How long requests wait for another test to complete when the maximum number of concurrent tests is reached, before being rejected with a 429. 0 rejects them right away",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    flagDefaultWaitSeconds,
+			EnvVars: []string{"DEFAULT_WAIT_SECONDS"},
+			Value:   handlers.DefaultWaitTimeSeconds,
+			Usage:   "Retry-After (in seconds) of the requests rejected because of the maximum number of concurrent tests, until a test has completed. The median duration of the tests is used afterwards",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    flagMinWaitSeconds,
+			EnvVars: []string{"MIN_WAIT_SECONDS"},
+			Value:   handlers.DefaultMinWaitTimeSeconds,
+			Usage:   "Minimum Retry-After (in seconds) computed from the duration of the tests",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    flagMaxWaitSeconds,
+			EnvVars: []string{"MAX_WAIT_SECONDS"},
+			Value:   handlers.DefaultMaxWaitTimeSeconds,
+			Usage:   "Maximum Retry-After (in seconds) computed from the duration of the tests",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagHandlerTimeout,
+			EnvVars: []string{"HANDLER_TIMEOUT"},
+			Usage:   "How long requests wait for the results of their test before a 504 is returned, no matter the 'test_timeout' of the test. The test is then killed. 0 disables the timeout",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagMaxAsyncDuration,
+			EnvVars: []string{"MAX_ASYNC_TEST_DURATION"},
+			Usage:   "How long the tests whose results aren't waited for ('wait_for_results: false') may run before they are killed. Shorter 'test_timeout's still apply. 0 disables the limit",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    flagTestFailureStatus,
+			EnvVars: []string{"TEST_FAILURE_STATUS"},
+			Value:   400,
+			Usage:   "Status returned when a test is run but fails (ex: 422 to tell it apart from the 400 of invalid requests). Must be a 4xx or 5xx status",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    flagRejectDuplicates,
+			EnvVars: []string{"REJECT_DUPLICATE_TESTS"},
+			Usage:   "If set, requests for a test (by namespace, name and phase) which is already running are rejected with a 409",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    flagMaxOutputBytes,
+			EnvVars: []string{"MAX_OUTPUT_BYTES"},
+			Value:   handlers.DefaultMaxOutputBytes,
+			Usage:   "Maximum size of the k6 output kept in memory for each test. The output is truncated past that size. 0 disables the limit",
+		}),
+		altsrc.NewInt64Flag(&cli.Int64Flag{
+			Name:    flagMaxRequestBytes,
+			EnvVars: []string{"MAX_REQUEST_BYTES"},
+			Value:   handlers.DefaultMaxRequestBytes,
+			Usage:   "Maximum size of the body of /launch-test requests. Larger requests are rejected with a 413. 0 disables the limit",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagScriptFetchTimeout,
+			EnvVars: []string{"SCRIPT_FETCH_TIMEOUT"},
+			Value:   handlers.DefaultScriptFetchTimeout,
+			Usage:   "Timeout when fetching a script from the 'script_url' metadata field",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagWebhookAuthToken,
+			EnvVars: []string{"WEBHOOK_AUTH_TOKEN"},
+			Usage:   "If set, requests to /launch-test, /tests/{key}, /history and /admin/concurrency must carry an 'Authorization: Bearer <token>' header. /admin/concurrency is only served if set",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagOtelEndpoint,
+			EnvVars: []string{"OTEL_EXPORTER_ENDPOINT"},
+			Usage:   "If set, traces of the tests are exported to this OTLP HTTP endpoint (ex: http://tempo:4318)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    flagHealthCheckK6,
+			EnvVars: []string{"HEALTH_CHECK_K6"},
+			Usage:   "If set, /readyz returns a 503 if 'k6 version' fails. The result is cached for 30 seconds",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:    flagReadyMinAvailable,
+			EnvVars: []string{"READY_MIN_AVAILABLE_TESTS"},
+			Value:   defaultReadyMinAvailable,
+			Usage:   "/readyz returns a 503 when fewer than this number of tests can be started",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagFailureEviction,
+			EnvVars: []string{"FAILURE_EVICTION_INTERVAL"},
+			Value:   handlers.DefaultFailureEvictionInterval,
+			Usage:   "How often failures older than 10 times their 'min_failure_delay' are forgotten",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagStartTemplate,
+			EnvVars: []string{"START_MESSAGE_TEMPLATE"},
+			Usage:   "Go template of the message sent when a test starts. See the README for the available fields",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagSuccessTemplate,
+			EnvVars: []string{"SUCCESS_MESSAGE_TEMPLATE"},
+			Usage:   "Go template of the message sent when a test succeeds. See the README for the available fields",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagFailureTemplate,
+			EnvVars: []string{"FAILURE_MESSAGE_TEMPLATE"},
+			Usage:   "Go template of the message sent when a test fails. See the README for the available fields",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagDrainTimeout,
+			EnvVars: []string{"DRAIN_TIMEOUT"},
+			Value:   defaultDrainTimeout,
+			Usage:   "On shutdown, how long to wait for in-flight requests (and the tests whose results they wait for) to complete before killing them. New requests are rejected in the meantime. 0 kills them right away",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagReadTimeout,
+			EnvVars: []string{"READ_TIMEOUT"},
+			Value:   defaultReadTimeout,
+			Usage:   "Maximum duration for reading a request, including its body. 0 disables the timeout",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagWriteTimeout,
+			EnvVars: []string{"WRITE_TIMEOUT"},
+			Value:   defaultWriteTimeout,
+			Usage:   "Maximum duration of a request, from the end of its headers to the end of the response. It must be longer than the tests whose results are waited for. 0 disables the timeout",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:    flagIdleTimeout,
+			EnvVars: []string{"IDLE_TIMEOUT"},
+			Value:   defaultIdleTimeout,
+			Usage:   "Maximum duration to wait for the next request on a keep-alive connection. 0 uses the read timeout",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:    flagEnableH2C,
+			EnvVars: []string{"ENABLE_H2C"},
+			Usage:   "Also accept HTTP/2 over cleartext connections (h2c), ex: from a service mesh preferring HTTP/2. HTTP/1.1 keeps working",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagRoutePrefix,
+			EnvVars: []string{"ROUTE_PREFIX"},
+			Usage:   "Path prefix of all the routes (ex: '/k6' to serve /k6/launch-test and /k6/metrics), for ingresses that don't strip it",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    flagHistoryDB,
+			EnvVars: []string{"HISTORY_DB"},
+			Usage:   "Path of a SQLite database to record every test run in (canary, phase, start time, duration, exit code and cloud URL), ex: for audit. The runs are listed by GET /history",
+		}),
+	}
+	// Values from the config file only apply to the flags that aren't set
+	// otherwise
+	loadConfigFile := altsrc.InitInputSourceWithContext(app.Flags, altsrc.NewYamlSourceFromFlagFunc(flagConfig))
+	app.Before = func(c *cli.Context) error {
+		// This has to be checked before the config file is loaded, as its
+		// values are then considered set
+		c.App.Metadata[metadataLogLevelFixed] = c.IsSet(flagLogLevel)
+		return loadConfigFile(c)
 	}
 
-	return app.RunContext(ctx, args)
+	return app
 }
 
 func launchServer(c *cli.Context) error {
-	ctx := c.Context
+	if err := configureLogging(c); err != nil {
+		return err
+	}
+	launchConfig, err := newLaunchConfig(c)
+	if err != nil {
+		return err
+	}
+	defer launchConfig.shutdown()
+
+	return pkg.Listen(c.Context, launchConfig.client, launchConfig.kubeClient, launchConfig.slackClient, c.Int(flagMaxConcurrentTests), serverConfig(c), launchConfig.opts...)
+}
+
+// replay runs the test of the payload file given as argument once, printing
+// the response to stdout. It exits with the exit code of k6.
+func replay(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected the path of a payload file, got %d arguments", c.NArg())
+	}
+	payload, err := os.Open(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+
+	if err := configureLogging(c); err != nil {
+		return err
+	}
+	launchConfig, err := newLaunchConfig(c)
+	if err != nil {
+		return err
+	}
+	defer launchConfig.shutdown()
+
+	launcherCtx, cancelLaunchCtx := context.WithCancel(c.Context)
+	launchHandler, err := handlers.NewLaunchHandler(launcherCtx, launchConfig.client, launchConfig.kubeClient, launchConfig.slackClient, 1, launchConfig.opts...)
+	if err != nil {
+		cancelLaunchCtx()
+		return err
+	}
+	defer func() {
+		// Tests whose results aren't waited for are waited for here
+		cancelLaunchCtx()
+		launchHandler.Wait()
+	}()
+
+	exitCode, err := handlers.Replay(c.Context, launchHandler, payload, c.App.Writer)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return cli.Exit("", exitCode)
+	}
+	return nil
+}
+
+// launchConfig is what the launch handler is created with, from the flags.
+type launchConfig struct {
+	client      k6.Client
+	kubeClient  kubernetes.Interface
+	slackClient slack.Client
+	opts        []handlers.LaunchHandlerOption
+	// Flushes the traces and closes the history, if enabled
+	shutdown func()
+}
+
+func configureLogging(c *cli.Context) error {
 	logLevel, err := log.ParseLevel(c.String(flagLogLevel))
 	if err != nil {
 		return err
 	}
 	log.SetLevel(logLevel)
+	if configPath := c.String(flagConfig); configPath != "" && c.App.Metadata[metadataLogLevelFixed] != true {
+		go reloadLogLevelOnSIGHUP(c.Context, configPath)
+	}
+	switch logFormat := c.String(flagLogFormat); logFormat {
+	case "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, must be 'text' or 'json'", logFormat)
+	}
+	return nil
+}
 
-	client, err := k6.NewLocalRunnerClient(c.String(flagCloudToken))
+func newLaunchConfig(c *cli.Context) (*launchConfig, error) {
+	client, err := k6.NewLocalRunnerClient(k6.LocalRunnerOptions{
+		Token:           c.String(flagCloudToken),
+		TokenFile:       c.String(flagCloudTokenFile),
+		BinaryPath:      c.String(flagK6BinaryPath),
+		CloudOutputMode: c.String(flagCloudOutputMode),
+		PlainOutput:     c.Bool(flagK6PlainOutput),
+		Nice:            c.Int(flagK6Nice),
+		CloudCACertPath: c.String(flagCloudCACert),
+		IsolateHome:     c.Bool(flagK6IsolateHome),
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	slackClient := slack.NewClient(c.String(flagSlackToken))
+	slackClient := slack.NewClient(c.String(flagSlackToken), c.Int(flagSlackMaxRetries), c.Bool(flagSlackConsolidated))
 
-	var kubeClient kubernetes.Interface
-	if c.String(flagKubernetesClient) == kubernetesClientInCluster {
-		log.Info("creating in-cluster kubernetes client")
-		kubeConfig, err := rest.InClusterConfig()
+	kubeClient, err := newKubeClient(c.String(flagKubernetesClient), c.String(flagKubeconfigPath))
+	if err != nil {
+		return nil, err
+	}
+
+	messageTemplates, err := handlers.ParseMessageTemplates(c.String(flagStartTemplate), c.String(flagSuccessTemplate), c.String(flagFailureTemplate))
+	if err != nil {
+		return nil, err
+	}
+
+	cloudURLRegex, err := handlers.ParseCloudURLRegex(c.String(flagCloudURLRegex))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &launchConfig{client: client, kubeClient: kubeClient, slackClient: slackClient, shutdown: func() {}}
+	launchOpts := []handlers.LaunchHandlerOption{
+		handlers.WithMessageTemplates(messageTemplates),
+		handlers.WithCloudURLRegex(cloudURLRegex),
+		handlers.WithScriptFetchTimeout(c.Duration(flagScriptFetchTimeout)),
+		handlers.WithMaxOutputBytes(c.Int64(flagMaxOutputBytes)),
+		handlers.WithMaxRequestBytes(c.Int64(flagMaxRequestBytes)),
+		handlers.WithFailureEvictionInterval(c.Duration(flagFailureEviction)),
+		handlers.WithAllowedSecretNamespaces(c.StringSlice(flagAllowedSecretNS)),
+		handlers.WithRejectDuplicateTests(c.Bool(flagRejectDuplicates)),
+		handlers.WithQueueTimeout(c.Duration(flagQueueTimeout)),
+		handlers.WithRejectionNotifications(c.String(flagRejectionChannel), c.Duration(flagRejectionInterval)),
+		handlers.WithWaitTime(c.Int64(flagDefaultWaitSeconds), c.Int64(flagMinWaitSeconds), c.Int64(flagMaxWaitSeconds)),
+		handlers.WithHandlerTimeout(c.Duration(flagHandlerTimeout)),
+		handlers.WithMaxAsyncTestDuration(c.Duration(flagMaxAsyncDuration)),
+		handlers.WithTestFailureStatus(c.Int(flagTestFailureStatus)),
+		handlers.WithStartMaxRetries(c.Int(flagK6StartMaxRetries)),
+		handlers.WithLogOutput(c.String(flagK6LogOutput)),
+	}
+
+	if teamsWebhooks := c.StringSlice(flagTeamsWebhookURL); len(teamsWebhooks) > 0 {
+		webhookURLs, err := teams.ParseWebhookURLs(teamsWebhooks)
+		if err != nil {
+			return nil, err
+		}
+		launchOpts = append(launchOpts, handlers.WithTeamsClient(teams.NewClient(webhookURLs)))
+	}
+
+	if discordWebhookURL := c.String(flagDiscordWebhookURL); discordWebhookURL != "" {
+		launchOpts = append(launchOpts, handlers.WithDiscordClient(discord.NewClient(discordWebhookURL)))
+	}
+
+	if notificationURL := c.String(flagNotificationURL); notificationURL != "" {
+		launchOpts = append(launchOpts, handlers.WithTestNotifier(jsonwebhook.NewClient(notificationURL).ForTest))
+	}
+
+	if routingKey := c.String(flagPagerDutyKey); routingKey != "" {
+		launchOpts = append(launchOpts, handlers.WithTestNotifier(pagerduty.NewClient(routingKey).ForTest))
+	}
+
+	if grafanaURL := c.String(flagGrafanaURL); grafanaURL != "" {
+		launchOpts = append(launchOpts, handlers.WithTestNotifier(grafana.NewClient(grafanaURL, c.String(flagGrafanaAPIKey)).ForTest))
+	}
+
+	if c.Bool(flagEmitK8sEvents) {
+		if kubeClient == nil {
+			return nil, fmt.Errorf("--%s requires a kubernetes client (see --%s)", flagEmitK8sEvents, flagKubernetesClient)
+		}
+		launchOpts = append(launchOpts, handlers.WithTestNotifier(kubeevents.NewClient(kubeClient).ForTest))
+	}
+
+	if otelEndpoint := c.String(flagOtelEndpoint); otelEndpoint != "" {
+		log.Infof("exporting traces to %s", otelEndpoint)
+		exporter, err := otlptracehttp.New(c.Context, otlptracehttp.WithEndpointURL(otelEndpoint))
 		if err != nil {
-			return err
+			return nil, err
+		}
+		tracerProvider := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "flagger-k6-webhook"))),
+		)
+		config.shutdown = func() {
+			// The main context is done at this point
+			if err := tracerProvider.Shutdown(context.Background()); err != nil {
+				log.Errorf("error flushing traces: %v", err)
+			}
+		}
+		launchOpts = append(launchOpts, handlers.WithTracerProvider(tracerProvider))
+	}
+
+	if historyPath := c.String(flagHistoryDB); historyPath != "" {
+		store, err := history.Open(historyPath)
+		if err != nil {
+			return nil, err
+		}
+		shutdownTracer := config.shutdown
+		config.shutdown = func() {
+			shutdownTracer()
+			if err := store.Close(); err != nil {
+				log.Errorf("error closing the history: %v", err)
+			}
 		}
-		if kubeClient, err = kubernetes.NewForConfig(kubeConfig); err != nil {
-			return err
+		launchOpts = append(launchOpts, handlers.WithHistory(store))
+	}
+
+	config.opts = launchOpts
+	return config, nil
+}
+
+func serverConfig(c *cli.Context) pkg.ServerConfig {
+	return pkg.ServerConfig{
+		Port:                   c.Int(flagListenPort),
+		AuthToken:              c.String(flagWebhookAuthToken),
+		ReadyMinAvailableTests: c.Int(flagReadyMinAvailable),
+		HealthCheckK6:          c.Bool(flagHealthCheckK6),
+		DrainTimeout:           c.Duration(flagDrainTimeout),
+		Timeouts: pkg.ServerTimeouts{
+			Read:  c.Duration(flagReadTimeout),
+			Write: c.Duration(flagWriteTimeout),
+			Idle:  c.Duration(flagIdleTimeout),
+		},
+		EnableH2C:   c.Bool(flagEnableH2C),
+		RoutePrefix: c.String(flagRoutePrefix),
+	}
+}
+
+// newKubeClient creates the kubernetes client of the given type. It returns nil
+// if no client should be created.
+func newKubeClient(clientType, kubeconfigPath string) (kubernetes.Interface, error) {
+	var kubeConfig *rest.Config
+	var err error
+	switch clientType {
+	case kubernetesClientInCluster:
+		log.Info("creating in-cluster kubernetes client")
+		if kubeConfig, err = rest.InClusterConfig(); err != nil {
+			return nil, err
+		}
+	case kubernetesClientKubeconfig:
+		log.Infof("creating kubernetes client from %s", kubeconfigPath)
+		if kubeconfigPath == "" {
+			return nil, fmt.Errorf("--%s is required with the '%s' kubernetes client", flagKubeconfigPath, kubernetesClientKubeconfig)
+		}
+		if _, err := os.Stat(kubeconfigPath); err != nil {
+			return nil, fmt.Errorf("invalid kubeconfig: %w", err)
 		}
-	} else {
+		if kubeConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfigPath); err != nil {
+			return nil, err
+		}
+	default:
 		log.Info("not creating a kubernetes client")
+		return nil, nil
+	}
+	return kubernetes.NewForConfig(kubeConfig)
+}
+
+// reloadLogLevelOnSIGHUP reloads the log level from the config file whenever a
+// SIGHUP is received, until the context is done.
+func reloadLogLevelOnSIGHUP(ctx context.Context, configPath string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			if err := reloadLogLevel(configPath); err != nil {
+				log.Errorf("error reloading the log level: %v", err)
+			}
+		}
 	}
+}
 
-	return pkg.Listen(ctx, client, kubeClient, slackClient, c.Int(flagListenPort), c.Int(flagMaxConcurrentTests))
+func reloadLogLevel(configPath string) error {
+	config, err := altsrc.NewYamlSourceFromFile(configPath)
+	if err != nil {
+		return err
+	}
+	level, err := config.String(flagLogLevel)
+	if err != nil {
+		return err
+	}
+	if level == "" {
+		level = log.InfoLevel.String()
+	}
+	logLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(logLevel)
+	log.Infof("log level set to %s", logLevel)
+	return nil
 }
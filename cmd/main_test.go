@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestConfigFile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`
+listen-port: 9000
+log-level: debug
+max-concurrent-tests: 10
+script-fetch-timeout: 1m
+teams-webhook-url:
+  - deploys=https://example.com/webhook
+`), 0o600))
+
+	// runApp runs the app with the given arguments and returns the context
+	// the server would have been launched with
+	runApp := func(t *testing.T, args ...string) *cli.Context {
+		t.Helper()
+
+		var result *cli.Context
+		app := newApp()
+		app.Action = func(c *cli.Context) error {
+			result = c
+			return nil
+		}
+		require.NoError(t, app.Run(append([]string{"flagger-k6-webhook"}, args...)))
+		return result
+	}
+
+	t.Run("values from the file", func(t *testing.T) {
+		c := runApp(t, "--config", configPath)
+		assert.Equal(t, 9000, c.Int(flagListenPort))
+		assert.Equal(t, "debug", c.String(flagLogLevel))
+		assert.Equal(t, 10, c.Int(flagMaxConcurrentTests))
+		assert.Equal(t, time.Minute, c.Duration(flagScriptFetchTimeout))
+		assert.Equal(t, []string{"deploys=https://example.com/webhook"}, c.StringSlice(flagTeamsWebhookURL))
+
+		// * Flags missing from the file keep their default
+		assert.Equal(t, defaultReadyMinAvailable, c.Int(flagReadyMinAvailable))
+	})
+
+	t.Run("flags take precedence", func(t *testing.T) {
+		c := runApp(t, "--config", configPath, "--listen-port", "9001")
+		assert.Equal(t, 9001, c.Int(flagListenPort))
+		assert.Equal(t, "debug", c.String(flagLogLevel))
+	})
+
+	t.Run("environment variables take precedence", func(t *testing.T) {
+		t.Setenv("LOG_LEVEL", "warn")
+		c := runApp(t, "--config", configPath)
+		assert.Equal(t, "warn", c.String(flagLogLevel))
+		assert.Equal(t, 9000, c.Int(flagListenPort))
+	})
+
+	t.Run("no config file", func(t *testing.T) {
+		c := runApp(t)
+		assert.Equal(t, defaultPort, c.Int(flagListenPort))
+	})
+
+	t.Run("missing config file", func(t *testing.T) {
+		app := newApp()
+		app.Action = func(*cli.Context) error { return nil }
+		assert.Error(t, app.Run([]string{"flagger-k6-webhook", "--config", filepath.Join(t.TempDir(), "missing.yaml")}))
+	})
+}
+
+func TestReloadLogLevel(t *testing.T) {
+	t.Cleanup(func() { log.SetLevel(log.InfoLevel) })
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+
+	require.NoError(t, os.WriteFile(configPath, []byte("log-level: debug\n"), 0o600))
+	require.NoError(t, reloadLogLevel(configPath))
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+
+	// * The level goes back to the default if it is removed from the file
+	require.NoError(t, os.WriteFile(configPath, []byte("listen-port: 9000\n"), 0o600))
+	require.NoError(t, reloadLogLevel(configPath))
+	assert.Equal(t, log.InfoLevel, log.GetLevel())
+
+	// * Invalid levels are ignored
+	require.NoError(t, os.WriteFile(configPath, []byte("log-level: verbose\n"), 0o600))
+	assert.Error(t, reloadLogLevel(configPath))
+	assert.Equal(t, log.InfoLevel, log.GetLevel())
+}
+
+func TestLogLevelFixed(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte("log-level: debug\n"), 0o600))
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		env      string
+		expected bool
+	}{
+		{name: "from the config file", args: []string{"--config", configPath}, expected: false},
+		{name: "from the flag", args: []string{"--config", configPath, "--log-level", "warn"}, expected: true},
+		{name: "from the environment", args: []string{"--config", configPath}, env: "warn", expected: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.env != "" {
+				t.Setenv("LOG_LEVEL", tc.env)
+			}
+			app := newApp()
+			var fixed interface{}
+			app.Action = func(c *cli.Context) error {
+				fixed = c.App.Metadata[metadataLogLevelFixed]
+				return nil
+			}
+			require.NoError(t, app.Run(append([]string{"flagger-k6-webhook"}, tc.args...)))
+			assert.Equal(t, tc.expected, fixed)
+		})
+	}
+}
+
+func TestNewKubeClient(t *testing.T) {
+	kubeconfigPath := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfigPath, []byte(`
+apiVersion: v1
+kind: Config
+clusters:
+- name: secrets
+  cluster:
+    server: https://secrets.example.com
+contexts:
+- name: secrets
+  context:
+    cluster: secrets
+    user: webhook
+current-context: secrets
+users:
+- name: webhook
+  user:
+    token: my-token
+`), 0o600))
+
+	t.Run("none", func(t *testing.T) {
+		client, err := newKubeClient(kubernetesClientNone, kubeconfigPath)
+		require.NoError(t, err)
+		assert.Nil(t, client)
+	})
+
+	t.Run("in-cluster", func(t *testing.T) {
+		// The kubeconfig is ignored
+		t.Setenv("KUBERNETES_SERVICE_HOST", "")
+		_, err := newKubeClient(kubernetesClientInCluster, kubeconfigPath)
+		assert.ErrorIs(t, err, rest.ErrNotInCluster)
+	})
+
+	t.Run("kubeconfig", func(t *testing.T) {
+		client, err := newKubeClient(kubernetesClientKubeconfig, kubeconfigPath)
+		require.NoError(t, err)
+		require.IsType(t, &kubernetes.Clientset{}, client)
+		assert.Equal(t, "secrets.example.com", client.(*kubernetes.Clientset).CoreV1().RESTClient().Get().URL().Host)
+	})
+
+	t.Run("missing kubeconfig path", func(t *testing.T) {
+		_, err := newKubeClient(kubernetesClientKubeconfig, "")
+		assert.EqualError(t, err, "--kubeconfig-path is required with the 'kubeconfig' kubernetes client")
+	})
+
+	t.Run("missing kubeconfig", func(t *testing.T) {
+		_, err := newKubeClient(kubernetesClientKubeconfig, filepath.Join(t.TempDir(), "missing"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		expected pkg.ServerTimeouts
+	}{
+		{
+			name:     "defaults",
+			expected: pkg.ServerTimeouts{Read: defaultReadTimeout, Write: defaultWriteTimeout, Idle: defaultIdleTimeout},
+		},
+		{
+			name:     "from the flags",
+			args:     []string{"--read-timeout", "10s", "--write-timeout", "1h", "--idle-timeout", "0"},
+			expected: pkg.ServerTimeouts{Read: 10 * time.Second, Write: time.Hour, Idle: 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newApp()
+			var timeouts pkg.ServerTimeouts
+			app.Action = func(c *cli.Context) error {
+				timeouts = serverConfig(c).Timeouts
+				return nil
+			}
+			require.NoError(t, app.Run(append([]string{"flagger-k6-webhook"}, tc.args...)))
+			assert.Equal(t, tc.expected, timeouts)
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		k6ExitCode       int
+		expectedExitCode int
+		expectedOutput   string
+	}{
+		{
+			name:           "success",
+			expectedOutput: "     output: -\n     checks: 100.00% 1 out of 1\n",
+		},
+		{
+			name:             "failure",
+			k6ExitCode:       99,
+			expectedExitCode: 99,
+			expectedOutput:   "failed to run: exit status 99\n     output: -\n     checks: 100.00% 1 out of 1\n\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			binaryPath := filepath.Join(t.TempDir(), "k6")
+			require.NoError(t, os.WriteFile(binaryPath, []byte(fmt.Sprintf("#!/bin/sh\necho '     output: -'\necho '     checks: 100.00%% 1 out of 1'\nexit %d\n", tc.k6ExitCode)), 0o755))
+
+			var out bytes.Buffer
+			app := newApp()
+			app.Writer = &out
+			// Keep the exit code from exiting the tests
+			app.ExitErrHandler = func(*cli.Context, error) {}
+			err := app.Run([]string{"flagger-k6-webhook", "--k6-binary-path", binaryPath, "replay", "testdata/replay-payload.json"})
+
+			assert.Equal(t, tc.expectedOutput, out.String())
+			if tc.expectedExitCode == 0 {
+				require.NoError(t, err)
+				return
+			}
+			var exitErr cli.ExitCoder
+			require.ErrorAs(t, err, &exitErr)
+			assert.Equal(t, tc.expectedExitCode, exitErr.ExitCode())
+		})
+	}
+
+	t.Run("missing payload file", func(t *testing.T) {
+		app := newApp()
+		err := app.Run([]string{"flagger-k6-webhook", "replay", filepath.Join(t.TempDir(), "missing.json")})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("invalid flags", func(t *testing.T) {
+		app := newApp()
+		err := app.Run([]string{"flagger-k6-webhook", "--k6-binary-path", "echo", "--test-failure-status", "200", "replay", "testdata/replay-payload.json"})
+		assert.EqualError(t, err, "invalid test failure status: 200 is not a 4xx or 5xx status")
+	})
+}
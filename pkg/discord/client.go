@@ -0,0 +1,149 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+)
+
+// webhookChannel is the key of the single message in the thread maps returned
+// by this client. A Discord webhook always posts to the same channel.
+const webhookChannel = "webhook"
+
+var statusColors = map[notifier.Status]int{
+	notifier.StatusUnknown: 0x979c9f,
+	notifier.StatusWarning: 0xecb22e,
+	notifier.StatusSuccess: 0x2eb67d,
+	notifier.StatusFailure: 0xe01e5a,
+}
+
+type discordClient struct {
+	webhookURL string
+	httpClient *http.Client
+}
+
+type embed struct {
+	Description string `json:"description"`
+	Color       int    `json:"color"`
+}
+
+type message struct {
+	Embeds []embed `json:"embeds"`
+}
+
+// NewClient returns a notifier posting to a Discord webhook. As the webhook
+// determines the channel, the channels passed to SendMessages are ignored and
+// every test is posted.
+func NewClient(webhookURL string) notifier.Notifier {
+	return &discordClient{
+		webhookURL: webhookURL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *discordClient) SendMessages(_ []string, text, context string) (map[string]string, error) {
+	body, err := json.Marshal(statusMessage(text, context))
+	if err != nil {
+		return nil, err
+	}
+
+	// wait=true makes Discord return the created message, which is needed to
+	// update it afterwards
+	respBody, err := c.do(http.MethodPost, "", url.Values{"wait": {"true"}}, "application/json", body)
+	if err != nil {
+		return nil, fmt.Errorf("error sending message to discord: %w", err)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(respBody, &created); err != nil {
+		return nil, fmt.Errorf("error parsing the created discord message: %w", err)
+	}
+	return map[string]string{webhookChannel: created.ID}, nil
+}
+
+func (c *discordClient) UpdateMessages(threads map[string]string, text, context string) error {
+	body, err := json.Marshal(statusMessage(text, context))
+	if err != nil {
+		return err
+	}
+	for _, messageID := range threads {
+		if _, err := c.do(http.MethodPatch, "/messages/"+messageID, nil, "application/json", body); err != nil {
+			return fmt.Errorf("error updating discord message %s: %w", messageID, err)
+		}
+	}
+	return nil
+}
+
+// AddFileToThreads posts the file as an attachment in a new message since
+// Discord webhooks can't post to threads of regular channels.
+func (c *discordClient) AddFileToThreads(threads map[string]string, fileName, content string) error {
+	if len(threads) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("files[0]", fileName)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write([]byte(content)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if _, err := c.do(http.MethodPost, "", nil, writer.FormDataContentType(), body.Bytes()); err != nil {
+		return fmt.Errorf("error while uploading output to discord: %w", err)
+	}
+	return nil
+}
+
+func (c *discordClient) do(method, path string, query url.Values, contentType string, body []byte) ([]byte, error) {
+	u, err := url.Parse(c.webhookURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += path
+	q := u.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, respBody)
+	}
+	return respBody, nil
+}
+
+func statusMessage(text, context string) message {
+	text, status := notifier.ParseStatus(text)
+	if context != "" {
+		text += "\n\n" + context
+	}
+	return message{Embeds: []embed{{Description: text, Color: statusColors[status]}}}
+}
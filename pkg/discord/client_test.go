@@ -0,0 +1,92 @@
+package discord
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedRequest struct {
+	method string
+	path   string
+	query  string
+	body   message
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *[]receivedRequest) {
+	var requests []receivedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received := receivedRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery}
+		if r.Header.Get("Content-Type") == "application/json" {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&received.body))
+		}
+		requests = append(requests, received)
+		w.Write([]byte(`{"id": "1234"}`)) //nolint:errcheck
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestStatusColors(t *testing.T) {
+	server, requests := newTestServer(t)
+	client := NewClient(server.URL + "/api/webhooks/1/token")
+
+	threads, err := client.SendMessages([]string{"ignored"}, ":warning: Load testing of `test-name` in namespace `test-space` has started", "extra context")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"webhook": "1234"}, threads)
+	require.NoError(t, client.UpdateMessages(threads, ":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded", "extra context"))
+	require.NoError(t, client.UpdateMessages(threads, ":red_circle: Load testing of `test-name` in namespace `test-space` has failed", ""))
+
+	assert.Equal(t, []receivedRequest{
+		{
+			method: http.MethodPost,
+			path:   "/api/webhooks/1/token",
+			query:  "wait=true",
+			body:   message{Embeds: []embed{{Description: "⚠️ Load testing of `test-name` in namespace `test-space` has started\n\nextra context", Color: 0xecb22e}}},
+		},
+		{
+			method: http.MethodPatch,
+			path:   "/api/webhooks/1/token/messages/1234",
+			body:   message{Embeds: []embed{{Description: "🟢 Load testing of `test-name` in namespace `test-space` has succeeded\n\nextra context", Color: 0x2eb67d}}},
+		},
+		{
+			method: http.MethodPatch,
+			path:   "/api/webhooks/1/token/messages/1234",
+			body:   message{Embeds: []embed{{Description: "🔴 Load testing of `test-name` in namespace `test-space` has failed", Color: 0xe01e5a}}},
+		},
+	}, *requests)
+}
+
+func TestAddFileToThreads(t *testing.T) {
+	var fileName, content string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("files[0]")
+		require.NoError(t, err)
+		b, err := io.ReadAll(file)
+		require.NoError(t, err)
+		fileName, content = header.Filename, string(b)
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL)
+	require.NoError(t, client.AddFileToThreads(map[string]string{"webhook": "1234"}, "k6-results.txt", "the output"))
+	assert.Equal(t, "k6-results.txt", fileName)
+	assert.Equal(t, "the output", content)
+}
+
+func TestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Unknown Webhook"}`)) //nolint:errcheck
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL)
+	_, err := client.SendMessages(nil, "text", "")
+	assert.EqualError(t, err, `error sending message to discord: unexpected status 404 Not Found: {"message": "Unknown Webhook"}`)
+}
@@ -0,0 +1,136 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+)
+
+// key of the single entry in the thread maps returned by this notifier. Its
+// value is the ID of the annotation.
+const annotationThread = "annotation"
+
+// Annotation is the body of the requests to the Grafana annotations API
+type Annotation struct {
+	Time    int64    `json:"time,omitempty"`
+	TimeEnd int64    `json:"timeEnd,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Text    string   `json:"text,omitempty"`
+}
+
+type createAnnotationResponse struct {
+	ID int64 `json:"id"`
+}
+
+// Client annotates Grafana dashboards with the tests. A region annotation is
+// created when a test starts and is ended when the test is done.
+type Client struct {
+	url        string
+	apiKey     string
+	httpClient *http.Client
+
+	// mockables
+	now func() time.Time
+}
+
+func NewClient(url, apiKey string) *Client {
+	return &Client{
+		url:        strings.TrimSuffix(url, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+}
+
+// ForTest returns a notifier annotating the given test. The channels passed
+// to the notifier are ignored.
+func (c *Client) ForTest(test *notifier.Test) notifier.Notifier {
+	return &testNotifier{client: c, test: test}
+}
+
+type testNotifier struct {
+	client *Client
+	test   *notifier.Test
+}
+
+func (n *testNotifier) SendMessages(_ []string, text, _ string) (map[string]string, error) {
+	message, status := notifier.StripStatus(text)
+	now := n.client.now().UnixMilli()
+	annotation := Annotation{
+		Time: now,
+		Tags: []string{"k6", "namespace:" + n.test.Namespace, "name:" + n.test.Name, "phase:" + n.test.Phase},
+		Text: n.text(message),
+	}
+	// Tests which didn't start are already done
+	if status == notifier.StatusFailure || status == notifier.StatusSuccess {
+		annotation.TimeEnd = now
+	}
+
+	var resp createAnnotationResponse
+	if err := n.client.do(http.MethodPost, "/api/annotations", annotation, &resp); err != nil {
+		return nil, fmt.Errorf("error creating the annotation: %w", err)
+	}
+	return map[string]string{annotationThread: strconv.FormatInt(resp.ID, 10)}, nil
+}
+
+func (n *testNotifier) UpdateMessages(threads map[string]string, text, _ string) error {
+	id, ok := threads[annotationThread]
+	if !ok {
+		return nil
+	}
+	message, status := notifier.StripStatus(text)
+	annotation := Annotation{Text: n.text(message)}
+	if status == notifier.StatusFailure || status == notifier.StatusSuccess {
+		annotation.TimeEnd = n.client.now().UnixMilli()
+	}
+	if err := n.client.do(http.MethodPatch, "/api/annotations/"+id, annotation, nil); err != nil {
+		return fmt.Errorf("error updating the annotation: %w", err)
+	}
+	return nil
+}
+
+func (n *testNotifier) AddFileToThreads(map[string]string, string, string) error {
+	return nil
+}
+
+func (n *testNotifier) text(message string) string {
+	if n.test.CloudURL != "" {
+		message += fmt.Sprintf(` (<a href="%s">k6 Cloud run</a>)`, n.test.CloudURL)
+	}
+	return message
+}
+
+// do sends the body as JSON and decodes the response in result, if not nil.
+func (c *Client) do(method, path string, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
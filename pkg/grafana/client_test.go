@@ -0,0 +1,112 @@
+package grafana
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedRequest struct {
+	method        string
+	path          string
+	authorization string
+	body          string
+}
+
+func newTestClient(t *testing.T, now *time.Time) (*Client, *[]receivedRequest) {
+	t.Helper()
+	var requests []receivedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests = append(requests, receivedRequest{
+			method:        r.Method,
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			body:          string(body),
+		})
+		if r.Method == http.MethodPost {
+			w.Write([]byte(`{"id": 42, "message": "Annotation added"}`)) //nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{"message": "Annotation patched"}`)) //nolint:errcheck
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL+"/", "my-api-key")
+	client.now = func() time.Time { return *now }
+	return client, &requests
+}
+
+func TestAnnotations(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	client, requests := newTestClient(t, &now)
+
+	test := &notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout", CloudURL: "https://app.k6.io/runs/1"}
+	n := client.ForTest(test)
+	threads, err := n.SendMessages(nil, ":warning: Load testing of `test-name` in namespace `test-space` has started", "context")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"annotation": "42"}, threads)
+	require.NoError(t, n.AddFileToThreads(threads, "k6-results.txt", "the output"))
+
+	now = now.Add(5 * time.Minute)
+	require.NoError(t, n.UpdateMessages(threads, ":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded", "context"))
+
+	require.Len(t, *requests, 2)
+	create, update := (*requests)[0], (*requests)[1]
+
+	assert.Equal(t, "POST", create.method)
+	assert.Equal(t, "/api/annotations", create.path)
+	assert.Equal(t, "Bearer my-api-key", create.authorization)
+	assert.JSONEq(t, `{
+		"time": 1700000000000,
+		"tags": ["k6", "namespace:test-space", "name:test-name", "phase:pre-rollout"],
+		"text": "Load testing of `+"`test-name`"+` in namespace `+"`test-space`"+` has started (<a href=\"https://app.k6.io/runs/1\">k6 Cloud run</a>)"
+	}`, create.body)
+
+	assert.Equal(t, "PATCH", update.method)
+	assert.Equal(t, "/api/annotations/42", update.path)
+	assert.Equal(t, "Bearer my-api-key", update.authorization)
+	assert.JSONEq(t, `{
+		"timeEnd": 1700000300000,
+		"text": "Load testing of `+"`test-name`"+` in namespace `+"`test-space`"+` has succeeded (<a href=\"https://app.k6.io/runs/1\">k6 Cloud run</a>)"
+	}`, update.body)
+}
+
+func TestAnnotationIfStartFailed(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	client, requests := newTestClient(t, &now)
+
+	n := client.ForTest(&notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"})
+	_, err := n.SendMessages(nil, ":red_circle: Load testing of `test-name` in namespace `test-space` didn't start successfully", "")
+	require.NoError(t, err)
+
+	require.Len(t, *requests, 1)
+	assert.JSONEq(t, `{
+		"time": 1700000000000,
+		"timeEnd": 1700000000000,
+		"tags": ["k6", "namespace:test-space", "name:test-name", "phase:pre-rollout"],
+		"text": "Load testing of `+"`test-name`"+` in namespace `+"`test-space`"+` didn't start successfully"
+	}`, (*requests)[0].body)
+}
+
+func TestNoUpdatesIfCreateFailed(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(server.Close)
+
+	n := NewClient(server.URL, "wrong-key").ForTest(&notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"})
+	threads, err := n.SendMessages(nil, ":warning: started", "")
+	assert.EqualError(t, err, "error creating the annotation: unexpected status 401 Unauthorized")
+	require.NoError(t, n.UpdateMessages(threads, ":red_circle: failed", ""))
+	assert.Equal(t, 1, calls)
+}
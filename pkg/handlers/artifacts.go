@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Name of the file bundling the artifacts of a test, if `bundle_artifacts` is
+// set
+const artifactsFilename = "k6-artifacts.tar.gz"
+
+// artifact is a file produced by a test, uploaded to the notification threads
+type artifact struct {
+	name    string
+	content string
+}
+
+// addArtifactsToThreads uploads the results and the summary exported by k6, if
+// any, either as separate files or bundled in a single tarball.
+func (h *singleRequestHandler) addArtifactsToThreads() error {
+	artifacts := []artifact{{name: h.payload.resultsFilename(), content: h.buf.String()}}
+	summary, exported, summaryErr := h.readSummary()
+	if exported {
+		artifacts = append(artifacts, artifact{name: "k6-summary.json", content: summary})
+	}
+
+	if !h.payload.Metadata.BundleArtifacts {
+		errs := []error{summaryErr}
+		for _, a := range artifacts {
+			errs = append(errs, h.addFileToThreads(a.name, a.content))
+		}
+		return errors.Join(errs...)
+	}
+
+	bundle, err := bundleArtifacts(artifacts, time.Now())
+	if err != nil {
+		return errors.Join(summaryErr, err)
+	}
+	return errors.Join(summaryErr, h.addFileToThreads(artifactsFilename, string(bundle)))
+}
+
+// bundleArtifacts returns a gzipped tarball of the artifacts, modified at the
+// given time.
+func bundleArtifacts(artifacts []artifact, modTime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, a := range artifacts {
+		header := &tar.Header{
+			Name:    a.name,
+			Mode:    0o644,
+			Size:    int64(len(a.content)),
+			ModTime: modTime,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("error bundling %s: %w", a.name, err)
+		}
+		if _, err := tarWriter.Write([]byte(a.content)); err != nil {
+			return nil, fmt.Errorf("error bundling %s: %w", a.name, err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, fmt.Errorf("error bundling the artifacts: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, fmt.Errorf("error bundling the artifacts: %w", err)
+	}
+	return buf.Bytes(), nil
+}
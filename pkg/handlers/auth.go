@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// RequireBearerToken wraps the given handler so that it is only called if the
+// request carries an `Authorization: Bearer <token>` header matching the given
+// token. If the token is empty, the handler is returned as is.
+func RequireBearerToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(resp, req, "unauthorized", "", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireBearerToken(t *testing.T) {
+	next := http.HandlerFunc(func(resp http.ResponseWriter, _ *http.Request) {
+		resp.Write([]byte("ok")) //nolint:errcheck
+	})
+
+	for _, tc := range []struct {
+		name          string
+		token         string
+		authorization string
+		expectedCode  int
+	}{
+		{
+			name:         "missing token",
+			token:        "secret",
+			expectedCode: 401,
+		},
+		{
+			name:          "wrong token",
+			token:         "secret",
+			authorization: "Bearer wrong",
+			expectedCode:  401,
+		},
+		{
+			name:          "wrong scheme",
+			token:         "secret",
+			authorization: "Basic secret",
+			expectedCode:  401,
+		},
+		{
+			name:          "correct token",
+			token:         "secret",
+			authorization: "Bearer secret",
+			expectedCode:  200,
+		},
+		{
+			name:         "authentication disabled",
+			expectedCode: 200,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/launch-test", nil)
+			if tc.authorization != "" {
+				request.Header.Set("Authorization", tc.authorization)
+			}
+			rr := httptest.NewRecorder()
+			RequireBearerToken(tc.token, next).ServeHTTP(rr, request)
+
+			assert.Equal(t, tc.expectedCode, rr.Result().StatusCode)
+		})
+	}
+}
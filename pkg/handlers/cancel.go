@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errTestNotFound   = errors.New("no running test with this key")
+	errTestNotStarted = errors.New("the test with this key is being started")
+)
+
+// CancelTest kills the running test with the given key.
+func (h *launchHandler) CancelTest(key string) error {
+	h.runningTestsMutex.Lock()
+	var cmd k6.TestRun
+	var cancel context.CancelFunc
+	test, ok := h.runningTests[key]
+	if ok {
+		cmd, cancel = test.cmd, test.cancel
+	}
+	h.runningTestsMutex.Unlock()
+	if !ok {
+		return errTestNotFound
+	}
+	if cmd == nil {
+		return errTestNotStarted
+	}
+
+	cancel()
+	// The process may have exited in the meantime
+	if err := cmd.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("error while killing the test: %w", err)
+	}
+	return nil
+}
+
+type cancelHandler struct {
+	launchHandler LaunchHandler
+}
+
+// NewCancelHandler returns the handler killing the running test whose key
+// (`<namespace>-<name>-<phase>`) is given by the `key` path value. It returns
+// a 404 if there is no such test and a 409 if it hasn't started yet.
+func NewCancelHandler(launchHandler LaunchHandler) http.Handler {
+	return &cancelHandler{launchHandler: launchHandler}
+}
+
+func (h *cancelHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+	err := h.launchHandler.CancelTest(key)
+	if errors.Is(err, errTestNotFound) {
+		writeError(resp, req, fmt.Sprintf("%s: %s", err, key), "", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errTestNotStarted) {
+		writeError(resp, req, fmt.Sprintf("%s: %s", err, key), "", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to cancel the test %s: %v", key, err)
+		writeError(resp, req, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	log.Infof("canceled the test %s", key)
+	resp.Write([]byte(fmt.Sprintf("Canceled the test %s", key))) //nolint:errcheck
+}
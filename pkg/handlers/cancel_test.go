@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelTest(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	mux := http.NewServeMux()
+	mux.Handle("DELETE /tests/{key}", NewCancelHandler(handler))
+
+	// The process runs until it is killed
+	killed := make(chan struct{})
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Kill().DoAndReturn(func() error {
+		close(killed)
+		return nil
+	})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		<-killed
+		return nil
+	})
+
+	// Expected calls
+	// * Start the run
+	_, resultParts := getTestOutput(t)
+	var processCtx context.Context
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		processCtx = ctx
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * Send the initial slack message
+	slackClient.EXPECT().SendMessages(nil, ":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started", "").Return(nil, nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "wait_for_results": "false"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+
+	// Cancel the test
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/tests/test-space-test-name-pre-rollout", nil))
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "Canceled the test test-space-test-name-pre-rollout", rr.Body.String())
+	assert.Error(t, processCtx.Err())
+
+	// The test is forgotten once the process has exited
+	assert.Eventually(t, func() bool {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/tests/test-space-test-name-pre-rollout", nil))
+		return rr.Code == 404
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCancelTestNotFound(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	mux := http.NewServeMux()
+	mux.Handle("DELETE /tests/{key}", NewCancelHandler(handler))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/tests/test-space-test-name-pre-rollout", nil))
+	assert.Equal(t, 404, rr.Code)
+	assert.Equal(t, "no running test with this key: test-space-test-name-pre-rollout\n", rr.Body.String())
+}
+
+func TestRejectDuplicateTests(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	handler.rejectDuplicateTests = true
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// The processes run until the end of the test
+	waiting := make(chan struct{}, 2)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Kill().Return(nil).AnyTimes()
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		waiting <- struct{}{}
+		<-done
+		return nil
+	}).Times(2)
+
+	// Expected calls
+	// * Start the runs of the first test and of the other phase, but not of the duplicate
+	_, resultParts := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, gomock.Any(), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	}).Times(2)
+
+	// * Send the initial slack messages
+	slackClient.EXPECT().SendMessages(nil, ":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started", "").Return(nil, nil)
+	slackClient.EXPECT().SendMessages(nil, ":warning: `post-rollout` load testing of `test-name` in namespace `test-space` has started", "").Return(nil, nil)
+
+	launch := func(phase string) *httptest.ResponseRecorder {
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "` + phase + `", "metadata": {"script": "my-script", "wait_for_results": "false"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		return rr
+	}
+
+	assert.Equal(t, 200, launch("pre-rollout").Code)
+
+	// The same test is rejected while it is running
+	rr := launch("pre-rollout")
+	assert.Equal(t, 409, rr.Code)
+	assert.Equal(t, "a test is already running for test-space-test-name-pre-rollout\n", rr.Body.String())
+	assert.Equal(t, 99, handler.AvailableTestRuns())
+	assert.Empty(t, handler.lastFailureTime)
+
+	// Another phase of the same canary is a different test
+	assert.Equal(t, 200, launch("post-rollout").Code)
+	assert.Equal(t, 98, handler.AvailableTestRuns())
+	<-waiting
+	<-waiting
+}
@@ -1,36 +1,162 @@
 package handlers
 
 import (
+	"encoding/json"
 	"errors"
+	"mime"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// requestIDHeader carries the ID used to correlate a request across flagger,
+// the webhook logs and the response.
+const requestIDHeader = "X-Request-ID"
+
+// errorResponse is the body of the errors returned to the clients accepting
+// JSON
+type errorResponse struct {
+	Error string `json:"error"`
+	// The output of k6, if any
+	Output string `json:"output,omitempty"`
+	// The invalid fields of the request, if it failed validation
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// fieldError is an invalid field of a request, identified by its path in the
+// payload, ex: `metadata.min_failure_delay`.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists every invalid field of a request, so that they can
+// all be fixed at once.
+type validationError struct {
+	Errors []fieldError
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fieldErr := range e.Errors {
+		messages = append(messages, fieldErr.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add records that the field is invalid. Only the first error of each field
+// is kept.
+func (e *validationError) add(field string, err error) {
+	for _, fieldErr := range e.Errors {
+		if fieldErr.Field == field {
+			return
+		}
+	}
+	e.Errors = append(e.Errors, fieldError{Field: field, Message: err.Error()})
+}
+
+// err returns the validation error, or nil if all the fields are valid.
+func (e *validationError) err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
 type flaggerWebhook struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
 	Phase     string `json:"phase"`
 }
 
+// The phases of the webhooks sent by Flagger
+var knownPhases = []string{
+	"confirm-rollout",
+	"pre-rollout",
+	"rollout",
+	"confirm-traffic-increase",
+	"confirm-promotion",
+	"post-rollout",
+	"rollback",
+	"event",
+}
+
 func (w *flaggerWebhook) validateBaseWebhook() error {
+	errs := &validationError{}
 	if w.Name == "" {
-		return errors.New("missing name")
+		errs.add("name", errors.New("missing name"))
 	}
 	if w.Namespace == "" {
-		return errors.New("missing namespace")
+		errs.add("namespace", errors.New("missing namespace"))
 	}
 	if w.Phase == "" {
-		return errors.New("missing phase")
+		errs.add("phase", errors.New("missing phase"))
+	}
+	return errs.err()
+}
+
+// requestID returns the ID sent by the client in the X-Request-ID header, or
+// a new UUID if there is none.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
 	}
-	return nil
+	return uuid.NewString()
 }
 
-func createLogEntry(req *http.Request) *log.Entry {
+func createLogEntry(req *http.Request, requestID string) *log.Entry {
 	return log.WithFields(log.Fields{
-		"requestID": uuid.NewString(),
+		"requestID": requestID,
 		"command":   req.RequestURI,
 		"ip":        req.RemoteAddr,
 	})
 }
+
+// knownPhase returns whether the phase is one that Flagger sends. Unknown
+// phases are accepted, in case new ones are added.
+func (w *flaggerWebhook) knownPhase() bool {
+	return slices.Contains(knownPhases, w.Phase)
+}
+
+// writeError replies to the request with the given error and the output of k6,
+// if any. The reply is JSON if the client accepts it (`Accept:
+// application/json`), and plain text otherwise.
+func writeError(resp http.ResponseWriter, req *http.Request, msg, output string, status int) {
+	writeErrorResponse(resp, req, errorResponse{Error: msg, Output: output}, status)
+}
+
+// writeErrorResponse is writeError for errors that may list invalid fields,
+// only returned to the clients accepting JSON.
+func writeErrorResponse(resp http.ResponseWriter, req *http.Request, body errorResponse, status int) {
+	if !acceptsJSON(req) {
+		msg := body.Error
+		if body.Output != "" {
+			msg += "\n" + body.Output
+		}
+		http.Error(resp, msg, status)
+		return
+	}
+	resp.Header().Del("Content-Length")
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(status)
+	if err := json.NewEncoder(resp).Encode(body); err != nil {
+		log.Errorf("error while writing the error response: %v", err)
+	}
+}
+
+// acceptsJSON returns whether the request explicitly accepts JSON responses.
+func acceptsJSON(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateLogEntryJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.StandardLogger()
+	previousOut, previousFormatter := logger.Out, logger.Formatter
+	logger.SetOutput(buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	t.Cleanup(func() {
+		logger.SetOutput(previousOut)
+		logger.SetFormatter(previousFormatter)
+	})
+
+	req := httptest.NewRequest("POST", "/launch-test", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	createLogEntry(req, "my-id").Info("hello")
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "hello", fields["msg"])
+	assert.Equal(t, "info", fields["level"])
+	assert.Equal(t, "/launch-test", fields["command"])
+	assert.Equal(t, "1.2.3.4:5678", fields["ip"])
+	assert.Equal(t, "my-id", fields["requestID"])
+	assert.Contains(t, fields, "time")
+}
+
+func TestRequestID(t *testing.T) {
+	t.Run("from header", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/launch-test", nil)
+		req.Header.Set("X-Request-ID", "flagger-request-1")
+		rr := httptest.NewRecorder()
+
+		h := newSingleRequestHandler(rr, req, nil)
+		assert.Equal(t, "flagger-request-1", h.log.Data["requestID"])
+		assert.Equal(t, "flagger-request-1", rr.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("generated", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/launch-test", nil)
+		rr := httptest.NewRecorder()
+
+		h := newSingleRequestHandler(rr, req, nil)
+		id := rr.Header().Get("X-Request-ID")
+		_, err := uuid.Parse(id)
+		require.NoError(t, err)
+		assert.Equal(t, id, h.log.Data["requestID"])
+	})
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum size of the body of /admin/concurrency requests
+const maxConcurrencyRequestBytes = 1024
+
+var errInvalidConcurrency = errors.New("the maximum number of concurrent tests must be positive")
+
+// SetMaxConcurrentTests changes the maximum number of concurrent tests. The
+// tests already running aren't affected: a smaller maximum only takes effect
+// as they complete.
+func (h *launchHandler) SetMaxConcurrentTests(maxConcurrentTests int) error {
+	if maxConcurrentTests <= 0 {
+		return errInvalidConcurrency
+	}
+	h.heldTestRunsMutex.Lock()
+	defer h.heldTestRunsMutex.Unlock()
+
+	h.heldTestRunsTarget = math.MaxInt64 - int64(maxConcurrentTests)
+	if h.heldTestRuns > h.heldTestRunsTarget {
+		h.testRuns.Release(h.heldTestRuns - h.heldTestRunsTarget)
+		h.heldTestRuns = h.heldTestRunsTarget
+	}
+	// The free slots are taken right away, the others by releaseTestRun as
+	// the tests complete
+	for h.heldTestRuns < h.heldTestRunsTarget && h.testRuns.TryAcquire(1) {
+		h.heldTestRuns++
+	}
+	h.maxTestRuns.Store(int64(maxConcurrentTests))
+	h.metricMaxConcurrentTests.Set(float64(maxConcurrentTests))
+	return nil
+}
+
+type concurrencyHandler struct {
+	launchHandler LaunchHandler
+}
+
+// NewConcurrencyHandler returns the handler changing the maximum number of
+// concurrent tests to the `max_concurrent_tests` of the JSON body, ex:
+// `{"max_concurrent_tests": 20}`. It returns a 400 if it isn't a positive
+// number.
+func NewConcurrencyHandler(launchHandler LaunchHandler) http.Handler {
+	return &concurrencyHandler{launchHandler: launchHandler}
+}
+
+func (h *concurrencyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	var body struct {
+		MaxConcurrentTests int `json:"max_concurrent_tests"`
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxConcurrencyRequestBytes)).Decode(&body); err != nil {
+		writeError(resp, req, fmt.Sprintf("error while reading the request: %v", err), "", http.StatusBadRequest)
+		return
+	}
+	if err := h.launchHandler.SetMaxConcurrentTests(body.MaxConcurrentTests); err != nil {
+		writeError(resp, req, err.Error(), "", http.StatusBadRequest)
+		return
+	}
+	log.Infof("set the maximum number of concurrent tests to %d", body.MaxConcurrentTests)
+	resp.Write([]byte(fmt.Sprintf("Set the maximum number of concurrent tests to %d", body.MaxConcurrentTests))) //nolint:errcheck
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetMaxConcurrentTests(t *testing.T) {
+	t.Run("growing", func(t *testing.T) {
+		// Initialize controller
+		ctx, cancel, _, _, _, _, handler := setupHandler(t, 1)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		require.NoError(t, handler.requestTestRun(ctx))
+		require.Error(t, handler.requestTestRun(ctx))
+
+		// The new slots are available right away
+		require.NoError(t, handler.SetMaxConcurrentTests(3))
+		assert.Equal(t, float64(3), getMetricValue(t, handler.metricMaxConcurrentTests, nil))
+		assert.Equal(t, 2, handler.AvailableTestRuns())
+		require.NoError(t, handler.requestTestRun(ctx))
+		require.NoError(t, handler.requestTestRun(ctx))
+		assert.Error(t, handler.requestTestRun(ctx))
+	})
+
+	t.Run("shrinking", func(t *testing.T) {
+		// Initialize controller
+		ctx, cancel, _, _, _, _, handler := setupHandler(t, 3)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		for range 3 {
+			require.NoError(t, handler.requestTestRun(ctx))
+		}
+
+		// The running tests go on
+		require.NoError(t, handler.SetMaxConcurrentTests(1))
+		assert.Equal(t, float64(1), getMetricValue(t, handler.metricMaxConcurrentTests, nil))
+		assert.Equal(t, 0, handler.AvailableTestRuns())
+
+		// The slots released aren't available until only one test is left
+		for range 2 {
+			handler.releaseTestRun()
+			assert.Equal(t, 0, handler.AvailableTestRuns())
+			require.Error(t, handler.requestTestRun(ctx))
+		}
+		handler.releaseTestRun()
+		assert.Equal(t, 1, handler.AvailableTestRuns())
+		require.NoError(t, handler.requestTestRun(ctx))
+		assert.Error(t, handler.requestTestRun(ctx))
+	})
+
+	t.Run("growing while shrinking", func(t *testing.T) {
+		// Initialize controller
+		ctx, cancel, _, _, _, _, handler := setupHandler(t, 2)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		for range 2 {
+			require.NoError(t, handler.requestTestRun(ctx))
+		}
+
+		// The slots that the shrink was waiting for are no longer needed
+		require.NoError(t, handler.SetMaxConcurrentTests(1))
+		require.NoError(t, handler.SetMaxConcurrentTests(3))
+		assert.Equal(t, float64(3), getMetricValue(t, handler.metricMaxConcurrentTests, nil))
+		assert.Equal(t, 1, handler.AvailableTestRuns())
+		require.NoError(t, handler.requestTestRun(ctx))
+		assert.Error(t, handler.requestTestRun(ctx))
+	})
+
+	t.Run("invalid maximum", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, _, _, _, handler := setupHandler(t, 2)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		assert.ErrorIs(t, handler.SetMaxConcurrentTests(0), errInvalidConcurrency)
+		assert.Equal(t, float64(2), getMetricValue(t, handler.metricMaxConcurrentTests, nil))
+		assert.Equal(t, 2, handler.AvailableTestRuns())
+	})
+}
+
+func TestConcurrencyHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedBody string
+		expectedMax  int
+	}{
+		{
+			name:         "valid",
+			body:         `{"max_concurrent_tests": 5}`,
+			expectedCode: http.StatusOK,
+			expectedBody: "Set the maximum number of concurrent tests to 5",
+			expectedMax:  5,
+		},
+		{
+			name:         "not positive",
+			body:         `{"max_concurrent_tests": -1}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "the maximum number of concurrent tests must be positive\n",
+			expectedMax:  2,
+		},
+		{
+			name:         "missing",
+			body:         `{}`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "the maximum number of concurrent tests must be positive\n",
+			expectedMax:  2,
+		},
+		{
+			name:         "invalid body",
+			body:         `bad`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: "error while reading the request: invalid character 'b' looking for beginning of value\n",
+			expectedMax:  2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, _, _, _, handler := setupHandler(t, 2)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			rr := httptest.NewRecorder()
+			NewConcurrencyHandler(handler).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/concurrency", strings.NewReader(tc.body)))
+
+			assert.Equal(t, tc.expectedCode, rr.Code)
+			assert.Equal(t, tc.expectedBody, rr.Body.String())
+			assert.Equal(t, tc.expectedMax, handler.AvailableTestRuns())
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+)
+
+const (
+	defaultErrorRatePollInterval = 10 * time.Second
+	// The error rate isn't judged on fewer requests
+	errorRateMinRequests = 100
+)
+
+// k6MetricsResponse is the response of the `/v1/metrics` endpoint of the REST
+// API of k6, which holds the live values of the metrics.
+type k6MetricsResponse struct {
+	Data []struct {
+		ID         string `json:"id"`
+		Attributes struct {
+			Sample map[string]float64 `json:"sample"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+// freeAPIAddress returns an address for the REST API of k6. As k6 listens on
+// 6565 by default, concurrent tests would compete for the same port.
+func freeAPIAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("could not find a free port for the k6 API: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// getErrorRate returns the rate of failed HTTP requests of the running test
+// and the number of requests it is computed from.
+func (h *singleRequestHandler) getErrorRate(ctx context.Context) (float64, float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+h.apiAddress+"/v1/metrics", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := h.lh.httpClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var metrics k6MetricsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		return 0, 0, fmt.Errorf("error decoding the metrics: %w", err)
+	}
+	var rate, requests float64
+	for _, m := range metrics.Data {
+		switch m.ID {
+		case "http_req_failed":
+			rate = m.Attributes.Sample["rate"]
+		case "http_reqs":
+			requests = m.Attributes.Sample["count"]
+		}
+	}
+	return rate, requests, nil
+}
+
+// monitorErrorRate polls the error rate of the test until it exits, and kills
+// it as soon as the rate exceeds `abort_on_error_rate`. The reason is then sent
+// to errorRateAbort.
+func (h *singleRequestHandler) monitorErrorRate(ctx context.Context, cmd k6.TestRun) {
+	ticker := time.NewTicker(h.lh.errorRatePollInterval)
+	defer ticker.Stop()
+	threshold := h.payload.Metadata.AbortOnErrorRate
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if cmd.Exited() {
+			return
+		}
+		rate, requests, err := h.getErrorRate(ctx)
+		if err != nil {
+			// The API isn't up until k6 has initialized the test
+			h.log.Debugf("couldn't get the error rate: %v", err)
+			continue
+		}
+		if requests < errorRateMinRequests || rate <= threshold {
+			continue
+		}
+
+		h.errorRateAbort <- fmt.Sprintf("error rate of %.2f%% above %.2f%%", rate*100, threshold*100)
+		h.log.Warnf("killing the test as its error rate of %.2f%% is above %.2f%%", rate*100, threshold*100)
+		if err := cmd.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			h.log.Errorf("error while killing the test: %v", err)
+		}
+		return
+	}
+}
@@ -1,8 +1,83 @@
 package handlers
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the result of `k6 version` is reused for. This avoids forking on
+// every probe.
+const k6HealthCheckTTL = 30 * time.Second
+
+// HandleHealth is the liveness probe. It succeeds as long as the process can
+// serve requests.
 func HandleHealth(resp http.ResponseWriter, _ *http.Request) {
 	resp.WriteHeader(200)
 	resp.Write([]byte("Good to go!")) //nolint:errcheck
 }
+
+type readyHandler struct {
+	launchHandler     LaunchHandler
+	minAvailableTests int
+	k6Check           *k6Check
+}
+
+// NewReadyHandler returns the readiness probe. It returns a 503 when fewer than
+// minAvailableTests tests can be started, so that traffic is shed while the
+// handler is saturated. If k6Client is not nil, it also returns a 503 when k6
+// can't be run.
+func NewReadyHandler(launchHandler LaunchHandler, minAvailableTests int, k6Client k6.Client) http.Handler {
+	h := &readyHandler{launchHandler: launchHandler, minAvailableTests: minAvailableTests}
+	if k6Client != nil {
+		h.k6Check = &k6Check{client: k6Client, now: time.Now}
+	}
+	return h
+}
+
+func (h *readyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if available := h.launchHandler.AvailableTestRuns(); available < h.minAvailableTests {
+		http.Error(resp, fmt.Sprintf("not enough available test runs (%d < %d)", available, h.minAvailableTests), http.StatusServiceUnavailable)
+		return
+	}
+	if h.k6Check != nil {
+		if err := h.k6Check.check(req.Context()); err != nil {
+			http.Error(resp, fmt.Sprintf("k6 is unavailable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	HandleHealth(resp, req)
+}
+
+// k6Check checks that k6 can be run, caching the result.
+type k6Check struct {
+	client k6.Client
+
+	mutex     sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+
+	// mockables
+	now func() time.Time
+}
+
+func (c *k6Check) check(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.checkedAt.IsZero() && c.now().Sub(c.checkedAt) < k6HealthCheckTTL {
+		return c.lastErr
+	}
+
+	_, c.lastErr = c.client.Version(ctx)
+	c.checkedAt = c.now()
+	if c.lastErr != nil {
+		log.Warnf("k6 health check failed: %v", c.lastErr)
+	}
+	return c.lastErr
+}
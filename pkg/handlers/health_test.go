@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafana/flagger-k6-webhook/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadyHandlerSaturation(t *testing.T) {
+	ctx, cancel, _, _, _, _, handler := setupHandler(t, 2)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	readyHandler := NewReadyHandler(handler, 1, nil)
+
+	rr := httptest.NewRecorder()
+	readyHandler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 200, rr.Code)
+
+	// Saturate the handler
+	require.NoError(t, handler.requestTestRun(ctx))
+	require.NoError(t, handler.requestTestRun(ctx))
+
+	rr = httptest.NewRecorder()
+	readyHandler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, rr.Code)
+	assert.Equal(t, "not enough available test runs (0 < 1)\n", rr.Body.String())
+
+	// Liveness is not affected
+	rr = httptest.NewRecorder()
+	HandleHealth(rr, httptest.NewRequest("GET", "/livez", nil))
+	assert.Equal(t, 200, rr.Code)
+
+	// With a higher threshold, one available test run isn't enough
+	handler.releaseTestRun()
+	rr = httptest.NewRecorder()
+	NewReadyHandler(handler, 2, nil).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 503, rr.Code)
+
+	rr = httptest.NewRecorder()
+	readyHandler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, 200, rr.Code)
+	handler.releaseTestRun()
+}
+
+func TestReadyHandlerK6Check(t *testing.T) {
+	t.Run("k6 available", func(t *testing.T) {
+		_, cancel, ctrl, _, _, _, handler := setupHandler(t, 1)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		k6Client := mocks.NewMockK6Client(ctrl)
+		k6Client.EXPECT().Version(gomock.Any()).Return("k6 v0.55.0", nil)
+
+		rr := httptest.NewRecorder()
+		NewReadyHandler(handler, 1, k6Client).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, 200, rr.Code)
+		assert.Equal(t, "Good to go!", rr.Body.String())
+	})
+
+	t.Run("k6 unavailable", func(t *testing.T) {
+		_, cancel, ctrl, _, _, _, handler := setupHandler(t, 1)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		k6Client := mocks.NewMockK6Client(ctrl)
+		k6Client.EXPECT().Version(gomock.Any()).Return("", errors.New("exec: \"k6\": executable file not found in $PATH"))
+
+		rr := httptest.NewRecorder()
+		NewReadyHandler(handler, 1, k6Client).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, 503, rr.Code)
+		assert.Equal(t, "k6 is unavailable: exec: \"k6\": executable file not found in $PATH\n", rr.Body.String())
+	})
+
+	t.Run("result is cached", func(t *testing.T) {
+		_, cancel, ctrl, _, _, _, handler := setupHandler(t, 1)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		k6Client := mocks.NewMockK6Client(ctrl)
+		readyHandler := NewReadyHandler(handler, 1, k6Client).(*readyHandler)
+		now := time.Now()
+		readyHandler.k6Check.now = func() time.Time { return now }
+
+		// Only one check within the TTL
+		k6Client.EXPECT().Version(gomock.Any()).Return("", errors.New("broken"))
+		for range 2 {
+			rr := httptest.NewRecorder()
+			readyHandler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+			assert.Equal(t, 503, rr.Code)
+		}
+
+		// The check is redone once the TTL has expired
+		now = now.Add(k6HealthCheckTTL)
+		k6Client.EXPECT().Version(gomock.Any()).Return("k6 v0.55.0", nil)
+		rr := httptest.NewRecorder()
+		readyHandler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, 200, rr.Code)
+	})
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/history"
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Result recorded for the tests whose results aren't waited for
+	historyResultLaunched = "launched"
+
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+
+	// Recording a run isn't tied to the request, which may be done already
+	historyWriteTimeout = 5 * time.Second
+)
+
+var errHistoryDisabled = errors.New("the run history is not enabled")
+
+// RecentRuns returns the last runs recorded in the history, up to limit, most
+// recent first.
+func (h *launchHandler) RecentRuns(ctx context.Context, limit int) ([]history.Run, error) {
+	if h.history == nil {
+		return nil, errHistoryDisabled
+	}
+	return h.history.Recent(ctx, limit)
+}
+
+// trackTestResult counts the result of the test and records its run in the
+// history, if enabled.
+func (h *singleRequestHandler) trackTestResult(result string, cmd k6.TestRun) {
+	h.lh.trackTestResult(h.payload, result)
+	h.recordRun(result, cmd)
+}
+
+// recordRun records the run of the test in the history, if enabled. Failing to
+// do so is only logged, so that it doesn't fail the test.
+func (h *singleRequestHandler) recordRun(result string, cmd k6.TestRun) {
+	if h.lh.history == nil {
+		return
+	}
+	run := history.Run{
+		Namespace: h.payload.Namespace,
+		Name:      h.payload.Name,
+		Phase:     h.payload.Phase,
+		StartedAt: h.startedAt,
+		ExitCode:  -1,
+		Result:    result,
+		CloudURL:  h.test.CloudURL,
+	}
+	// k6 is still running when the tests whose results aren't waited for
+	// are recorded
+	if result != historyResultLaunched {
+		run.DurationSeconds = cmd.ExecutionDuration().Seconds()
+		run.ExitCode = cmd.ExitCode()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), historyWriteTimeout)
+	defer cancel()
+	if err := h.lh.history.Add(ctx, run); err != nil {
+		h.log.Warnf("error recording the run in the history: %v", err)
+	}
+}
+
+type historyHandler struct {
+	launchHandler LaunchHandler
+}
+
+// NewHistoryHandler returns the handler listing the last runs recorded in the
+// history as JSON, up to the `limit` query parameter (100 by default). It
+// returns a 404 if the history isn't enabled.
+func NewHistoryHandler(launchHandler LaunchHandler) http.Handler {
+	return &historyHandler{launchHandler: launchHandler}
+}
+
+func (h *historyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	limit := defaultHistoryLimit
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxHistoryLimit {
+			writeError(resp, req, "invalid limit, it must be between 1 and "+strconv.Itoa(maxHistoryLimit), "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs, err := h.launchHandler.RecentRuns(req.Context(), limit)
+	if errors.Is(err, errHistoryDisabled) {
+		writeError(resp, req, err.Error(), "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to read the history: %v", err)
+		writeError(resp, req, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(runs) //nolint:errcheck
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafana/flagger-k6-webhook/pkg/history"
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		waitErr    error
+		wantStatus int
+		wantResult string
+	}{
+		{
+			name:       "success",
+			wantStatus: http.StatusOK,
+			wantResult: testResultSuccess,
+		},
+		{
+			name:       "failure",
+			waitErr:    errors.New("exit code 1"),
+			wantStatus: http.StatusBadRequest,
+			wantResult: testResultFailure,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+			store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() { store.Close() })
+			handler.history = store
+
+			// Expected calls
+			// * Start the run
+			_, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return tc.waitErr
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+			slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), gomock.Any()).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: io.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+			assert.Equal(t, tc.wantStatus, rr.Code)
+
+			// The run is listed in the history
+			rr = httptest.NewRecorder()
+			NewHistoryHandler(handler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/history", nil))
+			require.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			var runs []history.Run
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &runs))
+			require.Len(t, runs, 1)
+			assert.Equal(t, "test-space", runs[0].Namespace)
+			assert.Equal(t, "test-name", runs[0].Name)
+			assert.Equal(t, "pre-rollout", runs[0].Phase)
+			assert.Equal(t, tc.wantResult, runs[0].Result)
+			assert.Equal(t, float64(60), runs[0].DurationSeconds)
+			assert.False(t, runs[0].StartedAt.IsZero())
+		})
+	}
+}
+
+// The tests whose results aren't waited for are recorded while k6 is still
+// running, without exit code nor duration.
+func TestHistoryLaunched(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	handler.history = store
+
+	// Expected calls
+	_, resultParts := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	waiting := make(chan struct{})
+	exited := make(chan struct{})
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		close(waiting)
+		<-exited
+		return nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+	// Make request
+	request := &http.Request{
+		Body: io.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "wait_for_results": "false"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	<-waiting
+	close(exited)
+
+	runs, err := store.Recent(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, historyResultLaunched, runs[0].Result)
+	assert.Equal(t, -1, runs[0].ExitCode)
+	assert.Zero(t, runs[0].DurationSeconds)
+}
+
+func TestHistoryWriteFailureDoesntFailTheTest(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+	require.NoError(t, err)
+	// Writes fail once the database is closed
+	require.NoError(t, store.Close())
+	handler.history = store
+
+	// Expected calls
+	_, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), gomock.Any()).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: io.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		rr := httptest.NewRecorder()
+		NewHistoryHandler(handler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/history", nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		store, err := history.Open(filepath.Join(t.TempDir(), "history.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		handler.history = store
+		for _, name := range []string{"first", "second", "third"} {
+			require.NoError(t, store.Add(context.Background(), history.Run{Namespace: "test-space", Name: name, Phase: "pre-rollout", Result: testResultSuccess}))
+		}
+
+		rr := httptest.NewRecorder()
+		NewHistoryHandler(handler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/history?limit=2", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		var runs []history.Run
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &runs))
+		require.Len(t, runs, 2)
+		assert.Equal(t, "third", runs[0].Name)
+		assert.Equal(t, "second", runs[1].Name)
+
+		for _, limit := range []string{"0", "-1", "1001", "all"} {
+			rr := httptest.NewRecorder()
+			NewHistoryHandler(handler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/history?limit="+limit, nil))
+			assert.Equal(t, http.StatusBadRequest, rr.Code, limit)
+		}
+	})
+}
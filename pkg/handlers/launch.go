@@ -5,17 +5,30 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"mime"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/grafana/flagger-k6-webhook/pkg/history"
 	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
 	"github.com/grafana/flagger-k6-webhook/pkg/slack"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/sync/semaphore"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -25,52 +38,313 @@ const (
 	emojiFailure = ":red_circle:"
 
 	metricTestDurationName = "launch_test_duration"
+
+	testResultSuccess = "success"
+	testResultFailure = "failure"
+	testResultTimeout = "timeout"
+
+	secretErrorNotFound   = "not_found"
+	secretErrorMissingKey = "missing_key"
+	secretErrorNoClient   = "no_client"
+	secretErrorForbidden  = "forbidden"
+
+	defaultMaxScriptSize = 5 * 1024 * 1024
+
+	// Failures are forgotten after this many times their min_failure_delay
+	failureRetentionFactor = 10
+
+	// The output of k6 is polled every outputPollInterval, give or take
+	// outputPollJitter so that concurrent tests don't poll in lockstep
+	outputPollInterval = 2 * time.Second
+	outputPollJitter   = 500 * time.Millisecond
+	outputPollAttempts = 10
+
+	// Starting k6 is retried with an exponential backoff on transient
+	// errors, ex: if it can't fork
+	initialStartRetryBackoff = time.Second
+
+	// Sent in the Retry-After header of the requests rejected while shutting
+	// down
+	shutdownRetryAfter = 30 * time.Second
+)
+
+// The defaults of the launch handler options, also used as the defaults of
+// the command line flags
+const (
+	DefaultScriptFetchTimeout      = 30 * time.Second
+	DefaultMaxOutputBytes          = 5 * 1024 * 1024
+	DefaultMaxRequestBytes         = 10 * 1024 * 1024
+	DefaultFailureEvictionInterval = time.Minute
+	DefaultStartMaxRetries         = 2
+
+	// Retry-After of the requests rejected because of the concurrency limit,
+	// in seconds: the default one is sent until a test has completed, then
+	// the median duration of the tests is sent, within the bounds
+	DefaultWaitTimeSeconds    = 60
+	DefaultMinWaitTimeSeconds = 1
+	DefaultMaxWaitTimeSeconds = 3600
 )
 
+// k6 is not run through a shell but we still reject shell metacharacters in
+// extra arguments to be on the safe side.
+const extraArgsDisallowedChars = ";&|`$<>(){}\\\n\r"
+
 // https://regex101.com/r/OZwd8Y/1
 var outputRegex = regexp.MustCompile(`output: cloud \((?P<url>https:\/\/((app\.k6\.io)|([^/]+\.grafana.net\/a\/k6-app))\/runs\/\d+)\)`)
 
+// Slack message timestamps, ex: 1712345678.123456
+var slackTimestampRegex = regexp.MustCompile(`^\d+\.\d+$`)
+
+// Slack user (U... or W...) and user group (S...) IDs
+var slackMentionRegex = regexp.MustCompile(`^[UWS][A-Z0-9]+$`)
+
+// Returned for request bodies that aren't JSON
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// Tags that every test has, which can't be set in `tags`
+var reservedTags = []string{"canary", "namespace"}
+
+// The cloud URL is captured by this group of the regex
+const cloudURLGroup = "url"
+
 type launchPayload struct {
 	flaggerWebhook
 	Metadata struct {
 		Script string `json:"script"`
 
+		// Load the script from an HTTP(S) URL instead. Only used if `script` is empty
+		ScriptURL string `json:"script_url"`
+
+		// Load the script from a configmap instead (`<namespace (default: payload namespace)>/<configmap name>/<key>`). Only used if both `script` and `script_url` are empty
+		ScriptConfigMap string `json:"script_configmap"`
+
+		// Scripts run in sequence instead of the script above, ex: a smoke test then a load test
+		// (list of `{"name": <name>, "script": <script>, "options": <k6 options replacing the ones below>}`).
+		// The test fails as soon as one of them fails. Requires wait_for_results
+		Scripts       []suiteScript
+		ScriptsString string `json:"scripts"`
+
+		// Files written alongside the script, for it to import or open (map of `<relative path>` -> `<content>`)
+		ExtraFiles       map[string]string
+		ExtraFilesString string `json:"extra_files"`
+
+		// k6 options (as in a k6 JSON configuration file), passed with `--config`
+		Options string `json:"options"`
+
 		// If true, the test results will be uploaded to cloud
 		UploadToCloudString string `json:"upload_to_cloud"`
 		UploadToCloud       bool
 
+		// k6 Cloud project to upload the results to. Only used if upload_to_cloud is true
+		CloudProjectID string `json:"cloud_project_id"`
+
+		// If true, k6 is run with `--insecure-skip-tls-verify`, ex: for
+		// self-hosted cloud instances with internal CAs. Only used if
+		// upload_to_cloud is true
+		CloudInsecureSkipTLSVerifyString string `json:"cloud_insecure_skip_tls_verify"`
+		CloudInsecureSkipTLSVerify       bool
+
+		// If true, the script is only validated (with `k6 inspect`) after
+		// resolving secrets and env vars. No test is run
+		DryRunString string `json:"dry_run"`
+		DryRun       bool
+
 		// If true, the handler will wait for the k6 run to be completed
 		WaitForResultsString string `json:"wait_for_results"`
 		WaitForResults       bool
 
+		// If true, the response body starts with the cloud URL (it is
+		// always in the X-K6-Cloud-URL header). Ignored if the output is
+		// streamed
+		ReturnCloudURLString string `json:"return_cloud_url"`
+		ReturnCloudURL       bool
+
+		// If true, the request fails if the cloud URL can't be found in the
+		// output of k6. Otherwise, a warning is logged and the test goes on
+		// without it
+		StrictCloudURLString string `json:"strict_cloud_url"`
+		StrictCloudURL       bool
+
+		// If true, the k6 output is streamed to the client while the test is
+		// running. Requires wait_for_results
+		StreamOutputString string `json:"stream_output"`
+		StreamOutput       bool
+
+		// If true, the end-of-test summary is exported as JSON (with
+		// `--summary-export`) and uploaded to the notification threads as
+		// `k6-summary.json`. Requires wait_for_results
+		SummaryExportString string `json:"summary_export"`
+		SummaryExport       bool
+
+		// If true, the results and the summary (if exported) are uploaded to
+		// the notification threads as a single `k6-artifacts.tar.gz` file
+		BundleArtifactsString string `json:"bundle_artifacts"`
+		BundleArtifacts       bool
+
+		// The test is killed as soon as the rate of failed HTTP requests
+		// (from 0 to 1) exceeds this, once enough requests were made. The
+		// rate is polled from the REST API of k6. Requires wait_for_results
+		AbortOnErrorRateString string `json:"abort_on_error_rate"`
+		AbortOnErrorRate       float64
+
 		// Notification settings. Context is added at the end of the message
 		SlackChannelsString string `json:"slack_channels"`
 		SlackChannels       []string
+		TeamsChannelsString string `json:"teams_channels"`
+		TeamsChannels       []string
 		NotificationContext string `json:"notification_context"`
 
-		// Min delay between failures. All other runs will fail immediately. This prevents retries
+		// Timestamp of a Slack message to post the messages as replies to,
+		// ex: to keep all the rollouts of a canary in one thread. Requires a
+		// single Slack channel, the one of the message
+		SlackThreadTS string `json:"slack_thread_ts"`
+
+		// Slack user and user group IDs mentioned in the message when the
+		// test fails, ex: "U0123ABCD,S0456EFGH" to page an on-call group
+		SlackMentionsOnFailureString string `json:"slack_mentions_on_failure"`
+		SlackMentionsOnFailure       []string
+
+		// If true, failing to send the notifications fails the request, even
+		// if the test succeeds. Otherwise, the failures are only logged
+		RequireNotificationsString string `json:"require_notifications"`
+		RequireNotifications       bool
+
+		// Name of the results file uploaded to the notification threads
+		// (default: `<name>-<namespace>-k6-results.txt`)
+		ResultsFilename string `json:"results_filename"`
+
+		// Min delay between failures. All other runs will fail immediately. This prevents retries.
+		// 0 disables the check
 		MinFailureDelay       time.Duration
 		MinFailureDelayString string `json:"min_failure_delay"`
 
+		// Maximum duration of the k6 run. The process is killed past that
+		// duration. No timeout if empty
+		TestTimeout       time.Duration
+		TestTimeoutString string `json:"test_timeout"`
+
 		// Set environment variables when running the k6 script
 		EnvVars       map[string]string
 		EnvVarsString string `json:"env_vars"`
 
+		// Tags added to the metrics of the test (map of `<name>` -> `<value>`),
+		// besides the `canary` and `namespace` tags that every test has
+		Tags       map[string]string
+		TagsString string `json:"tags"`
+
+		// Where k6 sends its logs (`--log-output`), ex: `loki=<push URL>,label.canary={{.Name}}`.
+		// A template with the name, namespace and phase of the test. Overrides the default of the load tester
+		LogOutput string `json:"log_output"`
+
+		// Additional arguments passed to `k6 run` before the script path
+		ExtraArgs       []string
+		ExtraArgsString string `json:"extra_args"`
+
 		// Inject secrets to environment (map of `<ENV>` -> `<namespace (default: payload namespace)>/<secret name>/<secret key>`)
 		KubernetesSecrets       map[string]string
 		KubernetesSecretsString string `json:"kubernetes_secrets"`
+
+		// If true (the default), `kubernetes_secrets` take precedence over `env_vars` for the variables set by
+		// both. Otherwise, `env_vars` do. Collisions are logged either way
+		SecretsOverrideEnvString string `json:"secrets_override_env"`
+		SecretsOverrideEnv       bool
+
+		// Inject configmap values to environment (map of `<ENV>` -> `<namespace (default: payload namespace)>/<configmap name>/<key>`)
+		KubernetesConfigMaps       map[string]string
+		KubernetesConfigMapsString string `json:"kubernetes_configmaps"`
+
+		// Inject all keys of secrets to environment (list of `<namespace (default: payload namespace)>/<secret name>`).
+		// Keys that aren't valid environment variable names are skipped
+		KubernetesSecretEnvs       []string
+		KubernetesSecretEnvsString string `json:"kubernetes_secret_envs"`
+
+		// Write secrets to files (map of `<NAME>` -> `<namespace (default: payload namespace)>/<secret name>/<secret key>`).
+		// The path of each file is passed in the `K6_SECRET_FILE_<NAME>` environment variable
+		KubernetesSecretFiles       map[string]string
+		KubernetesSecretFilesString string `json:"kubernetes_secret_files"`
+
+		// Settings overriding the ones above for some phases (map of `<phase>` -> map of `<setting>` -> `<value>`).
+		// ex: `{"rollout": {"upload_to_cloud": "false"}}`
+		PhaseOverridesString string `json:"phase_overrides"`
 	} `json:"metadata"`
 }
 
-func (p *launchPayload) statusMessage(emoji, status string) string {
-	return fmt.Sprintf("%s Load testing of `%s` in namespace `%s` %s", emoji, p.Name, p.Namespace, status)
+// validateEnvVar checks that the variable can be passed to k6 as is: the name
+// must be a POSIX identifier and the value must not contain NUL bytes.
+func validateEnvVar(name, value string) error {
+	if !envVarNameRegex.MatchString(name) {
+		return fmt.Errorf("%q is not a valid environment variable name", name)
+	}
+	if strings.ContainsRune(value, 0) {
+		return fmt.Errorf("the value of %s contains a NUL byte", name)
+	}
+	return nil
+}
+
+// splitList returns the comma-separated values, trimmed and without the empty
+// entries (ex: from a trailing comma)
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// slackMentions returns the mentions of the Slack users and user groups
+func slackMentions(ids []string) string {
+	mentions := make([]string, len(ids))
+	for i, id := range ids {
+		if strings.HasPrefix(id, "S") {
+			mentions[i] = "<!subteam^" + id + ">"
+		} else {
+			mentions[i] = "<@" + id + ">"
+		}
+	}
+	return strings.Join(mentions, " ")
+}
+
+func (p *launchPayload) script(content string) k6.Script {
+	tags := map[string]string{"canary": p.Name, "namespace": p.Namespace}
+	maps.Copy(tags, p.Metadata.Tags)
+	return k6.Script{Content: content, Files: p.Metadata.ExtraFiles, Options: p.Metadata.Options, Tags: tags}
+}
+
+func (p *launchPayload) resultsFilename() string {
+	if p.Metadata.ResultsFilename != "" {
+		return p.Metadata.ResultsFilename
+	}
+	return fmt.Sprintf("%s-%s-k6-results.txt", p.Name, p.Namespace)
+}
+
+// logOutputData is what the `log_output` template has access to
+func (p *launchPayload) logOutputData() messageData {
+	return messageData{Name: p.Name, Namespace: p.Namespace, Phase: p.Phase}
 }
 
 func (p *launchPayload) key() string {
 	return fmt.Sprintf("%s-%s-%s", p.Namespace, p.Name, p.Phase)
 }
 
-func newLaunchPayload(req *http.Request) (*launchPayload, error) {
+// checkContentType returns errUnsupportedMediaType if the body of the request
+// isn't JSON. Bodies without a Content-Type are assumed to be JSON.
+func checkContentType(req *http.Request) error {
+	value := req.Header.Get("Content-Type")
+	if value == "" {
+		return nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(value); err != nil || mediaType != "application/json" {
+		return fmt.Errorf("%w %q, expected application/json", errUnsupportedMediaType, value)
+	}
+	return nil
+}
+
+// newLaunchPayload parses and validates the request body. Bodies larger than
+// maxBytes are rejected with an *http.MaxBytesError and bodies that aren't JSON
+// with errUnsupportedMediaType. 0 disables the limit.
+func newLaunchPayload(req *http.Request, maxBytes int64) (*launchPayload, error) {
 	var err error
 	payload := &launchPayload{}
 
@@ -78,7 +352,14 @@ func newLaunchPayload(req *http.Request) (*launchPayload, error) {
 		return nil, errors.New("no request body")
 	}
 	defer req.Body.Close()
-	if err = json.NewDecoder(req.Body).Decode(payload); err != nil {
+	if err := checkContentType(req); err != nil {
+		return nil, err
+	}
+	body := req.Body
+	if maxBytes > 0 {
+		body = http.MaxBytesReader(nil, body, maxBytes)
+	}
+	if err = json.NewDecoder(body).Decode(payload); err != nil {
 		return nil, err
 	}
 
@@ -86,6 +367,14 @@ func newLaunchPayload(req *http.Request) (*launchPayload, error) {
 		return nil, fmt.Errorf("error while validating base webhook: %w", err)
 	}
 
+	if err := payload.applyPhaseOverrides(); err != nil {
+		// The other settings may have been partially overridden, they aren't
+		// validated
+		errs := &validationError{}
+		errs.add("metadata.phase_overrides", err)
+		return nil, errs
+	}
+
 	if err := payload.validate(); err != nil {
 		return nil, err
 	}
@@ -93,106 +382,777 @@ func newLaunchPayload(req *http.Request) (*launchPayload, error) {
 	return payload, nil
 }
 
+// applyPhaseOverrides replaces the settings given in `phase_overrides` for the
+// phase of the webhook, before they are validated.
+func (p *launchPayload) applyPhaseOverrides() error {
+	if p.Metadata.PhaseOverridesString == "" {
+		return nil
+	}
+	// As in the metadata, the values are strings
+	var overrides map[string]map[string]string
+	if err := json.Unmarshal([]byte(p.Metadata.PhaseOverridesString), &overrides); err != nil {
+		return fmt.Errorf("error parsing value for 'phase_overrides': %w", err)
+	}
+	override, ok := overrides[p.Phase]
+	if !ok {
+		return nil
+	}
+	// Overrides can't be overridden
+	delete(override, "phase_overrides")
+	data, err := json.Marshal(override)
+	if err != nil {
+		return fmt.Errorf("error parsing value for 'phase_overrides': %w", err)
+	}
+	if err := json.Unmarshal(data, &p.Metadata); err != nil {
+		return fmt.Errorf("error parsing value for 'phase_overrides': %s: %w", p.Phase, err)
+	}
+	return nil
+}
+
+// parseScripts parses and validates the scripts of a suite.
+func (p *launchPayload) parseScripts() error {
+	if p.Metadata.Script != "" || p.Metadata.ScriptURL != "" || p.Metadata.ScriptConfigMap != "" {
+		return errors.New("'scripts' can't be combined with 'script', 'script_url' or 'script_configmap'")
+	}
+	if err := json.Unmarshal([]byte(p.Metadata.ScriptsString), &p.Metadata.Scripts); err != nil {
+		return fmt.Errorf("error parsing value for 'scripts': %w", err)
+	}
+	if len(p.Metadata.Scripts) == 0 {
+		return errors.New("error parsing value for 'scripts': no script given")
+	}
+	names := map[string]bool{}
+	for i, script := range p.Metadata.Scripts {
+		if script.Name == "" {
+			return fmt.Errorf("error parsing value for 'scripts': script %d has no name", i)
+		}
+		if names[script.Name] {
+			return fmt.Errorf("error parsing value for 'scripts': %q is the name of several scripts", script.Name)
+		}
+		names[script.Name] = true
+		if script.Script == "" {
+			return fmt.Errorf("error parsing value for 'scripts': %q has no script", script.Name)
+		}
+		if script.Options != "" {
+			var options map[string]interface{}
+			if err := json.Unmarshal([]byte(script.Options), &options); err != nil {
+				return fmt.Errorf("error parsing value for 'scripts': options of %q: %w", script.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (p *launchPayload) validate() error {
 	var err error
+	errs := &validationError{}
+
+	// The script is taken from the first of these that is set: `script`,
+	// `script_url`, `script_configmap`. Suites replace them all
+	switch {
+	case p.Metadata.ScriptsString != "":
+		if err := p.parseScripts(); err != nil {
+			errs.add("metadata.scripts", err)
+		}
+	case p.Metadata.Script != "":
+	case p.Metadata.ScriptURL != "":
+		if u, err := url.Parse(p.Metadata.ScriptURL); err != nil {
+			errs.add("metadata.script_url", fmt.Errorf("error parsing value for 'script_url': %w", err))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errs.add("metadata.script_url", fmt.Errorf("error parsing value for 'script_url': unsupported scheme %q", u.Scheme))
+		}
+	case p.Metadata.ScriptConfigMap != "":
+		if _, _, _, err := parseKubernetesReference(p.Metadata.ScriptConfigMap, p.Namespace); err != nil {
+			errs.add("metadata.script_configmap", fmt.Errorf("error parsing value for 'script_configmap': %w", err))
+		}
+	default:
+		errs.add("metadata.script", errors.New("missing script"))
+	}
+
+	if p.Metadata.ExtraFilesString != "" {
+		if err := json.Unmarshal([]byte(p.Metadata.ExtraFilesString), &p.Metadata.ExtraFiles); err != nil {
+			errs.add("metadata.extra_files", fmt.Errorf("error parsing value for 'extra_files': %w", err))
+		}
+		for name := range p.Metadata.ExtraFiles {
+			if err := k6.ValidateFileName(name); err != nil {
+				errs.add("metadata.extra_files", fmt.Errorf("error parsing value for 'extra_files': %w", err))
+			}
+		}
+	}
 
-	if p.Metadata.Script == "" {
-		return errors.New("missing script")
+	if p.Metadata.Options != "" {
+		var options map[string]interface{}
+		if err := json.Unmarshal([]byte(p.Metadata.Options), &options); err != nil {
+			errs.add("metadata.options", fmt.Errorf("error parsing value for 'options': %w", err))
+		}
 	}
 
 	if p.Metadata.UploadToCloudString == "" {
 		p.Metadata.UploadToCloud = false
 	} else if p.Metadata.UploadToCloud, err = strconv.ParseBool(p.Metadata.UploadToCloudString); err != nil {
-		return fmt.Errorf("error parsing value for 'upload_to_cloud': %w", err)
+		errs.add("metadata.upload_to_cloud", fmt.Errorf("error parsing value for 'upload_to_cloud': %w", err))
+	}
+
+	if p.Metadata.CloudInsecureSkipTLSVerifyString == "" {
+		p.Metadata.CloudInsecureSkipTLSVerify = false
+	} else if p.Metadata.CloudInsecureSkipTLSVerify, err = strconv.ParseBool(p.Metadata.CloudInsecureSkipTLSVerifyString); err != nil {
+		errs.add("metadata.cloud_insecure_skip_tls_verify", fmt.Errorf("error parsing value for 'cloud_insecure_skip_tls_verify': %w", err))
+	}
+
+	if p.Metadata.CloudProjectID != "" {
+		if _, err := strconv.ParseUint(p.Metadata.CloudProjectID, 10, 64); err != nil {
+			errs.add("metadata.cloud_project_id", fmt.Errorf("error parsing value for 'cloud_project_id': %w", err))
+		}
+	}
+
+	if strings.ContainsAny(p.Metadata.ResultsFilename, `/\`) {
+		errs.add("metadata.results_filename", fmt.Errorf("error parsing value for 'results_filename': %q must not contain path separators", p.Metadata.ResultsFilename))
+	}
+
+	if p.Metadata.DryRunString == "" {
+		p.Metadata.DryRun = false
+	} else if p.Metadata.DryRun, err = strconv.ParseBool(p.Metadata.DryRunString); err != nil {
+		errs.add("metadata.dry_run", fmt.Errorf("error parsing value for 'dry_run': %w", err))
 	}
 
 	if p.Metadata.WaitForResultsString == "" {
 		p.Metadata.WaitForResults = true
 	} else if p.Metadata.WaitForResults, err = strconv.ParseBool(p.Metadata.WaitForResultsString); err != nil {
-		return fmt.Errorf("error parsing value for 'wait_for_results': %w", err)
+		errs.add("metadata.wait_for_results", fmt.Errorf("error parsing value for 'wait_for_results': %w", err))
+	}
+
+	if p.Metadata.StreamOutputString == "" {
+		p.Metadata.StreamOutput = false
+	} else if p.Metadata.StreamOutput, err = strconv.ParseBool(p.Metadata.StreamOutputString); err != nil {
+		errs.add("metadata.stream_output", fmt.Errorf("error parsing value for 'stream_output': %w", err))
+	} else if p.Metadata.StreamOutput && !p.Metadata.WaitForResults {
+		errs.add("metadata.stream_output", errors.New("'stream_output' requires 'wait_for_results'"))
+	}
+
+	if p.Metadata.SummaryExportString == "" {
+		p.Metadata.SummaryExport = false
+	} else if p.Metadata.SummaryExport, err = strconv.ParseBool(p.Metadata.SummaryExportString); err != nil {
+		errs.add("metadata.summary_export", fmt.Errorf("error parsing value for 'summary_export': %w", err))
+	} else if p.Metadata.SummaryExport && !p.Metadata.WaitForResults {
+		errs.add("metadata.summary_export", errors.New("'summary_export' requires 'wait_for_results'"))
+	}
+
+	if p.Metadata.BundleArtifactsString == "" {
+		p.Metadata.BundleArtifacts = false
+	} else if p.Metadata.BundleArtifacts, err = strconv.ParseBool(p.Metadata.BundleArtifactsString); err != nil {
+		errs.add("metadata.bundle_artifacts", fmt.Errorf("error parsing value for 'bundle_artifacts': %w", err))
+	}
+
+	if p.Metadata.AbortOnErrorRateString != "" {
+		if p.Metadata.AbortOnErrorRate, err = strconv.ParseFloat(p.Metadata.AbortOnErrorRateString, 64); err != nil {
+			errs.add("metadata.abort_on_error_rate", fmt.Errorf("error parsing value for 'abort_on_error_rate': %w", err))
+		} else if p.Metadata.AbortOnErrorRate <= 0 || p.Metadata.AbortOnErrorRate >= 1 {
+			errs.add("metadata.abort_on_error_rate", fmt.Errorf("error parsing value for 'abort_on_error_rate': %s must be between 0 and 1 (excluded)", p.Metadata.AbortOnErrorRateString))
+		} else if !p.Metadata.WaitForResults {
+			errs.add("metadata.abort_on_error_rate", errors.New("'abort_on_error_rate' requires 'wait_for_results'"))
+		}
+	}
+
+	if len(p.Metadata.Scripts) > 0 {
+		switch {
+		case !p.Metadata.WaitForResults:
+			errs.add("metadata.scripts", errors.New("'scripts' requires 'wait_for_results'"))
+		case p.Metadata.DryRun:
+			errs.add("metadata.scripts", errors.New("'scripts' can't be combined with 'dry_run'"))
+		case p.Metadata.SummaryExport:
+			errs.add("metadata.scripts", errors.New("'scripts' can't be combined with 'summary_export'"))
+		case p.Metadata.AbortOnErrorRate > 0:
+			errs.add("metadata.scripts", errors.New("'scripts' can't be combined with 'abort_on_error_rate'"))
+		}
+	}
+
+	if p.Metadata.ReturnCloudURLString == "" {
+		p.Metadata.ReturnCloudURL = false
+	} else if p.Metadata.ReturnCloudURL, err = strconv.ParseBool(p.Metadata.ReturnCloudURLString); err != nil {
+		errs.add("metadata.return_cloud_url", fmt.Errorf("error parsing value for 'return_cloud_url': %w", err))
+	}
+
+	if p.Metadata.StrictCloudURLString == "" {
+		p.Metadata.StrictCloudURL = false
+	} else if p.Metadata.StrictCloudURL, err = strconv.ParseBool(p.Metadata.StrictCloudURLString); err != nil {
+		errs.add("metadata.strict_cloud_url", fmt.Errorf("error parsing value for 'strict_cloud_url': %w", err))
+	}
+
+	if p.Metadata.RequireNotificationsString == "" {
+		p.Metadata.RequireNotifications = false
+	} else if p.Metadata.RequireNotifications, err = strconv.ParseBool(p.Metadata.RequireNotificationsString); err != nil {
+		errs.add("metadata.require_notifications", fmt.Errorf("error parsing value for 'require_notifications': %w", err))
 	}
 
 	if p.Metadata.SlackChannelsString != "" {
-		p.Metadata.SlackChannels = strings.Split(p.Metadata.SlackChannelsString, ",")
+		if p.Metadata.SlackChannels = splitList(p.Metadata.SlackChannelsString); len(p.Metadata.SlackChannels) == 0 {
+			errs.add("metadata.slack_channels", fmt.Errorf("error parsing value for 'slack_channels': %q doesn't contain any channel", p.Metadata.SlackChannelsString))
+		}
+	}
+
+	if p.Metadata.SlackThreadTS != "" {
+		if !slackTimestampRegex.MatchString(p.Metadata.SlackThreadTS) {
+			errs.add("metadata.slack_thread_ts", fmt.Errorf("error parsing value for 'slack_thread_ts': %q is not a Slack message timestamp", p.Metadata.SlackThreadTS))
+		}
+		if len(p.Metadata.SlackChannels) != 1 {
+			errs.add("metadata.slack_thread_ts", errors.New("'slack_thread_ts' requires a single Slack channel"))
+		}
+	}
+
+	if p.Metadata.SlackMentionsOnFailureString != "" {
+		p.Metadata.SlackMentionsOnFailure = splitList(p.Metadata.SlackMentionsOnFailureString)
+		for _, id := range p.Metadata.SlackMentionsOnFailure {
+			if !slackMentionRegex.MatchString(id) {
+				errs.add("metadata.slack_mentions_on_failure", fmt.Errorf("error parsing value for 'slack_mentions_on_failure': %q is not a Slack user or user group ID", id))
+			}
+		}
+		if len(p.Metadata.SlackChannels) == 0 {
+			errs.add("metadata.slack_mentions_on_failure", errors.New("'slack_mentions_on_failure' requires 'slack_channels'"))
+		}
+	}
+
+	if p.Metadata.TeamsChannelsString != "" {
+		p.Metadata.TeamsChannels = splitList(p.Metadata.TeamsChannelsString)
 	}
 
 	if p.Metadata.MinFailureDelayString == "" {
 		p.Metadata.MinFailureDelay = 2 * time.Minute
 	} else if p.Metadata.MinFailureDelay, err = time.ParseDuration(p.Metadata.MinFailureDelayString); err != nil {
-		return fmt.Errorf("error parsing value for 'min_failure_delay': %w", err)
+		errs.add("metadata.min_failure_delay", fmt.Errorf("error parsing value for 'min_failure_delay': %w", err))
+	} else if p.Metadata.MinFailureDelay < 0 {
+		errs.add("metadata.min_failure_delay", fmt.Errorf("error parsing value for 'min_failure_delay': %s is negative", p.Metadata.MinFailureDelayString))
+	}
+
+	if p.Metadata.TestTimeoutString != "" {
+		if p.Metadata.TestTimeout, err = time.ParseDuration(p.Metadata.TestTimeoutString); err != nil {
+			errs.add("metadata.test_timeout", fmt.Errorf("error parsing value for 'test_timeout': %w", err))
+		}
+	}
+
+	if p.Metadata.TagsString != "" {
+		if err := json.Unmarshal([]byte(p.Metadata.TagsString), &p.Metadata.Tags); err != nil {
+			errs.add("metadata.tags", fmt.Errorf("error parsing value for 'tags': %w", err))
+		}
+		for name, value := range p.Metadata.Tags {
+			if slices.Contains(reservedTags, name) {
+				errs.add("metadata.tags", fmt.Errorf("error parsing value for 'tags': %q is set automatically", name))
+			}
+			if err := k6.ValidateTag(name, value); err != nil {
+				errs.add("metadata.tags", fmt.Errorf("error parsing value for 'tags': %w", err))
+			}
+		}
 	}
 
 	if p.Metadata.EnvVarsString != "" {
 		if err := json.Unmarshal([]byte(p.Metadata.EnvVarsString), &p.Metadata.EnvVars); err != nil {
-			return fmt.Errorf("error parsing value for 'env_vars': %w", err)
+			errs.add("metadata.env_vars", fmt.Errorf("error parsing value for 'env_vars': %w", err))
+		}
+		for name, value := range p.Metadata.EnvVars {
+			if err := validateEnvVar(name, value); err != nil {
+				errs.add("metadata.env_vars", fmt.Errorf("error parsing value for 'env_vars': %w", err))
+			}
+		}
+	}
+
+	if p.Metadata.LogOutput != "" {
+		if _, err := renderLogOutput(p.Metadata.LogOutput, p.logOutputData()); err != nil {
+			errs.add("metadata.log_output", fmt.Errorf("error parsing value for 'log_output': %w", err))
+		}
+	}
+
+	if p.Metadata.ExtraArgsString != "" {
+		if err := json.Unmarshal([]byte(p.Metadata.ExtraArgsString), &p.Metadata.ExtraArgs); err != nil {
+			errs.add("metadata.extra_args", fmt.Errorf("error parsing value for 'extra_args': %w", err))
+		}
+		for _, arg := range p.Metadata.ExtraArgs {
+			if strings.ContainsAny(arg, extraArgsDisallowedChars) {
+				errs.add("metadata.extra_args", fmt.Errorf("error parsing value for 'extra_args': argument %q contains disallowed characters", arg))
+			}
 		}
 	}
 
 	if p.Metadata.KubernetesSecretsString != "" {
 		if err := json.Unmarshal([]byte(p.Metadata.KubernetesSecretsString), &p.Metadata.KubernetesSecrets); err != nil {
-			return fmt.Errorf("error parsing value for 'kubernetes_secrets': %w", err)
+			errs.add("metadata.kubernetes_secrets", fmt.Errorf("error parsing value for 'kubernetes_secrets': %w", err))
+		}
+		for name := range p.Metadata.KubernetesSecrets {
+			if !envVarNameRegex.MatchString(name) {
+				errs.add("metadata.kubernetes_secrets", fmt.Errorf("error parsing value for 'kubernetes_secrets': %q is not a valid environment variable name", name))
+			}
 		}
 	}
 
-	return nil
+	if p.Metadata.SecretsOverrideEnvString == "" {
+		p.Metadata.SecretsOverrideEnv = true
+	} else if p.Metadata.SecretsOverrideEnv, err = strconv.ParseBool(p.Metadata.SecretsOverrideEnvString); err != nil {
+		errs.add("metadata.secrets_override_env", fmt.Errorf("error parsing value for 'secrets_override_env': %w", err))
+	}
+
+	if p.Metadata.KubernetesConfigMapsString != "" {
+		if err := json.Unmarshal([]byte(p.Metadata.KubernetesConfigMapsString), &p.Metadata.KubernetesConfigMaps); err != nil {
+			errs.add("metadata.kubernetes_configmaps", fmt.Errorf("error parsing value for 'kubernetes_configmaps': %w", err))
+		}
+		for name := range p.Metadata.KubernetesConfigMaps {
+			if !envVarNameRegex.MatchString(name) {
+				errs.add("metadata.kubernetes_configmaps", fmt.Errorf("error parsing value for 'kubernetes_configmaps': %q is not a valid environment variable name", name))
+			}
+		}
+	}
+
+	if p.Metadata.KubernetesSecretEnvsString != "" {
+		if err := json.Unmarshal([]byte(p.Metadata.KubernetesSecretEnvsString), &p.Metadata.KubernetesSecretEnvs); err != nil {
+			errs.add("metadata.kubernetes_secret_envs", fmt.Errorf("error parsing value for 'kubernetes_secret_envs': %w", err))
+		}
+	}
+
+	if p.Metadata.KubernetesSecretFilesString != "" {
+		if err := json.Unmarshal([]byte(p.Metadata.KubernetesSecretFilesString), &p.Metadata.KubernetesSecretFiles); err != nil {
+			errs.add("metadata.kubernetes_secret_files", fmt.Errorf("error parsing value for 'kubernetes_secret_files': %w", err))
+		}
+		for name := range p.Metadata.KubernetesSecretFiles {
+			if !envVarNameRegex.MatchString(name) {
+				errs.add("metadata.kubernetes_secret_files", fmt.Errorf("error parsing value for 'kubernetes_secret_files': %q is not a valid environment variable name", name))
+			}
+		}
+	}
+
+	return errs.err()
+}
+
+// failure is the last failure of a test, along with the min_failure_delay it
+// was run with, which determines how long it is kept.
+type failure struct {
+	at              time.Time
+	minFailureDelay time.Duration
 }
 
 // launchHandler is responsible for receiving new requests and dispatching a
 // singleRequestHandler based on the received payload. It also keeps track of
 // all currently running processes.
 type launchHandler struct {
-	client      k6.Client
-	kubeClient  kubernetes.Interface
-	slackClient slack.Client
+	client     k6.Client
+	kubeClient kubernetes.Interface
+	notifiers  []registeredNotifier
 
-	lastFailureTime      map[string]time.Time
-	lastFailureTimeMutex sync.Mutex
+	lastFailureTime         map[string]failure
+	lastFailureTimeMutex    sync.Mutex
+	failureEvictionInterval time.Duration
 
-	processToWaitFor     chan k6.TestRun
+	// The processes waited for in the background, each by its own
+	// goroutine. No more are tracked once the context is done
+	processes            sync.WaitGroup
+	processesMutex       sync.Mutex
+	processesStopped     bool
 	waitForProcessesDone chan struct{}
 	ctx                  context.Context
 
-	availableTestRuns chan struct{}
+	// Test run slots, granted in the order they are requested so that no
+	// canary is starved while requests are queued. The semaphore has as many
+	// slots as possible, those above the maximum are held by the handler so
+	// that the maximum can be changed at runtime
+	testRuns    *semaphore.Weighted
+	maxTestRuns atomic.Int64
+	// How many slots are taken by tests, as the semaphore doesn't tell
+	activeTestRuns atomic.Int64
+	// The slots held by the handler and how many it should hold. Once the
+	// maximum is shrunk, the slots released by the tests are kept until
+	// they are equal
+	heldTestRuns, heldTestRunsTarget int64
+	heldTestRunsMutex                sync.Mutex
+	// How long requests wait for a test run slot before being rejected
+	queueTimeout time.Duration
+	// How many requests are waiting for a test run slot
+	queuedRequests atomic.Int64
+	// Notifications of the rejected requests, sent through slackClient
+	rejectionNotifications rejectionNotifications
+	slackClient            slack.Client
+	// Retry-After of the rejected requests, in seconds, before any test has
+	// completed and the bounds of the one computed afterwards
+	defaultWaitSeconds, minWaitSeconds, maxWaitSeconds int64
+
+	// How many times starting k6 is retried on transient errors
+	startMaxRetries int
 
-	metricsRegistry    *prometheus.Registry
-	metricTestDuration *prometheus.SummaryVec
+	// Default `--log-output` of k6, a template as `log_output`
+	logOutput string
+
+	// The status returned when a test is run but fails. Invalid requests
+	// always get a 400
+	testFailureStatus int
+
+	// How long requests wait for the results of their test before a 504 is
+	// returned. 0 disables the timeout
+	handlerTimeout time.Duration
+
+	// How long the tests whose results aren't waited for may run before they
+	// are killed. 0 disables the limit
+	maxAsyncTestDuration time.Duration
+
+	// How often the error rate of the tests with abort_on_error_rate is
+	// polled
+	errorRatePollInterval time.Duration
+
+	// Set by Drain. New requests are rejected (as they are once the context
+	// is done) while in-flight requests are tracked so that they can complete.
+	shuttingDownMutex sync.Mutex
+	shuttingDown      bool
+	inFlightRequests  sync.WaitGroup
+
+	// Running tests by key, so that they can be canceled
+	runningTests         map[string]*runningTest
+	runningTestsMutex    sync.Mutex
+	rejectDuplicateTests bool
+
+	// Namespaces, besides the one of the canary, that secrets can be read
+	// from. "*" allows all namespaces.
+	allowedSecretNamespaces []string
+
+	httpClient      *http.Client
+	maxScriptSize   int64
+	maxOutputBytes  int64
+	maxRequestBytes int64
+
+	messageTemplates *MessageTemplates
+	cloudURLRegex    *regexp.Regexp
+
+	metricsRegistry          *prometheus.Registry
+	metricMaxConcurrentTests prometheus.Gauge
+	metricTestDuration       prometheus.Summary
+	metricDurations          *prometheus.HistogramVec
+	metricTestResults        *prometheus.CounterVec
+	metricLastExitCode       *prometheus.GaugeVec
+	metricSecretErrors       *prometheus.CounterVec
+	metricActiveTests        prometheus.GaugeFunc
+	metricRejected           prometheus.Counter
+
+	tracer trace.Tracer
+
+	// Where the runs are recorded. nil if the history isn't enabled
+	history *history.Store
 
 	// mockables
 	sleep func(time.Duration)
+	// Returns a random duration between 0 and the given one
+	jitter func(time.Duration) time.Duration
 }
 
 type LaunchHandler interface {
 	http.Handler
 	Wait()
+
+	// AvailableTestRuns returns the number of tests that can be started
+	// before requests are rejected.
+	AvailableTestRuns() int
+
+	// Drain rejects new requests and blocks until the in-flight ones are
+	// done or the context is done. Running tests are only killed once the
+	// context passed to NewLaunchHandler is canceled.
+	Drain(ctx context.Context) error
+
+	// CancelTest kills the running test with the given key.
+	CancelTest(key string) error
+
+	// RecentRuns returns the last runs recorded in the history, up to limit,
+	// most recent first.
+	RecentRuns(ctx context.Context, limit int) ([]history.Run, error)
+
+	// SetMaxConcurrentTests changes the maximum number of concurrent tests.
+	SetMaxConcurrentTests(maxConcurrentTests int) error
+}
+
+// registeredNotifier is a notifier along with the function selecting the
+// channels to notify from the payload.
+type registeredNotifier struct {
+	notifier notifier.Notifier
+	channels func(*launchPayload) []string
+	// If set, returns the mentions prepended to the failure messages
+	failureMentions func(*launchPayload) string
+
+	// If set, a notifier is created for each test instead
+	forTest func(*notifier.Test) notifier.Notifier
+}
+
+// LaunchHandlerOption configures optional behavior of the launch handler.
+type LaunchHandlerOption func(*launchHandler)
+
+// WithScriptFetchTimeout sets the timeout used when fetching a script from
+// `script_url`.
+func WithScriptFetchTimeout(timeout time.Duration) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.httpClient.Timeout = timeout
+	}
+}
+
+// WithMaxOutputBytes sets the maximum size of the k6 output kept in memory. The
+// output is truncated past that size. 0 disables the limit.
+func WithMaxOutputBytes(maxOutputBytes int64) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.maxOutputBytes = maxOutputBytes
+	}
+}
+
+// WithMaxRequestBytes sets the maximum size of the body of /launch-test
+// requests. Larger requests are rejected with a 413. 0 disables the limit.
+func WithMaxRequestBytes(maxRequestBytes int64) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.maxRequestBytes = maxRequestBytes
+	}
+}
+
+// WithMessageTemplates customizes the status messages sent to notifiers.
+func WithMessageTemplates(templates *MessageTemplates) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.messageTemplates = templates
+	}
+}
+
+// WithCloudURLRegex sets the regex finding the cloud URL in the output of k6,
+// ex: for self-hosted instances. See ParseCloudURLRegex.
+func WithCloudURLRegex(re *regexp.Regexp) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.cloudURLRegex = re
+	}
+}
+
+// ParseCloudURLRegex compiles the regex finding the cloud URL in the output of
+// k6. The URL must be captured by a group named `url`. An empty regex is
+// replaced by the default one.
+func ParseCloudURLRegex(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return outputRegex, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the cloud URL regex: %w", err)
+	}
+	if re.SubexpIndex(cloudURLGroup) < 0 {
+		return nil, fmt.Errorf("the cloud URL regex must have a group named %q capturing the URL", cloudURLGroup)
+	}
+	return re, nil
+}
+
+// WithFailureEvictionInterval sets how often failures which no longer matter
+// for min_failure_delay are forgotten.
+func WithFailureEvictionInterval(interval time.Duration) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.failureEvictionInterval = interval
+	}
+}
+
+// WithAllowedSecretNamespaces allows reading secrets from the given namespaces
+// besides the namespace of the canary. "*" allows all namespaces.
+func WithAllowedSecretNamespaces(namespaces []string) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.allowedSecretNamespaces = namespaces
+	}
+}
+
+// WithQueueTimeout makes the requests received while the maximum number of
+// concurrent tests is reached wait up to the given duration for a test to
+// complete, instead of being rejected right away with a 429.
+func WithQueueTimeout(timeout time.Duration) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.queueTimeout = timeout
+	}
+}
+
+// WithRejectionNotifications posts a message to the given Slack channel when
+// requests are rejected because the maximum number of concurrent tests is
+// reached, at most once per interval. An empty channel disables the
+// notifications.
+func WithRejectionNotifications(channel string, interval time.Duration) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.rejectionNotifications.channel = channel
+		h.rejectionNotifications.interval = interval
+	}
+}
+
+// WithWaitTime sets the Retry-After (in seconds) of the requests rejected
+// because of the concurrency limit before any test has completed, and the
+// bounds of the one computed from the duration of the tests afterwards, so that
+// a single outlier doesn't make clients retry too early or too late.
+func WithWaitTime(defaultSeconds, minSeconds, maxSeconds int64) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.defaultWaitSeconds = defaultSeconds
+		h.minWaitSeconds = minSeconds
+		h.maxWaitSeconds = maxSeconds
+	}
+}
+
+// WithHandlerTimeout sets how long a request waits for the results of its test
+// before a 504 is returned, no matter the test_timeout of the test. The test is
+// then killed and cleaned up asynchronously. 0 disables the timeout.
+func WithHandlerTimeout(timeout time.Duration) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.handlerTimeout = timeout
+	}
+}
+
+// WithLogOutput sets the `--log-output` of k6 for the tests that don't set
+// `log_output`, ex: to send the logs of all the tests to Loki. It is a template
+// with the name, namespace and phase of the test, ex:
+// `loki=<push URL>,label.canary={{.Name}}`.
+func WithLogOutput(logOutput string) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.logOutput = logOutput
+	}
+}
+
+// WithTestFailureStatus sets the status returned when a test is run but fails,
+// ex: 422 to tell failed tests apart from invalid requests, which get a 400.
+// It must be a 4xx or 5xx status, for Flagger to see the failure.
+func WithTestFailureStatus(status int) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.testFailureStatus = status
+	}
+}
+
+// WithMaxAsyncTestDuration sets how long the tests whose results aren't waited
+// for may run before they are killed, ex: if the script loops forever, so that
+// they don't hold a test run slot until the load tester stops. Shorter
+// test_timeouts still apply. 0 disables the limit.
+func WithMaxAsyncTestDuration(duration time.Duration) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.maxAsyncTestDuration = duration
+	}
+}
+
+// WithStartMaxRetries sets how many times starting k6 is retried when it fails
+// with a transient error, ex: if it can't fork. 0 disables the retries.
+func WithStartMaxRetries(maxRetries int) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.startMaxRetries = maxRetries
+	}
+}
+
+// WithRejectDuplicateTests rejects the requests for a test (by namespace, name
+// and phase) which is already running with a 409, instead of starting it
+// again.
+func WithRejectDuplicateTests(reject bool) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.rejectDuplicateTests = reject
+	}
+}
+
+// WithHistory records every run in the given store, ex: for audit.
+func WithHistory(store *history.Store) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.history = store
+	}
+}
+
+// WithTracerProvider enables tracing of the tests with the given provider.
+// Without it, a no-op tracer is used.
+func WithTracerProvider(tp trace.TracerProvider) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithTeamsClient enables Microsoft Teams notifications to the channels listed
+// in `teams_channels`.
+func WithTeamsClient(teamsClient notifier.Notifier) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.notifiers = append(h.notifiers, registeredNotifier{
+			notifier: teamsClient,
+			channels: func(p *launchPayload) []string { return p.Metadata.TeamsChannels },
+		})
+	}
+}
+
+// WithDiscordClient enables Discord notifications. The webhook determines the
+// channel so every test is posted.
+func WithDiscordClient(discordClient notifier.Notifier) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.notifiers = append(h.notifiers, registeredNotifier{
+			notifier: discordClient,
+			channels: func(*launchPayload) []string { return nil },
+		})
+	}
+}
+
+// WithTestNotifier enables notifications through notifiers that need details
+// about the test (for example to send structured events). All tests are
+// notified.
+func WithTestNotifier(forTest func(*notifier.Test) notifier.Notifier) LaunchHandlerOption {
+	return func(h *launchHandler) {
+		h.notifiers = append(h.notifiers, registeredNotifier{
+			forTest:  forTest,
+			channels: func(*launchPayload) []string { return nil },
+		})
+	}
 }
 
 // NewLaunchHandler returns an handler that launches a k6 load test.
-func NewLaunchHandler(ctx context.Context, client k6.Client, kubeClient kubernetes.Interface, slackClient slack.Client, maxConcurrentTests int) (LaunchHandler, error) {
+func NewLaunchHandler(ctx context.Context, client k6.Client, kubeClient kubernetes.Interface, slackClient slack.Client, maxConcurrentTests int, opts ...LaunchHandlerOption) (LaunchHandler, error) {
 	if slackClient == nil {
 		return nil, errors.New("unexpected state. Slack client is nil")
 	}
 
 	h := &launchHandler{
-		client:               client,
-		kubeClient:           kubeClient,
-		slackClient:          slackClient,
-		lastFailureTime:      make(map[string]time.Time),
-		sleep:                time.Sleep,
-		processToWaitFor:     make(chan k6.TestRun, maxConcurrentTests),
-		waitForProcessesDone: make(chan struct{}, 1),
-		ctx:                  ctx,
+		client:                  client,
+		kubeClient:              kubeClient,
+		slackClient:             slackClient,
+		lastFailureTime:         make(map[string]failure),
+		runningTests:            make(map[string]*runningTest),
+		failureEvictionInterval: DefaultFailureEvictionInterval,
+		sleep:                   time.Sleep,
+		jitter:                  randomDuration,
+		waitForProcessesDone:    make(chan struct{}, 1),
+		ctx:                     ctx,
+		httpClient:              &http.Client{Timeout: DefaultScriptFetchTimeout},
+		maxScriptSize:           defaultMaxScriptSize,
+		maxOutputBytes:          DefaultMaxOutputBytes,
+		maxRequestBytes:         DefaultMaxRequestBytes,
+		startMaxRetries:         DefaultStartMaxRetries,
+		testFailureStatus:       http.StatusBadRequest,
+		defaultWaitSeconds:      DefaultWaitTimeSeconds,
+		minWaitSeconds:          DefaultMinWaitTimeSeconds,
+		maxWaitSeconds:          DefaultMaxWaitTimeSeconds,
+		errorRatePollInterval:   defaultErrorRatePollInterval,
+		messageTemplates:        defaultMessageTemplates(),
+		cloudURLRegex:           outputRegex,
+		tracer:                  noop.NewTracerProvider().Tracer(tracerName),
+	}
+	slackNotifier := registeredNotifier{
+		notifier: slackClient,
+		channels: func(p *launchPayload) []string { return p.Metadata.SlackChannels },
+		failureMentions: func(p *launchPayload) string {
+			return slackMentions(p.Metadata.SlackMentionsOnFailure)
+		},
+	}
+	// The Slack client adds the metrics of the test to the messages if it can
+	if c, ok := slackClient.(interface {
+		ForTest(*notifier.Test) notifier.Notifier
+	}); ok {
+		slackNotifier.forTest = c.ForTest
+	}
+	h.notifiers = []registeredNotifier{slackNotifier}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.minWaitSeconds < 0 || h.minWaitSeconds > h.maxWaitSeconds {
+		return nil, fmt.Errorf("invalid wait time bounds: the minimum (%d) must be between 0 and the maximum (%d)", h.minWaitSeconds, h.maxWaitSeconds)
 	}
-	h.availableTestRuns = make(chan struct{}, maxConcurrentTests)
-	for range maxConcurrentTests {
-		h.releaseTestRun()
+	if h.testFailureStatus < 400 || h.testFailureStatus > 599 {
+		return nil, fmt.Errorf("invalid test failure status: %d is not a 4xx or 5xx status", h.testFailureStatus)
 	}
+	if h.logOutput != "" {
+		if _, err := renderLogOutput(h.logOutput, messageData{Name: "name", Namespace: "namespace", Phase: "phase"}); err != nil {
+			return nil, fmt.Errorf("invalid k6 log output: %w", err)
+		}
+	}
+	h.maxTestRuns.Store(int64(maxConcurrentTests))
+	h.heldTestRuns = math.MaxInt64 - int64(maxConcurrentTests)
+	h.heldTestRunsTarget = h.heldTestRuns
+	h.testRuns = semaphore.NewWeighted(math.MaxInt64)
+	h.testRuns.TryAcquire(h.heldTestRuns)
 
-	metricMaxConcurrentTests := prometheus.NewGauge(prometheus.GaugeOpts{
+	h.metricMaxConcurrentTests = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "launch_max_concurrent_tests",
 		Help: "The maximum number of concurrent tests",
 	})
-	metricMaxConcurrentTests.Set(float64(maxConcurrentTests))
-	if err := prometheus.Register(metricMaxConcurrentTests); err != nil {
+	h.metricMaxConcurrentTests.Set(float64(maxConcurrentTests))
+	if err := prometheus.Register(h.metricMaxConcurrentTests); err != nil {
 		log.Warnf("Failed to register new metric: %s", err.Error())
 	}
 
@@ -200,25 +1160,88 @@ func NewLaunchHandler(ctx context.Context, client k6.Client, kubeClient kubernet
 		Name: "launch_available_concurrent_tests",
 		Help: "The current number of available concurrent tests. If 0 then new requests will be rejected",
 	}, func() float64 {
-		return float64(len(h.availableTestRuns))
+		return float64(h.freeTestRuns())
 	})
 	if err := prometheus.Register(metricAvailableConcurrentTests); err != nil {
 		log.Warnf("Failed to register new metric: %s", err.Error())
 	}
 
+	// The active tests are counted when their slot is taken and released
+	// rather than computed from the semaphore, whose size is math.MaxInt64
+	// and which also holds the slots removed with SetMaxConcurrentTests. The
+	// metric is accurate no matter which path (synchronous or asynchronous
+	// cleanup) releases the slot
+	h.metricActiveTests = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "launch_active_tests",
+		Help: "The current number of running tests",
+	}, func() float64 {
+		return float64(h.activeTestRuns.Load())
+	})
+	if err := prometheus.Register(h.metricActiveTests); err != nil {
+		log.Warnf("Failed to register new metric: %s", err.Error())
+	}
+
+	h.metricRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "launch_rejected_total",
+		Help: "Total number of requests rejected (with a 429) because the maximum number of concurrent tests was reached",
+	})
+	if err := prometheus.Register(h.metricRejected); err != nil {
+		log.Warnf("Failed to register new metric: %s", err.Error())
+	}
+
+	// The namespace and name labels are bounded by the number of canaries
+	// using this webhook, which is expected to be reasonably small:
+	h.metricTestResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "launch_test_result_total",
+		Help: "Total number of k6 test runs by canary namespace, name and result (success, failure or timeout)",
+	}, []string{"namespace", "name", "result"})
+	if err := prometheus.Register(h.metricTestResults); err != nil {
+		log.Warnf("Failed to register new metric: %s", err.Error())
+	}
+
+	// Same assumption on the cardinality of the labels as above
+	h.metricLastExitCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "launch_last_exit_code",
+		Help: "Exit code of the last k6 test run by canary namespace and name. -1 if the process was still running when the test was considered failed",
+	}, []string{"namespace", "name"})
+	if err := prometheus.Register(h.metricLastExitCode); err != nil {
+		log.Warnf("Failed to register new metric: %s", err.Error())
+	}
+
+	h.metricSecretErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "launch_secret_resolution_errors_total",
+		Help: "Total number of failures to read the secrets of a test by kind (not_found, missing_key, no_client or forbidden)",
+	}, []string{"kind"})
+	if err := prometheus.Register(h.metricSecretErrors); err != nil {
+		log.Warnf("Failed to register new metric: %s", err.Error())
+	}
+
+	// The phases are the ones of Flagger, so the cardinality is bounded
+	h.metricDurations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "launch_test_duration_seconds",
+		Help:    "Durations of the k6 test runs in seconds by Flagger phase and exit code",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 10),
+	}, []string{"phase", "exit_code"})
+	if err := prometheus.Register(h.metricDurations); err != nil {
+		log.Warnf("Failed to register new metric: %s", err.Error())
+	}
+
 	// metricTestDuration is an internal metric that we use to calculate the
 	// expected wait time in case the maximum number of concurrent tests is
-	// reached:
-	metricTestDuration := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+	// reached. It isn't labeled, so that its median is the one of all the
+	// runs: whatever their phase or exit code, they all hold a test run slot
+	// for their whole duration.
+	metricTestDuration := prometheus.NewSummary(prometheus.SummaryOpts{
 		Name:       metricTestDurationName,
 		Help:       "Durations of the executed k6 test run in seconds",
 		Objectives: map[float64]float64{0.5: float64(30)},
-	}, []string{"exit_code"})
+	})
 	h.metricTestDuration = metricTestDuration
 	h.metricsRegistry = prometheus.NewRegistry()
 	_ = h.metricsRegistry.Register(h.metricTestDuration)
 
 	go h.waitForProcesses(ctx)
+	go h.evictFailures(ctx)
 	return h, nil
 }
 
@@ -229,31 +1252,20 @@ func (h *launchHandler) Wait() {
 	log.Debug("launch handler finished")
 }
 
-// waitForProcesses handles incoming processes and waits for them to complete.
-// This way we can avoid k6 jobs where we do not need the results to become
-// zombie processes.
+// waitForProcesses waits for the processes registered for cleanup to complete
+// once the context is done. This way we can avoid k6 jobs where we do not need
+// the results to become zombie processes.
 func (h *launchHandler) waitForProcesses(ctx context.Context) {
-	defer func() {
-		h.waitForProcessesDone <- struct{}{}
-	}()
-	wg := sync.WaitGroup{}
-loop:
-	for {
-		select {
-		case cmd := <-h.processToWaitFor:
-			wg.Add(1)
-			go func() {
-				h.waitForProcess(cmd)
-				wg.Done()
-			}()
-		case <-ctx.Done():
-			break loop
-		}
-	}
-	wg.Wait()
+	<-ctx.Done()
+	h.processesMutex.Lock()
+	h.processesStopped = true
+	h.processesMutex.Unlock()
+	h.processes.Wait()
+	h.waitForProcessesDone <- struct{}{}
 }
 
-func (h *launchHandler) waitForProcess(cmd k6.TestRun) {
+func (h *launchHandler) waitForProcess(process asyncProcess) {
+	cmd := process.cmd
 	if cmd == nil {
 		log.Warnf("nil as testrun passed")
 		return
@@ -261,7 +1273,8 @@ func (h *launchHandler) waitForProcess(cmd k6.TestRun) {
 	pid := cmd.PID()
 	log.WithField("pid", pid).Debug("waiting for testrun to exit")
 	_ = cmd.Wait()
-	h.trackExecutionDuration(cmd)
+	h.removeRunningTestProcess(cmd)
+	h.trackExecutionDuration(process.phase, cmd)
 	log.WithField("pid", pid).Debugf("testrun exited")
 
 	// Also clean up the context attached to this process if present:
@@ -270,68 +1283,248 @@ func (h *launchHandler) waitForProcess(cmd k6.TestRun) {
 	h.releaseTestRun()
 }
 
-// registerProcessCleanup adds a handler to the process so that it will
-// eventually be closed and its resources returned.
-//
-// Note that this method can actually block which will, in turn, cause the
-// calling HTTP handler to be blocked.
-func (h *launchHandler) registerProcessCleanup(cmd k6.TestRun) {
-	h.processToWaitFor <- cmd
+// outputPollDelay returns how long to wait before polling the output of k6
+// again, between outputPollInterval-outputPollJitter and
+// outputPollInterval+outputPollJitter.
+func (h *launchHandler) outputPollDelay() time.Duration {
+	return outputPollInterval - outputPollJitter + h.jitter(2*outputPollJitter)
+}
+
+// sleepContext sleeps for the given duration, or until the context is done.
+func (h *launchHandler) sleepContext(ctx context.Context, d time.Duration) error {
+	slept := make(chan struct{})
+	go func() {
+		h.sleep(d)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func randomDuration(maxDuration time.Duration) time.Duration {
+	return rand.N(maxDuration + 1)
+}
+
+// asyncProcess is a test run waited for in the background, along with the
+// Flagger phase of its test for the duration metrics.
+type asyncProcess struct {
+	cmd   k6.TestRun
+	phase string
+}
+
+// registerProcessCleanup waits for the process in the background so that it
+// will eventually be closed and its resources returned. It never blocks, no
+// matter how many processes are running.
+func (h *launchHandler) registerProcessCleanup(cmd k6.TestRun, phase string) {
+	process := asyncProcess{cmd: cmd, phase: phase}
+	h.processesMutex.Lock()
+	defer h.processesMutex.Unlock()
+	if h.processesStopped {
+		// The process has been killed along with the context, Wait
+		// doesn't wait for it anymore
+		go h.waitForProcess(process)
+		return
+	}
+	h.processes.Add(1)
+	go func() {
+		defer h.processes.Done()
+		h.waitForProcess(process)
+	}()
 }
 
 func (h *launchHandler) getLastFailureTime(payload *launchPayload) (time.Time, bool) {
 	h.lastFailureTimeMutex.Lock()
 	defer h.lastFailureTimeMutex.Unlock()
 	v, ok := h.lastFailureTime[payload.key()]
-	return v, ok
+	return v.at, ok
 }
 
 func (h *launchHandler) setLastFailureTime(payload *launchPayload) {
 	h.lastFailureTimeMutex.Lock()
 	defer h.lastFailureTimeMutex.Unlock()
-	h.lastFailureTime[payload.key()] = time.Now()
+	h.lastFailureTime[payload.key()] = failure{at: time.Now(), minFailureDelay: payload.Metadata.MinFailureDelay}
 }
 
+// evictFailures periodically forgets failures that are long past their
+// min_failure_delay. Otherwise, the map grows with every new canary.
+func (h *launchHandler) evictFailures(ctx context.Context) {
+	ticker := time.NewTicker(h.failureEvictionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.evictExpiredFailures(now)
+		}
+	}
+}
+
+func (h *launchHandler) evictExpiredFailures(now time.Time) {
+	h.lastFailureTimeMutex.Lock()
+	defer h.lastFailureTimeMutex.Unlock()
+	for key, f := range h.lastFailureTime {
+		if now.Sub(f.at) > failureRetentionFactor*f.minFailureDelay {
+			log.Debugf("forgetting the last failure of %s", key)
+			delete(h.lastFailureTime, key)
+		}
+	}
+}
+
+// getWaitTime returns the median duration of the test runs, whatever their
+// phase or exit code, within the wait time bounds.
 func (h *launchHandler) getWaitTime() int64 {
 	families, err := h.metricsRegistry.Gather()
 	if err != nil {
-		return 60
+		return h.defaultWaitSeconds
 	}
 	for _, family := range families {
 		if family.GetName() == metricTestDurationName {
 			for _, metric := range family.GetMetric() {
+				// Until a test has completed
+				if metric.GetSummary().GetSampleCount() == 0 {
+					break
+				}
 				for _, quantile := range metric.GetSummary().GetQuantile() {
 					if quantile.GetQuantile() == 0.5 {
 						result := quantile.GetValue()
-						return int64(result)
+						return min(max(int64(result), h.minWaitSeconds), h.maxWaitSeconds)
 					}
 				}
 			}
 		}
 	}
-	return 60
+	return h.defaultWaitSeconds
 }
 
-func (h *launchHandler) requestTestRun() error {
-	select {
-	case <-h.availableTestRuns:
+// requestTestRun takes a test run slot. If none is free, it waits up to the
+// queue timeout for one to be released. Queued requests get the slots in the
+// order they have been received.
+func (h *launchHandler) requestTestRun(ctx context.Context) error {
+	// Fails while requests are queued, even if a slot is free, so that they
+	// aren't overtaken
+	if h.testRuns.TryAcquire(1) {
+		h.activeTestRuns.Add(1)
 		return nil
-	default:
-		return fmt.Errorf("maximum concurrent test runs reached")
 	}
+	if h.queueTimeout > 0 {
+		h.queuedRequests.Add(1)
+		defer h.queuedRequests.Add(-1)
+		queueCtx, cancel := context.WithTimeout(ctx, h.queueTimeout)
+		defer cancel()
+		// Queued requests are rejected once the handler is done as well
+		stop := context.AfterFunc(h.ctx, cancel)
+		defer stop()
+		if err := h.testRuns.Acquire(queueCtx, 1); err == nil {
+			h.activeTestRuns.Add(1)
+			return nil
+		}
+	}
+	h.metricRejected.Inc()
+	return fmt.Errorf("maximum concurrent test runs reached")
 }
 
 func (h *launchHandler) releaseTestRun() {
-	h.availableTestRuns <- struct{}{}
+	h.heldTestRunsMutex.Lock()
+	defer h.heldTestRunsMutex.Unlock()
+	h.activeTestRuns.Add(-1)
+	// The maximum has been shrunk below the number of running tests
+	if h.heldTestRuns < h.heldTestRunsTarget {
+		h.heldTestRuns++
+		return
+	}
+	h.testRuns.Release(1)
+}
+
+// freeTestRuns returns the number of test run slots that aren't taken. There
+// are none while more tests are running than the maximum, after it has been
+// shrunk.
+func (h *launchHandler) freeTestRuns() int {
+	return int(max(h.maxTestRuns.Load()-h.activeTestRuns.Load(), 0))
+}
+
+func (h *launchHandler) AvailableTestRuns() int {
+	if h.isShuttingDown() {
+		return 0
+	}
+	return h.freeTestRuns()
+}
+
+func (h *launchHandler) Drain(ctx context.Context) error {
+	h.shuttingDownMutex.Lock()
+	h.shuttingDown = true
+	h.shuttingDownMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.inFlightRequests.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("in-flight requests did not complete in time: %w", ctx.Err())
+	}
+}
+
+// isShuttingDown returns true once the handler is draining or its context is
+// done. Tests started past that point would be killed right away.
+func (h *launchHandler) isShuttingDown() bool {
+	h.shuttingDownMutex.Lock()
+	defer h.shuttingDownMutex.Unlock()
+	return h.shuttingDown || h.ctx.Err() != nil
+}
+
+// startRequest tracks a new request, unless the handler is shutting down.
+func (h *launchHandler) startRequest() bool {
+	h.shuttingDownMutex.Lock()
+	defer h.shuttingDownMutex.Unlock()
+	if h.shuttingDown || h.ctx.Err() != nil {
+		return false
+	}
+	h.inFlightRequests.Add(1)
+	return true
 }
 
 func (h *launchHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !h.startRequest() {
+		// Another replica may be able to run the test
+		resp.Header().Set("Retry-After", fmt.Sprintf("%d", int64(shutdownRetryAfter/time.Second)))
+		writeError(resp, req, "shutting down, not accepting new tests", "", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.inFlightRequests.Done()
+
+	ctx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := h.tracer.Start(ctx, spanLaunchTest, trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	handler := newSingleRequestHandler(resp, req, h)
-	handler.Handle(req.Context())
+	handler.Handle(ctx)
+}
+
+func (h *launchHandler) trackTestResult(payload *launchPayload, result string) {
+	h.metricTestResults.With(prometheus.Labels{"namespace": payload.Namespace, "name": payload.Name, "result": result}).Inc()
+}
+
+func (h *launchHandler) trackExitCode(payload *launchPayload, cmd k6.TestRun) {
+	h.metricLastExitCode.With(prometheus.Labels{"namespace": payload.Namespace, "name": payload.Name}).Set(float64(cmd.ExitCode()))
+}
+
+func (h *launchHandler) trackSecretResolutionError(kind string) {
+	h.metricSecretErrors.With(prometheus.Labels{"kind": kind}).Inc()
 }
 
-func (h *launchHandler) trackExecutionDuration(cmd k6.TestRun) {
+func (h *launchHandler) trackExecutionDuration(phase string, cmd k6.TestRun) {
 	if dur := cmd.ExecutionDuration(); dur != 0 {
-		h.metricTestDuration.With(prometheus.Labels{"exit_code": fmt.Sprintf("%d", cmd.ExitCode())}).Observe(float64(dur / time.Second))
+		labels := prometheus.Labels{"exit_code": fmt.Sprintf("%d", cmd.ExitCode()), "phase": phase}
+		h.metricTestDuration.Observe(float64(dur / time.Second))
+		h.metricDurations.With(labels).Observe(dur.Seconds())
 	}
 }
@@ -1,29 +1,38 @@
 package handlers
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"maps"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/grafana/flagger-k6-webhook/pkg/k6"
 	"github.com/grafana/flagger-k6-webhook/pkg/mocks"
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestNewLaunchPayload(t *testing.T) {
@@ -50,7 +59,7 @@ func TestNewLaunchPayload(t *testing.T) {
 			request: &http.Request{
 				Body: ioutil.NopCloser(strings.NewReader("{}")),
 			},
-			wantErr: errors.New("error while validating base webhook: missing name"),
+			wantErr: errors.New("error while validating base webhook: missing name; missing namespace; missing phase"),
 		},
 		{
 			name: "missing script",
@@ -69,6 +78,7 @@ func TestNewLaunchPayload(t *testing.T) {
 				p.Metadata.Script = "my-script"
 				p.Metadata.UploadToCloud = false
 				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
 				p.Metadata.SlackChannels = nil
 				p.Metadata.MinFailureDelay = 2 * time.Minute
 				return p
@@ -99,6 +109,7 @@ func TestNewLaunchPayload(t *testing.T) {
 				p.Metadata.UploadToCloud = true
 				p.Metadata.WaitForResultsString = "false"
 				p.Metadata.WaitForResults = false
+				p.Metadata.SecretsOverrideEnv = true
 				p.Metadata.SlackChannelsString = "test,test2"
 				p.Metadata.SlackChannels = []string{"test", "test2"}
 				p.Metadata.MinFailureDelay = 3 * time.Minute
@@ -110,6 +121,49 @@ func TestNewLaunchPayload(t *testing.T) {
 				return p
 			}(),
 		},
+		{
+			name: "script from configmap",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script_configmap": "other-namespace/my-configmap/script.js"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.ScriptConfigMap = "other-namespace/my-configmap/script.js"
+				p.Metadata.UploadToCloud = false
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				return p
+			}(),
+		},
+		{
+			name: "invalid script_url scheme",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script_url": "file:///etc/passwd"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'script_url': unsupported scheme "file"`),
+		},
+		{
+			name: "invalid script_configmap",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script_configmap": "my-configmap"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'script_configmap': invalid reference "my-configmap", expected [<namespace>/]<name>/<key>`),
+		},
+		{
+			name: "stream_output without wait_for_results",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "stream_output": "true", "wait_for_results": "false"}}`)),
+			},
+			wantErr: errors.New(`'stream_output' requires 'wait_for_results'`),
+		},
+		{
+			name: "invalid cloud_project_id",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "cloud_project_id": "my-project"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'cloud_project_id': strconv.ParseUint: parsing "my-project": invalid syntax`),
+		},
 		{
 			name: "invalid upload_to_cloud",
 			request: &http.Request{
@@ -124,6 +178,13 @@ func TestNewLaunchPayload(t *testing.T) {
 			},
 			wantErr: errors.New(`error parsing value for 'wait_for_results': strconv.ParseBool: parsing "bad": invalid syntax`),
 		},
+		{
+			name: "negative min_failure_delay",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "min_failure_delay": "-1m"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'min_failure_delay': -1m is negative`),
+		},
 		{
 			name: "invalid min_failure_delay",
 			request: &http.Request{
@@ -131,6 +192,13 @@ func TestNewLaunchPayload(t *testing.T) {
 			},
 			wantErr: errors.New(`error parsing value for 'min_failure_delay': time: invalid duration "bad"`),
 		},
+		{
+			name: "invalid test_timeout",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "test_timeout": "bad"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'test_timeout': time: invalid duration "bad"`),
+		},
 		{
 			name: "invalid kubernetes_secrets",
 			request: &http.Request{
@@ -139,464 +207,3746 @@ func TestNewLaunchPayload(t *testing.T) {
 			wantErr: errors.New(`error parsing value for 'kubernetes_secrets': json: cannot unmarshal array into Go value of type map[string]string`),
 		},
 		{
-			name: "invalid env_vars",
+			name: "invalid kubernetes_configmaps",
 			request: &http.Request{
-				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "env_vars": "[]"}}`)),
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "kubernetes_configmaps": "[]"}}`)),
 			},
-			wantErr: errors.New(`error parsing value for 'env_vars': json: cannot unmarshal array into Go value of type map[string]string`),
+			wantErr: errors.New(`error parsing value for 'kubernetes_configmaps': json: cannot unmarshal array into Go value of type map[string]string`),
 		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			payload, err := newLaunchPayload(tc.request)
-			if tc.wantErr != nil {
-				assert.EqualError(t, err, tc.wantErr.Error())
-			} else {
-				assert.NoError(t, err)
-			}
-			assert.Equal(t, tc.want, payload)
-		})
-	}
-}
-
-func TestLaunchAndWaitCloud(t *testing.T) {
-	tests := map[string]struct {
-		k6OutputFile string
-		cloudURL     string
-	}{
-		"legacy-cloud-url": {
-			k6OutputFile: "testdata/k6-output-legacy.txt",
-			cloudURL:     "https://app.k6.io/runs/1157843",
+		{
+			name: "extra args",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "extra_args": "[\"--vus\", \"10\", \"--tag\", \"env=dev\"]"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				p.Metadata.ExtraArgs = []string{"--vus", "10", "--tag", "env=dev"}
+				p.Metadata.ExtraArgsString = `["--vus", "10", "--tag", "env=dev"]`
+				return p
+			}(),
 		},
-		"grafana-cloud-url": {
-			k6OutputFile: "testdata/k6-output.txt",
-			cloudURL:     "https://somewhere.grafana.net/a/k6-app/runs/1157843",
+		{
+			name: "env_vars with an equal sign in a name",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "env_vars": "{\"FOO=BAR\": \"value\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'env_vars': "FOO=BAR" is not a valid environment variable name`),
 		},
-	}
-
-	for testName, test := range tests {
-		t.Run(testName, func(t *testing.T) {
-			// Initialize controller
-			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
-			t.Cleanup(handler.Wait)
-			t.Cleanup(cancel)
-
-			// Expected calls
-			// * Start the run
-			fullResults, resultParts := getTestOutputFromFile(t, test.k6OutputFile)
-			var bufferWriter io.Writer
-			k6Client.EXPECT().Start(gomock.Any(), "my-script", true, nil, gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
-				bufferWriter = outputWriter
-				outputWriter.Write([]byte(resultParts[0]))
-				return testRun, nil
-			})
-
-			// * Send the initial slack message
-			channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
-			slackClient.EXPECT().SendMessages(
-				[]string{"test", "test2"},
-				":warning: Load testing of `test-name` in namespace `test-space` has started",
-				fmt.Sprintf("extra context\nCloud URL: <%s>", test.cloudURL),
-			).Return(channelMap, nil)
-
-			// * Wait for the command to finish
-			testRun.EXPECT().Wait().DoAndReturn(func() error {
-				bufferWriter.Write([]byte("running" + resultParts[1]))
-				return nil
-			})
-
-			// * Upload the results file and update the slack message
-			slackClient.EXPECT().AddFileToThreads(
-				channelMap,
-				"k6-results.txt",
-				string(fullResults),
-			).Return(nil)
-			slackClient.EXPECT().UpdateMessages(
-				channelMap,
-				":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded",
-				fmt.Sprintf("extra context\nCloud URL: <%s>", test.cloudURL),
-			).Return(nil)
+		{
+			name: "env_vars with a space in a name",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "env_vars": "{\"FOO BAR\": \"value\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'env_vars': "FOO BAR" is not a valid environment variable name`),
+		},
+		{
+			name: "env_vars with a NUL byte in a value",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "env_vars": "{\"FOO\": \"val\\u0000ue\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'env_vars': the value of FOO contains a NUL byte`),
+		},
+		{
+			name: "tags with an equal sign in a name",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "tags": "{\"team=a\": \"value\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'tags': invalid tag name "team=a", it must not be empty nor contain '='`),
+		},
+		{
+			name: "tags with a newline in a value",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "tags": "{\"team\": \"a\\nb\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'tags': invalid tag "team", it must not contain control characters`),
+		},
+		{
+			name: "tags overriding an automatic tag",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "tags": "{\"canary\": \"other\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'tags': "canary" is set automatically`),
+		},
+		{
+			name: "kubernetes_secrets with an invalid name",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "kubernetes_secrets": "{\"FOO\\nBAR\": \"secret/key\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'kubernetes_secrets': "FOO\nBAR" is not a valid environment variable name`),
+		},
+		{
+			name: "kubernetes_configmaps with an invalid name",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "kubernetes_configmaps": "{\"FOO=BAR\": \"config/key\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'kubernetes_configmaps': "FOO=BAR" is not a valid environment variable name`),
+		},
+		{
+			name: "invalid extra_args",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "extra_args": "{}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'extra_args': json: cannot unmarshal object into Go value of type []string`),
+		},
+		{
+			name: "extra_args with shell metacharacters",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "extra_args": "[\"--vus\", \"10; rm -rf /\"]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'extra_args': argument "10; rm -rf /" contains disallowed characters`),
+		},
+		{
+			name: "kubernetes_secret_files with invalid name",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "kubernetes_secret_files": "{\"tls.crt\": \"secret/key\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'kubernetes_secret_files': "tls.crt" is not a valid environment variable name`),
+		},
+		{
+			name: "results_filename with path separators",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "results_filename": "../results.txt"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'results_filename': "../results.txt" must not contain path separators`),
+		},
+		{
+			name: "invalid extra_files",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "extra_files": "[]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'extra_files': json: cannot unmarshal array into Go value of type map[string]string`),
+		},
+		{
+			name: "extra_files outside of the script directory",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "extra_files": "{\"../lib.js\": \"export default 1\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'extra_files': "../lib.js" must be a relative path inside the script directory other than script.js and k6-options.json`),
+		},
+		{
+			name: "extra_files overriding the script",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "extra_files": "{\"script.js\": \"export default 1\"}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'extra_files': "script.js" must be a relative path inside the script directory other than script.js and k6-options.json`),
+		},
+		{
+			name: "options",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "options": "{\"vus\": 10, \"duration\": \"30s\"}"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.Options = `{"vus": 10, "duration": "30s"}`
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				return p
+			}(),
+		},
+		{
+			name: "invalid options",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "options": "{\"vus\": 10"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'options': unexpected end of JSON input`),
+		},
+		{
+			name: "options not being an object",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "options": "[]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'options': json: cannot unmarshal array into Go value of type map[string]interface {}`),
+		},
+		{
+			name: "summary_export without wait_for_results",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "summary_export": "true", "wait_for_results": "false"}}`)),
+			},
+			wantErr: errors.New(`'summary_export' requires 'wait_for_results'`),
+		},
+		{
+			name: "invalid log_output",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "log_output": "file=/tmp/{{.Name}}.log"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'log_output': "file=/tmp/test.log" is not a supported k6 log output (none, stdout, stderr or loki)`),
+		},
+		{
+			name: "scripts",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"scripts": "[{\"name\": \"smoke\", \"script\": \"smoke-script\"}, {\"name\": \"load\", \"script\": \"load-script\", \"options\": \"{\\\"vus\\\": 10}\"}]"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.ScriptsString = `[{"name": "smoke", "script": "smoke-script"}, {"name": "load", "script": "load-script", "options": "{\"vus\": 10}"}]`
+				p.Metadata.Scripts = []suiteScript{{Name: "smoke", Script: "smoke-script"}, {Name: "load", Script: "load-script", Options: `{"vus": 10}`}}
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				return p
+			}(),
+		},
+		{
+			name: "scripts with script",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "scripts": "[{\"name\": \"smoke\", \"script\": \"smoke-script\"}]"}}`)),
+			},
+			wantErr: errors.New(`'scripts' can't be combined with 'script', 'script_url' or 'script_configmap'`),
+		},
+		{
+			name: "empty scripts",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"scripts": "[]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'scripts': no script given`),
+		},
+		{
+			name: "scripts with the same name",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"scripts": "[{\"name\": \"smoke\", \"script\": \"smoke-script\"}, {\"name\": \"smoke\", \"script\": \"load-script\"}]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'scripts': "smoke" is the name of several scripts`),
+		},
+		{
+			name: "scripts without a script",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"scripts": "[{\"name\": \"smoke\"}]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'scripts': "smoke" has no script`),
+		},
+		{
+			name: "scripts without wait_for_results",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"scripts": "[{\"name\": \"smoke\", \"script\": \"smoke-script\"}]", "wait_for_results": "false"}}`)),
+			},
+			wantErr: errors.New(`'scripts' requires 'wait_for_results'`),
+		},
+		{
+			name: "phase overrides",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "phase_overrides": "{\"rollout\": {\"upload_to_cloud\": \"false\", \"min_failure_delay\": \"1m\"}, \"pre-rollout\": {\"script\": \"other-script\"}}"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.UploadToCloudString = "false"
+				p.Metadata.UploadToCloud = false
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.MinFailureDelayString = "1m"
+				p.Metadata.MinFailureDelay = time.Minute
+				p.Metadata.PhaseOverridesString = `{"rollout": {"upload_to_cloud": "false", "min_failure_delay": "1m"}, "pre-rollout": {"script": "other-script"}}`
+				return p
+			}(),
+		},
+		{
+			name: "phase overrides for other phases",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "post-rollout", "metadata": {"script": "my-script", "phase_overrides": "{\"rollout\": {\"script\": \"other-script\"}}"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "post-rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				p.Metadata.PhaseOverridesString = `{"rollout": {"script": "other-script"}}`
+				return p
+			}(),
+		},
+		{
+			name: "invalid phase_overrides",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "rollout", "metadata": {"script": "my-script", "phase_overrides": "[]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'phase_overrides': json: cannot unmarshal array into Go value of type map[string]map[string]string`),
+		},
+		{
+			name: "invalid phase_overrides value",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "rollout", "metadata": {"script": "my-script", "phase_overrides": "{\"rollout\": {\"upload_to_cloud\": false}}"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'phase_overrides': json: cannot unmarshal bool into Go struct field .rollout.upload_to_cloud of type string`),
+		},
+		{
+			name: "invalid abort_on_error_rate",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "abort_on_error_rate": "10%"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'abort_on_error_rate': strconv.ParseFloat: parsing "10%": invalid syntax`),
+		},
+		{
+			name: "abort_on_error_rate out of range",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "abort_on_error_rate": "10"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'abort_on_error_rate': 10 must be between 0 and 1 (excluded)`),
+		},
+		{
+			name: "abort_on_error_rate without waiting for results",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "abort_on_error_rate": "0.1", "wait_for_results": "false"}}`)),
+			},
+			wantErr: errors.New(`'abort_on_error_rate' requires 'wait_for_results'`),
+		},
+		{
+			name: "invalid return_cloud_url",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "return_cloud_url": "maybe"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'return_cloud_url': strconv.ParseBool: parsing "maybe": invalid syntax`),
+		},
+		{
+			name: "invalid require_notifications",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "require_notifications": "maybe"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'require_notifications': strconv.ParseBool: parsing "maybe": invalid syntax`),
+		},
+		{
+			name: "slack thread",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "slack_thread_ts": "1712345678.123456"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.SlackChannelsString = "test"
+				p.Metadata.SlackChannels = []string{"test"}
+				p.Metadata.SlackThreadTS = "1712345678.123456"
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				return p
+			}(),
+		},
+		{
+			name: "slack_channels with whitespace and empty entries",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": " test,, test2 ,"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.SlackChannelsString = " test,, test2 ,"
+				p.Metadata.SlackChannels = []string{"test", "test2"}
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				return p
+			}(),
+		},
+		{
+			name: "slack thread with a trailing comma",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test,", "slack_thread_ts": "1712345678.123456"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.SlackChannelsString = "test,"
+				p.Metadata.SlackChannels = []string{"test"}
+				p.Metadata.SlackThreadTS = "1712345678.123456"
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				return p
+			}(),
+		},
+		{
+			name: "empty slack_channels",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": " , ,"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'slack_channels': " , ," doesn't contain any channel`),
+		},
+		{
+			name: "slack_mentions_on_failure",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "slack_mentions_on_failure": "U0123ABCD,S0456EFGH"}}`)),
+			},
+			want: func() *launchPayload {
+				p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "test", Namespace: "test", Phase: "pre-rollout"}}
+				p.Metadata.Script = "my-script"
+				p.Metadata.WaitForResults = true
+				p.Metadata.SecretsOverrideEnv = true
+				p.Metadata.SlackChannelsString = "test"
+				p.Metadata.SlackChannels = []string{"test"}
+				p.Metadata.SlackMentionsOnFailureString = "U0123ABCD,S0456EFGH"
+				p.Metadata.SlackMentionsOnFailure = []string{"U0123ABCD", "S0456EFGH"}
+				p.Metadata.MinFailureDelay = 2 * time.Minute
+				return p
+			}(),
+		},
+		{
+			name: "invalid slack_mentions_on_failure",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "slack_mentions_on_failure": "@oncall"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'slack_mentions_on_failure': "@oncall" is not a Slack user or user group ID`),
+		},
+		{
+			name: "slack_mentions_on_failure without slack_channels",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_mentions_on_failure": "U0123ABCD"}}`)),
+			},
+			wantErr: errors.New(`'slack_mentions_on_failure' requires 'slack_channels'`),
+		},
+		{
+			name: "invalid slack_thread_ts",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "slack_thread_ts": "yesterday"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'slack_thread_ts': "yesterday" is not a Slack message timestamp`),
+		},
+		{
+			name: "slack_thread_ts with several channels",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test,test2", "slack_thread_ts": "1712345678.123456"}}`)),
+			},
+			wantErr: errors.New(`'slack_thread_ts' requires a single Slack channel`),
+		},
+		{
+			name: "invalid env_vars",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script": "my-script", "env_vars": "[]"}}`)),
+			},
+			wantErr: errors.New(`error parsing value for 'env_vars': json: cannot unmarshal array into Go value of type map[string]string`),
+		},
+		{
+			name: "several invalid settings",
+			request: &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"upload_to_cloud": "maybe", "min_failure_delay": "soon", "env_vars": "[]"}}`)),
+			},
+			wantErr: errors.New(`missing script; error parsing value for 'upload_to_cloud': strconv.ParseBool: parsing "maybe": invalid syntax; error parsing value for 'min_failure_delay': time: invalid duration "soon"; error parsing value for 'env_vars': json: cannot unmarshal array into Go value of type map[string]string`),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			payload, err := newLaunchPayload(tc.request, DefaultMaxRequestBytes)
+			if tc.wantErr != nil {
+				assert.EqualError(t, err, tc.wantErr.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.want, payload)
+		})
+	}
+}
+
+func TestValidationErrorFields(t *testing.T) {
+	req := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test", "namespace": "test", "phase": "pre-rollout", "metadata": {"script_url": "ftp://example.com/script.js", "slack_thread_ts": "yesterday", "tags": "{\"canary\": \"other\"}"}}`)),
+	}
+	_, err := newLaunchPayload(req, DefaultMaxRequestBytes)
+
+	var validationErr *validationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, []fieldError{
+		{Field: "metadata.script_url", Message: `error parsing value for 'script_url': unsupported scheme "ftp"`},
+		// Only the first error of each field is reported
+		{Field: "metadata.slack_thread_ts", Message: `error parsing value for 'slack_thread_ts': "yesterday" is not a Slack message timestamp`},
+		{Field: "metadata.tags", Message: `error parsing value for 'tags': "canary" is set automatically`},
+	}, validationErr.Errors)
+}
+
+func TestLaunchAndWaitCloud(t *testing.T) {
+	tests := map[string]struct {
+		k6OutputFile  string
+		cloudURLRegex string
+		cloudURL      string
+	}{
+		"legacy-cloud-url": {
+			k6OutputFile: "testdata/k6-output-legacy.txt",
+			cloudURL:     "https://app.k6.io/runs/1157843",
+		},
+		"grafana-cloud-url": {
+			k6OutputFile: "testdata/k6-output.txt",
+			cloudURL:     "https://somewhere.grafana.net/a/k6-app/runs/1157843",
+		},
+		"cloud-run-url": {
+			k6OutputFile: "testdata/k6-output-cloud-run.txt",
+			cloudURL:     "https://my-stack.grafana.net/a/k6-app/runs/3754122",
+		},
+		"self-hosted-url": {
+			k6OutputFile:  "testdata/k6-output-self-hosted.txt",
+			cloudURLRegex: `output: cloud \((?P<url>https://k6\.example\.com/projects/\d+/runs/\d+)\)`,
+			cloudURL:      "https://k6.example.com/projects/3/runs/1157843",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+			cloudURLRegex, err := ParseCloudURLRegex(test.cloudURLRegex)
+			require.NoError(t, err)
+			handler.cloudURLRegex = cloudURLRegex
+
+			// Expected calls
+			// * Start the run
+			fullResults, resultParts := getTestOutputFromFile(t, test.k6OutputFile)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), true, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+
+			// * Send the initial slack message
+			channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
+			slackClient.EXPECT().SendMessages(
+				[]string{"test", "test2"},
+				":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started",
+				fmt.Sprintf("extra context\nCloud URL: <%s>", test.cloudURL),
+			).Return(channelMap, nil)
+
+			// * Wait for the command to finish
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+
+			// * Upload the results file and update the slack message
+			slackClient.EXPECT().AddFileToThreads(
+				channelMap,
+				"test-name-test-space-k6-results.txt",
+				string(fullResults),
+			).Return(nil)
+			slackClient.EXPECT().UpdateMessages(
+				channelMap,
+				":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded",
+				fmt.Sprintf("extra context\nCloud URL: <%s>", test.cloudURL),
+			).Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "slack_channels": "test,test2", "notification_context": "extra context"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, fullResults, rr.Body.Bytes())
+			assert.Equal(t, 200, rr.Result().StatusCode)
+			assert.Equal(t, test.cloudURL, rr.Header().Get("X-K6-Cloud-URL"))
+		})
+	}
+}
+
+func TestReturnCloudURL(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		uploadToCloud  bool
+		waitForResults bool
+		expectedURL    string
+		expectedPrefix string
+	}{
+		{
+			name:           "waiting for the results",
+			uploadToCloud:  true,
+			waitForResults: true,
+			expectedURL:    "https://somewhere.grafana.net/a/k6-app/runs/1157843",
+			expectedPrefix: "Cloud URL: https://somewhere.grafana.net/a/k6-app/runs/1157843\n",
+		},
+		{
+			name:           "not waiting for the results",
+			uploadToCloud:  true,
+			waitForResults: false,
+			expectedURL:    "https://somewhere.grafana.net/a/k6-app/runs/1157843",
+			expectedPrefix: "Cloud URL: https://somewhere.grafana.net/a/k6-app/runs/1157843\n",
+		},
+		{
+			name:           "not uploading",
+			uploadToCloud:  false,
+			waitForResults: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), tc.uploadToCloud, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), gomock.Any()).Return(nil, nil)
+			waited := make(chan struct{})
+			testRun.EXPECT().PID().Return(-1).AnyTimes()
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				defer close(waited)
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			expectedBody := tc.expectedPrefix
+			if tc.waitForResults {
+				slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+				slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(nil)
+				expectedBody += string(fullResults)
+			}
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "%t", "wait_for_results": "%t", "return_cloud_url": "true"}}`, tc.uploadToCloud, tc.waitForResults))),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, 200, rr.Result().StatusCode)
+			assert.Equal(t, expectedBody, rr.Body.String())
+			assert.Equal(t, tc.expectedURL, rr.Header().Get("X-K6-Cloud-URL"))
+			<-waited
+		})
+	}
+}
+
+func TestStrictCloudURL(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		strict       bool
+		expectedCode int
+	}{
+		{
+			name:         "lenient by default",
+			expectedCode: 200,
+		},
+		{
+			name:         "strict",
+			strict:       true,
+			expectedCode: 400,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+			// The output of k6 doesn't match the regex
+			cloudURLRegex, err := ParseCloudURLRegex(`output: cloud \((?P<url>https://k6\.example\.com/runs/\d+)\)`)
+			require.NoError(t, err)
+			handler.cloudURLRegex = cloudURLRegex
+
+			// Expected calls
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), true, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			waited := make(chan struct{})
+			testRun.EXPECT().PID().Return(-1).AnyTimes()
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				defer close(waited)
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			if tc.strict {
+				// * The test is left to the async cleanup
+				testRun.EXPECT().ExitCode().Return(0).AnyTimes()
+				testRun.EXPECT().ExecutionDuration().Return(time.Second).AnyTimes()
+				testRun.EXPECT().CleanupContext().AnyTimes()
+			} else {
+				// * The test goes on without the cloud URL
+				slackClient.EXPECT().SendMessages(nil, ":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started", "").Return(nil, nil)
+				slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+				slackClient.EXPECT().UpdateMessages(nil, ":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded", "").Return(nil)
+			}
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "strict_cloud_url": "%t"}}`, tc.strict))),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, tc.expectedCode, rr.Result().StatusCode)
+			assert.Empty(t, rr.Header().Get("X-K6-Cloud-URL"))
+			if tc.strict {
+				assert.Contains(t, rr.Body.String(), "couldn't find the cloud URL in the output")
+			} else {
+				assert.Equal(t, string(fullResults), rr.Body.String())
+			}
+			<-waited
+		})
+	}
+}
+
+func TestParseCloudURLRegex(t *testing.T) {
+	// The default regex doesn't match self-hosted instances
+	re, err := ParseCloudURLRegex("")
+	require.NoError(t, err)
+	_, err = getCloudURL(re, "output: cloud (https://k6.example.com/runs/1)")
+	assert.EqualError(t, err, "couldn't find the cloud URL in the output")
+
+	re, err = ParseCloudURLRegex(`output: cloud \((?P<url>https://k6\.example\.com/runs/\d+)\)`)
+	require.NoError(t, err)
+	url, err := getCloudURL(re, "output: cloud (https://k6.example.com/runs/1)")
+	require.NoError(t, err)
+	assert.Equal(t, "https://k6.example.com/runs/1", url)
+
+	_, err = ParseCloudURLRegex(`output: cloud \((`)
+	assert.ErrorContains(t, err, "error parsing the cloud URL regex")
+
+	_, err = ParseCloudURLRegex(`output: cloud \((https://k6\.example\.com/runs/\d+)\)`)
+	assert.EqualError(t, err, `the cloud URL regex must have a group named "url" capturing the URL`)
+}
+
+func TestPhaseOverrides(t *testing.T) {
+	// The results are only uploaded to the cloud for the pre-rollout tests
+	for _, tc := range []struct {
+		phase  string
+		upload bool
+	}{
+		{phase: "pre-rollout", upload: true},
+		{phase: "rollout", upload: false},
+	} {
+		t.Run(tc.phase, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			// * Start the run
+			fullResults, resultParts := getTestOutputFromFile(t, "testdata/k6-output-legacy.txt")
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), tc.upload, testEnvVars(map[string]string{"K6_CANARY_PHASE": tc.phase}), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+
+			// * Send the initial slack message, with the phase
+			slackClient.EXPECT().SendMessages(nil, fmt.Sprintf(":warning: `%s` load testing of `test-name` in namespace `test-space` has started", tc.phase), gomock.Any()).Return(nil, nil)
+
+			// * Wait for the command to finish
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+
+			// * Upload the results file and update the slack message
+			slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, fmt.Sprintf(":large_green_circle: `%s` load testing of `test-name` in namespace `test-space` has succeeded", tc.phase), gomock.Any()).Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "` + tc.phase + `", "metadata": {"script": "my-script", "upload_to_cloud": "true", "phase_overrides": "{\"rollout\": {\"upload_to_cloud\": \"false\"}}"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, fullResults, rr.Body.Bytes())
+			assert.Equal(t, 200, rr.Result().StatusCode)
+		})
+	}
+}
+
+func TestNotificationContextTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		notificationContext string
+		expectedContext     string
+	}{
+		{
+			name:                "template",
+			notificationContext: "<https://grafana.example.com/d/abc?var-namespace={{.Namespace}}&var-name={{.Name}}|Dashboard> of {{.Phase}}, run {{.CloudURL}}",
+			expectedContext:     "<https://grafana.example.com/d/abc?var-namespace=test-space&var-name=test-name|Dashboard> of pre-rollout, run https://app.k6.io/runs/1157843\nCloud URL: <https://app.k6.io/runs/1157843>",
+		},
+		{
+			name:                "invalid template (used as is)",
+			notificationContext: "{{.Name",
+			expectedContext:     "{{.Name\nCloud URL: <https://app.k6.io/runs/1157843>",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			// * Start the run
+			fullResults, resultParts := getTestOutputFromFile(t, "testdata/k6-output-legacy.txt")
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), true, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+
+			// * The context is rendered once the cloud URL is known
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), tc.expectedContext).Return(nil, nil)
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), tc.expectedContext).Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "notification_context": "%s"}}`, tc.notificationContext))),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+			assert.Equal(t, 200, rr.Result().StatusCode)
+		})
+	}
+}
+
+func TestColoredOutput(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// The colors that k6 can output despite --no-color
+	colorize := func(s string) string {
+		s = strings.ReplaceAll(s, "output: cloud", "output: \x1b[36mcloud\x1b[0m")
+		return strings.ReplaceAll(s, "execution:", "\x1b[1m\x1b[32mexecution:\x1b[0m")
+	}
+
+	// Expected calls
+	// * Start the run
+	fullResults, resultParts := getTestOutputFromFile(t, "testdata/k6-output-legacy.txt")
+	require.NotEqual(t, resultParts[0], colorize(resultParts[0]))
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), true, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(colorize(resultParts[0])))
+		return testRun, nil
+	})
+
+	// * The cloud URL is found despite the colors
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "\nCloud URL: <https://app.k6.io/runs/1157843>").Return(nil, nil)
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+
+	// * The results are uploaded without the colors
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+	assert.Equal(t, string(fullResults), rr.Body.String())
+}
+
+func TestCloudURLOnlyFromStdout(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run. A log line on stderr looks like the output line
+	stderrNoise := "WARN[0000] script printed: output: cloud (https://app.k6.io/runs/666)\n"
+	fullResults, resultParts := getTestOutputFromFile(t, "testdata/k6-output-legacy.txt")
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), true, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		errWriter.Write([]byte(stderrNoise))
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * The cloud URL is the one from stdout
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "\nCloud URL: <https://app.k6.io/runs/1157843>").Return(nil, nil)
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+
+	// * The results have both stdout and stderr
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), stderrNoise+string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestOutputOnlyOnStderr(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run, which only logs something that looks like the output
+	// line on stderr
+	stderrNoise := "WARN[0000] script printed: output: cloud (https://app.k6.io/runs/666)\n"
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), true, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		errWriter.Write([]byte(stderrNoise))
+		return testRun, nil
+	})
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Kill().Return(nil).AnyTimes()
+	testRun.EXPECT().Wait().Return(nil).AnyTimes()
+	testRun.EXPECT().Exited().Return(true).AnyTimes()
+	handler.sleep = func(time.Duration) {}
+
+	// * The test is considered as not started
+	slackClient.EXPECT().SendMessages(nil, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` didn't start successfully", "").Return(nil, nil)
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), stderrNoise).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "error while waiting for test to start")
+}
+
+func TestCloudProjectID(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		uploadToCloud   bool
+		expectedEnvVars map[string]string
+	}{
+		{
+			name:            "uploading",
+			uploadToCloud:   true,
+			expectedEnvVars: map[string]string{"FOO": "bar", "K6_CLOUD_PROJECT_ID": "12345"},
+		},
+		{
+			name:            "not uploading (ignored)",
+			uploadToCloud:   false,
+			expectedEnvVars: map[string]string{"FOO": "bar"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			// * Start the run with the project ID in the environment
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), tc.uploadToCloud, testEnvVars(tc.expectedEnvVars), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), gomock.Any()).Return(nil, nil)
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "%t", "cloud_project_id": "12345", "env_vars": "{\"FOO\": \"bar\"}"}}`, tc.uploadToCloud))),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, fullResults, rr.Body.Bytes())
+			assert.Equal(t, 200, rr.Result().StatusCode)
+		})
+	}
+}
+
+func TestCloudInsecureSkipTLSVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		uploadToCloud     bool
+		expectedExtraArgs []string
+	}{
+		{
+			name:              "uploading",
+			uploadToCloud:     true,
+			expectedExtraArgs: []string{"--vus", "10", "--insecure-skip-tls-verify"},
+		},
+		{
+			name:              "not uploading (ignored)",
+			uploadToCloud:     false,
+			expectedExtraArgs: []string{"--vus", "10"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			// * Start the run with the flag, only when uploading
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), tc.uploadToCloud, testEnvVars(nil), tc.expectedExtraArgs, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), gomock.Any()).Return(nil, nil)
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "%t", "cloud_insecure_skip_tls_verify": "true", "extra_args": "[\"--vus\", \"10\"]"}}`, tc.uploadToCloud))),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, fullResults, rr.Body.Bytes())
+			assert.Equal(t, 200, rr.Result().StatusCode)
+		})
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		defaultLogOutput  string
+		logOutput         string
+		expectedExtraArgs []string
+	}{
+		{
+			name: "not set",
+		},
+		{
+			name:              "from the metadata",
+			logOutput:         "loki=https://loki.example.com/loki/api/v1/push,label.canary={{.Name}},label.namespace={{.Namespace}}",
+			expectedExtraArgs: []string{"--log-output", "loki=https://loki.example.com/loki/api/v1/push,label.canary=test-name,label.namespace=test-space"},
+		},
+		{
+			name:              "default",
+			defaultLogOutput:  "loki=https://loki.example.com/loki/api/v1/push,label.canary={{.Name}},label.phase={{.Phase}}",
+			expectedExtraArgs: []string{"--log-output", "loki=https://loki.example.com/loki/api/v1/push,label.canary=test-name,label.phase=pre-rollout"},
+		},
+		{
+			name:              "metadata overriding the default",
+			defaultLogOutput:  "loki=https://loki.example.com/loki/api/v1/push,label.canary={{.Name}}",
+			logOutput:         "none",
+			expectedExtraArgs: []string{"--log-output", "none"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+			WithLogOutput(tc.defaultLogOutput)(handler)
+
+			// Expected calls
+			// * Start the run with the log output, if any
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), tc.expectedExtraArgs, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), gomock.Any()).Return(nil, nil)
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(nil)
+
+			// Make request
+			logOutput := ""
+			if tc.logOutput != "" {
+				logOutput = fmt.Sprintf(`, "log_output": %q`, tc.logOutput)
+			}
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"%s}}`, logOutput))),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, fullResults, rr.Body.Bytes())
+			assert.Equal(t, 200, rr.Result().StatusCode)
+		})
+	}
+
+	t.Run("invalid default", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		_, err := NewLaunchHandler(context.Background(), mocks.NewMockK6Client(mockCtrl), nil, mocks.NewMockSlackClient(mockCtrl), 1, WithLogOutput("file=/tmp/k6.log"))
+		assert.EqualError(t, err, `invalid k6 log output: "file=/tmp/k6.log" is not a supported k6 log output (none, stdout, stderr or loki)`)
+	})
+}
+
+func TestSlackFailuresDontAbort(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), true, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * Send the initial slack message
+	slackClient.EXPECT().SendMessages(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("error sending message"))
+
+	// * Wait for the command to finish
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+
+	// * Upload the results file and update the slack message
+	slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(errors.New("error adding file"))
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(errors.New("error updating message"))
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "slack_channels": "test,test2", "notification_context": "extra context"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fullResults, rr.Body.Bytes())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestRequireNotifications(t *testing.T) {
+	t.Run("initial message", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		// Expected calls
+		// * Start the run
+		_, resultParts := getTestOutput(t)
+		var processCtx context.Context
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+			processCtx = ctx
+			outputWriter.Write([]byte(resultParts[0]))
+			return testRun, nil
+		})
+
+		// * Fail to send the initial slack message
+		slackClient.EXPECT().SendMessages([]string{"test"}, gomock.Any(), gomock.Any()).Return(nil, errors.New("error sending message"))
+
+		// * The process is killed and cleaned up
+		waited := make(chan struct{})
+		testRun.EXPECT().PID().Return(-1).AnyTimes()
+		testRun.EXPECT().Wait().DoAndReturn(func() error {
+			close(waited)
+			return nil
+		})
+
+		// Make request
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "require_notifications": "true"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		// Expected response
+		assert.Equal(t, "error sending the notifications: error sending message\n"+resultParts[0]+"\n", rr.Body.String())
+		assert.Equal(t, 400, rr.Result().StatusCode)
+		assert.Error(t, processCtx.Err())
+		<-waited
+	})
+
+	t.Run("final message", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		// Expected calls
+		// * Start the run
+		fullResults, resultParts := getTestOutput(t)
+		var bufferWriter io.Writer
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+			bufferWriter = outputWriter
+			outputWriter.Write([]byte(resultParts[0]))
+			return testRun, nil
+		})
+
+		// * Send the initial slack message
+		channelMap := map[string]string{"C1234": "ts1"}
+		slackClient.EXPECT().SendMessages([]string{"test"}, gomock.Any(), gomock.Any()).Return(channelMap, nil)
+
+		// * Wait for the command to finish
+		testRun.EXPECT().Wait().DoAndReturn(func() error {
+			bufferWriter.Write([]byte("running" + resultParts[1]))
+			return nil
+		})
+
+		// * Upload the results file but fail to update the slack message
+		slackClient.EXPECT().AddFileToThreads(channelMap, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+		slackClient.EXPECT().UpdateMessages(channelMap, gomock.Any(), gomock.Any()).Return(errors.New("error updating message"))
+
+		// Make request
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "require_notifications": "true"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		// Expected response
+		assert.Equal(t, "error sending the notifications: error updating message\n"+string(fullResults)+"\n", rr.Body.String())
+		assert.Equal(t, 400, rr.Result().StatusCode)
+		// The test itself succeeded
+		assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "success"))
+	})
+}
+
+func TestTeamsNotifications(t *testing.T) {
+	// Initialize controller
+	_, cancel, ctrl, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// The Teams client has the same interface as the Slack one
+	teamsClient := mocks.NewMockSlackClient(ctrl)
+	WithTeamsClient(teamsClient)(handler)
+
+	// Expected calls
+	// * Start the run
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * Send the initial messages to both Slack and Teams
+	slackChannelMap := map[string]string{"C1234": "ts1"}
+	slackClient.EXPECT().SendMessages(
+		[]string{"test"},
+		":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started",
+		"",
+	).Return(slackChannelMap, nil)
+	teamsChannelMap := map[string]string{"deploys": "", "alerts": ""}
+	teamsClient.EXPECT().SendMessages(
+		[]string{"deploys", "alerts"},
+		":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started",
+		"",
+	).Return(teamsChannelMap, nil)
+
+	// * Wait for the command to finish
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+
+	// * Upload the results file and update the messages (a Teams failure
+	// doesn't prevent the Slack update)
+	slackClient.EXPECT().AddFileToThreads(slackChannelMap, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+	teamsClient.EXPECT().AddFileToThreads(teamsChannelMap, "test-name-test-space-k6-results.txt", string(fullResults)).Return(errors.New("error adding file"))
+	slackClient.EXPECT().UpdateMessages(
+		slackChannelMap,
+		":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded",
+		"",
+	).Return(nil)
+	teamsClient.EXPECT().UpdateMessages(
+		teamsChannelMap,
+		":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded",
+		"",
+	).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "teams_channels": "deploys, alerts,"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fullResults, rr.Body.Bytes())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestMessageTemplates(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	templates, err := ParseMessageTemplates(":rocket: {{.Name}} {{.Status}}", ":tada: {{.Name}} passed in {{.Duration}}", "")
+	require.NoError(t, err)
+	WithMessageTemplates(templates)(handler)
+
+	// Expected calls
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	channelMap := map[string]string{"C1234": "ts1"}
+	// * The messages use the custom templates
+	slackClient.EXPECT().SendMessages([]string{"test"}, ":rocket: test-name has started", "").Return(channelMap, nil)
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+	slackClient.EXPECT().AddFileToThreads(channelMap, gomock.Any(), string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(channelMap, ":tada: test-name passed in 1m0s", "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestSummaryMetrics(t *testing.T) {
+	// Initialize controller
+	_, cancel, ctrl, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// The metrics are passed to notifiers through the test
+	testNotifier := mocks.NewMockSlackClient(ctrl)
+	var test *notifier.Test
+	WithTestNotifier(func(t *notifier.Test) notifier.Notifier {
+		test = t
+		return testNotifier
+	})(handler)
+
+	// Expected calls
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+	testNotifier.EXPECT().SendMessages(nil, gomock.Any(), "").DoAndReturn(func(channels []string, text, context string) (map[string]string, error) {
+		// * The metrics are unknown while the test is running
+		assert.Nil(t, test.Metrics)
+		return map[string]string{"webhook": ""}, nil
+	})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+	testNotifier.EXPECT().AddFileToThreads(map[string]string{"webhook": ""}, gomock.Any(), string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+	testNotifier.EXPECT().UpdateMessages(map[string]string{"webhook": ""}, gomock.Any(), "").DoAndReturn(func(threads map[string]string, text, context string) error {
+		// * The metrics are parsed from the summary once the test is done
+		assert.Equal(t, &notifier.Metrics{VUs: "2", Iterations: "582", HTTPReqDurationP95: "524.76µs", HTTPReqFailedRate: "0.00%"}, test.Metrics)
+		return nil
+	})
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestResultHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		k6OutputFile    string
+		expectedHeaders http.Header
+	}{
+		{
+			name:         "with checks",
+			k6OutputFile: "testdata/k6-output-cloud-run.txt",
+			expectedHeaders: http.Header{
+				"X-K6-Exit-Code":     []string{"0"},
+				"X-K6-Checks-Passed": []string{"582"},
+				"X-K6-Checks-Failed": []string{"0"},
+			},
+		},
+		{
+			name:            "without checks",
+			k6OutputFile:    "testdata/k6-output.txt",
+			expectedHeaders: http.Header{"X-K6-Exit-Code": []string{"0"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			fullResults, resultParts := getTestOutputFromFile(t, tc.k6OutputFile)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), gomock.Any()).Return(nil, nil)
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response: the body is unchanged
+			assert.Equal(t, fullResults, rr.Body.Bytes())
+			assert.Equal(t, 200, rr.Result().StatusCode)
+			for name := range rr.Header() {
+				if !strings.HasPrefix(name, "X-K6-") {
+					rr.Header().Del(name)
+				}
+			}
+			assert.Equal(t, tc.expectedHeaders, rr.Header())
+		})
+	}
+}
+
+func TestResultsFilename(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		p := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "my-app", Namespace: "my-namespace", Phase: "pre-rollout"}}
+		assert.Equal(t, "my-app-my-namespace-k6-results.txt", p.resultsFilename())
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		// Expected calls
+		fullResults, resultParts := getTestOutput(t)
+		var bufferWriter io.Writer
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+			bufferWriter = outputWriter
+			outputWriter.Write([]byte(resultParts[0]))
+			return testRun, nil
+		})
+		channelMap := map[string]string{"C1234": "ts1"}
+		slackClient.EXPECT().SendMessages([]string{"test"}, gomock.Any(), "").Return(channelMap, nil)
+		testRun.EXPECT().Wait().DoAndReturn(func() error {
+			bufferWriter.Write([]byte("running" + resultParts[1]))
+			return nil
+		})
+
+		// * The results are uploaded with the custom name
+		slackClient.EXPECT().AddFileToThreads(channelMap, "canary-results.txt", string(fullResults)).Return(nil)
+		slackClient.EXPECT().UpdateMessages(channelMap, gomock.Any(), "").Return(nil)
+
+		// Make request
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "results_filename": "canary-results.txt"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+		assert.Equal(t, 200, rr.Result().StatusCode)
+	})
+}
+
+func TestExtraFiles(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * The extra files are passed along with the script
+	expectedScript := testScript("my-script")
+	expectedScript.Files = map[string]string{"lib/helpers.js": "export const x = 1;", "data.json": "{}"}
+	fullResults, _ := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), expectedScript, false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write(fullResults)
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+	testRun.EXPECT().Wait().Return(nil)
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "extra_files": "{\"lib/helpers.js\": \"export const x = 1;\", \"data.json\": \"{}\"}"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestTags(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * The tags are added to the automatic ones
+	expectedScript := testScript("my-script")
+	expectedScript.Tags["team"] = "checkout"
+	expectedScript.Tags["env"] = "dev's cluster"
+	fullResults, _ := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), expectedScript, false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write(fullResults)
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+	testRun.EXPECT().Wait().Return(nil)
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "tags": "{\"team\": \"checkout\", \"env\": \"dev's cluster\"}"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestOptions(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * The options are passed along with the script
+	expectedScript := testScript("my-script")
+	expectedScript.Options = `{"vus": 10, "duration": "30s"}`
+	fullResults, _ := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), expectedScript, false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write(fullResults)
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+	testRun.EXPECT().Wait().Return(nil)
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "options": "{\"vus\": 10, \"duration\": \"30s\"}"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestSummaryExport(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		writeSummary  bool
+		expectSummary bool
+	}{
+		{
+			name:          "summary exported",
+			writeSummary:  true,
+			expectSummary: true,
+		},
+		{
+			name:          "summary missing (test crashed)",
+			writeSummary:  false,
+			expectSummary: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			// * Start the run with the summary export argument
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			var summaryPath string
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				require.Len(t, extraArgs, 4)
+				assert.Equal(t, []string{"--vus", "10", "--summary-export"}, extraArgs[:3])
+				summaryPath = extraArgs[3]
+
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+
+			channelMap := map[string]string{"C1234": "ts1"}
+			slackClient.EXPECT().SendMessages([]string{"test"}, gomock.Any(), "").Return(channelMap, nil)
+
+			// * Wait for the command to finish. k6 writes the summary at the end
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				if tc.writeSummary {
+					require.NoError(t, os.WriteFile(summaryPath, []byte(`{"metrics": {}}`), 0o600))
+				}
+				return nil
+			})
+
+			// * Upload the results and the summary, then update the slack message
+			slackClient.EXPECT().AddFileToThreads(channelMap, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+			if tc.expectSummary {
+				slackClient.EXPECT().AddFileToThreads(channelMap, "k6-summary.json", `{"metrics": {}}`).Return(nil)
+			}
+			slackClient.EXPECT().UpdateMessages(channelMap, ":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded", "").Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "summary_export": "true", "extra_args": "[\"--vus\", \"10\"]"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, fullResults, rr.Body.Bytes())
+			assert.Equal(t, 200, rr.Result().StatusCode)
+
+			// The summary is removed once the test is done
+			assert.Eventually(t, func() bool {
+				_, err := os.Stat(summaryPath)
+				return os.IsNotExist(err)
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestBundleArtifacts(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run with the summary export argument
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	var summaryPath string
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		require.Len(t, extraArgs, 2)
+		summaryPath = extraArgs[1]
+
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	channelMap := map[string]string{"C1234": "ts1"}
+	slackClient.EXPECT().SendMessages([]string{"test"}, gomock.Any(), "").Return(channelMap, nil)
+
+	// * Wait for the command to finish. k6 writes the summary at the end
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		require.NoError(t, os.WriteFile(summaryPath, []byte(`{"metrics": {}}`), 0o600))
+		return nil
+	})
+
+	// * Upload a single tarball, then update the slack message
+	var bundle string
+	slackClient.EXPECT().AddFileToThreads(channelMap, "k6-artifacts.tar.gz", gomock.Any()).DoAndReturn(func(threads map[string]string, fileName, content string) error {
+		bundle = content
+		return nil
+	})
+	slackClient.EXPECT().UpdateMessages(channelMap, ":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded", "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "summary_export": "true", "bundle_artifacts": "true"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fullResults, rr.Body.Bytes())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+
+	// The tarball contains the results and the summary
+	gzipReader, err := gzip.NewReader(strings.NewReader(bundle))
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzipReader)
+	entries := map[string]string{}
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tarReader)
+		require.NoError(t, err)
+		entries[header.Name] = string(content)
+	}
+	assert.Equal(t, map[string]string{
+		"test-name-test-space-k6-results.txt": string(fullResults),
+		"k6-summary.json":                     `{"metrics": {}}`,
+	}, entries)
+}
+
+func TestLaunchAndWaitLocal(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	}).Times(2)
+
+	// * Send the initial slack message
+	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
+	slackClient.EXPECT().SendMessages(
+		[]string{"test", "test2"},
+		":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started",
+		"",
+	).Times(2).Return(channelMap, nil)
+
+	// * Wait for the command to finish
+	testRun.EXPECT().Wait().Times(2).DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+
+	// * Upload the results file and update the slack message
+	slackClient.EXPECT().AddFileToThreads(
+		channelMap,
+		"test-name-test-space-k6-results.txt",
+		string(fullResults),
+	).Times(2).Return(nil)
+	slackClient.EXPECT().UpdateMessages(
+		channelMap,
+		":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded",
+		"",
+	).Times(2).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fullResults, rr.Body.Bytes())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+	// The results aren't uploaded, so there is no cloud URL
+	assert.Empty(t, rr.Header().Get("X-K6-Cloud-URL"))
+
+	//
+	// Run it again immediately to see if we get the same result
+	//
+
+	// Make request
+	request = &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fullResults, rr.Body.Bytes())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+	assert.Equal(t, float64(2), getTestResultCount(t, handler, "test-space", "test-name", "success"))
+	assert.Equal(t, float64(0), getMetricValue(t, handler.metricActiveTests, nil))
+	assert.Equal(t, float64(0), getTestResultCount(t, handler, "test-space", "test-name", "failure"))
+}
+
+func TestLaunchAndWaitAndGetError(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * Send the initial slack message
+	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
+	slackClient.EXPECT().SendMessages(
+		[]string{"test", "test2"},
+		":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started",
+		"",
+	).Return(channelMap, nil)
+
+	// * Wait for the command to finish
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return errors.New("exit code 1")
+	})
+
+	// * Upload the results file and update the slack message
+	slackClient.EXPECT().AddFileToThreads(
+		channelMap,
+		"test-name-test-space-k6-results.txt",
+		string(fullResults),
+	).Return(nil)
+	slackClient.EXPECT().UpdateMessages(
+		channelMap,
+		":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed",
+		"",
+	).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fmt.Sprintf("failed to run: exit code 1\n%s\n", string(fullResults)), rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "failure"))
+	assert.Equal(t, float64(0), getTestResultCount(t, handler, "test-space", "test-name", "success"))
+
+	//
+	// Run it again immediately to get the failure due to min_failure_delay
+	//
+
+	// Make request
+	request = &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, "not enough time since last failure\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+}
+
+func TestLaunchKilled(t *testing.T) {
+	// Initialize controller
+	_, cancel, mockCtrl, k6Client, slackClient, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	testRun := mocks.NewMockK6TestRun(mockCtrl)
+	testRun.EXPECT().ExecutionDuration().Return(time.Minute).AnyTimes()
+	testRun.EXPECT().ExitCode().Return(137).AnyTimes()
+
+	// Expected calls
+	// * Start the run
+	_, resultParts := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * Send the initial slack message
+	channelMap := map[string]string{"C1234": "ts1"}
+	slackClient.EXPECT().SendMessages([]string{"test"}, ":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started", "").Return(channelMap, nil)
+
+	// * k6 is killed by the kernel, without printing anything
+	testRun.EXPECT().Wait().Return(errors.New("signal: killed"))
+
+	// * Upload the results file and update the slack message with the
+	// likely cause
+	slackClient.EXPECT().AddFileToThreads(channelMap, "test-name-test-space-k6-results.txt", resultParts[0]).Return(nil)
+	slackClient.EXPECT().UpdateMessages(channelMap, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed: k6 was killed (possibly OOM)", "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fmt.Sprintf("k6 was killed (possibly OOM): signal: killed\n%s\n", resultParts[0]), rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Equal(t, "137", rr.Result().Header.Get(headerExitCode))
+	assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "failure"))
+}
+
+func TestTestFailureStatus(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	WithTestFailureStatus(http.StatusUnprocessableEntity)(handler)
+	slackClient.EXPECT().SendMessages(gomock.Any(), gomock.Any(), gomock.Any()).Return(map[string]string{}, nil).AnyTimes()
+	slackClient.EXPECT().AddFileToThreads(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	slackClient.EXPECT().UpdateMessages(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	// Invalid requests still get a 400
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, "error while validating request: missing script\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+
+	// Failed tests get the configured status
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return errors.New("exit code 1")
+	})
+
+	request = &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, fmt.Sprintf("failed to run: exit code 1\n%s\n", string(fullResults)), rr.Body.String())
+	assert.Equal(t, 422, rr.Result().StatusCode)
+
+	// Errors unrelated to the run of the test, ex: min_failure_delay, are
+	// still a 400
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	})
+	assert.Equal(t, "not enough time since last failure\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+
+	t.Run("invalid status", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		_, err := NewLaunchHandler(context.Background(), mocks.NewMockK6Client(mockCtrl), nil, mocks.NewMockSlackClient(mockCtrl), 1, WithTestFailureStatus(200))
+		assert.EqualError(t, err, "invalid test failure status: 200 is not a 4xx or 5xx status")
+	})
+}
+
+func TestAbortOnErrorRate(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		failedRate       float64
+		expectedStatus   int
+		expectedPrefix   string
+		expectedMessage  string
+		expectedResult   string
+		expectedKillCall bool
+	}{
+		{
+			name:             "error rate above the threshold",
+			failedRate:       0.5,
+			expectedStatus:   400,
+			expectedPrefix:   "test aborted: error rate of 50.00% above 10.00%\n",
+			expectedMessage:  ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has been aborted: error rate of 50.00% above 10.00%",
+			expectedResult:   "failure",
+			expectedKillCall: true,
+		},
+		{
+			name:            "error rate below the threshold",
+			failedRate:      0.05,
+			expectedStatus:  200,
+			expectedMessage: ":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded",
+			expectedResult:  "success",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+			handler.errorRatePollInterval = 10 * time.Millisecond
+
+			// The REST API of k6 reports the live metrics
+			polls := make(chan struct{}, 100)
+			api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/v1/metrics", r.URL.Path)
+				fmt.Fprintf(w, `{"data": [
+					{"type": "metrics", "id": "http_reqs", "attributes": {"type": "counter", "sample": {"count": 200, "rate": 20}}},
+					{"type": "metrics", "id": "http_req_failed", "attributes": {"type": "rate", "sample": {"rate": %g}}}
+				]}`, tc.failedRate)
+				select {
+				case polls <- struct{}{}:
+				default:
+				}
+			}))
+			t.Cleanup(api.Close)
+
+			// Expected calls
+			// * Start the run with the API listening on a free port
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				require.Len(t, extraArgs, 2)
+				assert.Equal(t, "--address", extraArgs[0])
+				l, err := net.Listen("tcp", extraArgs[1])
+				require.NoError(t, err)
+				api.Listener = l
+				api.Start()
+
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+			// * The test runs until it is killed or until the error rate
+			// has been checked a few times
+			killed := make(chan struct{})
+			testRun.EXPECT().Exited().Return(false).AnyTimes()
+			if tc.expectedKillCall {
+				testRun.EXPECT().Kill().DoAndReturn(func() error {
+					close(killed)
+					return nil
+				})
+			}
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				if tc.expectedKillCall {
+					<-killed
+					bufferWriter.Write([]byte("running" + resultParts[1]))
+					return errors.New("signal: killed")
+				}
+				for range 3 {
+					<-polls
+				}
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return nil
+			})
+			slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, tc.expectedMessage, "").Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "abort_on_error_rate": "0.1"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, tc.expectedStatus, rr.Result().StatusCode)
+			if tc.expectedPrefix != "" {
+				assert.Equal(t, tc.expectedPrefix+string(fullResults)+"\n", rr.Body.String())
+			} else {
+				assert.Equal(t, fullResults, rr.Body.Bytes())
+			}
+			assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", tc.expectedResult))
+		})
+	}
+}
+
+func TestStartRetries(t *testing.T) {
+	t.Run("transient error", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		var sleepCalls []time.Duration
+		handler.sleep = func(d time.Duration) {
+			sleepCalls = append(sleepCalls, d)
+		}
+
+		// Expected calls
+		// * Fail to start the run once (k6 can't fork), then start it
+		fullResults, resultParts := getTestOutput(t)
+		var bufferWriter io.Writer
+		gomock.InOrder(
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("fork/exec k6: %w", syscall.EAGAIN)),
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			}),
+		)
+		slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+		testRun.EXPECT().Wait().DoAndReturn(func() error {
+			bufferWriter.Write([]byte("running" + resultParts[1]))
+			return nil
+		})
+		slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), string(fullResults)).Return(nil)
+		slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+		// Make request
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		// Expected response
+		assert.Equal(t, fullResults, rr.Body.Bytes())
+		assert.Equal(t, 200, rr.Result().StatusCode)
+		assert.Equal(t, []time.Duration{time.Second}, sleepCalls)
+	})
+
+	t.Run("too many transient errors", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, _, _, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		var sleepCalls []time.Duration
+		handler.sleep = func(d time.Duration) {
+			sleepCalls = append(sleepCalls, d)
+		}
+
+		// Expected calls
+		// * Fail to start the run, until the retries are exhausted
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("fork/exec k6: %w", syscall.EAGAIN)).Times(3)
+
+		// Make request
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		// Expected response
+		assert.Equal(t, "error while launching test: fork/exec k6: resource temporarily unavailable\n", rr.Body.String())
+		assert.Equal(t, 400, rr.Result().StatusCode)
+		assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleepCalls)
+	})
+
+	t.Run("non-transient error", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, _, _, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		var sleepCalls []time.Duration
+		handler.sleep = func(d time.Duration) {
+			sleepCalls = append(sleepCalls, d)
+		}
+
+		// Expected calls
+		// * Fail to start the run once, as it would fail again
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).Return(nil, errors.New(`extra argument "--foo" must not reference the script file`))
+
+		// Make request
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		// Expected response
+		assert.Equal(t, "error while launching test: extra argument \"--foo\" must not reference the script file\n", rr.Body.String())
+		assert.Equal(t, 400, rr.Result().StatusCode)
+		assert.Empty(t, sleepCalls)
+	})
+
+	t.Run("canceled while backing off", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, _, _, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		reqCtx, cancelReq := context.WithCancel(context.Background())
+		sleeping, slept := make(chan struct{}), make(chan struct{})
+		t.Cleanup(func() { close(slept) })
+		handler.sleep = func(d time.Duration) {
+			close(sleeping)
+			<-slept
+		}
+		go func() {
+			<-sleeping
+			cancelReq()
+		}()
+
+		// Expected calls
+		// * Fail to start the run once, the request is canceled before retrying
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).Return(nil, fmt.Errorf("fork/exec k6: %w", syscall.EAGAIN))
+
+		// Make request
+		request := (&http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+		}).WithContext(reqCtx)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		// Expected response
+		assert.Equal(t, "error while launching test: context canceled\n", rr.Body.String())
+		assert.Equal(t, 400, rr.Result().StatusCode)
+	})
+}
+
+func TestMinFailureDelayDisabled(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls: both runs fail, the second one isn't rejected because
+	// of the first failure
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	}).Times(2)
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil).Times(2)
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return errors.New("exit code 1")
+	}).Times(2)
+	slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil).Times(2)
+	slackClient.EXPECT().UpdateMessages(nil, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed", "").Return(nil).Times(2)
+
+	for range 2 {
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "min_failure_delay": "0"}}`)),
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request)
+
+		assert.Equal(t, fmt.Sprintf("failed to run: exit code 1\n%s\n", string(fullResults)), rr.Body.String())
+		assert.Equal(t, 400, rr.Result().StatusCode)
+	}
+
+	// The failures aren't recorded
+	_, present := handler.getLastFailureTime(&launchPayload{flaggerWebhook: flaggerWebhook{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"}})
+	assert.False(t, present)
+}
+
+func TestLastExitCode(t *testing.T) {
+	// Initialize controller
+	_, cancel, ctrl, k6Client, slackClient, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	_, resultParts := getTestOutput(t)
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil).AnyTimes()
+	slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil).AnyTimes()
+
+	for _, run := range []struct {
+		exitCode int
+		err      error
+	}{
+		{exitCode: 0},
+		{exitCode: 99, err: errors.New("exit code 99")},
+	} {
+		testRun := mocks.NewMockK6TestRun(ctrl)
+		testRun.EXPECT().ExecutionDuration().Return(time.Minute).AnyTimes()
+		testRun.EXPECT().ExitCode().Return(run.exitCode).AnyTimes()
+
+		var bufferWriter io.Writer
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+			bufferWriter = outputWriter
+			outputWriter.Write([]byte(resultParts[0]))
+			return testRun, nil
+		})
+		testRun.EXPECT().Wait().DoAndReturn(func() error {
+			bufferWriter.Write([]byte("running" + resultParts[1]))
+			return run.err
+		})
+
+		request := &http.Request{
+			Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		// The gauge reflects the latest run
+		assert.Equal(t, float64(run.exitCode), getMetricValue(t, handler.metricLastExitCode, map[string]string{"namespace": "test-space", "name": "test-name"}))
+	}
+}
+
+func TestLaunchAndWaitAndGetFailedThresholds(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run
+	fullResults, resultParts := getTestOutputFromFile(t, "testdata/k6-output-failed-thresholds-v1.txt")
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * Send the initial slack message
+	channelMap := map[string]string{"C1234": "ts1"}
+	slackClient.EXPECT().SendMessages([]string{"test"}, gomock.Any(), "").Return(channelMap, nil)
+
+	// * Wait for the command to finish
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return errors.New("exit code 99")
+	})
+
+	// * Upload the results file and update the slack message with the failed thresholds
+	slackClient.EXPECT().AddFileToThreads(channelMap, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(
+		channelMap,
+		":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed. Failed thresholds: http_req_duration p(95)<200, http_req_failed rate<0.01",
+		"",
+	).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fmt.Sprintf("failed to run: exit code 99\n%s\n", string(fullResults)), rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+}
+
+func TestSlackMentionsOnFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		waitErr    error
+		wantStatus string
+	}{
+		{
+			name:       "success",
+			wantStatus: ":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded",
+		},
+		{
+			name:       "failure",
+			waitErr:    errors.New("exit code 1"),
+			wantStatus: "<@U0123ABCD> <!subteam^S0456EFGH> :red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			// * Start the run
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+
+			// * Send the initial slack message, without mentions
+			channelMap := map[string]string{"C1234": "ts1"}
+			slackClient.EXPECT().SendMessages([]string{"test"}, ":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started", "").Return(channelMap, nil)
+
+			// * Wait for the command to finish
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return tc.waitErr
+			})
+
+			// * Upload the results file and update the slack message, with
+			// the mentions on failure only
+			slackClient.EXPECT().AddFileToThreads(channelMap, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(channelMap, tc.wantStatus, "").Return(nil)
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "slack_channels": "test", "slack_mentions_on_failure": "U0123ABCD, S0456EFGH"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+		})
+	}
+}
+
+func TestScripts(t *testing.T) {
+	// Initialize controller
+	_, cancel, mockCtrl, k6Client, slackClient, smokeRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	loadRun := mocks.NewMockK6TestRun(mockCtrl)
+	loadRun.EXPECT().ExecutionDuration().Return(time.Minute).AnyTimes()
+	loadRun.EXPECT().ExitCode().Return(1).AnyTimes()
+
+	// Expected calls
+	// * Start the smoke test, with the options of the payload
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	startSmoke := k6Client.EXPECT().Start(gomock.Any(), testScript("smoke-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return smokeRun, nil
+	})
+
+	// * Send the initial slack message
+	channelMap := map[string]string{"C1234": "ts1"}
+	slackClient.EXPECT().SendMessages([]string{"test"}, ":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started", "").Return(channelMap, nil)
+
+	// * Wait for the smoke test to succeed
+	waitSmoke := smokeRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+
+	// * Start the load test, with its own options. Its output is written to
+	// the same writers, so that the output of the suite is bounded as a whole
+	loadScript := testScript("load-script")
+	loadScript.Options = `{"vus": 10}`
+	startLoad := k6Client.EXPECT().Start(gomock.Any(), loadScript, false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		assert.True(t, outputWriter == bufferWriter, "the output writer of the smoke test isn't reused")
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return loadRun, nil
+	})
+
+	// * Wait for the load test to fail. The soak test is never started
+	waitLoad := loadRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return errors.New("exit code 1")
+	})
+	gomock.InOrder(startSmoke, waitSmoke, startLoad, waitLoad)
+
+	// * Upload the results of both scripts and summarize them in the slack
+	// message
+	allResults := string(fullResults) + string(fullResults)
+	slackClient.EXPECT().AddFileToThreads(channelMap, "test-name-test-space-k6-results.txt", allResults).Return(nil)
+	slackClient.EXPECT().UpdateMessages(channelMap, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed. Scripts: `smoke` succeeded, `load` failed, `soak` skipped", "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"slack_channels": "test", "scripts": "[{\"name\": \"smoke\", \"script\": \"smoke-script\"}, {\"name\": \"load\", \"script\": \"load-script\", \"options\": \"{\\\"vus\\\": 10}\"}, {\"name\": \"soak\", \"script\": \"soak-script\"}]"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fmt.Sprintf("failed to run: exit code 1\n%s\n", allResults), rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "failure"))
+	assert.Equal(t, float64(0), getTestResultCount(t, handler, "test-space", "test-name", "success"))
+}
+
+func TestStreamOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		waitErr error
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:    "failure aborts the response",
+			waitErr: errors.New("exit code 1"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			server := httptest.NewServer(handler)
+			t.Cleanup(server.Close)
+
+			// Expected calls
+			// * Start the run
+			fullResults, resultParts := getTestOutput(t)
+			var bufferWriter io.Writer
+			k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+				bufferWriter = outputWriter
+				outputWriter.Write([]byte(resultParts[0]))
+				return testRun, nil
+			})
+			slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+			// * Wait for the command to finish. It only finishes once the client
+			// has received the first part of the output
+			firstPartReceived := make(chan struct{})
+			testRun.EXPECT().Wait().DoAndReturn(func() error {
+				select {
+				case <-firstPartReceived:
+				case <-time.After(5 * time.Second):
+					return errors.New("output was not streamed")
+				}
+				bufferWriter.Write([]byte("running" + resultParts[1]))
+				return tc.waitErr
+			})
+
+			// * The full output is still uploaded to slack
+			slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+			slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+			// Make request
+			resp, err := http.Post(server.URL, "application/json", strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "stream_output": "true"}}`))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, 200, resp.StatusCode)
+
+			firstPart := make([]byte, len(resultParts[0]))
+			_, err = io.ReadFull(resp.Body, firstPart)
+			require.NoError(t, err)
+			assert.Equal(t, resultParts[0], string(firstPart))
+			close(firstPartReceived)
+
+			rest, err := io.ReadAll(resp.Body)
+			if tc.waitErr == nil {
+				require.NoError(t, err)
+				assert.Equal(t, "running"+resultParts[1], string(rest))
+			} else {
+				assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+				assert.Equal(t, "running"+resultParts[1]+"\nfailed to run: exit code 1\n", string(rest))
+			}
+		})
+	}
+}
+
+func TestOutputTruncation(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	handler.maxOutputBytes = 1024
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run
+	_, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+	// * The script logs a lot more than the limit
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		for range 1000 {
+			bufferWriter.Write([]byte("INFO[0001] chatty log line\n"))
+		}
+		return nil
+	})
+
+	// * The uploaded file is truncated
+	expected := (resultParts[0] + strings.Repeat("INFO[0001] chatty log line\n", 1000))[:1024] + "\n...[output truncated]...\n"
+	slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", expected).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, expected, rr.Body.String())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestTestTimeout(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Expected calls
+	// * Start the run
+	_, resultParts := getTestOutput(t)
+	var processCtx context.Context
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		processCtx = ctx
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+	// * The run would block way past the timeout but is killed through its
+	// context
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		select {
+		case <-processCtx.Done():
+			return errors.New("signal: killed")
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	})
+
+	// * Upload the results file and update the slack message
+	slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", resultParts[0]).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has timed out after 100ms", "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "test_timeout": "100ms"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fmt.Sprintf("test timed out after 100ms: signal: killed\n%s\n", resultParts[0]), rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "timeout"))
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	handler.handlerTimeout = 100 * time.Millisecond
+
+	// Expected calls
+	// * Start the run
+	_, resultParts := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+	// * The run hangs past the handler timeout. It is waited for by the
+	// request, then by the asynchronous cleanup
+	hung := make(chan struct{})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		<-hung
+		return errors.New("signal: killed")
+	}).Times(2)
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+
+	// * Update the slack message. The results are never uploaded
+	slackClient.EXPECT().UpdateMessages(nil, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has timed out: no results after 100ms", "").Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, fmt.Sprintf("timed out waiting for the results after 100ms\n%s\n", resultParts[0]), rr.Body.String())
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Result().StatusCode)
+	assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "timeout"))
+
+	// * The test run is released once the process has been cleaned up
+	assert.Equal(t, 99, handler.AvailableTestRuns())
+	close(hung)
+	assert.Eventually(t, func() bool { return handler.AvailableTestRuns() == 100 }, time.Second, 10*time.Millisecond)
+}
+
+func TestDryRun(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		validateErr  error
+		output       string
+		expected     string
+		expectedCode int
+	}{
+		{
+			name:         "valid script",
+			output:       `{"vus": 2}`,
+			expected:     `{"vus": 2}`,
+			expectedCode: 200,
+		},
+		{
+			name:         "invalid script",
+			validateErr:  errors.New("exit status 107"),
+			output:       "SyntaxError: Unexpected token",
+			expected:     "error while validating script: exit status 107\nSyntaxError: Unexpected token\n",
+			expectedCode: 400,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, _, _, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			// Expected calls
+			// * Validate the script. Nothing is started and no notifications are sent
+			k6Client.EXPECT().Validate(gomock.Any(), testScript("my-script"), false, testEnvVars(map[string]string{"FOO": "bar"}), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, outputWriter io.Writer) error {
+				outputWriter.Write([]byte(tc.output))
+				return tc.validateErr
+			})
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "dry_run": "true", "env_vars": "{\"FOO\": \"bar\"}", "slack_channels": "test"}}`)),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, tc.expected, rr.Body.String())
+			assert.Equal(t, tc.expectedCode, rr.Result().StatusCode)
+
+			// The test run slot has been released and failures don't count
+			// towards min_failure_delay
+			assert.Equal(t, 100, handler.freeTestRuns())
+			_, present := handler.getLastFailureTime(&launchPayload{flaggerWebhook: flaggerWebhook{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"}})
+			assert.False(t, present)
+		})
+	}
+}
+
+// The variables describing the canary are validated too, even when no secret
+// nor configmap is resolved.
+func TestInvalidCanaryEnvVar(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test\u0000name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "dry_run": "true"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, "the value of K6_CANARY_NAME contains a NUL byte\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+}
+
+func TestFailureEviction(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	lh, err := NewLaunchHandler(ctx, mocks.NewMockK6Client(mockCtrl), nil, mocks.NewMockSlackClient(mockCtrl), 1, WithFailureEvictionInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	handler := lh.(*launchHandler)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	stale := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "stale", Namespace: "test-space", Phase: "pre-rollout"}}
+	stale.Metadata.MinFailureDelay = time.Minute
+	recent := &launchPayload{flaggerWebhook: flaggerWebhook{Name: "recent", Namespace: "test-space", Phase: "pre-rollout"}}
+	recent.Metadata.MinFailureDelay = time.Minute
+
+	handler.setLastFailureTime(recent)
+	handler.lastFailureTimeMutex.Lock()
+	handler.lastFailureTime[stale.key()] = failure{at: time.Now().Add(-11 * time.Minute), minFailureDelay: time.Minute}
+	handler.lastFailureTimeMutex.Unlock()
+
+	// The stale failure is evicted by the janitor, the recent one is kept
+	assert.Eventually(t, func() bool {
+		_, present := handler.getLastFailureTime(stale)
+		return !present
+	}, time.Second, 10*time.Millisecond)
+	_, present := handler.getLastFailureTime(recent)
+	assert.True(t, present)
+}
+
+func TestLaunchNeverStarted(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Kill().Return(nil).AnyTimes()
+	testRun.EXPECT().Wait().Return(nil).AnyTimes()
+	// The process hangs without starting the test
+	testRun.EXPECT().Exited().Return(false).AnyTimes()
+
+	var sleepCalls []time.Duration
+	sleepMock := func(d time.Duration) {
+		sleepCalls = append(sleepCalls, d)
+	}
+	handler.sleep = sleepMock
+	// No jitter
+	handler.jitter = func(d time.Duration) time.Duration { return d / 2 }
+
+	// Expected calls
+	// * Start the run (process fails and prints out an error)
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write([]byte("failed to run (k6 error)"))
+		return testRun, nil
+	})
+
+	// * Upload the results file and send the error slack message
+	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
+	slackClient.EXPECT().SendMessages(
+		[]string{"test", "test2"},
+		":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` didn't start successfully",
+		"",
+	).Return(channelMap, nil)
+	slackClient.EXPECT().AddFileToThreads(
+		channelMap,
+		"test-name-test-space-k6-results.txt",
+		"failed to run (k6 error)",
+	).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, "error while waiting for test to start: timeout\nfailed to run (k6 error)\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "timeout"))
+	assert.Equal(t, float64(0), getMetricValue(t, handler.metricLastExitCode, map[string]string{"namespace": "test-space", "name": "test-name"}))
+	// 10 sleep calls
+	assert.Equal(t, sleepCalls, []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second,
+		2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second})
+}
+
+func TestLaunchCanceledBeforeStart(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Kill().Return(nil).AnyTimes()
+	testRun.EXPECT().Wait().Return(nil).AnyTimes()
+	// The process hangs without starting the test
+	testRun.EXPECT().Exited().Return(false).AnyTimes()
+
+	// Polling the output never ends by itself
+	polling := make(chan struct{}, outputPollAttempts)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	handler.sleep = func(time.Duration) {
+		polling <- struct{}{}
+		<-release
+	}
+
+	// Expected calls
+	// * Start the run
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).Return(testRun, nil)
+	// * Send the error slack message
+	slackClient.EXPECT().SendMessages(nil, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` didn't start successfully", "").Return(nil, nil)
+	slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", "").Return(nil)
+
+	// Make request, canceled by the client while polling
+	requestCtx, cancelRequest := context.WithCancel(context.Background())
+	request := (&http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}).WithContext(requestCtx)
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(rr, request)
+		close(done)
+	}()
+	<-polling
+	cancelRequest()
+
+	// The request returns without waiting for the remaining polls
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request didn't return once canceled")
+	}
+	assert.Equal(t, "error while waiting for test to start: canceled: context canceled\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Len(t, polling, 0)
+}
+
+func TestLaunchExitedEarly(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Kill().Return(nil).AnyTimes()
+	testRun.EXPECT().Wait().Return(nil).AnyTimes()
+	// The process exits after the first poll
+	testRun.EXPECT().Exited().Return(false)
+	testRun.EXPECT().Exited().Return(true)
+
+	var sleepCalls []time.Duration
+	sleepMock := func(d time.Duration) {
+		sleepCalls = append(sleepCalls, d)
+	}
+	handler.sleep = sleepMock
+	// No jitter
+	handler.jitter = func(d time.Duration) time.Duration { return d / 2 }
+
+	// Expected calls
+	// * Start the run (process fails and prints out an error)
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write([]byte("failed to run (k6 error)"))
+		return testRun, nil
+	})
+
+	// * Upload the results file and send the error slack message
+	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
+	slackClient.EXPECT().SendMessages(
+		[]string{"test", "test2"},
+		":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` didn't start successfully",
+		"",
+	).Return(channelMap, nil)
+	slackClient.EXPECT().AddFileToThreads(
+		channelMap,
+		"test-name-test-space-k6-results.txt",
+		"failed to run (k6 error)",
+	).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, "error while waiting for test to start: k6 exited with code 0\nfailed to run (k6 error)\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+	assert.Equal(t, float64(1), getTestResultCount(t, handler, "test-space", "test-name", "failure"))
+	assert.Equal(t, float64(0), getTestResultCount(t, handler, "test-space", "test-name", "timeout"))
+	assert.Equal(t, float64(0), getMetricValue(t, handler.metricLastExitCode, map[string]string{"namespace": "test-space", "name": "test-name"}))
+	// No sleep once the process has exited
+	assert.Equal(t, sleepCalls, []time.Duration{2 * time.Second})
+}
+
+func TestOutputPollDelay(t *testing.T) {
+	_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// The bounds
+	handler.jitter = func(time.Duration) time.Duration { return 0 }
+	assert.Equal(t, 1500*time.Millisecond, handler.outputPollDelay())
+	handler.jitter = func(d time.Duration) time.Duration { return d }
+	assert.Equal(t, 2500*time.Millisecond, handler.outputPollDelay())
+
+	// The default jitter source
+	handler.jitter = randomDuration
+	delays := make(map[time.Duration]bool)
+	for range 1000 {
+		delay := handler.outputPollDelay()
+		assert.GreaterOrEqual(t, delay, 1500*time.Millisecond)
+		assert.LessOrEqual(t, delay, 2500*time.Millisecond)
+		delays[delay] = true
+	}
+	assert.Greater(t, len(delays), 1, "the delays should be jittered")
+}
+
+func TestLaunchWithoutWaiting(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().Kill().Return(nil).AnyTimes()
+	testRun.EXPECT().Wait().Return(nil).AnyTimes()
+	testRun.EXPECT().Exited().Return(true).AnyTimes()
+
+	// Expected calls
+	// * Start the run
+	_, resultParts := getTestOutput(t)
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+
+	// * Send the initial slack message (process ends here)
+	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
+	slackClient.EXPECT().SendMessages(
+		[]string{"test", "test2"},
+		":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started",
+		"",
+	).Return(channelMap, nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "wait_for_results": "false", "slack_channels": "test,test2"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, "", rr.Body.String())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+}
+
+func TestMaxAsyncTestDuration(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 1)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	WithMaxAsyncTestDuration(100 * time.Millisecond)(handler)
+
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+
+	// Expected calls
+	// * Start the run
+	_, resultParts := getTestOutput(t)
+	var processCtx context.Context
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		processCtx = ctx
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+	// * The run would block way past the limit, even after the request, but is
+	// killed through its context
+	killed := make(chan struct{})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		select {
+		case <-processCtx.Done():
+			close(killed)
+			return errors.New("signal: killed")
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	})
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "wait_for_results": "false", "test_timeout": "1h"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, 200, rr.Result().StatusCode)
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run wasn't killed")
+	}
+	assert.ErrorIs(t, processCtx.Err(), context.DeadlineExceeded)
+
+	// The test run slot is released
+	assert.Eventually(t, func() bool { return handler.freeTestRuns() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestBadPayload(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, "error while validating request: error while validating base webhook: missing name; missing namespace; missing phase\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	handler.maxRequestBytes = 100
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "` + strings.Repeat("a", 100) + `"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+
+	// Expected response
+	assert.Equal(t, "error while validating request: http: request body too large\n", rr.Body.String())
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Result().StatusCode)
+
+	// * The test slot is released
+	assert.Equal(t, 100, handler.AvailableTestRuns())
+}
+
+func TestNoRequestBody(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, &http.Request{})
+
+	// Expected response
+	assert.Equal(t, "error while validating request: no request body\n", rr.Body.String())
+	assert.Equal(t, 400, rr.Result().StatusCode)
+}
+
+func TestContentType(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		contentType    string
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "no content type",
+			expectedStatus: 400,
+			expected:       "error while validating request: error while validating base webhook: missing name; missing namespace; missing phase\n",
+		},
+		{
+			name:           "json",
+			contentType:    "application/json",
+			expectedStatus: 400,
+			expected:       "error while validating request: error while validating base webhook: missing name; missing namespace; missing phase\n",
+		},
+		{
+			name:           "json with a charset",
+			contentType:    "application/json; charset=utf-8",
+			expectedStatus: 400,
+			expected:       "error while validating request: error while validating base webhook: missing name; missing namespace; missing phase\n",
+		},
+		{
+			name:           "form",
+			contentType:    "application/x-www-form-urlencoded",
+			expectedStatus: 415,
+			expected:       "error while validating request: unsupported media type \"application/x-www-form-urlencoded\", expected application/json\n",
+		},
+		{
+			name:           "xml",
+			contentType:    "application/xml; charset=utf-8",
+			expectedStatus: 415,
+			expected:       "error while validating request: unsupported media type \"application/xml; charset=utf-8\", expected application/json\n",
+		},
+		{
+			name:           "invalid",
+			contentType:    "application/json;;",
+			expectedStatus: 415,
+			expected:       "error while validating request: unsupported media type \"application/json;;\", expected application/json\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, _, _, _, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			request := httptest.NewRequest(http.MethodPost, "/launch-test", strings.NewReader(`{}`))
+			if tc.contentType != "" {
+				request.Header.Set("Content-Type", tc.contentType)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, tc.expected, rr.Body.String())
+			assert.Equal(t, tc.expectedStatus, rr.Result().StatusCode)
+		})
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		accept              string
+		payload             string
+		validateOutput      string
+		expectedContentType string
+		expected            string
+	}{
+		{
+			name:                "text by default",
+			payload:             `{}`,
+			expectedContentType: "text/plain; charset=utf-8",
+			expected:            "error while validating request: error while validating base webhook: missing name; missing namespace; missing phase\n",
+		},
+		{
+			name:                "json",
+			accept:              "application/json",
+			payload:             `{}`,
+			expectedContentType: "application/json",
+			expected:            `{"error":"error while validating request: error while validating base webhook: missing name; missing namespace; missing phase","errors":[{"field":"name","message":"missing name"},{"field":"namespace","message":"missing namespace"},{"field":"phase","message":"missing phase"}]}` + "\n",
+		},
+		{
+			name:                "json among other media types",
+			accept:              "text/html, application/json;q=0.9",
+			payload:             `{}`,
+			expectedContentType: "application/json",
+			expected:            `{"error":"error while validating request: error while validating base webhook: missing name; missing namespace; missing phase","errors":[{"field":"name","message":"missing name"},{"field":"namespace","message":"missing namespace"},{"field":"phase","message":"missing phase"}]}` + "\n",
+		},
+		{
+			name:                "json with several invalid settings",
+			accept:              "application/json",
+			payload:             `{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "wait_for_results": "false", "stream_output": "true", "min_failure_delay": "-1m"}}`,
+			expectedContentType: "application/json",
+			expected:            `{"error":"error while validating request: 'stream_output' requires 'wait_for_results'; error parsing value for 'min_failure_delay': -1m is negative","errors":[{"field":"metadata.stream_output","message":"'stream_output' requires 'wait_for_results'"},{"field":"metadata.min_failure_delay","message":"error parsing value for 'min_failure_delay': -1m is negative"}]}` + "\n",
+		},
+		{
+			name:                "json with the output of k6",
+			accept:              "application/json",
+			payload:             `{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "dry_run": "true"}}`,
+			validateOutput:      "SyntaxError: Unexpected token",
+			expectedContentType: "application/json",
+			expected:            `{"error":"error while validating script: exit status 107","output":"SyntaxError: Unexpected token"}` + "\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, _, _, handler := setupHandler(t, 100)
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			if tc.validateOutput != "" {
+				k6Client.EXPECT().Validate(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, outputWriter io.Writer) error {
+					outputWriter.Write([]byte(tc.validateOutput))
+					return errors.New("exit status 107")
+				})
+			}
+
+			// Make request
+			request := httptest.NewRequest("POST", "/launch-test", strings.NewReader(tc.payload))
+			if tc.accept != "" {
+				request.Header.Set("Accept", tc.accept)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
+
+			// Expected response
+			assert.Equal(t, 400, rr.Result().StatusCode)
+			assert.Equal(t, tc.expectedContentType, rr.Header().Get("Content-Type"))
+			assert.Equal(t, tc.expected, rr.Body.String())
+		})
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	fullResults, resultParts := getTestOutput(t)
+
+	for _, tc := range []struct {
+		name              string
+		secretsSetting    string
+		secretEnvsSetting string
+		configMapsSetting string
+		envVarsSetting    string
+		// `secrets_override_env`, empty for the default
+		secretsOverrideEnvSetting string
+		kubernetesObjects         []runtime.Object
+		allowedNamespaces         []string
+		nilKubeClient             bool
+		secretsForbidden          bool
+		expected                  string
+		expectedEnvVars           map[string]string
+		expectedCode              int
+		// The kind of the secret resolution error tracked by the metric, if any
+		expectedSecretError string
+	}{
+		{
+			name:         "no secrets",
+			expected:     string(fullResults),
+			expectedCode: 200,
+		},
+		{
+			name:            "direct env vars",
+			envVarsSetting:  `{\"FOO\": \"bar\", \"BAZ\": \"qux\"}`,
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"FOO": "bar", "BAZ": "qux"},
+			expectedCode:    200,
+		},
+		{
+			name:            "env vars override the canary env vars",
+			envVarsSetting:  `{\"K6_CANARY_NAME\": \"custom-name\"}`,
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"K6_CANARY_NAME": "custom-name"},
+			expectedCode:    200,
+		},
+		{
+			name:           "working example",
+			secretsSetting: `{\"TEST_VAR\": \"other-namespace/secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+			},
+			allowedNamespaces: []string{"other-namespace"},
+			expected:          string(fullResults),
+			expectedEnvVars:   map[string]string{"TEST_VAR": "secret-value"},
+			expectedCode:      200,
+		},
+		{
+			name:           "both env vars and secrets",
+			envVarsSetting: `{\"FOO\": \"bar\", \"BAZ\": \"qux\"}`,
+			secretsSetting: `{\"TEST_VAR\": \"other-namespace/secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+			},
+			allowedNamespaces: []string{"*"},
+			expected:          string(fullResults),
+			expectedEnvVars:   map[string]string{"FOO": "bar", "BAZ": "qux", "TEST_VAR": "secret-value"},
+			expectedCode:      200,
+		},
+		{
+			name:           "env vars and secrets collisions (secrets take precedence by default)",
+			envVarsSetting: `{\"FOO\": \"env-value\", \"BAR\": \"bar\"}`,
+			secretsSetting: `{\"FOO\": \"secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"FOO": "secret-value", "BAR": "bar"},
+			expectedCode:    200,
+		},
+		{
+			name:                      "env vars and secrets collisions (env vars take precedence)",
+			envVarsSetting:            `{\"FOO\": \"env-value\", \"BAR\": \"bar\"}`,
+			secretsSetting:            `{\"FOO\": \"secret-name/secret-key\", \"BAZ\": \"secret-name/other-key\"}`,
+			secretsOverrideEnvSetting: "false",
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value"), "other-key": []byte("other-value")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"FOO": "env-value", "BAR": "bar", "BAZ": "other-value"},
+			expectedCode:    200,
+		},
+		{
+			name:           "no given namespace (defaults to the payload namespace)",
+			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"TEST_VAR": "secret-value"},
+			expectedCode:    200,
+		},
+		{
+			name:           "disallowed namespace",
+			secretsSetting: `{\"TEST_VAR\": \"other-namespace/secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+			},
+			allowedNamespaces:   []string{"another-namespace"},
+			expected:            "reading secrets from namespace other-namespace is not allowed\n",
+			expectedCode:        400,
+			expectedSecretError: "forbidden",
+		},
+		{
+			name:           "payload namespace given explicitly (always allowed)",
+			secretsSetting: `{\"TEST_VAR\": \"test-space/secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"TEST_VAR": "secret-value"},
+			expectedCode:    200,
+		},
+		{
+			name:              "whole secret from a disallowed namespace",
+			secretEnvsSetting: `[\"other-namespace/secret-name\"]`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"FOO": []byte("foo-value")}},
+			},
+			expected:            "reading secrets from namespace other-namespace is not allowed\n",
+			expectedCode:        400,
+			expectedSecretError: "forbidden",
+		},
+		{
+			name:              "whole secret",
+			secretEnvsSetting: `[\"other-namespace/secret-name\", \"secret-name\"]`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"FOO": []byte("foo-value"), "BAR": []byte("bar-value")}},
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"BAZ": []byte("baz-value")}},
+			},
+			allowedNamespaces: []string{"other-namespace"},
+			expected:          string(fullResults),
+			expectedEnvVars:   map[string]string{"FOO": "foo-value", "BAR": "bar-value", "BAZ": "baz-value"},
+			expectedCode:      200,
+		},
+		{
+			name:              "whole secret collisions (env vars and individual secrets take precedence)",
+			envVarsSetting:    `{\"FOO\": \"env-value\"}`,
+			secretsSetting:    `{\"BAR\": \"secret-name/other-key\"}`,
+			secretEnvsSetting: `[\"secret-name\"]`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"FOO": []byte("foo-value"), "BAR": []byte("bar-value"), "BAZ": []byte("baz-value"), "other-key": []byte("other-value")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"FOO": "env-value", "BAR": "other-value", "BAZ": "baz-value"},
+			expectedCode:    200,
+		},
+		{
+			name:              "whole secret with invalid key names",
+			secretEnvsSetting: `[\"secret-name\"]`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"FOO": []byte("foo-value"), "tls.crt": []byte("cert"), "1ABC": []byte("value"), "with-dash": []byte("value")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"FOO": "foo-value"},
+			expectedCode:    200,
+		},
+		{
+			name:                "missing whole secret",
+			secretEnvsSetting:   `[\"secret-name\"]`,
+			expected:            "error fetching secret test-space/secret-name: secrets \"secret-name\" not found\n",
+			expectedCode:        400,
+			expectedSecretError: "not_found",
+		},
+		{
+			name:                "missing secret",
+			secretsSetting:      `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			expected:            "error fetching secret test-space/secret-name: secrets \"secret-name\" not found\n",
+			expectedCode:        400,
+			expectedSecretError: "not_found",
+		},
+		{
+			name:           "missing secret key",
+			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"other-key": []byte("secret-value")}},
+			},
+			expected:            "secret test-space/secret-name does not have key secret-key\n",
+			expectedCode:        400,
+			expectedSecretError: "missing_key",
+		},
+		{
+			name:           "base64-encoded secret (raw)",
+			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("c2VjcmV0LXZhbHVl")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"TEST_VAR": "c2VjcmV0LXZhbHVl"},
+			expectedCode:    200,
+		},
+		{
+			name:           "base64-encoded secret (decoded)",
+			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key:base64\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("c2VjcmV0LXZhbHVl\n")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"TEST_VAR": "secret-value"},
+			expectedCode:    200,
+		},
+		{
+			name:           "invalid base64-encoded secret",
+			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key:base64\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("not base64")}},
+			},
+			expected:     "error base64-decoding key secret-key of secret test-space/secret-name for TEST_VAR: illegal base64 data at input byte 3\n",
+			expectedCode: 400,
+		},
+		{
+			name:           "secret with a NUL byte",
+			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret\x00value")}},
+			},
+			expected:     "the value of TEST_VAR contains a NUL byte\n",
+			expectedCode: 400,
+		},
+		{
+			name:              "configmaps",
+			configMapsSetting: `{\"FOO\": \"other-namespace/config/foo\", \"BAR\": \"config/bar\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "other-namespace"}, Data: map[string]string{"foo": "foo-value"}},
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "test-space"}, BinaryData: map[string][]byte{"bar": []byte("bar-value")}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"FOO": "foo-value", "BAR": "bar-value"},
+			expectedCode:    200,
+		},
+		{
+			name:              "configmap collisions (env vars and secrets take precedence)",
+			envVarsSetting:    `{\"FOO\": \"env-value\"}`,
+			secretsSetting:    `{\"BAR\": \"secret-name/secret-key\"}`,
+			secretEnvsSetting: `[\"secret-name\"]`,
+			configMapsSetting: `{\"FOO\": \"config/foo\", \"BAR\": \"config/bar\", \"BAZ\": \"config/baz\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value"), "BAZ": []byte("whole-secret-value")}},
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "test-space"}, Data: map[string]string{"foo": "foo-value", "bar": "bar-value", "baz": "baz-value"}},
+			},
+			expected:        string(fullResults),
+			expectedEnvVars: map[string]string{"FOO": "env-value", "BAR": "secret-value", "BAZ": "baz-value"},
+			expectedCode:    200,
+		},
+		{
+			name:              "missing configmap",
+			configMapsSetting: `{\"FOO\": \"config/foo\"}`,
+			expected:          "error fetching configmap test-space/config: configmaps \"config\" not found\n",
+			expectedCode:      400,
+		},
+		{
+			name:              "missing configmap key",
+			configMapsSetting: `{\"FOO\": \"config/foo\"}`,
+			kubernetesObjects: []runtime.Object{
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "test-space"}, Data: map[string]string{"bar": "bar-value"}},
+			},
+			expected:     "configmap test-space/config does not have key foo\n",
+			expectedCode: 400,
+		},
+		{
+			name:              "no kube client (configmaps)",
+			configMapsSetting: `{\"FOO\": \"config/foo\"}`,
+			expected:          "kubernetes client is not configured\n",
+			expectedCode:      400,
+			nilKubeClient:     true,
+		},
+		{
+			name:                "forbidden secret",
+			secretsSetting:      `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			secretsForbidden:    true,
+			expected:            "error fetching secret test-space/secret-name: secrets \"secret-name\" is forbidden: denied\n",
+			expectedCode:        400,
+			expectedSecretError: "forbidden",
+		},
+		{
+			name:                "no kube client",
+			secretsSetting:      `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			expected:            "kubernetes client is not configured\n",
+			expectedCode:        400,
+			nilKubeClient:       true,
+			expectedSecretError: "no_client",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandlerWithKubernetesObjects(t, 100, tc.kubernetesObjects...)
+			if tc.nilKubeClient {
+				handler.kubeClient = nil
+			}
+			if tc.secretsForbidden {
+				handler.kubeClient.(*fake.Clientset).PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					name := action.(k8stesting.GetAction).GetName()
+					return true, nil, apierrors.NewForbidden(v1.Resource("secrets"), name, errors.New("denied"))
+				})
+			}
+			handler.allowedSecretNamespaces = tc.allowedNamespaces
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			if tc.expectedCode == 200 {
+				// Expected calls
+				// * Start the run
+				var bufferWriter io.Writer
+				k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(tc.expectedEnvVars), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+					bufferWriter = outputWriter
+					outputWriter.Write([]byte(resultParts[0]))
+					return testRun, nil
+				})
+
+				// * Send the initial slack message (to no channels)
+				slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+
+				// * Wait for the command to finish
+				testRun.EXPECT().Wait().DoAndReturn(func() error {
+					bufferWriter.Write([]byte("running" + resultParts[1]))
+					return nil
+				})
+
+				// * Upload the results file and update the slack message (to no channels)
+				slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+				slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+			}
 
 			// Make request
 			request := &http.Request{
-				Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "slack_channels": "test,test2", "notification_context": "extra context"}}`)),
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{
+					"name": "test-name",
+					"namespace": "test-space",
+					"phase": "pre-rollout",
+					"metadata": {
+						"script": "my-script",
+						"kubernetes_secrets": "%s",
+						"kubernetes_secret_envs": "%s",
+						"kubernetes_configmaps": "%s",
+						"env_vars": "%s",
+						"secrets_override_env": "%s"
+					}
+				}`, tc.secretsSetting, tc.secretEnvsSetting, tc.configMapsSetting, tc.envVarsSetting, tc.secretsOverrideEnvSetting))),
 			}
 			rr := httptest.NewRecorder()
 			handler.ServeHTTP(rr, request)
 
 			// Expected response
-			assert.Equal(t, fullResults, rr.Body.Bytes())
-			assert.Equal(t, 200, rr.Result().StatusCode)
-		})
-	}
-}
-
-func TestSlackFailuresDontAbort(t *testing.T) {
-	// Initialize controller
-	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
-	t.Cleanup(handler.Wait)
-	t.Cleanup(cancel)
-
-	// Expected calls
-	// * Start the run
-	fullResults, resultParts := getTestOutput(t)
-	var bufferWriter io.Writer
-	k6Client.EXPECT().Start(gomock.Any(), "my-script", true, nil, gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
-		bufferWriter = outputWriter
-		outputWriter.Write([]byte(resultParts[0]))
-		return testRun, nil
-	})
-
-	// * Send the initial slack message
-	slackClient.EXPECT().SendMessages(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("error sending message"))
-
-	// * Wait for the command to finish
-	testRun.EXPECT().Wait().DoAndReturn(func() error {
-		bufferWriter.Write([]byte("running" + resultParts[1]))
-		return nil
-	})
-
-	// * Upload the results file and update the slack message
-	slackClient.EXPECT().AddFileToThreads(nil, "k6-results.txt", string(fullResults)).Return(errors.New("error adding file"))
-	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), gomock.Any()).Return(errors.New("error updating message"))
+			assert.Equal(t, tc.expected, rr.Body.String())
+			assert.Equal(t, tc.expectedCode, rr.Result().StatusCode)
 
-	// Make request
-	request := &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "true", "slack_channels": "test,test2", "notification_context": "extra context"}}`)),
+			// Expected metrics
+			for _, kind := range []string{"not_found", "missing_key", "no_client", "forbidden"} {
+				expected := float64(0)
+				if kind == tc.expectedSecretError {
+					expected = 1
+				}
+				assert.Equal(t, expected, getMetricValue(t, handler.metricSecretErrors, map[string]string{"kind": kind}), kind)
+			}
+		})
 	}
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, request)
 
-	// Expected response
-	assert.Equal(t, fullResults, rr.Body.Bytes())
-	assert.Equal(t, 200, rr.Result().StatusCode)
 }
 
-func TestLaunchAndWaitLocal(t *testing.T) {
+func TestSecretFiles(t *testing.T) {
 	// Initialize controller
-	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandlerWithKubernetesObjects(t, 100,
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"tls.crt": []byte("my-cert")}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"creds.json": []byte(`{"user": "me"}`)}},
+	)
 	t.Cleanup(handler.Wait)
 	t.Cleanup(cancel)
+	handler.allowedSecretNamespaces = []string{"other-namespace"}
 
 	// Expected calls
-	// * Start the run
+	// * Start the run. The secret files exist while the test runs
 	fullResults, resultParts := getTestOutput(t)
 	var bufferWriter io.Writer
-	k6Client.EXPECT().Start(gomock.Any(), "my-script", false, nil, gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
-		bufferWriter = outputWriter
-		outputWriter.Write([]byte(resultParts[0]))
-		return testRun, nil
-	}).Times(2)
-
-	// * Send the initial slack message
-	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
-	slackClient.EXPECT().SendMessages(
-		[]string{"test", "test2"},
-		":warning: Load testing of `test-name` in namespace `test-space` has started",
-		"",
-	).Times(2).Return(channelMap, nil)
-
-	// * Wait for the command to finish
-	testRun.EXPECT().Wait().Times(2).DoAndReturn(func() error {
-		bufferWriter.Write([]byte("running" + resultParts[1]))
-		return nil
-	})
-
-	// * Upload the results file and update the slack message
-	slackClient.EXPECT().AddFileToThreads(
-		channelMap,
-		"k6-results.txt",
-		string(fullResults),
-	).Times(2).Return(nil)
-	slackClient.EXPECT().UpdateMessages(
-		channelMap,
-		":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded",
-		"",
-	).Times(2).Return(nil)
-
-	// Make request
-	request := &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
-	}
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, request)
-
-	// Expected response
-	assert.Equal(t, fullResults, rr.Body.Bytes())
-	assert.Equal(t, 200, rr.Result().StatusCode)
-
-	//
-	// Run it again immediately to see if we get the same result
-	//
-
-	// Make request
-	request = &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
-	}
-	rr = httptest.NewRecorder()
-	handler.ServeHTTP(rr, request)
-
-	// Expected response
-	assert.Equal(t, fullResults, rr.Body.Bytes())
-	assert.Equal(t, 200, rr.Result().StatusCode)
-}
+	var secretPaths []string
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, gomock.Any(), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		assert.Equal(t, "bar", envVars["FOO"])
+		for env, expected := range map[string]string{
+			"K6_SECRET_FILE_CLIENT_CERT": "my-cert",
+			"K6_SECRET_FILE_CREDS":       `{"user": "me"}`,
+		} {
+			path := envVars[env]
+			require.NotEmpty(t, path, env)
+			secretPaths = append(secretPaths, path)
 
-func TestLaunchAndWaitAndGetError(t *testing.T) {
-	// Initialize controller
-	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
-	t.Cleanup(handler.Wait)
-	t.Cleanup(cancel)
+			content, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, expected, string(content))
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+		}
 
-	// Expected calls
-	// * Start the run
-	fullResults, resultParts := getTestOutput(t)
-	var bufferWriter io.Writer
-	k6Client.EXPECT().Start(gomock.Any(), "my-script", false, nil, gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
 		bufferWriter = outputWriter
 		outputWriter.Write([]byte(resultParts[0]))
 		return testRun, nil
 	})
 
-	// * Send the initial slack message
-	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
-	slackClient.EXPECT().SendMessages(
-		[]string{"test", "test2"},
-		":warning: Load testing of `test-name` in namespace `test-space` has started",
-		"",
-	).Return(channelMap, nil)
+	// * Send the initial slack message (to no channels)
+	slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
 
 	// * Wait for the command to finish
 	testRun.EXPECT().Wait().DoAndReturn(func() error {
 		bufferWriter.Write([]byte("running" + resultParts[1]))
-		return errors.New("exit code 1")
-	})
-
-	// * Upload the results file and update the slack message
-	slackClient.EXPECT().AddFileToThreads(
-		channelMap,
-		"k6-results.txt",
-		string(fullResults),
-	).Return(nil)
-	slackClient.EXPECT().UpdateMessages(
-		channelMap,
-		":red_circle: Load testing of `test-name` in namespace `test-space` has failed",
-		"",
-	).Return(nil)
-
-	// Make request
-	request := &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
-	}
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, request)
-
-	// Expected response
-	assert.Equal(t, fmt.Sprintf("failed to run: exit code 1\n%s\n", string(fullResults)), rr.Body.String())
-	assert.Equal(t, 400, rr.Result().StatusCode)
-
-	//
-	// Run it again immediately to get the failure due to min_failure_delay
-	//
-
-	// Make request
-	request = &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
-	}
-	rr = httptest.NewRecorder()
-	handler.ServeHTTP(rr, request)
-
-	// Expected response
-	assert.Equal(t, "not enough time since last failure\n", rr.Body.String())
-	assert.Equal(t, 400, rr.Result().StatusCode)
-}
-
-func TestLaunchNeverStarted(t *testing.T) {
-	// Initialize controller
-	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
-	t.Cleanup(handler.Wait)
-	t.Cleanup(cancel)
-
-	testRun.EXPECT().PID().Return(-1).AnyTimes()
-	testRun.EXPECT().Kill().Return(nil).AnyTimes()
-	testRun.EXPECT().Wait().Return(nil).AnyTimes()
-	testRun.EXPECT().Exited().Return(true).AnyTimes()
-
-	var sleepCalls []time.Duration
-	sleepMock := func(d time.Duration) {
-		sleepCalls = append(sleepCalls, d)
-	}
-	handler.sleep = sleepMock
-
-	// Expected calls
-	// * Start the run (process fails and prints out an error)
-	k6Client.EXPECT().Start(gomock.Any(), "my-script", false, nil, gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
-		outputWriter.Write([]byte("failed to run (k6 error)"))
-		return testRun, nil
-	})
-
-	// * Upload the results file and send the error slack message
-	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
-	slackClient.EXPECT().SendMessages(
-		[]string{"test", "test2"},
-		":red_circle: Load testing of `test-name` in namespace `test-space` didn't start successfully",
-		"",
-	).Return(channelMap, nil)
-	slackClient.EXPECT().AddFileToThreads(
-		channelMap,
-		"k6-results.txt",
-		"failed to run (k6 error)",
-	).Return(nil)
-
-	// Make request
-	request := &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "upload_to_cloud": "false", "slack_channels": "test,test2"}}`)),
-	}
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, request)
-
-	// Expected response
-	assert.Equal(t, "error while waiting for test to start: timeout\nfailed to run (k6 error)\n", rr.Body.String())
-	assert.Equal(t, 400, rr.Result().StatusCode)
-	// 10 sleep calls
-	assert.Equal(t, sleepCalls, []time.Duration{2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second,
-		2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second})
-}
-
-func TestLaunchWithoutWaiting(t *testing.T) {
-	// Initialize controller
-	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
-	t.Cleanup(handler.Wait)
-	t.Cleanup(cancel)
-
-	testRun.EXPECT().PID().Return(-1).AnyTimes()
-	testRun.EXPECT().Kill().Return(nil).AnyTimes()
-	testRun.EXPECT().Wait().Return(nil).AnyTimes()
-	testRun.EXPECT().Exited().Return(true).AnyTimes()
-
-	// Expected calls
-	// * Start the run
-	_, resultParts := getTestOutput(t)
-	k6Client.EXPECT().Start(gomock.Any(), "my-script", false, nil, gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
-		outputWriter.Write([]byte(resultParts[0]))
-		return testRun, nil
+		return nil
 	})
 
-	// * Send the initial slack message (process ends here)
-	channelMap := map[string]string{"C1234": "ts1", "C12345": "ts2"}
-	slackClient.EXPECT().SendMessages(
-		[]string{"test", "test2"},
-		":warning: Load testing of `test-name` in namespace `test-space` has started",
-		"",
-	).Return(channelMap, nil)
+	// * Upload the results file and update the slack message (to no channels)
+	slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+	slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
 
 	// Make request
 	request := &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "wait_for_results": "false", "slack_channels": "test,test2"}}`)),
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "env_vars": "{\"FOO\": \"bar\"}", "kubernetes_secret_files": "{\"client_cert\": \"tls/tls.crt\", \"CREDS\": \"other-namespace/creds/creds.json\"}"}}`)),
 	}
 	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, request)
 
 	// Expected response
-	assert.Equal(t, "", rr.Body.String())
-	assert.Equal(t, 200, rr.Result().StatusCode)
-}
-
-func TestBadPayload(t *testing.T) {
-	// Initialize controller
-	_, cancel, _, _, _, _, handler := setupHandler(t, 100)
-	t.Cleanup(handler.Wait)
-	t.Cleanup(cancel)
-
-	// Make request
-	request := &http.Request{
-		Body: ioutil.NopCloser(strings.NewReader(`{}`)),
-	}
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, request)
+	assert.Equal(t, fullResults, rr.Body.Bytes())
+	assert.Equal(t, 200, rr.Result().StatusCode)
 
-	// Expected response
-	assert.Equal(t, "error while validating request: error while validating base webhook: missing name\n", rr.Body.String())
-	assert.Equal(t, 400, rr.Result().StatusCode)
+	// The files are removed once the test's context is canceled
+	require.Len(t, secretPaths, 2)
+	for _, path := range secretPaths {
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(path)
+			return os.IsNotExist(err)
+		}, time.Second, 10*time.Millisecond, path)
+	}
 }
 
-func TestEnvVars(t *testing.T) {
+func TestScriptConfigMap(t *testing.T) {
 	fullResults, resultParts := getTestOutput(t)
 
 	for _, tc := range []struct {
 		name              string
-		secretsSetting    string
-		envVarsSetting    string
+		configMapSetting  string
 		kubernetesObjects []runtime.Object
 		nilKubeClient     bool
 		expected          string
-		expectedEnvVars   map[string]string
 		expectedCode      int
 	}{
 		{
-			name:         "no secrets",
-			expected:     string(fullResults),
-			expectedCode: 200,
-		},
-		{
-			name:            "direct env vars",
-			envVarsSetting:  `{\"FOO\": \"bar\", \"BAZ\": \"qux\"}`,
-			expected:        string(fullResults),
-			expectedEnvVars: map[string]string{"FOO": "bar", "BAZ": "qux"},
-			expectedCode:    200,
-		},
-		{
-			name:           "working example",
-			secretsSetting: `{\"TEST_VAR\": \"other-namespace/secret-name/secret-key\"}`,
-			kubernetesObjects: []runtime.Object{
-				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
-			},
-			expected:        string(fullResults),
-			expectedEnvVars: map[string]string{"TEST_VAR": "secret-value"},
-			expectedCode:    200,
-		},
-		{
-			name:           "both env vars and secrets",
-			envVarsSetting: `{\"FOO\": \"bar\", \"BAZ\": \"qux\"}`,
-			secretsSetting: `{\"TEST_VAR\": \"other-namespace/secret-name/secret-key\"}`,
+			name:             "working example",
+			configMapSetting: "other-namespace/configmap-name/script.js",
 			kubernetesObjects: []runtime.Object{
-				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "other-namespace"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "configmap-name", Namespace: "other-namespace"}, Data: map[string]string{"script.js": "my-script"}},
 			},
-			expected:        string(fullResults),
-			expectedEnvVars: map[string]string{"FOO": "bar", "BAZ": "qux", "TEST_VAR": "secret-value"},
-			expectedCode:    200,
+			expected:     string(fullResults),
+			expectedCode: 200,
 		},
 		{
-			name:           "no given namespace (defaults to the payload namespace)",
-			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			name:             "no given namespace (defaults to the payload namespace)",
+			configMapSetting: "configmap-name/script.js",
 			kubernetesObjects: []runtime.Object{
-				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"secret-key": []byte("secret-value")}},
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "configmap-name", Namespace: "test-space"}, Data: map[string]string{"script.js": "my-script"}},
 			},
-			expected:        string(fullResults),
-			expectedEnvVars: map[string]string{"TEST_VAR": "secret-value"},
-			expectedCode:    200,
+			expected:     string(fullResults),
+			expectedCode: 200,
 		},
 		{
-			name:           "missing secret",
-			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
-			expected:       "error fetching secret test-space/secret-name: secrets \"secret-name\" not found\n",
-			expectedCode:   400,
+			name:             "missing configmap",
+			configMapSetting: "configmap-name/script.js",
+			expected:         "error fetching configmap test-space/configmap-name: configmaps \"configmap-name\" not found\n",
+			expectedCode:     400,
 		},
 		{
-			name:           "missing secret key",
-			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
+			name:             "missing configmap key",
+			configMapSetting: "configmap-name/script.js",
 			kubernetesObjects: []runtime.Object{
-				&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-name", Namespace: "test-space"}, Type: "Opaque", Data: map[string][]byte{"other-key": []byte("secret-value")}},
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "configmap-name", Namespace: "test-space"}, Data: map[string]string{"other.js": "my-script"}},
 			},
-			expected:     "secret test-space/secret-name does not have key secret-key\n",
+			expected:     "configmap test-space/configmap-name does not have key script.js\n",
 			expectedCode: 400,
 		},
 		{
-			name:           "no kube client",
-			secretsSetting: `{\"TEST_VAR\": \"secret-name/secret-key\"}`,
-			expected:       "kubernetes client is not configured\n",
-			expectedCode:   400,
-			nilKubeClient:  true,
+			name:             "no kube client",
+			configMapSetting: "configmap-name/script.js",
+			expected:         "kubernetes client is not configured\n",
+			expectedCode:     400,
+			nilKubeClient:    true,
 		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
@@ -610,25 +3960,19 @@ func TestEnvVars(t *testing.T) {
 
 			if tc.expectedCode == 200 {
 				// Expected calls
-				// * Start the run
+				// * Start the run with the script from the configmap
 				var bufferWriter io.Writer
-				k6Client.EXPECT().Start(gomock.Any(), "my-script", false, tc.expectedEnvVars, gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
+				k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
 					bufferWriter = outputWriter
 					outputWriter.Write([]byte(resultParts[0]))
 					return testRun, nil
 				})
-
-				// * Send the initial slack message (to no channels)
 				slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
-
-				// * Wait for the command to finish
 				testRun.EXPECT().Wait().DoAndReturn(func() error {
 					bufferWriter.Write([]byte("running" + resultParts[1]))
 					return nil
 				})
-
-				// * Upload the results file and update the slack message (to no channels)
-				slackClient.EXPECT().AddFileToThreads(nil, "k6-results.txt", string(fullResults)).Return(nil)
+				slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
 				slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
 			}
 
@@ -639,11 +3983,9 @@ func TestEnvVars(t *testing.T) {
 					"namespace": "test-space",
 					"phase": "pre-rollout",
 					"metadata": {
-						"script": "my-script",
-						"kubernetes_secrets": "%s",
-						"env_vars": "%s"
+						"script_configmap": "%s"
 					}
-				}`, tc.secretsSetting, tc.envVarsSetting))),
+				}`, tc.configMapSetting))),
 			}
 			rr := httptest.NewRecorder()
 			handler.ServeHTTP(rr, request)
@@ -653,7 +3995,99 @@ func TestEnvVars(t *testing.T) {
 			assert.Equal(t, tc.expectedCode, rr.Result().StatusCode)
 		})
 	}
+}
+
+func TestScriptURL(t *testing.T) {
+	fullResults, resultParts := getTestOutput(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/script.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("my-script"))
+	})
+	mux.HandleFunc("/redirect.js", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/script.js", http.StatusFound)
+	})
+	mux.HandleFunc("/large.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 1024)))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	for _, tc := range []struct {
+		name         string
+		path         string
+		expected     string
+		expectedCode int
+	}{
+		{
+			name:         "working example",
+			path:         "/script.js",
+			expected:     string(fullResults),
+			expectedCode: 200,
+		},
+		{
+			name:         "follows redirects",
+			path:         "/redirect.js",
+			expected:     string(fullResults),
+			expectedCode: 200,
+		},
+		{
+			name:         "not found",
+			path:         "/missing.js",
+			expected:     fmt.Sprintf("error fetching script from %s/missing.js: unexpected status 404 Not Found\n", server.URL),
+			expectedCode: 400,
+		},
+		{
+			name:         "oversized body",
+			path:         "/large.js",
+			expected:     fmt.Sprintf("script at %s/large.js exceeds the maximum size of 512 bytes\n", server.URL),
+			expectedCode: 400,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Initialize controller
+			_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+			handler.maxScriptSize = 512
+			t.Cleanup(handler.Wait)
+			t.Cleanup(cancel)
+
+			if tc.expectedCode == 200 {
+				// Expected calls
+				// * Start the run with the fetched script
+				var bufferWriter io.Writer
+				k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+					bufferWriter = outputWriter
+					outputWriter.Write([]byte(resultParts[0]))
+					return testRun, nil
+				})
+				slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+				testRun.EXPECT().Wait().DoAndReturn(func() error {
+					bufferWriter.Write([]byte("running" + resultParts[1]))
+					return nil
+				})
+				slackClient.EXPECT().AddFileToThreads(nil, "test-name-test-space-k6-results.txt", string(fullResults)).Return(nil)
+				slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+			}
+
+			// Make request
+			request := &http.Request{
+				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{
+					"name": "test-name",
+					"namespace": "test-space",
+					"phase": "pre-rollout",
+					"metadata": {
+						"script_url": "%s%s"
+					}
+				}`, server.URL, tc.path))),
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, request)
 
+			// Expected response
+			assert.Equal(t, tc.expected, rr.Body.String())
+			assert.Equal(t, tc.expectedCode, rr.Result().StatusCode)
+		})
+	}
 }
 
 func TestProcessHandler(t *testing.T) {
@@ -663,7 +4097,7 @@ func TestProcessHandler(t *testing.T) {
 		// Now let's produce a handful of test runs and check that they are waited
 		// on
 		for range 10 {
-			<-handler.availableTestRuns
+			require.NoError(t, handler.requestTestRun(context.Background()))
 			tr := mocks.NewMockK6TestRun(ctrl)
 			tr.EXPECT().PID().Return(-1).AnyTimes()
 			tr.EXPECT().Kill().Return(nil).AnyTimes()
@@ -674,7 +4108,7 @@ func TestProcessHandler(t *testing.T) {
 			tr.EXPECT().SetCancelFunc(gomock.Any()).Return().AnyTimes()
 			tr.EXPECT().CleanupContext().Return().AnyTimes()
 			tr.EXPECT().ExecutionDuration().Return(time.Minute).AnyTimes()
-			handler.registerProcessCleanup(tr)
+			handler.registerProcessCleanup(tr, "pre-rollout")
 		}
 		time.Sleep(time.Second * 2)
 		t.Log("Cancelling handler")
@@ -687,15 +4121,15 @@ func TestProcessHandler(t *testing.T) {
 		ctx, cancelCtx, _, _, _, _, handler := setupHandler(t, 100)
 		cmd := exec.CommandContext(ctx, "sleep", "10")
 		require.NoError(t, cmd.Start())
-		<-handler.availableTestRuns
-		handler.registerProcessCleanup(&k6.DefaultTestRun{Cmd: cmd})
+		require.NoError(t, handler.requestTestRun(context.Background()))
+		handler.registerProcessCleanup(&k6.DefaultTestRun{Cmd: cmd}, "pre-rollout")
 
 		// Also register a process that will be done by the time we are closing
 		// the handler:
 		cmdSuccess := exec.Command("true")
 		require.NoError(t, cmdSuccess.Start())
-		<-handler.availableTestRuns
-		handler.registerProcessCleanup(&k6.DefaultTestRun{Cmd: cmdSuccess})
+		require.NoError(t, handler.requestTestRun(context.Background()))
+		handler.registerProcessCleanup(&k6.DefaultTestRun{Cmd: cmdSuccess}, "pre-rollout")
 
 		// Yield so that the handler can actually pick up the process:
 		time.Sleep(time.Second)
@@ -705,6 +4139,257 @@ func TestProcessHandler(t *testing.T) {
 		require.False(t, cmd.ProcessState.Success())
 		require.True(t, cmdSuccess.ProcessState.Success())
 	})
+
+	t.Run("waits on more processes than the initial maximum once closed", func(t *testing.T) {
+		ctx, cancel, ctrl, _, _, _, handler := setupHandler(t, 1)
+		require.NoError(t, handler.SetMaxConcurrentTests(5))
+		for range 5 {
+			require.NoError(t, handler.requestTestRun(ctx))
+		}
+		cancel()
+		handler.Wait()
+
+		// The tests still in flight are cleaned up after the handler is closed
+		registered := make(chan struct{})
+		go func() {
+			for range 5 {
+				tr := mocks.NewMockK6TestRun(ctrl)
+				tr.EXPECT().PID().Return(-1).AnyTimes()
+				tr.EXPECT().Wait().Return(nil).Times(1)
+				tr.EXPECT().ExitCode().Return(0).AnyTimes()
+				tr.EXPECT().CleanupContext().Return().AnyTimes()
+				tr.EXPECT().ExecutionDuration().Return(time.Minute).AnyTimes()
+				handler.registerProcessCleanup(tr, "pre-rollout")
+			}
+			close(registered)
+		}()
+		select {
+		case <-registered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("registering the processes blocked")
+		}
+		assert.Eventually(t, func() bool { return handler.freeTestRuns() == 5 }, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+// While draining, new requests are rejected with a 503 and the in-flight ones
+// are waited for, up to the deadline of the context.
+func TestDrain(t *testing.T) {
+	waitedRequest := `{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`
+
+	t.Run("in-flight test completes", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+		slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), gomock.Any()).Return(nil)
+		slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+		// The test runs until it is released
+		fullResults, _ := getTestOutput(t)
+		release := make(chan struct{})
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+			outputWriter.Write(fullResults)
+			return testRun, nil
+		})
+		testRun.EXPECT().Wait().DoAndReturn(func() error {
+			<-release
+			return nil
+		})
+
+		rr := httptest.NewRecorder()
+		requestDone := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(rr, &http.Request{Body: io.NopCloser(strings.NewReader(waitedRequest))})
+			close(requestDone)
+		}()
+		assert.Eventually(t, func() bool {
+			return getMetricValue(t, handler.metricActiveTests, nil) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		drainErr := make(chan error)
+		go func() {
+			drainErr <- handler.Drain(context.Background())
+		}()
+
+		// * New requests are rejected and the handler isn't ready anymore
+		assert.Eventually(t, func() bool {
+			return handler.AvailableTestRuns() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		rejected := httptest.NewRecorder()
+		handler.ServeHTTP(rejected, &http.Request{Body: io.NopCloser(strings.NewReader(waitedRequest))})
+		assert.Equal(t, http.StatusServiceUnavailable, rejected.Code)
+		assert.Equal(t, "30", rejected.Header().Get("Retry-After"))
+
+		// * The drain lasts until the in-flight test is done
+		select {
+		case err := <-drainErr:
+			t.Fatalf("drain returned before the test was done: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(release)
+		require.NoError(t, <-drainErr)
+		<-requestDone
+		assert.Equal(t, 200, rr.Code)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		// Initialize controller
+		_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+
+		slackClient.EXPECT().SendMessages(nil, gomock.Any(), "").Return(nil, nil)
+		slackClient.EXPECT().AddFileToThreads(nil, gomock.Any(), gomock.Any()).Return(nil)
+		slackClient.EXPECT().UpdateMessages(nil, gomock.Any(), "").Return(nil)
+
+		// The test runs until it is killed
+		fullResults, _ := getTestOutput(t)
+		var processCtx context.Context
+		k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+			processCtx = ctx
+			outputWriter.Write(fullResults)
+			return testRun, nil
+		})
+		testRun.EXPECT().Wait().DoAndReturn(func() error {
+			<-processCtx.Done()
+			return errors.New("signal: killed")
+		})
+
+		rr := httptest.NewRecorder()
+		requestDone := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(rr, &http.Request{Body: io.NopCloser(strings.NewReader(waitedRequest))})
+			close(requestDone)
+		}()
+		assert.Eventually(t, func() bool {
+			return getMetricValue(t, handler.metricActiveTests, nil) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// * The drain gives up after the timeout, the test is killed once
+		// the handler's context is canceled
+		drainCtx, cancelDrain := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancelDrain()
+		assert.ErrorIs(t, handler.Drain(drainCtx), context.DeadlineExceeded)
+		cancel()
+		<-requestDone
+		assert.Equal(t, 400, rr.Code)
+	})
+}
+
+func Test503WhenShuttingDown(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// The handler's context is canceled on shutdown
+	cancel()
+
+	// Expected calls
+	// * No test is started
+	k6Client.EXPECT().Start(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	// Make request
+	request := &http.Request{
+		Body: io.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+
+	// * No test slot is used
+	assert.Equal(t, float64(0), getMetricValue(t, handler.metricActiveTests, nil))
+	assert.Equal(t, 0, handler.AvailableTestRuns())
+}
+
+func TestDurationMetrics(t *testing.T) {
+	_, cancel, ctrl, _, _, _, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	// Without any test, the default wait time is used
+	assert.Equal(t, int64(60), handler.getWaitTime())
+
+	for _, phase := range []string{"pre-rollout", "rollout"} {
+		testRun := mocks.NewMockK6TestRun(ctrl)
+		testRun.EXPECT().ExitCode().Return(0).AnyTimes()
+		testRun.EXPECT().ExecutionDuration().Return(90 * time.Second).AnyTimes()
+		handler.trackExecutionDuration(phase, testRun)
+	}
+
+	// The durations are labeled by phase in the exposed histogram, the
+	// internal summary has all of them
+	for _, phase := range []string{"pre-rollout", "rollout"} {
+		labels := map[string]string{"phase": phase, "exit_code": "0"}
+		assert.Equal(t, float64(1), getMetricValue(t, handler.metricDurations, labels), phase)
+	}
+	assert.Equal(t, float64(2), getMetricValue(t, handler.metricTestDuration, nil))
+	assert.Equal(t, float64(0), getMetricValue(t, handler.metricDurations, map[string]string{"phase": "post-rollout", "exit_code": "0"}))
+
+	// The wait time is still the median duration
+	assert.Equal(t, int64(90), handler.getWaitTime())
+}
+
+func TestGetWaitTime(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		durations []time.Duration
+		want      int64
+	}{
+		{
+			name: "no data",
+			want: 45,
+		},
+		{
+			name:      "median",
+			durations: []time.Duration{90 * time.Second},
+			want:      90,
+		},
+		{
+			name:      "median of all the phases and exit codes",
+			durations: []time.Duration{30 * time.Second, 90 * time.Second, 120 * time.Second, 100 * time.Second, 80 * time.Second},
+			want:      90,
+		},
+		{
+			name:      "clamped high",
+			durations: []time.Duration{10 * time.Hour},
+			want:      600,
+		},
+		{
+			name:      "clamped low",
+			durations: []time.Duration{time.Second},
+			want:      10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			handler, err := NewLaunchHandler(ctx, mocks.NewMockK6Client(mockCtrl), nil, mocks.NewMockSlackClient(mockCtrl), 1, WithWaitTime(45, 10, 600))
+			require.NoError(t, err)
+			h := handler.(*launchHandler)
+			t.Cleanup(h.Wait)
+			t.Cleanup(cancel)
+
+			phases := []string{"pre-rollout", "rollout", "post-rollout"}
+			for i, duration := range tc.durations {
+				testRun := mocks.NewMockK6TestRun(mockCtrl)
+				testRun.EXPECT().ExitCode().Return(i % 2).AnyTimes()
+				testRun.EXPECT().ExecutionDuration().Return(duration).AnyTimes()
+				h.trackExecutionDuration(phases[i%len(phases)], testRun)
+			}
+			assert.Equal(t, tc.want, h.getWaitTime())
+		})
+	}
+
+	t.Run("invalid bounds", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		_, err := NewLaunchHandler(context.Background(), mocks.NewMockK6Client(mockCtrl), nil, mocks.NewMockSlackClient(mockCtrl), 1, WithWaitTime(45, 600, 10))
+		assert.EqualError(t, err, "invalid wait time bounds: the minimum (600) must be between 0 and the maximum (10)")
+	})
 }
 
 // If we get too many concurrent test requests, a 429 should be returned by the
@@ -728,7 +4413,7 @@ func Test429OnExcessiveRequests(t *testing.T) {
 	}
 
 	var bufferWriter1 io.Writer
-	k6Client.EXPECT().Start(gomock.Any(), gomock.Any(), false, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (k6.TestRun, error) {
+	k6Client.EXPECT().Start(gomock.Any(), gomock.Any(), false, gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
 		bufferWriter1 = outputWriter
 		outputWriter.Write([]byte(resultParts[0]))
 		return testRun1, nil
@@ -742,6 +4427,7 @@ func Test429OnExcessiveRequests(t *testing.T) {
 	rr1 := httptest.NewRecorder()
 	handler.ServeHTTP(rr1, request1)
 	require.Equal(t, 200, rr1.Code)
+	assert.Equal(t, float64(1), getMetricValue(t, handler.metricActiveTests, nil))
 
 	testRun2 := mocks.NewMockK6TestRun(ctrl)
 	request2 := &http.Request{
@@ -749,13 +4435,158 @@ func Test429OnExcessiveRequests(t *testing.T) {
 	}
 
 	// All these mock calls should actually never happen as the request is rejected right away
-	k6Client.EXPECT().Start(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+	k6Client.EXPECT().Start(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
 	testRun2.EXPECT().PID().Return(-1).Times(0)
 	testRun2.EXPECT().Wait().Times(0)
 
+	assert.Equal(t, float64(0), getMetricValue(t, handler.metricRejected, nil))
 	rr2 := httptest.NewRecorder()
 	handler.ServeHTTP(rr2, request2)
 	require.Equal(t, 429, rr2.Code)
+	assert.Equal(t, float64(1), getMetricValue(t, handler.metricRejected, nil))
+
+	// The rejected request doesn't use a slot and the slot of the first one is
+	// released asynchronously once its test run is done
+	assert.Equal(t, float64(1), getMetricValue(t, handler.metricActiveTests, nil))
+	assert.Eventually(t, func() bool {
+		return getMetricValue(t, handler.metricActiveTests, nil) == 0
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+// Queued requests get the test run slots in the order they have been received.
+func TestQueueOrder(t *testing.T) {
+	// Initialize controller
+	ctx, cancel, _, _, _, _, handler := setupHandler(t, 1)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	handler.queueTimeout = 10 * time.Second
+
+	// The only slot is taken, the other requests are queued one after the
+	// other
+	require.NoError(t, handler.requestTestRun(ctx))
+	const queued = 5
+	served := make(chan int, queued)
+	for i := range queued {
+		go func() {
+			if err := handler.requestTestRun(ctx); err == nil {
+				served <- i
+			}
+		}()
+		require.Eventually(t, func() bool { return handler.queuedRequests.Load() == int64(i+1) }, time.Second, time.Millisecond)
+	}
+
+	// They are served in order as the slot is released
+	for i := range queued {
+		handler.releaseTestRun()
+		select {
+		case got := <-served:
+			assert.Equal(t, i, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %d wasn't served", i)
+		}
+	}
+	assert.Equal(t, 0, handler.freeTestRuns())
+	assert.Equal(t, int64(0), handler.queuedRequests.Load())
+}
+
+// Rejected requests are notified to the ops channel, once per interval.
+func TestRejectionNotifications(t *testing.T) {
+	// Initialize controller
+	ctx, cancel, _, _, slackClient, _, handler := setupHandler(t, 1)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+	handler.rejectionNotifications.channel = "ops"
+	handler.rejectionNotifications.interval = time.Hour
+
+	// The only slot is taken until the end of the test
+	require.NoError(t, handler.requestTestRun(ctx))
+	request := func(body string) *http.Request {
+		return &http.Request{Body: io.NopCloser(strings.NewReader(body))}
+	}
+	payload := `{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`
+
+	// * Notified once within the interval, once the response has been
+	// written
+	responded := make(chan struct{})
+	notified := make(chan struct{})
+	slackClient.EXPECT().SendMessages([]string{"ops"}, ":warning: Rejected the `pre-rollout` load testing of `test-name` in namespace `test-space`: maximum concurrent test runs reached (0 other requests queued)", "").DoAndReturn(func(channels []string, text, context string) (map[string]string, error) {
+		<-responded
+		close(notified)
+		return nil, nil
+	})
+	for range 3 {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, request(payload))
+		assert.Equal(t, 429, rr.Code)
+	}
+	close(responded)
+	<-notified
+
+	// * Notified again once the interval has elapsed, even if the canary
+	// can't be read from the request
+	handler.rejectionNotifications.lastSent = time.Now().Add(-time.Hour)
+	handler.queuedRequests.Store(2)
+	notified = make(chan struct{})
+	slackClient.EXPECT().SendMessages([]string{"ops"}, ":warning: Rejected a load test: maximum concurrent test runs reached (2 other requests queued)", "").DoAndReturn(func(channels []string, text, context string) (map[string]string, error) {
+		close(notified)
+		return nil, errors.New("slack is down")
+	})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request("bad"))
+	assert.Equal(t, 429, rr.Code)
+	<-notified
+}
+
+// With a queue timeout, requests received while no test run slot is free
+// wait for one before being rejected.
+func TestQueueTimeout(t *testing.T) {
+	dryRunRequest := func() *http.Request {
+		return &http.Request{
+			Body: io.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script", "dry_run": "true"}}`)),
+		}
+	}
+
+	t.Run("a slot is released in time", func(t *testing.T) {
+		// Initialize controller
+		ctx, cancel, _, k6Client, _, _, handler := setupHandler(t, 1)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		handler.queueTimeout = 10 * time.Second
+
+		k6Client.EXPECT().Validate(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), gomock.Any()).Return(nil)
+
+		// The only slot is taken and released a bit later
+		require.NoError(t, handler.requestTestRun(ctx))
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			handler.releaseTestRun()
+		}()
+
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, dryRunRequest())
+		assert.Equal(t, 200, rr.Code)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, 1, handler.AvailableTestRuns())
+	})
+
+	t.Run("no slot is released in time", func(t *testing.T) {
+		// Initialize controller
+		ctx, cancel, _, _, _, _, handler := setupHandler(t, 1)
+		t.Cleanup(handler.Wait)
+		t.Cleanup(cancel)
+		handler.queueTimeout = 100 * time.Millisecond
+
+		// The only slot is taken until the end of the test
+		require.NoError(t, handler.requestTestRun(ctx))
+
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, dryRunRequest())
+		assert.Equal(t, 429, rr.Code)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, 0, handler.AvailableTestRuns())
+	})
 }
 
 func setupHandler(t *testing.T, maxConcurrentTests int) (context.Context, context.CancelFunc, *gomock.Controller, *mocks.MockK6Client, *mocks.MockSlackClient, *mocks.MockK6TestRun, *launchHandler) {
@@ -786,6 +4617,62 @@ func setupHandlerWithKubernetesObjects(t *testing.T, maxConcurrentTests int, exp
 	return ctx, cancel, mockCtrl, k6Client, slackClient, testRun, handler.(*launchHandler)
 }
 
+// testScript returns the script run for the test-name canary in the test-space
+// namespace, tagged with them.
+func testScript(content string) k6.Script {
+	return k6.Script{Content: content, Tags: map[string]string{"canary": "test-name", "namespace": "test-space"}}
+}
+
+// testEnvVars returns the environment variables of a test of the test-name
+// canary in the test-space namespace during the pre-rollout phase, along with
+// the given ones.
+func testEnvVars(envVars map[string]string) map[string]string {
+	result := map[string]string{"K6_CANARY_NAME": "test-name", "K6_CANARY_NAMESPACE": "test-space", "K6_CANARY_PHASE": "pre-rollout"}
+	maps.Copy(result, envVars)
+	return result
+}
+
+// getTestResultCount scrapes the launch_test_result_total metric of the given
+// handler and returns the value for the given labels.
+func getTestResultCount(t *testing.T, handler *launchHandler, namespace, name, result string) float64 {
+	t.Helper()
+
+	return getMetricValue(t, handler.metricTestResults, map[string]string{"namespace": namespace, "name": name, "result": result})
+}
+
+// getMetricValue scrapes the given collector and returns the value of the
+// counter or gauge matching the given labels.
+func getMetricValue(t *testing.T, collector prometheus.Collector, labels map[string]string) float64 {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(collector))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			if metric.GetGauge() != nil {
+				return metric.GetGauge().GetValue()
+			}
+			// The number of observations of histograms and summaries
+			if metric.GetHistogram() != nil {
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+			if metric.GetSummary() != nil {
+				return float64(metric.GetSummary().GetSampleCount())
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
 func getTestOutput(t *testing.T) ([]byte, []string) {
 	t.Helper()
 
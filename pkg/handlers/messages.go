@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The default template of all status messages
+const defaultMessageTemplate = "{{.Emoji}} `{{.Phase}}` load testing of `{{.Name}}` in namespace `{{.Namespace}}` {{.Status}}"
+
+// The k6 log outputs that can be set, ex: `loki=https://loki.example.com/loki/api/v1/push,label.canary=my-app`.
+// Files aren't allowed, as they would be written on the load tester
+var logOutputRegex = regexp.MustCompile(`^(none|stdout|stderr|loki(=\S+)?)$`)
+
+// MessageTemplates are the text/template templates of the status messages,
+// by state of the test.
+type MessageTemplates struct {
+	start   *template.Template
+	success *template.Template
+	failure *template.Template
+}
+
+// messageData is what the message templates have access to
+type messageData struct {
+	Name      string
+	Namespace string
+	Phase     string
+	CloudURL  string
+	// Duration of the test run. Zero until the test is done
+	Duration time.Duration
+	// Emoji and Status are those of the default message, ex: ":red_circle:"
+	// and "has timed out after 10m"
+	Emoji  string
+	Status string
+}
+
+// ParseMessageTemplates parses the templates of the messages sent when a test
+// starts, succeeds and fails. Empty templates are replaced by the default one.
+func ParseMessageTemplates(start, success, failure string) (*MessageTemplates, error) {
+	templates := &MessageTemplates{}
+	for _, t := range []struct {
+		name     string
+		text     string
+		template **template.Template
+	}{
+		{"start", start, &templates.start},
+		{"success", success, &templates.success},
+		{"failure", failure, &templates.failure},
+	} {
+		if t.text == "" {
+			t.text = defaultMessageTemplate
+		}
+		tmpl, err := template.New(t.name).Option("missingkey=error").Parse(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing the %s message template: %w", t.name, err)
+		}
+		// Referencing unknown fields is only caught on execution
+		if err := tmpl.Execute(&strings.Builder{}, messageData{}); err != nil {
+			return nil, fmt.Errorf("error validating the %s message template: %w", t.name, err)
+		}
+		*t.template = tmpl
+	}
+	return templates, nil
+}
+
+func defaultMessageTemplates() *MessageTemplates {
+	templates, err := ParseMessageTemplates("", "", "")
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}
+
+// render returns the message for the given data. The template is picked
+// according to the emoji.
+func (t *MessageTemplates) render(data messageData) (string, error) {
+	tmpl := t.start
+	switch data.Emoji {
+	case emojiSuccess:
+		tmpl = t.success
+	case emojiFailure:
+		tmpl = t.failure
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// renderNotificationContext renders the `notification_context` metadata field,
+// which has access to the same data as the message templates.
+func renderNotificationContext(text string, data messageData) (string, error) {
+	return renderTemplate("notification_context", text, data)
+}
+
+// renderLogOutput renders the `--log-output` of k6, ex: to label the logs sent
+// to Loki with the name of the canary. Only the name, namespace and phase of
+// the test are known when k6 is started.
+func renderLogOutput(text string, data messageData) (string, error) {
+	logOutput, err := renderTemplate("log_output", text, data)
+	if err != nil {
+		return "", err
+	}
+	if !logOutputRegex.MatchString(logOutput) {
+		return "", fmt.Errorf("%q is not a supported k6 log output (none, stdout, stderr or loki)", logOutput)
+	}
+	return logOutput, nil
+}
+
+func renderTemplate(name, text string, data messageData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMessageTemplates(t *testing.T) {
+	data := messageData{
+		Name:      "test-name",
+		Namespace: "test-space",
+		Phase:     "pre-rollout",
+		CloudURL:  "https://app.k6.io/runs/1157843",
+		Duration:  90 * time.Second,
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		templates, err := ParseMessageTemplates("", "", "")
+		require.NoError(t, err)
+
+		for _, tc := range []struct {
+			emoji, status, expected string
+		}{
+			{emojiWarning, "has started", ":warning: `pre-rollout` load testing of `test-name` in namespace `test-space` has started"},
+			{emojiSuccess, "has succeeded", ":large_green_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has succeeded"},
+			{emojiFailure, "has failed", ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed"},
+		} {
+			data.Emoji, data.Status = tc.emoji, tc.status
+			msg, err := templates.render(data)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, msg)
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		templates, err := ParseMessageTemplates(
+			":rocket: {{.Phase}} of {{.Namespace}}/{{.Name}} started: {{.CloudURL}}",
+			":tada: {{.Name}} passed in {{.Duration}}",
+			"",
+		)
+		require.NoError(t, err)
+
+		data.Emoji, data.Status = emojiWarning, "has started"
+		msg, err := templates.render(data)
+		require.NoError(t, err)
+		assert.Equal(t, ":rocket: pre-rollout of test-space/test-name started: https://app.k6.io/runs/1157843", msg)
+
+		data.Emoji, data.Status = emojiSuccess, "has succeeded"
+		msg, err = templates.render(data)
+		require.NoError(t, err)
+		assert.Equal(t, ":tada: test-name passed in 1m30s", msg)
+
+		// * Unset templates keep the default
+		data.Emoji, data.Status = emojiFailure, "has failed"
+		msg, err = templates.render(data)
+		require.NoError(t, err)
+		assert.Equal(t, ":red_circle: `pre-rollout` load testing of `test-name` in namespace `test-space` has failed", msg)
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		_, err := ParseMessageTemplates("{{.Name", "", "")
+		assert.ErrorContains(t, err, "error parsing the start message template")
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := ParseMessageTemplates("", "", "{{.Reason}}")
+		assert.ErrorContains(t, err, "error validating the failure message template")
+	})
+}
+
+func TestRenderNotificationContext(t *testing.T) {
+	data := messageData{
+		Name:      "test-name",
+		Namespace: "test-space",
+		Phase:     "pre-rollout",
+		CloudURL:  "https://app.k6.io/runs/1157843",
+		Duration:  90 * time.Second,
+	}
+
+	t.Run("template", func(t *testing.T) {
+		text, err := renderNotificationContext("<https://grafana.example.com/d/abc?var-namespace={{.Namespace}}&var-name={{.Name}}|Dashboard> ({{.Phase}}, {{.Duration}}, {{.CloudURL}})", data)
+		require.NoError(t, err)
+		assert.Equal(t, "<https://grafana.example.com/d/abc?var-namespace=test-space&var-name=test-name|Dashboard> (pre-rollout, 1m30s, https://app.k6.io/runs/1157843)", text)
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		text, err := renderNotificationContext("My Cluster: `dev-us-east-1`", data)
+		require.NoError(t, err)
+		assert.Equal(t, "My Cluster: `dev-us-east-1`", text)
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		_, err := renderNotificationContext("{{.Name", data)
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := renderNotificationContext("{{.Reason}}", data)
+		assert.Error(t, err)
+	})
+}
+
+func TestRenderLogOutput(t *testing.T) {
+	data := messageData{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"}
+
+	for _, tc := range []struct {
+		name    string
+		text    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "loki",
+			text: "loki=https://loki.example.com/loki/api/v1/push,label.canary={{.Name}},label.namespace={{.Namespace}},label.phase={{.Phase}}",
+			want: "loki=https://loki.example.com/loki/api/v1/push,label.canary=test-name,label.namespace=test-space,label.phase=pre-rollout",
+		},
+		{
+			name: "loki with the defaults",
+			text: "loki",
+			want: "loki",
+		},
+		{
+			name: "stderr",
+			text: "stderr",
+			want: "stderr",
+		},
+		{
+			name:    "file",
+			text:    "file=/etc/passwd",
+			wantErr: `"file=/etc/passwd" is not a supported k6 log output (none, stdout, stderr or loki)`,
+		},
+		{
+			name:    "spaces",
+			text:    "loki=https://loki.example.com/loki/api/v1/push --out json",
+			wantErr: `"loki=https://loki.example.com/loki/api/v1/push --out json" is not a supported k6 log output (none, stdout, stderr or loki)`,
+		},
+		{
+			name:    "unknown field",
+			text:    "loki=https://loki.example.com/loki/api/v1/push,label.url={{.CloudURLs}}",
+			wantErr: `template: log_output:1:59: executing "log_output" at <.CloudURLs>: can't evaluate field CloudURLs in type handlers.messageData`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logOutput, err := renderLogOutput(tc.text, data)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, logOutput)
+		})
+	}
+}
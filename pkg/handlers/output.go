@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// streamWriter forwards the k6 output to the client as it is produced. Writes
+// are flushed right away and are dropped once the writer is closed (i.e. when
+// the request has been handled) so that a k6 process that outlives the request
+// can't write to a finished response.
+type streamWriter struct {
+	mu         sync.Mutex
+	controller *http.ResponseController
+	resp       http.ResponseWriter
+	started    bool
+	closed     bool
+}
+
+func newStreamWriter(resp http.ResponseWriter) *streamWriter {
+	return &streamWriter{
+		controller: http.NewResponseController(resp),
+		resp:       resp,
+	}
+}
+
+// Write never returns an error as this would stop the output from being
+// copied to the other writers.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return len(p), nil
+	}
+	if _, err := w.resp.Write(p); err != nil {
+		w.closed = true
+		return len(p), nil
+	}
+	w.started = true
+	_ = w.controller.Flush()
+	return len(p), nil
+}
+
+// Started returns true if anything has been sent to the client, in which case
+// the response status can no longer be changed.
+func (w *streamWriter) Started() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.started
+}
+
+func (w *streamWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+}
+
+const outputTruncatedMarker = "\n...[output truncated]...\n"
+
+// boundedWriter writes at most limit bytes to the underlying writer. Once the
+// limit is reached, a truncation marker is written and the rest of the output
+// is dropped. As with streamWriter, errors are never returned so that k6 keeps
+// running normally.
+type boundedWriter struct {
+	w         io.Writer
+	limit     int64
+	remaining int64
+	truncated bool
+}
+
+func newBoundedWriter(w io.Writer, limit int64) *boundedWriter {
+	return &boundedWriter{w: w, limit: limit, remaining: limit}
+}
+
+// Reset allows limit bytes to be written again. It must not be called while
+// writing.
+func (w *boundedWriter) Reset() {
+	w.remaining = w.limit
+	w.truncated = false
+}
+
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	if w.truncated {
+		return len(p), nil
+	}
+	if int64(len(p)) <= w.remaining {
+		w.remaining -= int64(len(p))
+		_, _ = w.w.Write(p)
+		return len(p), nil
+	}
+	_, _ = w.w.Write(p[:w.remaining])
+	_, _ = w.w.Write([]byte(outputTruncatedMarker))
+	w.remaining = 0
+	w.truncated = true
+	return len(p), nil
+}
+
+// ansiEscapeRegex matches the ANSI escape sequences (colors, cursor moves) k6
+// can output: CSI and OSC sequences as well as two-character escapes.
+var ansiEscapeRegex = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// outputBuffer is a bytes.Buffer that can be read while k6 writes to it. The
+// output is read without its ANSI escape sequences, which are stripped on read
+// as they can be split across writes.
+type outputBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *outputBuffer) String() string {
+	return string(b.Bytes())
+}
+
+func (b *outputBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return ansiEscapeRegex.ReplaceAll(b.buf.Bytes(), nil)
+}
+
+// Reset discards the output written so far.
+func (b *outputBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func (b *outputBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+// syncWriter serializes writes to the underlying writer, so that the k6
+// stdout and stderr can be written to the same writers.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
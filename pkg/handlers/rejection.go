@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the notification of a rejected request is waited for
+const rejectionNotificationTimeout = 30 * time.Second
+
+// rejectionNotifications posts to an ops Slack channel when requests are
+// rejected because the maximum number of concurrent tests is reached, at most
+// once per interval so that a saturated webhook doesn't flood the channel.
+type rejectionNotifications struct {
+	// Empty if the notifications are disabled
+	channel  string
+	interval time.Duration
+
+	mutex    sync.Mutex
+	lastSent time.Time
+}
+
+// take returns whether a notification can be sent now. If so, the next one
+// can't be sent before the interval has elapsed.
+func (n *rejectionNotifications) take(now time.Time) bool {
+	if n.channel == "" {
+		return false
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !n.lastSent.IsZero() && now.Sub(n.lastSent) < n.interval {
+		return false
+	}
+	n.lastSent = now
+	return true
+}
+
+// notifyRejection notifies the ops channel, if any, that the request was
+// rejected for lack of test runs. The canary is read from the request right
+// away but the notification is sent by the returned function, meant to be run
+// in the background once the response has been written so that Slack can't
+// delay it. It is nil if there is nothing to notify.
+func (h *launchHandler) notifyRejection(req *http.Request) func() {
+	if !h.rejectionNotifications.take(time.Now()) {
+		return nil
+	}
+	test := "a load test"
+	if webhook := h.rejectedWebhook(req); webhook.Name != "" {
+		test = fmt.Sprintf("the `%s` load testing of `%s` in namespace `%s`", webhook.Phase, webhook.Name, webhook.Namespace)
+	}
+	text := fmt.Sprintf("%s Rejected %s: maximum concurrent test runs reached (%d other requests queued)", emojiWarning, test, h.queuedRequests.Load())
+	return func() {
+		// The Slack client retries on its own and can't be canceled, the
+		// notification is given up on after the timeout
+		sent := make(chan error, 1)
+		go func() {
+			_, err := h.slackClient.SendMessages([]string{h.rejectionNotifications.channel}, text, "")
+			sent <- err
+		}()
+		select {
+		case err := <-sent:
+			if err != nil {
+				log.Errorf("error while notifying the rejection of a request: %v", err)
+			}
+		case <-time.After(rejectionNotificationTimeout):
+			log.Errorf("timed out after %s while notifying the rejection of a request", rejectionNotificationTimeout)
+		}
+	}
+}
+
+// rejectedWebhook reads the canary of a rejected request from its body, as
+// far as it can. Its fields are empty if the body isn't a valid webhook.
+func (h *launchHandler) rejectedWebhook(req *http.Request) *flaggerWebhook {
+	webhook := &flaggerWebhook{}
+	if req.Body == nil {
+		return webhook
+	}
+	var body io.Reader = req.Body
+	if h.maxRequestBytes > 0 {
+		body = io.LimitReader(body, h.maxRequestBytes)
+	}
+	_ = json.NewDecoder(body).Decode(webhook)
+	return webhook
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Replay sends a payload, ex: one captured from Flagger, to the launch handler
+// as if it was posted to /launch-test, and writes the response body to out. It
+// returns the exit code of k6, or 1 if the test failed without one (ex: the
+// payload is invalid or the streamed output was aborted).
+func Replay(ctx context.Context, handler http.Handler, payload io.Reader, out io.Writer) (exitCode int, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/launch-test", payload)
+	if err != nil {
+		return 0, err
+	}
+	resp := &replayResponse{header: http.Header{}, out: out}
+
+	defer func() {
+		// The handler aborts streamed responses when the test fails
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			exitCode = 1
+		}
+	}()
+	handler.ServeHTTP(resp, req)
+
+	if value := resp.header.Get(headerExitCode); value != "" {
+		return strconv.Atoi(value)
+	}
+	if resp.status >= http.StatusBadRequest {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// replayResponse writes the body of the response to out as it is produced, so
+// that streamed outputs are shown right away.
+type replayResponse struct {
+	header http.Header
+	status int
+	out    io.Writer
+}
+
+func (r *replayResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *replayResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *replayResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.out.Write(p)
+}
+
+// Flush is a no-op, as everything is written to out right away.
+func (r *replayResponse) Flush() {}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+)
+
+// runningTest is a test whose k6 process may still be running. The process
+// and the function canceling its context are set once it is started.
+type runningTest struct {
+	key    string
+	cmd    k6.TestRun
+	cancel context.CancelFunc
+}
+
+// addRunningTest registers a test about to be started, so that it can be
+// canceled. If a test with the same key is running, it returns false when
+// duplicates are rejected. Otherwise, the new test replaces the previous one.
+func (h *launchHandler) addRunningTest(key string) (*runningTest, bool) {
+	h.runningTestsMutex.Lock()
+	defer h.runningTestsMutex.Unlock()
+	if _, ok := h.runningTests[key]; ok && h.rejectDuplicateTests {
+		return nil, false
+	}
+	test := &runningTest{key: key}
+	h.runningTests[key] = test
+	return test, true
+}
+
+// setRunningTestProcess records the process of a started test.
+func (h *launchHandler) setRunningTestProcess(test *runningTest, cmd k6.TestRun, cancel context.CancelFunc) {
+	h.runningTestsMutex.Lock()
+	defer h.runningTestsMutex.Unlock()
+	test.cmd = cmd
+	test.cancel = cancel
+}
+
+// removeRunningTest forgets the test, unless it has already been replaced.
+func (h *launchHandler) removeRunningTest(test *runningTest) {
+	h.runningTestsMutex.Lock()
+	defer h.runningTestsMutex.Unlock()
+	if h.runningTests[test.key] == test {
+		delete(h.runningTests, test.key)
+	}
+}
+
+// removeRunningTestProcess forgets the test whose process has exited.
+func (h *launchHandler) removeRunningTestProcess(cmd k6.TestRun) {
+	h.runningTestsMutex.Lock()
+	defer h.runningTestsMutex.Unlock()
+	for key, test := range h.runningTests {
+		if test.cmd == cmd {
+			delete(h.runningTests, key)
+		}
+	}
+}
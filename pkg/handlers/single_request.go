@@ -1,19 +1,63 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// Appended to a secret reference to base64-decode the value of the key
+const secretBase64Suffix = ":base64"
+
+// Headers summarizing the test in the responses. Only the cloud URL is known
+// when the results aren't waited for
+const (
+	headerCloudURL     = "X-K6-Cloud-URL"
+	headerExitCode     = "X-K6-Exit-Code"
+	headerChecksPassed = "X-K6-Checks-Passed"
+	headerChecksFailed = "X-K6-Checks-Failed"
+)
+
+var (
+	errOutputTimeout  = errors.New("timeout")
+	errOutputCanceled = errors.New("canceled")
+	errHandlerTimeout = errors.New("timed out waiting for the results")
+	envVarNameRegex   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// testFailure is the error of a test that was run but failed, ex: because of
+// its thresholds, as opposed to the errors of invalid requests.
+type testFailure struct {
+	err error
+}
+
+func (f *testFailure) Error() string {
+	return f.err.Error()
+}
+
+func (f *testFailure) Unwrap() error {
+	return f.err
+}
+
 // singleRequestHandler is the counterpart to launchHandler as it holds state
 // and functionality for dealing with a single incoming request. All global
 // process-handling responsibilities are owned by launchHandler.
@@ -24,54 +68,176 @@ type singleRequestHandler struct {
 	lh   *launchHandler
 
 	// Fields that are set during handling
-	payload              *launchPayload
-	buf                  *bytes.Buffer
+	payload *launchPayload
+	// The combined k6 stdout and stderr
+	buf *outputBuffer
+	// The k6 stdout alone, where the output is announced
+	stdout               *outputBuffer
+	stream               *streamWriter
+	abortResponse        bool
 	processCtx           context.Context
 	cancelProcessContext context.CancelFunc
 	testRunRequested     bool
 	asyncCleanup         bool
+	// The entry of the test in the running tests, for cancellation
+	runningTest *runningTest
 	// This stores context information over the request time to be submitted to
-	// the end-user via slack.
-	slackContext string
-	slackThreads map[string]string
+	// the end-user via the notifiers.
+	notificationContext string
+	notifications       []*notification
+	test                *notifier.Test
+	// The first failure to send notifications, if they are required
+	notificationErr error
+	// Where k6 exports the summary, if `summary_export` is set
+	summaryPath string
+	// Where the REST API of k6 listens, if `abort_on_error_rate` is set
+	apiAddress string
+	// Receives the reason of the abort if the test is killed because of its
+	// error rate
+	errorRateAbort chan string
+	// Fires once the request has been handled for longer than the handler
+	// timeout. nil if there is no timeout
+	handlerTimeout <-chan time.Time
+	// When k6 was started, for the history
+	startedAt time.Time
+	// The script of the suite being run and the outcome of the ones run so
+	// far, if `scripts` is set
+	scriptIndex    int
+	scriptOutcomes []string
+	// What the scripts of the test are run with
+	inputs *k6Inputs
+}
+
+// notification holds the state of the messages sent by a single notifier
+// during a request.
+type notification struct {
+	notifier notifier.Notifier
+	channels []string
+	threads  map[string]string
+
+	// Prepended to the failure messages
+	failureMentions string
 }
 
 func newSingleRequestHandler(resp http.ResponseWriter, req *http.Request, lh *launchHandler) *singleRequestHandler {
+	id := requestID(req)
+	resp.Header().Set(requestIDHeader, id)
 	srh := singleRequestHandler{
 		resp: resp,
 		req:  req,
-		log:  createLogEntry(req),
+		log:  createLogEntry(req, id),
 		lh:   lh,
 	}
 	return &srh
 }
 
 func (h *singleRequestHandler) Handle(requestCtx context.Context) {
-	if err := h.requestTestRun(); err != nil {
+	defer func() {
+		// The status has already been sent when streaming the output. The
+		// only way left to tell the client about the failure is to abort the
+		// response.
+		if h.abortResponse {
+			panic(http.ErrAbortHandler)
+		}
+	}()
+
+	if h.lh.handlerTimeout > 0 {
+		timer := time.NewTimer(h.lh.handlerTimeout)
+		defer timer.Stop()
+		h.handlerTimeout = timer.C
+	}
+
+	if err := h.requestTestRun(requestCtx); err != nil {
 		h.log.Warn("Maximum concurrent test runs reached. Rejecting request.")
 		h.resp.Header().Set("Retry-After", fmt.Sprintf("%d", h.lh.getWaitTime()))
-		http.Error(h.resp, "Maximum concurrent test runs reached", http.StatusTooManyRequests)
+		notify := h.lh.notifyRejection(h.req)
+		writeError(h.resp, h.req, "Maximum concurrent test runs reached", "", http.StatusTooManyRequests)
+		if notify != nil {
+			go notify()
+		}
 		return
 	}
 
-	h.buf = &bytes.Buffer{}
+	h.buf = &outputBuffer{}
+	h.stdout = &outputBuffer{}
 
-	payload, err := newLaunchPayload(h.req)
+	payload, err := newLaunchPayload(h.req, h.lh.maxRequestBytes)
 	if err != nil {
 		h.log.Error(err)
-		http.Error(h.resp, fmt.Sprintf("error while validating request: %v", err), 400)
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, errUnsupportedMediaType) {
+			status = http.StatusUnsupportedMediaType
+		}
+		body := errorResponse{Error: fmt.Sprintf("error while validating request: %v", err)}
+		var validationErr *validationError
+		if errors.As(err, &validationErr) {
+			body.Errors = validationErr.Errors
+		}
+		writeErrorResponse(h.resp, h.req, body, status)
 		h.lh.releaseTestRun()
 		return
 	}
 	h.payload = payload
-	h.slackContext = payload.Metadata.NotificationContext
+	if !payload.knownPhase() {
+		h.log.Warnf("unknown phase %q, expected one of %s", payload.Phase, strings.Join(knownPhases, ", "))
+	}
+	trace.SpanFromContext(requestCtx).SetAttributes(payload.spanAttributes()...)
+	if payload.Metadata.StreamOutput {
+		h.stream = newStreamWriter(h.resp)
+		defer h.stream.Close()
+	}
+	h.notificationContext = payload.Metadata.NotificationContext
+	h.test = &notifier.Test{Name: payload.Name, Namespace: payload.Namespace, Phase: payload.Phase, Key: payload.key(), SlackThreadTS: payload.Metadata.SlackThreadTS}
+	for _, n := range h.lh.notifiers {
+		testNotifier := n.notifier
+		if n.forTest != nil {
+			testNotifier = n.forTest(h.test)
+		}
+		testNotification := &notification{notifier: testNotifier, channels: n.channels(payload)}
+		if n.failureMentions != nil {
+			testNotification.failureMentions = n.failureMentions(payload)
+		}
+		h.notifications = append(h.notifications, testNotification)
+	}
+
+	if payload.Metadata.DryRun {
+		h.dryRun(requestCtx)
+		return
+	}
 
 	if err := h.checkAgainstLastFailureTime(); err != nil {
 		h.failRequest(err)
 		return
 	}
 
-	ctx, cancelCtx := context.WithCancel(context.Background())
+	// Removed once the process has exited, either here or when it is cleaned
+	// up asynchronously
+	test, ok := h.lh.addRunningTest(payload.key())
+	if !ok {
+		// This isn't a failure of the test, so the last failure time is not
+		// updated
+		h.log.Warnf("a test is already running for %s, rejecting the request", payload.key())
+		writeError(h.resp, h.req, fmt.Sprintf("a test is already running for %s", payload.key()), "", http.StatusConflict)
+		h.releaseTestRun()
+		return
+	}
+	h.runningTest = test
+	defer func() {
+		if !h.asyncCleanup {
+			h.lh.removeRunningTest(test)
+		}
+	}()
+
+	// The process outlives the request when not waiting for the results, so
+	// its context only carries the request's span.
+	processCtx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(requestCtx))
+	ctx, cancelCtx := context.WithCancel(processCtx)
+	if timeout := h.testTimeout(); timeout > 0 {
+		ctx, cancelCtx = context.WithTimeout(processCtx, timeout)
+	}
 	defer func() {
 		if payload.Metadata.WaitForResults {
 			cancelCtx()
@@ -83,25 +249,47 @@ func (h *singleRequestHandler) Handle(requestCtx context.Context) {
 	h.processCtx = ctx
 	h.cancelProcessContext = cancelCtx
 
-	cmd, err := h.startK6Test(ctx)
+	h.startedAt = time.Now()
+	inputs, err := h.prepareK6Test(ctx)
+	if err != nil {
+		h.failRequest(err)
+		return
+	}
+	h.inputs = inputs
+	cmd, err := h.startK6Test(ctx, inputs)
+	if cmd != nil {
+		h.lh.setRunningTestProcess(test, cmd, cancelCtx)
+	}
 	if err != nil {
 		if cmd != nil {
-			h.logIfError(h.sendSlackMessage(h.payload.statusMessage(emojiFailure, "didn't start successfully")))
-			h.logIfError(h.addFileToSlackThread("k6-results.txt", h.buf.String()))
+			if errors.Is(err, errOutputTimeout) {
+				h.trackTestResult(testResultTimeout, cmd)
+			} else {
+				h.trackTestResult(testResultFailure, cmd)
+			}
+			h.lh.trackExitCode(h.payload, cmd)
+			h.logIfError(h.sendMessages(h.statusMessage(emojiFailure, "didn't start successfully", cmd)))
+			h.logIfError(h.addFileToThreads(h.payload.resultsFilename(), h.buf.String()))
 			h.registerProcessCleanup(cmd)
 		}
 		h.failRequest(err)
 		return
 	}
-
 	if err := h.attachCloudURL(); err != nil {
-		h.failRequest(err)
+		// The test run is released by the cleanup, not by failRequest
 		h.registerProcessCleanup(cmd)
+		h.failRequest(err)
 		return
 	}
 
 	// Write the initial message to each channel
-	h.logIfError(h.sendSlackMessage(payload.statusMessage(emojiWarning, "has started")))
+	h.logNotificationError(h.sendMessages(h.statusMessage(emojiWarning, "has started", nil)))
+	if h.notificationErr != nil {
+		// Nobody would know about the test, don't let it run
+		h.registerProcessCleanup(cmd)
+		h.failRequest(h.notificationErr)
+		return
+	}
 
 	// Now process the result
 	if err := h.processResult(cmd); err != nil {
@@ -112,9 +300,25 @@ func (h *singleRequestHandler) Handle(requestCtx context.Context) {
 	}
 }
 
-func (h *singleRequestHandler) requestTestRun() error {
+// testTimeout returns how long k6 may run before it is killed: the
+// test_timeout of the test, capped by the maximum duration of the tests whose
+// results aren't waited for, as nothing else would stop them. 0 if there is no
+// limit.
+func (h *singleRequestHandler) testTimeout() time.Duration {
+	timeout := h.payload.Metadata.TestTimeout
+	maxDuration := h.lh.maxAsyncTestDuration
+	if h.payload.Metadata.WaitForResults || maxDuration <= 0 {
+		return timeout
+	}
+	if timeout <= 0 || timeout > maxDuration {
+		return maxDuration
+	}
+	return timeout
+}
+
+func (h *singleRequestHandler) requestTestRun(ctx context.Context) error {
 	h.log.Info("Requesting test run")
-	if err := h.lh.requestTestRun(); err != nil {
+	if err := h.lh.requestTestRun(ctx); err != nil {
 		return err
 	}
 	h.testRunRequested = true
@@ -136,10 +340,15 @@ func (h *singleRequestHandler) releaseTestRun() {
 
 func (h *singleRequestHandler) registerProcessCleanup(cmd k6.TestRun) {
 	h.asyncCleanup = true
-	h.lh.registerProcessCleanup(cmd)
+	h.lh.registerProcessCleanup(cmd, h.payload.Phase)
 }
 
-func (h *singleRequestHandler) processResult(cmd k6.TestRun) error {
+func (h *singleRequestHandler) processResult(cmd k6.TestRun) (err error) {
+	_, span := h.startSpan(h.processCtx, spanProcessResult)
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	if !h.payload.Metadata.WaitForResults {
 		h.log.Infof("the load test for %s.%s was launched successfully!", h.payload.Name, h.payload.Namespace)
 		// We also need to register the cancelCtx func for asynchronous
@@ -147,6 +356,11 @@ func (h *singleRequestHandler) processResult(cmd k6.TestRun) error {
 		// away.
 		cmd.SetCancelFunc(h.cancelProcessContext)
 		h.registerProcessCleanup(cmd)
+		h.recordRun(historyResultLaunched, cmd)
+		if prefix := h.cloudURLPrefix(); prefix != "" {
+			_, err := h.resp.Write([]byte(prefix))
+			h.logIfError(err)
+		}
 		return nil
 	}
 
@@ -154,26 +368,114 @@ func (h *singleRequestHandler) processResult(cmd k6.TestRun) error {
 		h.releaseTestRun()
 	}()
 
+	if h.payload.Metadata.AbortOnErrorRate > 0 {
+		h.errorRateAbort = make(chan string, 1)
+		monitorCtx, stopMonitor := context.WithCancel(h.processCtx)
+		defer stopMonitor()
+		go h.monitorErrorRate(monitorCtx, cmd)
+	}
+
 	h.log.Info("waiting for the results")
-	err := cmd.Wait()
-	h.lh.trackExecutionDuration(cmd)
-	h.logIfError(h.addFileToSlackThread("k6-results.txt", h.buf.String()))
+	if cmd, err = h.waitForScripts(cmd); errors.Is(err, errHandlerTimeout) {
+		h.trackTestResult(testResultTimeout, cmd)
+		h.logNotificationError(h.updateFailureMessages(h.statusMessage(emojiFailure, fmt.Sprintf("has timed out: no results after %s", h.lh.handlerTimeout), nil)))
+		return err
+	}
+	h.lh.removeRunningTest(h.runningTest)
+	h.lh.trackExecutionDuration(h.payload.Phase, cmd)
+	h.lh.trackExitCode(h.payload, cmd)
+	span.SetAttributes(attribute.Int(attributeExitCode, cmd.ExitCode()))
+	h.test.Metrics = parseSummaryMetrics(h.buf.String())
+	h.setResultHeaders(cmd)
+	h.logNotificationError(h.addArtifactsToThreads())
+
+	// Load testing was killed because its error rate was too high
+	select {
+	case reason := <-h.errorRateAbort:
+		h.trackTestResult(testResultFailure, cmd)
+		h.logNotificationError(h.updateFailureMessages(h.statusMessage(emojiFailure, "has been aborted: "+reason, cmd)))
+		return &testFailure{fmt.Errorf("test aborted: %s", reason)}
+	default:
+	}
+
+	// Load testing was killed because it ran for too long
+	if err != nil && errors.Is(h.processCtx.Err(), context.DeadlineExceeded) {
+		h.trackTestResult(testResultTimeout, cmd)
+		h.logNotificationError(h.updateFailureMessages(h.statusMessage(emojiFailure, fmt.Sprintf("has timed out after %s", h.payload.Metadata.TestTimeout), cmd)))
+		return &testFailure{fmt.Errorf("test timed out after %s: %w", h.payload.Metadata.TestTimeout, err)}
+	}
 
 	// Load testing failed, log the output
 	if err != nil {
-		h.logIfError(h.updateSlackMessage(h.payload.statusMessage(emojiFailure, "has failed")))
-		return fmt.Errorf("failed to run: %w", err)
+		h.trackTestResult(testResultFailure, cmd)
+		// Nothing in the output tells why k6 was killed if we didn't kill it
+		if cmd.ExitCode() == k6.ExitCodeKilled && h.processCtx.Err() == nil {
+			h.logNotificationError(h.updateFailureMessages(h.statusMessage(emojiFailure, "has failed: k6 was killed (possibly OOM)", cmd)))
+			return &testFailure{fmt.Errorf("k6 was killed (possibly OOM): %w", err)}
+		}
+		status := "has failed"
+		if thresholds := parseFailedThresholds(h.buf.String()); len(thresholds) > 0 {
+			status += ". Failed thresholds: " + strings.Join(thresholds, ", ")
+		}
+		h.logNotificationError(h.updateFailureMessages(h.statusMessage(emojiFailure, status, cmd)))
+		return &testFailure{fmt.Errorf("failed to run: %w", err)}
 	}
 
 	// Success!
-	h.logIfError(h.updateSlackMessage(h.payload.statusMessage(emojiSuccess, "has succeeded")))
-	_, err = h.resp.Write(h.buf.Bytes())
-	h.logIfError(err)
+	h.trackTestResult(testResultSuccess, cmd)
+	h.logNotificationError(h.updateMessages(h.statusMessage(emojiSuccess, "has succeeded", cmd)))
+	if h.notificationErr != nil {
+		return h.notificationErr
+	}
+	if h.stream == nil {
+		_, err = h.resp.Write(append([]byte(h.cloudURLPrefix()), h.buf.Bytes()...))
+		h.logIfError(err)
+	}
 	h.log.Infof("the load test for %s.%s succeeded!", h.payload.Name, h.payload.Namespace)
 	return nil
 }
 
+// waitForResults waits for k6 to exit, up to the handler timeout. Past that
+// timeout, the process is left to be killed and cleaned up asynchronously and
+// errHandlerTimeout is returned.
+func (h *singleRequestHandler) waitForResults(cmd k6.TestRun) error {
+	if h.handlerTimeout == nil {
+		return cmd.Wait()
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- cmd.Wait()
+	}()
+	select {
+	case err := <-waitErr:
+		return err
+	case <-h.handlerTimeout:
+		h.log.Warnf("no results after %s, killing the test", h.lh.handlerTimeout)
+		cmd.SetCancelFunc(h.cancelProcessContext)
+		h.registerProcessCleanup(cmd)
+		return fmt.Errorf("%w after %s", errHandlerTimeout, h.lh.handlerTimeout)
+	}
+}
+
+// setResultHeaders sets the headers summarizing the result of the test, so
+// that clients don't have to parse the output. Streamed responses have
+// already been sent their headers.
+func (h *singleRequestHandler) setResultHeaders(cmd k6.TestRun) {
+	if h.stream != nil {
+		return
+	}
+	header := h.resp.Header()
+	header.Set(headerExitCode, strconv.Itoa(cmd.ExitCode()))
+	if counts := parseCheckCounts(h.buf.String()); counts != nil {
+		header.Set(headerChecksPassed, strconv.Itoa(counts.passed))
+		header.Set(headerChecksFailed, strconv.Itoa(counts.failed))
+	}
+}
+
 func (h *singleRequestHandler) checkAgainstLastFailureTime() error {
+	if h.payload.Metadata.MinFailureDelay == 0 {
+		return nil
+	}
 	lastFailureTime, present := h.lh.getLastFailureTime(h.payload)
 	if present && time.Since(lastFailureTime) < h.payload.Metadata.MinFailureDelay {
 		return fmt.Errorf("not enough time since last failure")
@@ -183,12 +485,28 @@ func (h *singleRequestHandler) checkAgainstLastFailureTime() error {
 
 func (h *singleRequestHandler) failRequest(err error) {
 	msg := err.Error()
-	h.lh.setLastFailureTime(h.payload)
+	if h.payload.Metadata.MinFailureDelay > 0 {
+		h.lh.setLastFailureTime(h.payload)
+	}
 	h.log.Error(msg)
-	if h.buf != nil && h.buf.Len() > 0 {
-		msg += "\n" + h.buf.String()
+	if h.stream != nil && h.stream.Started() {
+		_, _ = h.stream.Write([]byte("\n" + msg + "\n"))
+		h.stream.Close()
+		h.abortResponse = true
+	} else {
+		var output string
+		if h.buf != nil {
+			output = h.buf.String()
+		}
+		status := http.StatusBadRequest
+		var failure *testFailure
+		if errors.Is(err, errHandlerTimeout) {
+			status = http.StatusGatewayTimeout
+		} else if errors.As(err, &failure) {
+			status = h.lh.testFailureStatus
+		}
+		writeError(h.resp, h.req, h.cloudURLPrefix()+msg, output, status)
 	}
-	http.Error(h.resp, msg, 400)
 	// If the request has been marked for async cleanup, releasing happens there
 	if !h.asyncCleanup {
 		h.releaseTestRun()
@@ -198,82 +516,596 @@ func (h *singleRequestHandler) failRequest(err error) {
 	}
 }
 
-func (h *singleRequestHandler) startK6Test(ctx context.Context) (k6.TestRun, error) {
+// k6Inputs are the environment variables and the output writers k6 is run
+// with. They are shared by the scripts of a suite, so that the secrets are
+// only resolved once and the output is bounded as a whole.
+type k6Inputs struct {
+	envVars map[string]string
+	// The combined stdout and stderr, written to concurrently
+	output io.Writer
+	// The stdout, also written to the combined output
+	stdout io.Writer
+	// Bounds the stdout alone, nil if the output isn't bounded
+	stdoutLimit *boundedWriter
+}
+
+// prepareK6Test resolves the environment variables and sets up the writers of
+// the output of the test.
+func (h *singleRequestHandler) prepareK6Test(ctx context.Context) (*k6Inputs, error) {
 	h.log.Info("fetching secrets (if any)")
+	_, span := h.startSpan(ctx, spanResolveSecrets)
 	envVars, err := h.buildEnvVars(h.payload)
+	if err == nil {
+		envVars, err = h.writeSecretFiles(ctx, envVars)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.payload.Metadata.CloudProjectID != "" {
+		if h.payload.Metadata.UploadToCloud {
+			envVars = withEnvVar(envVars, "K6_CLOUD_PROJECT_ID", h.payload.Metadata.CloudProjectID)
+		} else {
+			h.log.Warn("ignoring 'cloud_project_id' as the results are not uploaded to the cloud")
+		}
+	}
+
+	inputs := &k6Inputs{envVars: envVars}
+	var output, stdout io.Writer = h.buf, h.stdout
+	if h.lh.maxOutputBytes > 0 {
+		output = newBoundedWriter(h.buf, h.lh.maxOutputBytes)
+		inputs.stdoutLimit = newBoundedWriter(h.stdout, h.lh.maxOutputBytes)
+		stdout = inputs.stdoutLimit
+	}
+	if h.stream != nil {
+		output = io.MultiWriter(output, h.stream)
+	}
+	// Both streams are written to concurrently
+	inputs.output = &syncWriter{w: output}
+	inputs.stdout = io.MultiWriter(inputs.output, stdout)
+	return inputs, nil
+}
+
+// startK6Test starts k6 with the current script and waits for it to announce
+// its output.
+func (h *singleRequestHandler) startK6Test(ctx context.Context, inputs *k6Inputs) (k6.TestRun, error) {
+	scriptContent, err := h.resolveScript(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	h.log.Info("launching k6 test")
-	cmd, err := h.lh.client.Start(ctx, h.payload.Metadata.Script, h.payload.Metadata.UploadToCloud, envVars, h.buf)
+	extraArgs := h.payload.Metadata.ExtraArgs
+	if h.payload.Metadata.CloudInsecureSkipTLSVerify {
+		if h.payload.Metadata.UploadToCloud {
+			extraArgs = append(slices.Clone(extraArgs), "--insecure-skip-tls-verify")
+		} else {
+			h.log.Warn("ignoring 'cloud_insecure_skip_tls_verify' as the results are not uploaded to the cloud")
+		}
+	}
+	logOutput := h.payload.Metadata.LogOutput
+	if logOutput == "" {
+		logOutput = h.lh.logOutput
+	}
+	if logOutput != "" {
+		rendered, err := renderLogOutput(logOutput, h.payload.logOutputData())
+		if err != nil {
+			return nil, fmt.Errorf("error rendering the log output: %w", err)
+		}
+		extraArgs = append(slices.Clone(extraArgs), "--log-output", rendered)
+	}
+	if h.payload.Metadata.SummaryExport {
+		if h.summaryPath, err = h.createSummaryPath(ctx); err != nil {
+			return nil, err
+		}
+		extraArgs = append(slices.Clone(extraArgs), "--summary-export", h.summaryPath)
+	}
+	if h.payload.Metadata.AbortOnErrorRate > 0 {
+		if h.apiAddress, err = freeAPIAddress(); err != nil {
+			return nil, err
+		}
+		extraArgs = append(slices.Clone(extraArgs), "--address", h.apiAddress)
+	}
+
+	script := h.payload.script(scriptContent)
+	if suiteScript := h.currentScript(); suiteScript != nil {
+		script.Options = suiteScript.Options
+	}
+	_, span := h.startSpan(ctx, spanStartK6)
+	cmd, err := h.startK6(ctx, script, inputs.envVars, extraArgs, inputs.stdout, inputs.output)
+	endSpan(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("error while launching test: %w", err)
 	}
 
 	h.log.Info("waiting for output path")
 	// Find the Cloud URL from the k6 output
-	if waitErr := h.waitForOutputPath(); waitErr != nil {
+	_, span = h.startSpan(ctx, spanWaitForOutput)
+	waitErr := h.waitForOutputPath(ctx, cmd)
+	endSpan(span, waitErr)
+	if waitErr != nil {
 		return cmd, fmt.Errorf("error while waiting for test to start: %w", waitErr)
 	}
 
 	return cmd, nil
 }
 
-func (h *singleRequestHandler) sendSlackMessage(msg string) error {
-	threads, err := h.lh.slackClient.SendMessages(h.payload.Metadata.SlackChannels, msg, h.slackContext)
+// startK6 starts k6, retrying transient errors (ex: if it can't fork) with an
+// exponential backoff. Nothing has been written to the outputs when it fails.
+func (h *singleRequestHandler) startK6(ctx context.Context, script k6.Script, envVars map[string]string, extraArgs []string, stdout, stderr io.Writer) (k6.TestRun, error) {
+	backoff := initialStartRetryBackoff
+	for attempt := 0; ; attempt++ {
+		cmd, err := h.lh.client.Start(ctx, script, h.payload.Metadata.UploadToCloud, envVars, extraArgs, stdout, stderr)
+		if err == nil || attempt >= h.lh.startMaxRetries || !k6.IsTransientError(err) || ctx.Err() != nil {
+			return cmd, err
+		}
+		h.log.Warnf("transient error while launching test, retrying in %s: %v", backoff, err)
+		if err := h.lh.sleepContext(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// dryRun resolves the script and the environment variables and has k6 validate
+// the script without running it. No notifications are sent and failures don't
+// count towards min_failure_delay.
+func (h *singleRequestHandler) dryRun(ctx context.Context) {
+	defer h.releaseTestRun()
+
+	h.log.Info("fetching secrets (if any)")
+	envVars, err := h.buildEnvVars(h.payload)
+	if err == nil {
+		envVars, err = h.writeSecretFiles(ctx, envVars)
+	}
 	if err != nil {
-		return err
+		h.log.Error(err)
+		writeError(h.resp, h.req, err.Error(), "", http.StatusBadRequest)
+		return
 	}
-	h.slackThreads = threads
-	return nil
+	scriptContent, err := h.resolveScript(ctx)
+	if err != nil {
+		h.log.Error(err)
+		writeError(h.resp, h.req, err.Error(), "", http.StatusBadRequest)
+		return
+	}
+
+	h.log.Info("validating k6 script")
+	if err := h.lh.client.Validate(ctx, h.payload.script(scriptContent), h.payload.Metadata.UploadToCloud, envVars, h.buf); err != nil {
+		msg := fmt.Sprintf("error while validating script: %v", err)
+		h.log.Error(msg)
+		writeError(h.resp, h.req, msg, h.buf.String(), http.StatusBadRequest)
+		return
+	}
+
+	h.log.Infof("the script for %s.%s is valid", h.payload.Name, h.payload.Namespace)
+	_, err = h.resp.Write(h.buf.Bytes())
+	h.logIfError(err)
 }
 
-func (h *singleRequestHandler) addFileToSlackThread(name string, content string) error {
-	return h.lh.slackClient.AddFileToThreads(h.slackThreads, name, content)
+// statusMessage renders the message for the given status along with the
+// notification context. cmd is the test run, if there is one.
+func (h *singleRequestHandler) statusMessage(emoji, status string, cmd k6.TestRun) (string, string) {
+	data := messageData{
+		Name:      h.payload.Name,
+		Namespace: h.payload.Namespace,
+		Phase:     h.payload.Phase,
+		CloudURL:  h.test.CloudURL,
+		Emoji:     emoji,
+		Status:    status,
+	}
+	if summary := h.suiteSummary(); summary != "" {
+		data.Status += ". " + summary
+	}
+	if cmd != nil {
+		data.Duration = cmd.ExecutionDuration()
+	}
+	msg, err := h.lh.messageTemplates.render(data)
+	if err != nil {
+		h.log.Errorf("error rendering the message template, using the default one: %v", err)
+		msg, _ = defaultMessageTemplates().render(data)
+	}
+	return msg, h.renderNotificationContext(data)
 }
 
-func (h *singleRequestHandler) updateSlackMessage(msg string) error {
-	return h.lh.slackClient.UpdateMessages(h.slackThreads, msg, h.slackContext)
+// renderNotificationContext renders the `notification_context` template, to
+// which the cloud URL is added once it is known.
+func (h *singleRequestHandler) renderNotificationContext(data messageData) string {
+	notificationContext, err := renderNotificationContext(h.notificationContext, data)
+	if err != nil {
+		h.log.Warnf("error rendering the notification context, using it as is: %v", err)
+		notificationContext = h.notificationContext
+	}
+	if data.CloudURL != "" {
+		notificationContext += fmt.Sprintf("\nCloud URL: <%s>", data.CloudURL)
+	}
+	return notificationContext
 }
 
-func (h *singleRequestHandler) buildEnvVars(payload *launchPayload) (map[string]string, error) {
-	envVars := payload.Metadata.EnvVars
+func (h *singleRequestHandler) sendMessages(msg, notificationContext string) error {
+	var errs []error
+	for _, n := range h.notifications {
+		threads, err := n.notifier.SendMessages(n.channels, msg, notificationContext)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n.threads = threads
+	}
+	return errors.Join(errs...)
+}
 
-	if len(payload.Metadata.KubernetesSecrets) == 0 {
+func (h *singleRequestHandler) addFileToThreads(name string, content string) error {
+	var errs []error
+	for _, n := range h.notifications {
+		errs = append(errs, n.notifier.AddFileToThreads(n.threads, name, content))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *singleRequestHandler) updateMessages(msg, notificationContext string) error {
+	var errs []error
+	for _, n := range h.notifications {
+		errs = append(errs, n.notifier.UpdateMessages(n.threads, msg, notificationContext))
+	}
+	return errors.Join(errs...)
+}
+
+// updateFailureMessages updates the messages like updateMessages, mentioning
+// the users to notify of failures of each notifier, if any.
+func (h *singleRequestHandler) updateFailureMessages(msg, notificationContext string) error {
+	var errs []error
+	for _, n := range h.notifications {
+		failureMsg := msg
+		if n.failureMentions != "" {
+			failureMsg = n.failureMentions + " " + msg
+		}
+		errs = append(errs, n.notifier.UpdateMessages(n.threads, failureMsg, notificationContext))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *singleRequestHandler) buildEnvVars(payload *launchPayload) (map[string]string, error) {
+	if len(payload.Metadata.KubernetesSecrets) == 0 && len(payload.Metadata.KubernetesSecretEnvs) == 0 && len(payload.Metadata.KubernetesConfigMaps) == 0 {
+		envVars := canaryEnvVars(payload)
+		maps.Copy(envVars, payload.Metadata.EnvVars)
+		if err := validateEnvVars(envVars); err != nil {
+			return nil, err
+		}
 		return envVars, nil
 	}
 
 	if h.lh.kubeClient == nil {
-		return nil, errors.New("kubernetes client is not configured")
+		err := errors.New("kubernetes client is not configured")
+		if len(payload.Metadata.KubernetesSecrets) > 0 || len(payload.Metadata.KubernetesSecretEnvs) > 0 {
+			h.secretResolutionFailed(secretErrorNoClient, err)
+		}
+		return nil, err
 	}
 
-	if envVars == nil {
-		envVars = make(map[string]string)
+	// The variables describing the canary have the lowest precedence, then
+	// whole secrets, `kubernetes_configmaps`, `env_vars` and finally the
+	// individual keys from `kubernetes_secrets`, unless `secrets_override_env`
+	// is false, in which case `env_vars` win
+	envVars := canaryEnvVars(payload)
+	for _, ref := range payload.Metadata.KubernetesSecretEnvs {
+		namespace, secretName := payload.Namespace, ref
+		if parts := strings.SplitN(ref, "/", 2); len(parts) == 2 {
+			namespace, secretName = parts[0], parts[1]
+		}
+		if err := h.checkSecretNamespace(namespace); err != nil {
+			h.secretResolutionFailed(secretErrorForbidden, err)
+			return nil, err
+		}
+		secret, err := h.lh.kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), secretName, metav1.GetOptions{})
+		if err != nil {
+			err = fmt.Errorf("error fetching secret %s/%s: %w", namespace, secretName, err)
+			h.secretFetchFailed(err)
+			return nil, err
+		}
+		for key, v := range secret.Data {
+			if !envVarNameRegex.MatchString(key) {
+				h.log.Warnf("skipping key %s of secret %s/%s as it is not a valid environment variable name", key, namespace, secretName)
+				continue
+			}
+			envVars[key] = string(v)
+		}
 	}
 
-	for env, secret := range payload.Metadata.KubernetesSecrets {
-		parts := strings.SplitN(secret, "/", 3)
-		namespace := payload.Namespace
-		if len(parts) > 2 {
-			namespace = parts[0]
-			parts = parts[1:]
+	for env, ref := range payload.Metadata.KubernetesConfigMaps {
+		v, err := h.getConfigMapValue(context.Background(), ref)
+		if err != nil {
+			return nil, err
 		}
-		secretName := parts[0]
-		secretKey := parts[1]
-		secret, err := h.lh.kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), secretName, metav1.GetOptions{})
+		envVars[env] = v
+	}
+
+	for k, v := range payload.Metadata.EnvVars {
+		envVars[k] = v
+	}
+
+	for env, ref := range payload.Metadata.KubernetesSecrets {
+		if _, ok := payload.Metadata.EnvVars[env]; ok {
+			if !payload.Metadata.SecretsOverrideEnv {
+				h.log.Warnf("%s is set by both 'env_vars' and 'kubernetes_secrets', using the value of 'env_vars'", env)
+				continue
+			}
+			h.log.Warnf("%s is set by both 'env_vars' and 'kubernetes_secrets', using the value of the secret", env)
+		}
+		v, err := h.getSecretValue(env, ref)
 		if err != nil {
-			return nil, fmt.Errorf("error fetching secret %s/%s: %w", namespace, secretName, err)
+			return nil, err
 		}
-		if v, ok := secret.Data[secretKey]; ok {
-			envVars[env] = string(v)
-		} else {
-			return nil, fmt.Errorf("secret %s/%s does not have key %s", namespace, secretName, secretKey)
+		envVars[env] = string(v)
+	}
+
+	// Values from secrets and configmaps are only known now
+	if err := validateEnvVars(envVars); err != nil {
+		return nil, err
+	}
+	return envVars, nil
+}
+
+// validateEnvVars checks all the variables passed to k6, including the ones
+// describing the canary which aren't validated with the payload.
+func validateEnvVars(envVars map[string]string) error {
+	for k, v := range envVars {
+		if err := validateEnvVar(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canaryEnvVars returns the variables set for every test, so that scripts
+// know which canary they test.
+func canaryEnvVars(payload *launchPayload) map[string]string {
+	return map[string]string{
+		"K6_CANARY_NAME":      payload.Name,
+		"K6_CANARY_NAMESPACE": payload.Namespace,
+		"K6_CANARY_PHASE":     payload.Phase,
+	}
+}
+
+// getSecretValue returns the value of the secret key referenced by ref. name is
+// the name of the variable or file the value is for. The value is
+// base64-decoded if ref ends with `:base64`.
+func (h *singleRequestHandler) getSecretValue(name, ref string) ([]byte, error) {
+	// Secret keys can't contain colons, so the suffix is unambiguous
+	ref, decode := strings.CutSuffix(ref, secretBase64Suffix)
+	namespace, secretName, secretKey, err := parseKubernetesReference(ref, h.payload.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing secret reference for %s: %w", name, err)
+	}
+	if err := h.checkSecretNamespace(namespace); err != nil {
+		h.secretResolutionFailed(secretErrorForbidden, err)
+		return nil, err
+	}
+	secret, err := h.lh.kubeClient.CoreV1().Secrets(namespace).Get(context.Background(), secretName, metav1.GetOptions{})
+	if err != nil {
+		err = fmt.Errorf("error fetching secret %s/%s: %w", namespace, secretName, err)
+		h.secretFetchFailed(err)
+		return nil, err
+	}
+	v, ok := secret.Data[secretKey]
+	if !ok {
+		err := fmt.Errorf("secret %s/%s does not have key %s", namespace, secretName, secretKey)
+		h.secretResolutionFailed(secretErrorMissingKey, err)
+		return nil, err
+	}
+	if decode {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(v)))
+		if err != nil {
+			return nil, fmt.Errorf("error base64-decoding key %s of secret %s/%s for %s: %w", secretKey, namespace, secretName, name, err)
+		}
+		return decoded, nil
+	}
+	return v, nil
+}
+
+// secretFetchFailed records the failure to get a secret from the Kubernetes
+// API. Only missing secrets and denied requests are tracked by the metric.
+func (h *singleRequestHandler) secretFetchFailed(err error) {
+	switch {
+	case apierrors.IsNotFound(err):
+		h.secretResolutionFailed(secretErrorNotFound, err)
+	case apierrors.IsForbidden(err):
+		h.secretResolutionFailed(secretErrorForbidden, err)
+	default:
+		h.log.Warnf("failed to resolve a secret: %v", err)
+	}
+}
+
+// secretResolutionFailed logs the failure to read a secret and tracks it by
+// kind, to spot misconfigurations such as missing RBAC permissions.
+func (h *singleRequestHandler) secretResolutionFailed(kind string, err error) {
+	h.log.WithField("kind", kind).Warnf("failed to resolve a secret: %v", err)
+	h.lh.trackSecretResolutionError(kind)
+}
+
+// checkSecretNamespace returns an error if secrets can't be read from the given
+// namespace. Secrets can always be read from the namespace of the canary.
+func (h *singleRequestHandler) checkSecretNamespace(namespace string) error {
+	if namespace == h.payload.Namespace {
+		return nil
+	}
+	for _, allowed := range h.lh.allowedSecretNamespaces {
+		if allowed == "*" || allowed == namespace {
+			return nil
+		}
+	}
+	return fmt.Errorf("reading secrets from namespace %s is not allowed", namespace)
+}
+
+// writeSecretFiles writes the secrets from `kubernetes_secret_files` to files
+// readable only by the current user and adds their paths to the environment
+// variables. The files are removed once the given context is done.
+func (h *singleRequestHandler) writeSecretFiles(ctx context.Context, envVars map[string]string) (map[string]string, error) {
+	if len(h.payload.Metadata.KubernetesSecretFiles) == 0 {
+		return envVars, nil
+	}
+	if h.lh.kubeClient == nil {
+		err := errors.New("kubernetes client is not configured")
+		h.secretResolutionFailed(secretErrorNoClient, err)
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "k6-secrets")
+	if err != nil {
+		return nil, fmt.Errorf("could not create a directory for the secret files: %w", err)
+	}
+	removeDir := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			h.log.Errorf("error removing secret files: %v", err)
 		}
 	}
+
+	for name, ref := range h.payload.Metadata.KubernetesSecretFiles {
+		v, err := h.getSecretValue(name, ref)
+		if err != nil {
+			removeDir()
+			return nil, err
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, v, 0o600); err != nil {
+			removeDir()
+			return nil, fmt.Errorf("could not write the secret file for %s: %w", name, err)
+		}
+		envVars = withEnvVar(envVars, secretFileEnvVar(name), path)
+	}
+
+	context.AfterFunc(ctx, removeDir)
 	return envVars, nil
 }
 
+// createSummaryPath returns a path for k6 to export the summary to. The
+// summary is removed once the given context is done.
+func (h *singleRequestHandler) createSummaryPath(ctx context.Context) (string, error) {
+	dir, err := os.MkdirTemp("", "k6-summary")
+	if err != nil {
+		return "", fmt.Errorf("could not create a directory for the summary: %w", err)
+	}
+	context.AfterFunc(ctx, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			h.log.Errorf("error removing the summary: %v", err)
+		}
+	})
+	return filepath.Join(dir, "summary.json"), nil
+}
+
+// readSummary returns the summary exported by k6, if any. k6 doesn't export it
+// if the test crashed, which isn't considered an error here.
+func (h *singleRequestHandler) readSummary() (string, bool, error) {
+	if h.summaryPath == "" {
+		return "", false, nil
+	}
+	summary, err := os.ReadFile(h.summaryPath)
+	if errors.Is(err, os.ErrNotExist) {
+		h.log.Warn("k6 didn't export a summary, not uploading it")
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("error reading the summary: %w", err)
+	}
+	return string(summary), true, nil
+}
+
+func secretFileEnvVar(name string) string {
+	return "K6_SECRET_FILE_" + strings.ToUpper(name)
+}
+
+// withEnvVar returns a copy of the given environment variables with the given
+// variable set.
+func withEnvVar(envVars map[string]string, key, value string) map[string]string {
+	result := make(map[string]string, len(envVars)+1)
+	for k, v := range envVars {
+		result[k] = v
+	}
+	result[key] = value
+	return result
+}
+
+func (h *singleRequestHandler) resolveScript(ctx context.Context) (string, error) {
+	if suiteScript := h.currentScript(); suiteScript != nil {
+		return suiteScript.Script, nil
+	}
+
+	if h.payload.Metadata.Script != "" {
+		return h.payload.Metadata.Script, nil
+	}
+
+	if h.payload.Metadata.ScriptURL != "" {
+		return h.fetchScript(ctx, h.payload.Metadata.ScriptURL)
+	}
+
+	if h.lh.kubeClient == nil {
+		return "", errors.New("kubernetes client is not configured")
+	}
+	return h.getConfigMapValue(ctx, h.payload.Metadata.ScriptConfigMap)
+}
+
+// getConfigMapValue returns the value of the configmap key referenced by ref.
+func (h *singleRequestHandler) getConfigMapValue(ctx context.Context, ref string) (string, error) {
+	namespace, name, key, err := parseKubernetesReference(ref, h.payload.Namespace)
+	if err != nil {
+		return "", err
+	}
+	configMap, err := h.lh.kubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error fetching configmap %s/%s: %w", namespace, name, err)
+	}
+	if v, ok := configMap.Data[key]; ok {
+		return v, nil
+	}
+	if v, ok := configMap.BinaryData[key]; ok {
+		return string(v), nil
+	}
+	return "", fmt.Errorf("configmap %s/%s does not have key %s", namespace, name, key)
+}
+
+func (h *singleRequestHandler) fetchScript(ctx context.Context, scriptURL string) (string, error) {
+	h.log.Infof("fetching script from %s", scriptURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scriptURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error fetching script from %s: %w", scriptURL, err)
+	}
+	resp, err := h.lh.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching script from %s: %w", scriptURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("error fetching script from %s: unexpected status %s", scriptURL, resp.Status)
+	}
+
+	// Read one byte more than allowed so that we can detect oversized scripts
+	body, err := io.ReadAll(io.LimitReader(resp.Body, h.lh.maxScriptSize+1))
+	if err != nil {
+		return "", fmt.Errorf("error reading script from %s: %w", scriptURL, err)
+	}
+	if int64(len(body)) > h.lh.maxScriptSize {
+		return "", fmt.Errorf("script at %s exceeds the maximum size of %d bytes", scriptURL, h.lh.maxScriptSize)
+	}
+	return string(body), nil
+}
+
+// parseKubernetesReference splits a reference of the form
+// `[<namespace>/]<name>/<key>` into its parts. If no namespace is given, the
+// default namespace is used.
+func parseKubernetesReference(ref, defaultNamespace string) (string, string, string, error) {
+	parts := strings.SplitN(ref, "/", 3)
+	namespace := defaultNamespace
+	if len(parts) > 2 {
+		namespace = parts[0]
+		parts = parts[1:]
+	}
+	if len(parts) != 2 || namespace == "" || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("invalid reference %q, expected [<namespace>/]<name>/<key>", ref)
+	}
+	return namespace, parts[0], parts[1], nil
+}
+
 func (h *singleRequestHandler) propagateCancel(requestCtx context.Context, payload *launchPayload, cancelCtx context.CancelFunc) {
 	if payload.Metadata.WaitForResults {
 		select {
@@ -290,36 +1122,82 @@ func (h *singleRequestHandler) propagateCancel(requestCtx context.Context, paylo
 	}
 }
 
-func (h *singleRequestHandler) waitForOutputPath() error {
-	for i := 0; i < 10; i++ {
-		if strings.Contains(h.buf.String(), "output:") {
+// waitForOutputPath waits for k6 to announce its output, which it does once
+// the test has started. It returns early if k6 exits before that, ex: if the
+// script is broken, or if the context of the process is done, ex: if the
+// request waiting for the results is canceled.
+func (h *singleRequestHandler) waitForOutputPath(ctx context.Context, cmd k6.TestRun) error {
+	started := func() bool { return strings.Contains(h.stdout.String(), "output:") }
+	for i := 0; i < outputPollAttempts; i++ {
+		if started() {
 			return nil
 		}
-		h.log.Debug("waiting 2 seconds for test to start")
-		h.lh.sleep(2 * time.Second)
+		if cmd.Exited() {
+			// The output may have been written right before exiting
+			if started() {
+				return nil
+			}
+			return fmt.Errorf("k6 exited with code %d", cmd.ExitCode())
+		}
+		delay := h.lh.outputPollDelay()
+		h.log.Debugf("waiting %s for test to start", delay)
+		if err := h.lh.sleepContext(ctx, delay); err != nil {
+			return fmt.Errorf("%w: %w", errOutputCanceled, err)
+		}
 	}
-	return errors.New("timeout")
+	return errOutputTimeout
 }
 
 func (h *singleRequestHandler) attachCloudURL() error {
 	if !h.payload.Metadata.UploadToCloud {
 		return nil
 	}
-	url, err := getCloudURL(h.buf.String())
+	url, err := getCloudURL(h.lh.cloudURLRegex, h.stdout.String())
 	if err != nil {
-		return err
+		if h.payload.Metadata.StrictCloudURL {
+			return err
+		}
+		// The test may be fine, ex: if the output of k6 has changed
+		h.log.Warnf("%v, going on without it", err)
+		return nil
 	}
-	h.slackContext += fmt.Sprintf("\nCloud URL: <%s>", url)
+	h.test.CloudURL = url
 	h.log.Infof("cloud run URL: %s", url)
+	// Streamed responses have already been sent their headers
+	if h.stream == nil {
+		h.resp.Header().Set(headerCloudURL, url)
+	}
 	return nil
 }
 
-func getCloudURL(output string) (string, error) {
-	matches := outputRegex.FindStringSubmatch(output)
-	if len(matches) < 2 {
+// cloudURLPrefix returns the line with the cloud URL that starts the response
+// body if requested, or an empty string. Streamed responses already contain
+// the URL in the output of k6.
+func (h *singleRequestHandler) cloudURLPrefix() string {
+	if !h.payload.Metadata.ReturnCloudURL || h.stream != nil || h.test == nil || h.test.CloudURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("Cloud URL: %s\n", h.test.CloudURL)
+}
+
+func getCloudURL(re *regexp.Regexp, output string) (string, error) {
+	matches := re.FindStringSubmatch(output)
+	if matches == nil {
 		return "", errors.New("couldn't find the cloud URL in the output")
 	}
-	return matches[1], nil
+	return matches[re.SubexpIndex(cloudURLGroup)], nil
+}
+
+// logNotificationError logs the failure to send notifications. If they are
+// required, the failure is also recorded to fail the request.
+func (h *singleRequestHandler) logNotificationError(err error) {
+	if err == nil {
+		return
+	}
+	h.log.Error(err.Error())
+	if h.payload.Metadata.RequireNotifications && h.notificationErr == nil {
+		h.notificationErr = fmt.Errorf("error sending the notifications: %w", err)
+	}
 }
 
 func (h *singleRequestHandler) logIfError(err error) {
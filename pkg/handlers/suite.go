@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+)
+
+// suiteScript is one of the scripts of a test suite, set with `scripts`. Its
+// options replace the `options` of the payload.
+type suiteScript struct {
+	Name    string `json:"name"`
+	Script  string `json:"script"`
+	Options string `json:"options"`
+}
+
+// currentScript returns the script of the suite being run, nil if `scripts`
+// isn't set.
+func (h *singleRequestHandler) currentScript() *suiteScript {
+	if len(h.payload.Metadata.Scripts) == 0 {
+		return nil
+	}
+	return &h.payload.Metadata.Scripts[h.scriptIndex]
+}
+
+// waitForScripts waits for the results of the test. For suites, the next
+// script is started once the previous one has succeeded, until one fails or
+// they have all been run. It returns the test run of the last script run.
+func (h *singleRequestHandler) waitForScripts(cmd k6.TestRun) (k6.TestRun, error) {
+	err := h.waitForResults(cmd)
+	for err == nil && h.scriptIndex+1 < len(h.payload.Metadata.Scripts) {
+		h.lh.trackExecutionDuration(h.payload.Phase, cmd)
+		h.addScriptOutcome("succeeded")
+		h.scriptIndex++
+
+		h.log.Infof("running script %s", h.currentScript().Name)
+		// The output of the previous script must not be mistaken for the one
+		// of this script
+		h.stdout.Reset()
+		if h.inputs.stdoutLimit != nil {
+			h.inputs.stdoutLimit.Reset()
+		}
+		next, startErr := h.startK6Test(h.processCtx, h.inputs)
+		if next == nil {
+			h.addScriptOutcome("didn't start")
+			return cmd, fmt.Errorf("error while starting script %s: %w", h.currentScript().Name, startErr)
+		}
+		cmd = next
+		h.lh.setRunningTestProcess(h.runningTest, cmd, h.cancelProcessContext)
+		if startErr != nil {
+			// k6 hangs or has exited, the test fails either way
+			h.cancelProcessContext()
+			_ = cmd.Wait()
+			h.addScriptOutcome("didn't start")
+			return cmd, fmt.Errorf("error while starting script %s: %w", h.currentScript().Name, startErr)
+		}
+		err = h.waitForResults(cmd)
+	}
+
+	switch {
+	case len(h.payload.Metadata.Scripts) == 0:
+	case err == nil:
+		h.addScriptOutcome("succeeded")
+	case errors.Is(err, errHandlerTimeout) || errors.Is(h.processCtx.Err(), context.DeadlineExceeded):
+		h.addScriptOutcome("timed out")
+	default:
+		h.addScriptOutcome("failed")
+	}
+	return cmd, err
+}
+
+// addScriptOutcome records the outcome of the script of the suite being run.
+func (h *singleRequestHandler) addScriptOutcome(outcome string) {
+	h.scriptOutcomes = append(h.scriptOutcomes, fmt.Sprintf("`%s` %s", h.currentScript().Name, outcome))
+}
+
+// suiteSummary returns the outcome of each script of the suite, the ones that
+// weren't run being skipped. Empty if no script of the suite has completed.
+func (h *singleRequestHandler) suiteSummary() string {
+	if len(h.scriptOutcomes) == 0 {
+		return ""
+	}
+	outcomes := slices.Clone(h.scriptOutcomes)
+	for _, script := range h.payload.Metadata.Scripts[len(outcomes):] {
+		outcomes = append(outcomes, fmt.Sprintf("`%s` skipped", script.Name))
+	}
+	return "Scripts: " + strings.Join(outcomes, ", ")
+}
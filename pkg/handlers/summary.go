@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+)
+
+var (
+	// Metrics of the end-of-test summary, ex: `iterations.....: 582 19.36/s`.
+	// Older versions of k6 prefix the metrics that have thresholds with ✓ or ✗
+	summaryMetricRegex = regexp.MustCompile(`^\s*(?:[✓✗]\s+)?(\w+)\.{2,}:\s*(.+)$`)
+
+	p95Regex = regexp.MustCompile(`p\(95\)=(\S+)`)
+
+	// Counts of the `checks` metric of k6 before v1.0, ex: `100.00% ✓ 582 ✗ 0`
+	checkCountsRegex = regexp.MustCompile(`✓\s*(\d+)\s+✗\s*(\d+)`)
+)
+
+// checkCounts are the numbers of passed and failed checks of a test.
+type checkCounts struct {
+	passed int
+	failed int
+}
+
+// parseSummaryMetrics returns the key metrics of the end-of-test summary
+// found in the k6 output. nil is returned if none are found.
+func parseSummaryMetrics(output string) *notifier.Metrics {
+	metrics := &notifier.Metrics{}
+	for _, line := range strings.Split(output, "\n") {
+		match := summaryMetricRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		name, value := match[1], match[2]
+		switch name {
+		case "vus_max":
+			metrics.VUs = strings.Fields(value)[0]
+		case "iterations":
+			metrics.Iterations = strings.Fields(value)[0]
+		case "http_req_failed":
+			metrics.HTTPReqFailedRate = strings.Fields(value)[0]
+		case "http_req_duration":
+			if p95 := p95Regex.FindStringSubmatch(value); p95 != nil {
+				metrics.HTTPReqDurationP95 = p95[1]
+			}
+		}
+	}
+	if *metrics == (notifier.Metrics{}) {
+		return nil
+	}
+	return metrics
+}
+
+// parseCheckCounts returns the numbers of passed and failed checks of the
+// end-of-test summary found in the k6 output. nil is returned if there are no
+// checks.
+func parseCheckCounts(output string) *checkCounts {
+	var counts checkCounts
+	var passedFound, failedFound bool
+	for _, line := range strings.Split(output, "\n") {
+		match := summaryMetricRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		name, value := match[1], match[2]
+		switch name {
+		case "checks":
+			if m := checkCountsRegex.FindStringSubmatch(value); m != nil {
+				counts.passed, _ = strconv.Atoi(m[1])
+				counts.failed, _ = strconv.Atoi(m[2])
+				passedFound, failedFound = true, true
+			}
+		// Since k6 v1.0, ex: `checks_succeeded...: 100.00% 582 out of 582`
+		case "checks_succeeded":
+			counts.passed, passedFound = parseCheckCount(value)
+		case "checks_failed":
+			counts.failed, failedFound = parseCheckCount(value)
+		}
+	}
+	if !passedFound || !failedFound {
+		return nil
+	}
+	return &counts
+}
+
+func parseCheckCount(value string) (int, bool) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	count, err := strconv.Atoi(fields[1])
+	return count, err == nil
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSummaryMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		expected *notifier.Metrics
+	}{
+		{
+			name:     "success",
+			file:     "testdata/k6-output.txt",
+			expected: &notifier.Metrics{VUs: "2", Iterations: "582", HTTPReqDurationP95: "524.76µs", HTTPReqFailedRate: "0.00%"},
+		},
+		{
+			name:     "failed thresholds",
+			file:     "testdata/k6-output-failed-thresholds.txt",
+			expected: &notifier.Metrics{VUs: "2", Iterations: "582", HTTPReqDurationP95: "524.76µs", HTTPReqFailedRate: "12.37%"},
+		},
+		{
+			name:     "failed thresholds (k6 v0.54+)",
+			file:     "testdata/k6-output-failed-thresholds-v1.txt",
+			expected: &notifier.Metrics{VUs: "2", Iterations: "582", HTTPReqDurationP95: "524.76µs", HTTPReqFailedRate: "12.37%"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := os.ReadFile(tc.file)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, parseSummaryMetrics(string(output)))
+		})
+	}
+
+	t.Run("no summary", func(t *testing.T) {
+		assert.Nil(t, parseSummaryMetrics("some error\nrunning (0m00.7s), 2/2 VUs, 9 complete and 0 interrupted iterations\n"))
+	})
+}
+
+func TestParseCheckCounts(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		output   string
+		expected *checkCounts
+	}{
+		{
+			name:     "k6 v1.0+",
+			output:   "    checks_total.......................: 200    19.36/s\n    checks_succeeded...................: 98.50% 197 out of 200\n    checks_failed......................: 1.50%  3 out of 200\n",
+			expected: &checkCounts{passed: 197, failed: 3},
+		},
+		{
+			name:     "before k6 v1.0",
+			output:   "     ✓ checks.........................: 98.50% ✓ 197       ✗ 3\n     data_received..................: 0 B    0 B/s\n",
+			expected: &checkCounts{passed: 197, failed: 3},
+		},
+		{
+			name:   "no checks",
+			output: "     iterations.....................: 582    19.360202/s\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseCheckCounts(tc.output))
+		})
+	}
+
+	t.Run("sample output", func(t *testing.T) {
+		output, err := os.ReadFile("testdata/k6-output-cloud-run.txt")
+		require.NoError(t, err)
+		assert.Equal(t, &checkCounts{passed: 582, failed: 0}, parseCheckCounts(string(output)))
+	})
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// k6 < v0.54 marks the metrics of the end-of-test summary that have
+	// thresholds with ✓ or ✗, ex: `✗ http_req_duration..............: avg=...`
+	legacyFailedThresholdRegex = regexp.MustCompile(`^\s*✗ (\S+?)\.{2,}:`)
+
+	// Newer versions list the thresholds in their own section, under the name
+	// of their metric, ex: `✗ 'p(95)<200' p(95)=524.76ms`
+	failedThresholdRegex = regexp.MustCompile(`^\s*✗ '(.+?)'`)
+)
+
+// parseFailedThresholds returns the thresholds that failed according to the
+// k6 output. The output format isn't stable, so nothing is returned if it
+// isn't recognized.
+func parseFailedThresholds(output string) []string {
+	var failed []string
+	inThresholds := false
+	metric := ""
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "█ ") {
+			inThresholds = strings.HasPrefix(trimmed, "█ THRESHOLDS")
+			continue
+		}
+
+		if !inThresholds {
+			if match := legacyFailedThresholdRegex.FindStringSubmatch(line); match != nil {
+				failed = append(failed, match[1])
+			}
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "✓"):
+		case strings.HasPrefix(trimmed, "✗"):
+			if match := failedThresholdRegex.FindStringSubmatch(line); match != nil && metric != "" {
+				failed = append(failed, metric+" "+match[1])
+			}
+		default:
+			metric = trimmed
+		}
+	}
+	return failed
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFailedThresholds(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		expected []string
+	}{
+		{
+			name:     "no failures",
+			file:     "testdata/k6-output.txt",
+			expected: nil,
+		},
+		{
+			name:     "no failures (legacy URL)",
+			file:     "testdata/k6-output-legacy.txt",
+			expected: nil,
+		},
+		{
+			name:     "failures",
+			file:     "testdata/k6-output-failed-thresholds.txt",
+			expected: []string{"http_req_duration", "http_req_failed"},
+		},
+		{
+			name:     "failures with the thresholds section (k6 v0.54+)",
+			file:     "testdata/k6-output-failed-thresholds-v1.txt",
+			expected: []string{"http_req_duration p(95)<200", "http_req_failed rate<0.01"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			output, err := os.ReadFile(tc.file)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, parseFailedThresholds(string(output)))
+		})
+	}
+
+	t.Run("unknown format", func(t *testing.T) {
+		assert.Nil(t, parseFailedThresholds("some error\n✗ not a threshold\n"))
+	})
+}
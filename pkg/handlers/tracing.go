@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/grafana/flagger-k6-webhook/pkg/handlers"
+
+	spanLaunchTest     = "launch-test"
+	spanResolveSecrets = "resolve-secrets"
+	spanStartK6        = "start-k6"
+	spanWaitForOutput  = "wait-for-output"
+	spanProcessResult  = "process-result"
+
+	attributeNamespace = "flagger.namespace"
+	attributeName      = "flagger.name"
+	attributePhase     = "flagger.phase"
+	attributeExitCode  = "k6.exit_code"
+)
+
+func (p *launchPayload) spanAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String(attributeNamespace, p.Namespace),
+		attribute.String(attributeName, p.Name),
+		attribute.String(attributePhase, p.Phase),
+	}
+}
+
+// startSpan starts a child span of the span in the given context, tagged with
+// the test's attributes.
+func (h *singleRequestHandler) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return h.lh.tracer.Start(ctx, name, trace.WithAttributes(h.payload.spanAttributes()...))
+}
+
+// endSpan records the error (if any) on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
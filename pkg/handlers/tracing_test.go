@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	// Initialize controller
+	_, cancel, _, k6Client, slackClient, testRun, handler := setupHandler(t, 100)
+	t.Cleanup(handler.Wait)
+	t.Cleanup(cancel)
+
+	recorder := tracetest.NewSpanRecorder()
+	WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))(handler)
+
+	// Expected calls
+	fullResults, resultParts := getTestOutput(t)
+	var bufferWriter io.Writer
+	k6Client.EXPECT().Start(gomock.Any(), testScript("my-script"), false, testEnvVars(nil), nil, gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, outputWriter, errWriter io.Writer) (k6.TestRun, error) {
+		bufferWriter = outputWriter
+		outputWriter.Write([]byte(resultParts[0]))
+		return testRun, nil
+	})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		bufferWriter.Write([]byte("running" + resultParts[1]))
+		return nil
+	})
+	slackClient.EXPECT().SendMessages(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil)
+	slackClient.EXPECT().AddFileToThreads(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+	slackClient.EXPECT().UpdateMessages(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+
+	// Make request
+	request := &http.Request{
+		Body: ioutil.NopCloser(strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`)),
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, request)
+	assert.Equal(t, fullResults, rr.Body.Bytes())
+	assert.Equal(t, 200, rr.Result().StatusCode)
+
+	// Child spans end before their parent
+	spans := recorder.Ended()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	require.Equal(t, []string{"resolve-secrets", "start-k6", "wait-for-output", "process-result", "launch-test"}, names)
+
+	root := spans[4]
+	expectedAttributes := []attribute.KeyValue{
+		attribute.String("flagger.namespace", "test-space"),
+		attribute.String("flagger.name", "test-name"),
+		attribute.String("flagger.phase", "pre-rollout"),
+	}
+	for _, span := range spans {
+		for _, attr := range expectedAttributes {
+			assert.Contains(t, span.Attributes(), attr, "span %s", span.Name())
+		}
+		if span != root {
+			assert.Equal(t, root.SpanContext().SpanID(), span.Parent().SpanID(), "span %s", span.Name())
+		}
+	}
+	assert.Contains(t, spans[3].Attributes(), attribute.Int("k6.exit_code", 0))
+}
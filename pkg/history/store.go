@@ -0,0 +1,103 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	// Pure Go driver, so that the binary can be built without cgo
+	_ "modernc.org/sqlite"
+)
+
+const schema = `CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	namespace TEXT NOT NULL,
+	name TEXT NOT NULL,
+	phase TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	exit_code INTEGER NOT NULL,
+	result TEXT NOT NULL,
+	cloud_url TEXT NOT NULL
+)`
+
+// Run is a load test run, as recorded in the history.
+type Run struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Phase     string    `json:"phase"`
+	StartedAt time.Time `json:"started_at"`
+	// 0 if the test didn't start or its results weren't waited for
+	DurationSeconds float64 `json:"duration_seconds"`
+	// -1 if k6 was still running when the run was recorded
+	ExitCode int    `json:"exit_code"`
+	Result   string `json:"result"`
+	CloudURL string `json:"cloud_url,omitempty"`
+}
+
+// Store records the runs in a SQLite database.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens the SQLite database at the given path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the history database: %w", err)
+	}
+	// SQLite doesn't support concurrent writes, serialize them instead of
+	// failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create the history table: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Add records a run.
+func (s *Store) Add(ctx context.Context, run Run) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO runs (namespace, name, phase, started_at, duration_ms, exit_code, result, cloud_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.Namespace, run.Name, run.Phase, run.StartedAt.UnixNano(), int64(run.DurationSeconds*1000), run.ExitCode, run.Result, run.CloudURL,
+	)
+	if err != nil {
+		return fmt.Errorf("could not record the run: %w", err)
+	}
+	return nil
+}
+
+// Recent returns the last runs recorded, up to limit, most recent first.
+func (s *Store) Recent(ctx context.Context, limit int) ([]Run, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT namespace, name, phase, started_at, duration_ms, exit_code, result, cloud_url FROM runs ORDER BY id DESC LIMIT ?`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []Run{}
+	for rows.Next() {
+		var run Run
+		var startedAt, durationMs int64
+		if err := rows.Scan(&run.Namespace, &run.Name, &run.Phase, &startedAt, &durationMs, &run.ExitCode, &run.Result, &run.CloudURL); err != nil {
+			return nil, fmt.Errorf("could not read the runs: %w", err)
+		}
+		run.StartedAt = time.Unix(0, startedAt).UTC()
+		run.DurationSeconds = float64(durationMs) / 1000
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the runs: %w", err)
+	}
+	return runs, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
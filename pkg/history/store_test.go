@@ -0,0 +1,49 @@
+package history
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := Open(path)
+	require.NoError(t, err)
+
+	// Nothing recorded yet
+	runs, err := store.Recent(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+
+	startedAt := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	first := Run{Namespace: "test-space", Name: "test-name", Phase: "pre-rollout", StartedAt: startedAt, DurationSeconds: 61.5, ExitCode: 0, Result: "success", CloudURL: "https://app.k6.io/runs/1"}
+	second := Run{Namespace: "test-space", Name: "test-name", Phase: "rollout", StartedAt: startedAt.Add(time.Minute), ExitCode: 99, DurationSeconds: 12, Result: "failure"}
+	third := Run{Namespace: "other-space", Name: "other-name", Phase: "pre-rollout", StartedAt: startedAt.Add(2 * time.Minute), ExitCode: -1, Result: "launched"}
+	for _, run := range []Run{first, second, third} {
+		require.NoError(t, store.Add(context.Background(), run))
+	}
+
+	// Most recent first, up to the limit
+	runs, err = store.Recent(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []Run{third, second}, runs)
+
+	// The runs are persisted
+	require.NoError(t, store.Close())
+	store, err = Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	runs, err = store.Recent(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []Run{third, second, first}, runs)
+}
+
+func TestOpenInvalidPath(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "missing", "history.db"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package jsonwebhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+)
+
+const (
+	EventHeader = "X-Flagger-K6-Event"
+
+	EventStart  = "start"
+	EventUpdate = "update"
+	EventResult = "result"
+
+	// key of the single entry in the thread maps returned by this notifier
+	webhookThread = "webhook"
+)
+
+var statusNames = map[notifier.Status]string{
+	notifier.StatusUnknown: "unknown",
+	notifier.StatusWarning: "running",
+	notifier.StatusSuccess: "success",
+	notifier.StatusFailure: "failure",
+}
+
+// Event is the JSON body posted to the webhook
+type Event struct {
+	Phase     string `json:"phase"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Status    string `json:"status,omitempty"`
+	Message   string `json:"message,omitempty"`
+	CloudURL  string `json:"cloud_url,omitempty"`
+	Output    string `json:"output,omitempty"`
+}
+
+// Client posts JSON events about tests to a URL, for custom integrations.
+type Client struct {
+	url        string
+	httpClient *http.Client
+}
+
+func NewClient(url string) *Client {
+	return &Client{
+		url:        url,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ForTest returns a notifier posting events about the given test. The
+// channels passed to the notifier are ignored.
+func (c *Client) ForTest(test *notifier.Test) notifier.Notifier {
+	return &testNotifier{client: c, test: test}
+}
+
+type testNotifier struct {
+	client *Client
+	test   *notifier.Test
+}
+
+func (n *testNotifier) SendMessages(_ []string, text, _ string) (map[string]string, error) {
+	if err := n.post(EventStart, n.statusEvent(text)); err != nil {
+		return nil, fmt.Errorf("error sending start event: %w", err)
+	}
+	return map[string]string{webhookThread: ""}, nil
+}
+
+func (n *testNotifier) UpdateMessages(threads map[string]string, text, _ string) error {
+	if len(threads) == 0 {
+		return nil
+	}
+	if err := n.post(EventUpdate, n.statusEvent(text)); err != nil {
+		return fmt.Errorf("error sending update event: %w", err)
+	}
+	return nil
+}
+
+func (n *testNotifier) AddFileToThreads(threads map[string]string, _, content string) error {
+	if len(threads) == 0 {
+		return nil
+	}
+	event := n.event()
+	event.Output = content
+	if err := n.post(EventResult, event); err != nil {
+		return fmt.Errorf("error sending result event: %w", err)
+	}
+	return nil
+}
+
+func (n *testNotifier) event() Event {
+	return Event{
+		Phase:     n.test.Phase,
+		Name:      n.test.Name,
+		Namespace: n.test.Namespace,
+		CloudURL:  n.test.CloudURL,
+	}
+}
+
+func (n *testNotifier) statusEvent(text string) Event {
+	message, status := notifier.StripStatus(text)
+	event := n.event()
+	event.Status = statusNames[status]
+	event.Message = message
+	return event
+}
+
+func (n *testNotifier) post(eventType string, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.client.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, eventType)
+
+	resp, err := n.client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package jsonwebhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedEvent struct {
+	eventType   string
+	contentType string
+	body        string
+}
+
+func TestEvents(t *testing.T) {
+	var events []receivedEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		events = append(events, receivedEvent{
+			eventType:   r.Header.Get(EventHeader),
+			contentType: r.Header.Get("Content-Type"),
+			body:        string(body),
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	test := &notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"}
+	n := NewClient(server.URL).ForTest(test)
+
+	// The cloud URL is set by the handler before the first message
+	test.CloudURL = "https://app.k6.io/runs/1"
+	threads, err := n.SendMessages(nil, ":warning: Load testing of `test-name` in namespace `test-space` has started", "context")
+	require.NoError(t, err)
+	require.NoError(t, n.AddFileToThreads(threads, "k6-results.txt", "the output"))
+	require.NoError(t, n.UpdateMessages(threads, ":red_circle: Load testing of `test-name` in namespace `test-space` has failed", "context"))
+
+	require.Len(t, events, 3)
+	for _, e := range events {
+		assert.Equal(t, "application/json", e.contentType)
+	}
+
+	assert.Equal(t, "start", events[0].eventType)
+	assert.JSONEq(t, `{
+		"phase": "pre-rollout",
+		"name": "test-name",
+		"namespace": "test-space",
+		"status": "running",
+		"message": "Load testing of `+"`test-name`"+` in namespace `+"`test-space`"+` has started",
+		"cloud_url": "https://app.k6.io/runs/1"
+	}`, events[0].body)
+
+	assert.Equal(t, "result", events[1].eventType)
+	assert.JSONEq(t, `{
+		"phase": "pre-rollout",
+		"name": "test-name",
+		"namespace": "test-space",
+		"cloud_url": "https://app.k6.io/runs/1",
+		"output": "the output"
+	}`, events[1].body)
+
+	assert.Equal(t, "update", events[2].eventType)
+	assert.JSONEq(t, `{
+		"phase": "pre-rollout",
+		"name": "test-name",
+		"namespace": "test-space",
+		"status": "failure",
+		"message": "Load testing of `+"`test-name`"+` in namespace `+"`test-space`"+` has failed",
+		"cloud_url": "https://app.k6.io/runs/1"
+	}`, events[2].body)
+}
+
+func TestNoUpdatesIfStartFailed(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	n := NewClient(server.URL).ForTest(&notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"})
+	threads, err := n.SendMessages(nil, ":warning: started", "")
+	assert.EqualError(t, err, "error sending start event: unexpected status 503 Service Unavailable")
+	require.NoError(t, n.UpdateMessages(threads, ":red_circle: failed", ""))
+	require.NoError(t, n.AddFileToThreads(threads, "k6-results.txt", "output"))
+	assert.Equal(t, 1, calls)
+}
@@ -2,22 +2,113 @@ package k6
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const DefaultBinaryPath = "k6"
+
+// How the results of tests are uploaded to the cloud
+const (
+	// `k6 run --out cloud <script>`
+	CloudOutputModeLegacy = "legacy"
+	// `k6 cloud run --local-execution <script>`, preferred since k6 v0.52
+	CloudOutputModeRun = "run"
+)
+
+// ExitCodeKilled is the exit code of k6 once killed with SIGKILL, ex: by the
+// kernel because it ran out of memory
+const ExitCodeKilled = 128 + int(syscall.SIGKILL)
+
+// Arguments making the output of k6 readable once captured: without colors
+// and progress bars
+var plainOutputArgs = []string{"--no-color", "--quiet"}
+
 type LocalRunnerClient struct {
-	token string
+	token           string
+	binaryPath      string
+	cloudOutputMode string
+	plainOutput     bool
+	nice            int
+	cloudCACertPath string
+	isolateHome     bool
+}
+
+// LocalRunnerOptions are the settings of a LocalRunnerClient.
+type LocalRunnerOptions struct {
+	// The cloud token, either given directly or read from TokenFile, ex: a
+	// mounted secret
+	Token     string
+	TokenFile string
+	// The path of the k6 binary, or its name looked up in $PATH.
+	// DefaultBinaryPath if empty
+	BinaryPath string
+	// How the results are uploaded to the cloud. CloudOutputModeLegacy if
+	// empty
+	CloudOutputMode string
+	// If true, tests are run with --no-color and --quiet
+	PlainOutput bool
+	// The nice value tests are run with (from -20 to 19), on Linux only
+	Nice int
+	// If set, tests uploading their results to the cloud trust the CAs of
+	// this PEM bundle instead of the system ones, ex: for self-hosted
+	// instances with internal CAs
+	CloudCACertPath string
+	// If true, each test gets its own empty home directory, so that the k6
+	// configuration (ex: a cloud login) isn't shared between tests
+	IsolateHome bool
 }
 
-func NewLocalRunnerClient(token string) (Client, error) {
-	client := &LocalRunnerClient{token: token}
+// NewLocalRunnerClient returns a client that runs k6 tests using the k6
+// binary with the given options.
+func NewLocalRunnerClient(opts LocalRunnerOptions) (Client, error) {
+	token, binaryPath, cloudOutputMode := opts.Token, opts.BinaryPath, opts.CloudOutputMode
+	if opts.TokenFile != "" {
+		if token != "" {
+			return nil, errors.New("the cloud token can't be given both directly and as a file")
+		}
+		content, err := os.ReadFile(opts.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the cloud token: %w", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if binaryPath == "" {
+		binaryPath = DefaultBinaryPath
+	}
+	if _, err := exec.LookPath(binaryPath); err != nil {
+		return nil, fmt.Errorf("could not find the k6 binary: %w", err)
+	}
+	if cloudOutputMode == "" {
+		cloudOutputMode = CloudOutputModeLegacy
+	}
+	if cloudOutputMode != CloudOutputModeLegacy && cloudOutputMode != CloudOutputModeRun {
+		return nil, fmt.Errorf("invalid cloud output mode %q, must be %q or %q", cloudOutputMode, CloudOutputModeLegacy, CloudOutputModeRun)
+	}
+	if opts.Nice < -20 || opts.Nice > 19 {
+		return nil, fmt.Errorf("invalid nice value %d, must be between -20 and 19", opts.Nice)
+	}
+	if opts.Nice != 0 && !niceSupported {
+		log.Warnf("setting the nice value of k6 is only supported on Linux, ignoring %d", opts.Nice)
+	}
+	if opts.CloudCACertPath != "" {
+		if _, err := os.Stat(opts.CloudCACertPath); err != nil {
+			return nil, fmt.Errorf("invalid cloud CA certificate: %w", err)
+		}
+	}
+	client := &LocalRunnerClient{token: token, binaryPath: binaryPath, cloudOutputMode: cloudOutputMode, plainOutput: opts.PlainOutput, nice: opts.Nice, cloudCACertPath: opts.CloudCACertPath, isolateHome: opts.IsolateHome}
 	return client, nil
 }
 
@@ -26,25 +117,65 @@ type DefaultTestRun struct {
 	startedAt     time.Time
 	exitedAt      time.Time
 	cancelContext context.CancelFunc
+	nice          int
+
+	// The process is waited for as soon as it is started, so that whether
+	// it has exited is known before Wait is called. done is closed once it
+	// has exited.
+	done    chan struct{}
+	waitErr error
+
+	// Called once the process has exited, before Wait returns
+	onExit func()
 }
 
 func (tr *DefaultTestRun) Start() error {
 	tr.startedAt = time.Now()
-	return tr.Cmd.Start()
+	var err error
+	if tr.nice != 0 {
+		err = startWithNice(tr.Cmd, tr.nice)
+	} else {
+		err = tr.Cmd.Start()
+	}
+	if err != nil {
+		return err
+	}
+	tr.done = make(chan struct{})
+	go func() {
+		tr.waitErr = tr.Cmd.Wait()
+		tr.exitedAt = time.Now()
+		if tr.onExit != nil {
+			tr.onExit()
+		}
+		close(tr.done)
+	}()
+	return nil
 }
 
 func (tr *DefaultTestRun) Wait() error {
-	defer func() {
-		tr.exitedAt = time.Now()
-	}()
-	return tr.Cmd.Wait()
+	if tr.done == nil {
+		// The process wasn't started by Start
+		defer func() {
+			tr.exitedAt = time.Now()
+		}()
+		return tr.Cmd.Wait()
+	}
+	<-tr.done
+	return tr.waitErr
 }
 
+// ExitCode returns the exit code of k6 or, if it was killed by a signal, 128 +
+// the signal, as shells do (ex: ExitCodeKilled). -1 if it hasn't exited.
 func (tr *DefaultTestRun) ExitCode() int {
-	if tr.Cmd != nil && tr.Cmd.ProcessState != nil {
-		return tr.Cmd.ProcessState.ExitCode()
+	// The process state is only written by the goroutine waiting for the
+	// process, it can be read once it has exited
+	if tr.Cmd == nil || !tr.Exited() || tr.Cmd.ProcessState == nil {
+		return -1
 	}
-	return -1
+	if status, ok := tr.Cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return tr.Cmd.ProcessState.ExitCode()
 }
 
 func (tr *DefaultTestRun) CleanupContext() {
@@ -53,8 +184,9 @@ func (tr *DefaultTestRun) CleanupContext() {
 	}
 }
 
+// ExecutionDuration returns how long k6 has run for, 0 if it hasn't exited.
 func (tr *DefaultTestRun) ExecutionDuration() time.Duration {
-	if tr.startedAt.IsZero() || tr.exitedAt.IsZero() {
+	if tr.startedAt.IsZero() || !tr.Exited() || tr.exitedAt.IsZero() {
 		return time.Duration(0)
 	}
 	return tr.exitedAt.Sub(tr.startedAt)
@@ -74,48 +206,240 @@ func (tr *DefaultTestRun) PID() int {
 	return -1
 }
 
+// Exited returns whether the process has exited, whether by itself or because
+// it was killed.
 func (tr *DefaultTestRun) Exited() bool {
-	if tr.Cmd != nil && tr.Cmd.ProcessState != nil {
-		return tr.Cmd.ProcessState.Exited()
+	if tr.done == nil {
+		return tr.Cmd != nil && tr.Cmd.ProcessState != nil
+	}
+	select {
+	case <-tr.done:
+		return true
+	default:
+		return false
 	}
-	return false
 }
 
 func (tr *DefaultTestRun) SetCancelFunc(fn context.CancelFunc) {
 	tr.cancelContext = fn
 }
 
-func (c *LocalRunnerClient) Start(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (TestRun, error) {
-	tempFile, err := os.CreateTemp("", "k6-script")
+// Start runs the script. Its directory (and home directory, if isolated) is
+// removed once k6 has exited, or right away if k6 can't be started.
+func (c *LocalRunnerClient) Start(ctx context.Context, script Script, upload bool, envVars map[string]string, extraArgs []string, stdout, stderr io.Writer) (TestRun, error) {
+	scriptDir, err := writeScript(script)
 	if err != nil {
-		return nil, fmt.Errorf("could not create a tempfile for the script: %w", err)
-	}
-	if _, err := tempFile.WriteString(scriptContent); err != nil {
-		return nil, fmt.Errorf("could not write the script to a tempfile: %w", err)
+		return nil, err
 	}
+	scriptPath := filepath.Join(scriptDir, ScriptFileName)
 
 	args := []string{"run"}
 	if upload {
-		args = append(args, "--out", "cloud")
+		if c.cloudOutputMode == CloudOutputModeRun {
+			args = []string{"cloud", "run", "--local-execution"}
+		} else {
+			args = append(args, "--out", "cloud")
+		}
+	}
+	for _, arg := range extraArgs {
+		if strings.Contains(arg, scriptDir) {
+			removeScript(scriptDir)
+			return nil, fmt.Errorf("extra argument %q must not reference the script file", arg)
+		}
+	}
+	if c.plainOutput {
+		args = append(args, plainOutputArgs...)
 	}
-	args = append(args, tempFile.Name())
+	if script.Options != "" {
+		args = append(args, "--config", filepath.Join(scriptDir, OptionsFileName))
+	}
+	for _, name := range slices.Sorted(maps.Keys(script.Tags)) {
+		if err := ValidateTag(name, script.Tags[name]); err != nil {
+			removeScript(scriptDir)
+			return nil, err
+		}
+		// k6 isn't run through a shell, so the tag doesn't need quoting
+		args = append(args, "--tag", name+"="+script.Tags[name])
+	}
+	args = append(args, extraArgs...)
+	args = append(args, scriptPath)
+
+	cmd := c.cmd(ctx, args...)
+	cmd.Dir = scriptDir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
-	cmd := c.cmd(ctx, "k6", args...)
+	env, removeEnv, err := c.env(upload, envVars)
+	if err != nil {
+		removeScript(scriptDir)
+		return nil, err
+	}
+	cmd.Env = env
+	cleanup := func() {
+		removeScript(scriptDir)
+		removeEnv()
+	}
+
+	log.Debugf("launching '%s %s'", c.binaryPath, strings.Join(args, " "))
+	run := &DefaultTestRun{Cmd: cmd, nice: c.nice, onExit: cleanup}
+	if err := run.Start(); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return run, nil
+}
+
+// env returns the environment of k6, along with a function removing its home
+// directory if it is isolated.
+func (c *LocalRunnerClient) env(upload bool, envVars map[string]string) ([]string, func(), error) {
+	env := os.Environ()
+	if c.token != "" {
+		env = append(env, "K6_CLOUD_TOKEN="+c.token)
+	}
+	if upload && c.cloudCACertPath != "" {
+		// Read by the TLS stack of k6 (Go) in place of the system roots
+		env = append(env, "SSL_CERT_FILE="+c.cloudCACertPath)
+	}
+	for k, v := range envVars {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	if !c.isolateHome {
+		return env, func() {}, nil
+	}
+
+	homeDir, err := os.MkdirTemp("", "k6-home")
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create a home directory for the test: %w", err)
+	}
+	// Set last, so that the env vars of the test can't override them
+	env = append(env, "HOME="+homeDir, "XDG_CONFIG_HOME="+filepath.Join(homeDir, ".config"))
+	return env, func() { removeHome(homeDir) }, nil
+}
+
+// transientErrors are the errors which may go away if k6 is started again, as
+// the system momentarily ran out of processes, memory or file descriptors.
+var transientErrors = []error{syscall.EAGAIN, syscall.EINTR, syscall.EMFILE, syscall.ENFILE, syscall.ENOMEM}
+
+// IsTransientError returns whether an error returned by Start may go away if
+// the test is started again. Errors due to the script or the settings never
+// are.
+func IsTransientError(err error) bool {
+	for _, transientErr := range transientErrors {
+		if errors.Is(err, transientErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the script can be loaded by k6 (i.e. it compiles and its
+// options are valid) without running it. This uses `k6 inspect`, in the same
+// environment as Start.
+func (c *LocalRunnerClient) Validate(ctx context.Context, script Script, upload bool, envVars map[string]string, outputWriter io.Writer) error {
+	scriptDir, err := writeScript(script)
+	if err != nil {
+		return err
+	}
+	defer removeScript(scriptDir)
+	scriptPath := filepath.Join(scriptDir, ScriptFileName)
+
+	env, removeEnv, err := c.env(upload, envVars)
+	if err != nil {
+		return err
+	}
+	defer removeEnv()
+
+	cmd := c.cmd(ctx, "inspect", scriptPath)
+	cmd.Dir = scriptDir
 	cmd.Stdout = outputWriter
 	cmd.Stderr = outputWriter
+	cmd.Env = env
 
-	cmd.Env = os.Environ()
-	for k, v := range envVars {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	log.Debugf("launching '%s inspect %s'", c.binaryPath, scriptPath)
+	return cmd.Run()
+}
+
+// Version returns the output of `k6 version`. This is used to check that k6 can
+// be run.
+func (c *LocalRunnerClient) Version(ctx context.Context) (string, error) {
+	out, err := c.cmd(ctx, "version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error running '%s version': %w: %s", c.binaryPath, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// writeScript writes the script and its files to a new directory, so that
+// imports relative to the script resolve.
+func writeScript(script Script) (string, error) {
+	dir, err := os.MkdirTemp("", "k6-script")
+	if err != nil {
+		return "", fmt.Errorf("could not create a directory for the script: %w", err)
+	}
+	if err := writeScriptFiles(dir, script); err != nil {
+		removeScript(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// ValidateFileName checks that a file can be written alongside the script.
+func ValidateFileName(name string) error {
+	if !filepath.IsLocal(name) || filepath.Clean(name) == ScriptFileName || filepath.Clean(name) == OptionsFileName {
+		return fmt.Errorf("%q must be a relative path inside the script directory other than %s and %s", name, ScriptFileName, OptionsFileName)
 	}
+	return nil
+}
 
-	log.Debugf("launching 'k6 %s'", strings.Join(args, " "))
-	run := &DefaultTestRun{Cmd: cmd}
-	return run, run.Start()
+// ValidateTag checks that a tag can be passed to k6 with `--tag <name>=<value>`.
+func ValidateTag(name, value string) error {
+	if name == "" || strings.ContainsAny(name, "=") {
+		return fmt.Errorf("invalid tag name %q, it must not be empty nor contain '='", name)
+	}
+	if strings.ContainsFunc(name+value, unicode.IsControl) {
+		return fmt.Errorf("invalid tag %q, it must not contain control characters", name)
+	}
+	return nil
+}
+
+func writeScriptFiles(dir string, script Script) error {
+	for name, content := range script.Files {
+		if err := ValidateFileName(name); err != nil {
+			return fmt.Errorf("invalid file name: %w", err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return fmt.Errorf("could not create the directory of %s: %w", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			return fmt.Errorf("could not write %s: %w", name, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, ScriptFileName), []byte(script.Content), 0o600); err != nil {
+		return fmt.Errorf("could not write the script: %w", err)
+	}
+	if script.Options != "" {
+		if err := os.WriteFile(filepath.Join(dir, OptionsFileName), []byte(script.Options), 0o600); err != nil {
+			return fmt.Errorf("could not write the options: %w", err)
+		}
+	}
+	return nil
+}
+
+func removeScript(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorf("error removing the script directory %s: %v", dir, err)
+	}
+}
+
+func removeHome(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Errorf("error removing the home directory %s: %v", dir, err)
+	}
 }
 
-func (c *LocalRunnerClient) cmd(ctx context.Context, name string, arg ...string) *exec.Cmd {
-	cmd := exec.CommandContext(ctx, name, arg...)
+func (c *LocalRunnerClient) cmd(ctx context.Context, arg ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, c.binaryPath, arg...)
 	cmd.Env = append(os.Environ(), "K6_CLOUD_TOKEN="+c.token)
 
 	return cmd
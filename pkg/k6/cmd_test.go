@@ -0,0 +1,492 @@
+package k6
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLocalRunnerClientBinaryPath(t *testing.T) {
+	t.Run("uses the configured binary", func(t *testing.T) {
+		binaryPath := filepath.Join(t.TempDir(), "k6-custom")
+		require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\n"), 0o755))
+
+		client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+		require.NoError(t, err)
+
+		cmd := client.(*LocalRunnerClient).cmd(context.Background(), "run", "script.js")
+		assert.Equal(t, binaryPath, cmd.Path)
+		assert.Equal(t, []string{binaryPath, "run", "script.js"}, cmd.Args)
+		assert.Contains(t, cmd.Env, "K6_CLOUD_TOKEN=token")
+	})
+
+	t.Run("fails if the binary cannot be found", func(t *testing.T) {
+		_, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: filepath.Join(t.TempDir(), "missing")})
+		assert.ErrorContains(t, err, "could not find the k6 binary")
+	})
+}
+
+func TestNewLocalRunnerClientTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("token-from-file\n"), 0o600))
+
+	t.Run("reads the token", func(t *testing.T) {
+		// The fake k6 binary prints the token it is given
+		binaryPath := filepath.Join(t.TempDir(), "k6")
+		require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\necho \"$K6_CLOUD_TOKEN\"\n"), 0o755))
+		t.Setenv("K6_CLOUD_TOKEN", "")
+
+		client, err := NewLocalRunnerClient(LocalRunnerOptions{TokenFile: tokenFile, BinaryPath: binaryPath})
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		run, err := client.Start(context.Background(), Script{Content: "my-script"}, true, nil, nil, &out, &out)
+		require.NoError(t, err)
+		require.NoError(t, run.Wait())
+		assert.Equal(t, "token-from-file\n", out.String())
+
+		out.Reset()
+		require.NoError(t, client.Validate(context.Background(), Script{Content: "my-script"}, true, nil, &out))
+		assert.Equal(t, "token-from-file\n", out.String())
+	})
+
+	t.Run("fails if the file cannot be read", func(t *testing.T) {
+		_, err := NewLocalRunnerClient(LocalRunnerOptions{TokenFile: filepath.Join(t.TempDir(), "missing"), BinaryPath: "echo"})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("fails if the token is also given directly", func(t *testing.T) {
+		_, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", TokenFile: tokenFile, BinaryPath: "echo"})
+		assert.EqualError(t, err, "the cloud token can't be given both directly and as a file")
+	})
+}
+
+func TestStartArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		cloudOutputMode string
+		upload          bool
+		plainOutput     bool
+		expected        []string
+	}{
+		{
+			name:     "local",
+			upload:   false,
+			expected: []string{"run", "--vus", "10"},
+		},
+		{
+			name:     "cloud (default mode)",
+			upload:   true,
+			expected: []string{"run", "--out", "cloud", "--vus", "10"},
+		},
+		{
+			name:            "cloud (legacy mode)",
+			cloudOutputMode: CloudOutputModeLegacy,
+			upload:          true,
+			expected:        []string{"run", "--out", "cloud", "--vus", "10"},
+		},
+		{
+			name:            "cloud (run mode)",
+			cloudOutputMode: CloudOutputModeRun,
+			upload:          true,
+			expected:        []string{"cloud", "run", "--local-execution", "--vus", "10"},
+		},
+		{
+			name:            "local (run mode)",
+			cloudOutputMode: CloudOutputModeRun,
+			upload:          false,
+			expected:        []string{"run", "--vus", "10"},
+		},
+		{
+			name:        "plain output",
+			plainOutput: true,
+			expected:    []string{"run", "--no-color", "--quiet", "--vus", "10"},
+		},
+		{
+			name:            "plain output (run mode)",
+			cloudOutputMode: CloudOutputModeRun,
+			upload:          true,
+			plainOutput:     true,
+			expected:        []string{"cloud", "run", "--local-execution", "--no-color", "--quiet", "--vus", "10"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// echo prints the arguments it receives which allows us to check their
+			// order
+			client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: "echo", CloudOutputMode: tc.cloudOutputMode, PlainOutput: tc.plainOutput})
+			require.NoError(t, err)
+
+			var out bytes.Buffer
+			run, err := client.Start(context.Background(), Script{Content: "my-script"}, tc.upload, nil, []string{"--vus", "10"}, &out, &out)
+			require.NoError(t, err)
+			require.NoError(t, run.Wait())
+
+			fields := strings.Fields(out.String())
+			require.Len(t, fields, len(tc.expected)+1)
+			assert.Equal(t, tc.expected, fields[:len(tc.expected)])
+			assert.Contains(t, fields[len(tc.expected)], "k6-script")
+		})
+	}
+}
+
+func TestStartWithExtraFiles(t *testing.T) {
+	// The fake k6 binary prints its working directory and the content of a
+	// file imported by the script, relative to that directory
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\npwd\ncat lib/helpers.js\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var out bytes.Buffer
+	script := Script{
+		Content: `import { x } from "./lib/helpers.js";`,
+		Files:   map[string]string{"lib/helpers.js": "export const x = 1;"},
+	}
+	run, err := client.Start(ctx, script, false, nil, nil, &out, &out)
+	require.NoError(t, err)
+	require.NoError(t, run.Wait())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	scriptDir := lines[0]
+	assert.Contains(t, scriptDir, "k6-script")
+	assert.Equal(t, "export const x = 1;", lines[1])
+
+	// The script directory is removed once k6 has exited
+	assert.NoDirExists(t, scriptDir)
+}
+
+// The script directory is removed even if k6 can't be started.
+func TestStartFailureRemovesScript(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\n"), 0o755))
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	// k6 is no longer executable
+	require.NoError(t, os.Chmod(binaryPath, 0o644))
+	_, err = client.Start(context.Background(), Script{Content: "my-script"}, false, nil, nil, &bytes.Buffer{}, &bytes.Buffer{})
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// A process that exits early is seen as such without waiting for it.
+func TestExited(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nexit 3\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var out bytes.Buffer
+	run, err := client.Start(ctx, Script{Content: "my-script"}, false, nil, nil, &out, &out)
+	require.NoError(t, err)
+
+	assert.Eventually(t, run.Exited, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, run.ExitCode())
+	assert.Error(t, run.Wait())
+}
+
+// The exit code and duration of a running process can be read while it is
+// waited for in the background (run with -race).
+func TestExitCodeWhileRunning(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nsleep 0.2\nexit 3\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	run, err := client.Start(context.Background(), Script{Content: "my-script"}, false, nil, nil, &out, &out)
+	require.NoError(t, err)
+
+	for !run.Exited() {
+		assert.Equal(t, -1, run.ExitCode())
+		assert.Zero(t, run.ExecutionDuration())
+		time.Sleep(time.Millisecond)
+	}
+	assert.Error(t, run.Wait())
+	assert.Equal(t, 3, run.ExitCode())
+	assert.NotZero(t, run.ExecutionDuration())
+}
+
+// A process killed by a signal has the exit code a shell would report.
+func TestExitCodeKilled(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nkill -9 $$\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	run, err := client.Start(context.Background(), Script{Content: "my-script"}, false, nil, nil, &out, &out)
+	require.NoError(t, err)
+
+	assert.EqualError(t, run.Wait(), "signal: killed")
+	assert.Equal(t, ExitCodeKilled, run.ExitCode())
+	assert.Equal(t, 137, run.ExitCode())
+}
+
+func TestStartWithOptions(t *testing.T) {
+	// The fake k6 binary prints its arguments and the content of the file
+	// passed with --config
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\necho \"$@\"\ncat \"$3\"\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	options := `{"vus": 10, "duration": "30s"}`
+	run, err := client.Start(context.Background(), Script{Content: "my-script", Options: options}, false, nil, []string{"--tag", "env=dev"}, &out, &out)
+	require.NoError(t, err)
+	require.NoError(t, run.Wait())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	args := strings.Fields(lines[0])
+	require.Len(t, args, 6)
+	assert.Equal(t, []string{"run", "--config"}, args[:2])
+	assert.Equal(t, OptionsFileName, filepath.Base(args[2]))
+	assert.Equal(t, []string{"--tag", "env=dev"}, args[3:5])
+	assert.Equal(t, ScriptFileName, filepath.Base(args[5]))
+	assert.Equal(t, filepath.Dir(args[5]), filepath.Dir(args[2]))
+	assert.Equal(t, options, lines[1])
+}
+
+func TestStartWithTags(t *testing.T) {
+	// The fake k6 binary prints each of its arguments on a line
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	tags := map[string]string{"namespace": "my-namespace", "canary": "my-app", "team": "it's \"us\" $HOME"}
+	run, err := client.Start(context.Background(), Script{Content: "my-script", Tags: tags}, false, nil, []string{"--vus", "10"}, &out, &out)
+	require.NoError(t, err)
+	require.NoError(t, run.Wait())
+
+	// The tags are sorted and passed as is
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 10)
+	assert.Equal(t, []string{"run", "--tag", "canary=my-app", "--tag", "namespace=my-namespace", "--tag", `team=it's "us" $HOME`, "--vus", "10"}, lines[:9])
+	assert.Equal(t, ScriptFileName, filepath.Base(lines[9]))
+
+	t.Run("invalid tag", func(t *testing.T) {
+		_, err := client.Start(context.Background(), Script{Content: "my-script", Tags: map[string]string{"team": "a\nb"}}, false, nil, nil, &out, &out)
+		assert.EqualError(t, err, `invalid tag "team", it must not contain control characters`)
+	})
+}
+
+func TestStartSeparateOutputs(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\necho out\necho err >&2\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	run, err := client.Start(context.Background(), Script{Content: "my-script"}, false, nil, nil, &stdout, &stderr)
+	require.NoError(t, err)
+	require.NoError(t, run.Wait())
+
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+}
+
+func TestStartWithCloudCACert(t *testing.T) {
+	// The fake k6 binary prints the CA bundle it trusts
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\necho \"$SSL_CERT_FILE\"\n"), 0o755))
+	caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCertPath, []byte("my-ca"), 0o600))
+	t.Setenv("SSL_CERT_FILE", "")
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath, CloudCACertPath: caCertPath})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		upload   bool
+		expected string
+	}{
+		{name: "cloud", upload: true, expected: caCertPath},
+		{name: "local", upload: false, expected: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			run, err := client.Start(context.Background(), Script{Content: "my-script"}, tc.upload, nil, nil, &out, &out)
+			require.NoError(t, err)
+			require.NoError(t, run.Wait())
+			assert.Equal(t, tc.expected+"\n", out.String())
+		})
+	}
+
+	t.Run("missing CA certificate", func(t *testing.T) {
+		_, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath, CloudCACertPath: filepath.Join(t.TempDir(), "missing.pem")})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestStartWithIsolatedHome(t *testing.T) {
+	// The fake k6 binary prints its home and config directories, and writes
+	// a config file like `k6 cloud login` would
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\necho \"$HOME\"\necho \"$XDG_CONFIG_HOME\"\nmkdir -p \"$XDG_CONFIG_HOME/k6\" && echo '{}' > \"$XDG_CONFIG_HOME/k6/config.json\"\n"), 0o755))
+	sharedHome := t.TempDir()
+	t.Setenv("HOME", sharedHome)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(sharedHome, ".config"))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath, IsolateHome: true})
+	require.NoError(t, err)
+
+	var homeDirs []string
+	for range 2 {
+		var out bytes.Buffer
+		// The env vars of the test don't override the isolated home
+		run, err := client.Start(context.Background(), Script{Content: "my-script"}, false, map[string]string{"HOME": "/root"}, nil, &out, &out)
+		require.NoError(t, err)
+		require.NoError(t, run.Wait())
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		require.Len(t, lines, 2)
+		homeDir := lines[0]
+		assert.NotEqual(t, sharedHome, homeDir)
+		assert.Equal(t, filepath.Join(homeDir, ".config"), lines[1])
+		// The home directory is removed with the config once k6 has exited
+		assert.NoDirExists(t, homeDir)
+		homeDirs = append(homeDirs, homeDir)
+	}
+	assert.NotEqual(t, homeDirs[0], homeDirs[1])
+
+	t.Run("shared home by default", func(t *testing.T) {
+		client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		run, err := client.Start(context.Background(), Script{Content: "my-script"}, false, nil, nil, &out, &out)
+		require.NoError(t, err)
+		require.NoError(t, run.Wait())
+		assert.True(t, strings.HasPrefix(out.String(), sharedHome+"\n"))
+	})
+}
+
+func TestStartWithInvalidExtraFiles(t *testing.T) {
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: "echo"})
+	require.NoError(t, err)
+
+	for _, name := range []string{"../outside.js", "/tmp/absolute.js", ScriptFileName, OptionsFileName} {
+		_, err := client.Start(context.Background(), Script{Content: "my-script", Files: map[string]string{name: "content"}}, false, nil, nil, &bytes.Buffer{}, &bytes.Buffer{})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestInvalidCloudOutputMode(t *testing.T) {
+	_, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: "echo", CloudOutputMode: "other"})
+	assert.EqualError(t, err, `invalid cloud output mode "other", must be "legacy" or "run"`)
+}
+
+func TestInvalidNice(t *testing.T) {
+	_, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: "echo", Nice: 20})
+	assert.EqualError(t, err, "invalid nice value 20, must be between -20 and 19")
+}
+
+func TestValidateArgs(t *testing.T) {
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: "echo"})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, client.Validate(context.Background(), Script{Content: "my-script"}, false, nil, &out))
+
+	fields := strings.Fields(out.String())
+	require.Len(t, fields, 2)
+	assert.Equal(t, "inspect", fields[0])
+	assert.Contains(t, fields[1], "k6-script")
+}
+
+func TestValidateEnv(t *testing.T) {
+	// The fake k6 binary prints the environment the script is validated in
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\necho \"$FROM_ENVIRON\"\necho \"$FOO\"\necho \"$SSL_CERT_FILE\"\necho \"$HOME\"\n"), 0o755))
+	caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCertPath, []byte("my-ca"), 0o600))
+	sharedHome := t.TempDir()
+	t.Setenv("HOME", sharedHome)
+	t.Setenv("FROM_ENVIRON", "environ-value")
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath, CloudCACertPath: caCertPath, IsolateHome: true})
+	require.NoError(t, err)
+
+	// Same as Start: the environment of the webhook, the env vars of the
+	// test, the CA bundle when uploading and an isolated home
+	var out bytes.Buffer
+	require.NoError(t, client.Validate(context.Background(), Script{Content: "my-script"}, true, map[string]string{"FOO": "bar"}, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, []string{"environ-value", "bar", caCertPath}, lines[:3])
+	assert.NotEqual(t, sharedHome, lines[3])
+	assert.NoDirExists(t, lines[3])
+}
+
+func TestVersion(t *testing.T) {
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: "echo"})
+	require.NoError(t, err)
+
+	version, err := client.Version(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "version", version)
+
+	client, err = NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: "false"})
+	require.NoError(t, err)
+
+	_, err = client.Version(context.Background())
+	assert.ErrorContains(t, err, "error running 'false version'")
+}
+
+// A hung k6 doesn't block the callers, ex: the readiness probe.
+func TestVersionCanceled(t *testing.T) {
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755))
+
+	client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Version(ctx)
+	assert.ErrorContains(t, err, "signal: killed")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, IsTransientError(fmt.Errorf("error: %w", &os.PathError{Op: "fork/exec", Path: "k6", Err: syscall.EAGAIN})))
+	assert.True(t, IsTransientError(fmt.Errorf("could not create a directory for the script: %w", &os.PathError{Op: "mkdirtemp", Path: "/tmp", Err: syscall.EMFILE})))
+	assert.False(t, IsTransientError(&os.PathError{Op: "fork/exec", Path: "k6", Err: syscall.ENOENT}))
+	assert.False(t, IsTransientError(errors.New(`extra argument "--foo" must not reference the script file`)))
+}
@@ -8,8 +8,33 @@ import (
 	"time"
 )
 
+// ScriptFileName is the name of the script file in the directory the script
+// is run from.
+const ScriptFileName = "script.js"
+
+// OptionsFileName is the name of the file the options are written to, in the
+// same directory.
+const OptionsFileName = "k6-options.json"
+
+// Script is a k6 script along with the files it imports or opens.
+type Script struct {
+	Content string
+	// Files written alongside the script (by path relative to the script)
+	Files map[string]string
+	// Options is a JSON k6 configuration passed with `--config`, if not empty
+	Options string
+	// Tags added to the metrics of the test (with `--tag <name>=<value>`)
+	Tags map[string]string
+}
+
 type Client interface {
-	Start(ctx context.Context, scriptContent string, upload bool, envVars map[string]string, outputWriter io.Writer) (TestRun, error)
+	// Start runs the script. The k6 stdout and stderr are written to the given
+	// writers, which can be the same.
+	Start(ctx context.Context, script Script, upload bool, envVars map[string]string, extraArgs []string, stdout, stderr io.Writer) (TestRun, error)
+	// Validate checks the script without running it, in the environment it
+	// would be started in
+	Validate(ctx context.Context, script Script, upload bool, envVars map[string]string, outputWriter io.Writer) error
+	Version(ctx context.Context) (string, error)
 }
 
 type TestRun interface {
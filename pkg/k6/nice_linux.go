@@ -0,0 +1,31 @@
+//go:build linux
+
+package k6
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+const niceSupported = true
+
+// startWithNice starts the command with the given nice value. The process
+// inherits the nice value of the thread forking it, so it is set on a thread
+// dedicated to this start. The thread is discarded afterwards since
+// unprivileged processes can't lower their nice value back.
+func startWithNice(cmd *exec.Cmd, nice int) error {
+	errCh := make(chan error, 1)
+	go func() {
+		// The thread is terminated when the goroutine returns without
+		// unlocking it
+		runtime.LockOSThread()
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), nice); err != nil {
+			errCh <- fmt.Errorf("could not set the nice value of k6 to %d: %w", nice, err)
+			return
+		}
+		errCh <- cmd.Start()
+	}()
+	return <-errCh
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package k6
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartWithNice(t *testing.T) {
+	// Prints the nice value of the process (19th field of its stat file)
+	binaryPath := filepath.Join(t.TempDir(), "k6")
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(binaryPath, []byte("#!/bin/sh\ncut -d ' ' -f 19 /proc/$$/stat\n"), 0o755))
+
+	for _, nice := range []int{0, 5} {
+		client, err := NewLocalRunnerClient(LocalRunnerOptions{Token: "token", BinaryPath: binaryPath, Nice: nice})
+		require.NoError(t, err)
+
+		var stdout bytes.Buffer
+		run, err := client.Start(context.Background(), Script{Content: "my-script"}, false, nil, nil, &stdout, &stdout)
+		require.NoError(t, err)
+		require.NoError(t, run.Wait())
+		assert.Equal(t, strconv.Itoa(nice), strings.TrimSpace(stdout.String()))
+	}
+
+	// The nice value of the webhook itself is unchanged
+	after, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	require.NoError(t, err)
+	assert.Equal(t, prio, after)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package k6
+
+import "os/exec"
+
+const niceSupported = false
+
+// startWithNice starts the command with the default nice value, setting it is
+// only supported on Linux.
+func startWithNice(cmd *exec.Cmd, _ int) error {
+	return cmd.Start()
+}
@@ -0,0 +1,112 @@
+package kubeevents
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	ReasonSucceeded = "LoadTestSucceeded"
+	ReasonFailed    = "LoadTestFailed"
+
+	// The object Flagger calls the webhook for
+	canaryAPIVersion = "flagger.app/v1beta1"
+	canaryKind       = "Canary"
+
+	component = "flagger-k6-webhook"
+
+	// key of the single entry in the thread maps returned by this notifier
+	eventThread = "event"
+)
+
+// Client records the results of tests as Kubernetes events on their canary,
+// so that they show up when describing it.
+type Client struct {
+	kubeClient kubernetes.Interface
+
+	// mockables
+	now func() time.Time
+}
+
+func NewClient(kubeClient kubernetes.Interface) *Client {
+	return &Client{kubeClient: kubeClient, now: time.Now}
+}
+
+// ForTest returns a notifier recording an event once the given test is done.
+// The channels passed to the notifier are ignored.
+func (c *Client) ForTest(test *notifier.Test) notifier.Notifier {
+	return &testNotifier{client: c, test: test}
+}
+
+type testNotifier struct {
+	client *Client
+	test   *notifier.Test
+}
+
+func (n *testNotifier) SendMessages(_ []string, text, _ string) (map[string]string, error) {
+	// Tests which didn't start are already done
+	if err := n.recordResult(text); err != nil {
+		return nil, err
+	}
+	return map[string]string{eventThread: ""}, nil
+}
+
+func (n *testNotifier) UpdateMessages(threads map[string]string, text, _ string) error {
+	if len(threads) == 0 {
+		return nil
+	}
+	return n.recordResult(text)
+}
+
+func (n *testNotifier) AddFileToThreads(map[string]string, string, string) error {
+	return nil
+}
+
+// recordResult creates an event if the status message is about a finished
+// test.
+func (n *testNotifier) recordResult(text string) error {
+	message, status := notifier.StripStatus(text)
+	var reason, eventType string
+	switch status {
+	case notifier.StatusSuccess:
+		reason, eventType = ReasonSucceeded, corev1.EventTypeNormal
+	case notifier.StatusFailure:
+		reason, eventType = ReasonFailed, corev1.EventTypeWarning
+	default:
+		return nil
+	}
+	if n.test.CloudURL != "" {
+		message += fmt.Sprintf(". Cloud URL: %s", n.test.CloudURL)
+	}
+
+	now := metav1.NewTime(n.client.now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: n.test.Name + "-",
+			Namespace:    n.test.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: canaryAPIVersion,
+			Kind:       canaryKind,
+			Name:       n.test.Name,
+			Namespace:  n.test.Namespace,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := n.client.kubeClient.CoreV1().Events(n.test.Namespace).Create(context.Background(), event, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("error creating %s event: %w", reason, err)
+	}
+	return nil
+}
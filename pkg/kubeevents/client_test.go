@@ -0,0 +1,123 @@
+package kubeevents
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEvents(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name     string
+		cloudURL string
+		// The messages sent for the test, the first one with SendMessages
+		messages []string
+		expected []corev1.Event
+	}{
+		{
+			name: "success",
+			messages: []string{
+				":warning: Load testing of `test-name` in namespace `test-space` has started",
+				":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded",
+			},
+			expected: []corev1.Event{
+				{
+					Reason:  ReasonSucceeded,
+					Message: "Load testing of `test-name` in namespace `test-space` has succeeded",
+					Type:    corev1.EventTypeNormal,
+				},
+			},
+		},
+		{
+			name:     "failure with a cloud URL",
+			cloudURL: "https://app.k6.io/runs/1",
+			messages: []string{
+				":warning: Load testing of `test-name` in namespace `test-space` has started",
+				":red_circle: Load testing of `test-name` in namespace `test-space` has failed",
+			},
+			expected: []corev1.Event{
+				{
+					Reason:  ReasonFailed,
+					Message: "Load testing of `test-name` in namespace `test-space` has failed. Cloud URL: https://app.k6.io/runs/1",
+					Type:    corev1.EventTypeWarning,
+				},
+			},
+		},
+		{
+			name: "didn't start",
+			messages: []string{
+				":red_circle: Load testing of `test-name` in namespace `test-space` didn't start successfully",
+			},
+			expected: []corev1.Event{
+				{
+					Reason:  ReasonFailed,
+					Message: "Load testing of `test-name` in namespace `test-space` didn't start successfully",
+					Type:    corev1.EventTypeWarning,
+				},
+			},
+		},
+		{
+			name: "running",
+			messages: []string{
+				":warning: Load testing of `test-name` in namespace `test-space` has started",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset()
+			client := NewClient(kubeClient)
+			client.now = func() time.Time { return now }
+
+			test := &notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout", CloudURL: tc.cloudURL}
+			n := client.ForTest(test)
+			threads, err := n.SendMessages(nil, tc.messages[0], "context")
+			require.NoError(t, err)
+			require.NoError(t, n.AddFileToThreads(threads, "k6-results.txt", "the output"))
+			for _, text := range tc.messages[1:] {
+				require.NoError(t, n.UpdateMessages(threads, text, "context"))
+			}
+
+			events, err := kubeClient.CoreV1().Events("test-space").List(context.Background(), metav1.ListOptions{})
+			require.NoError(t, err)
+			require.Len(t, events.Items, len(tc.expected))
+			for i, expected := range tc.expected {
+				event := events.Items[i]
+				assert.Equal(t, expected.Reason, event.Reason)
+				assert.Equal(t, expected.Message, event.Message)
+				assert.Equal(t, expected.Type, event.Type)
+				assert.Equal(t, "test-name-", event.GenerateName)
+				assert.Equal(t, "test-space", event.Namespace)
+				assert.Equal(t, corev1.ObjectReference{
+					APIVersion: "flagger.app/v1beta1",
+					Kind:       "Canary",
+					Name:       "test-name",
+					Namespace:  "test-space",
+				}, event.InvolvedObject)
+				assert.Equal(t, "flagger-k6-webhook", event.Source.Component)
+				assert.Equal(t, now, event.FirstTimestamp.Time)
+				assert.Equal(t, now, event.LastTimestamp.Time)
+				assert.Equal(t, int32(1), event.Count)
+			}
+		})
+	}
+}
+
+func TestNoThreads(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	n := NewClient(kubeClient).ForTest(&notifier.Test{Name: "test-name", Namespace: "test-space"})
+
+	require.NoError(t, n.UpdateMessages(nil, ":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded", ""))
+
+	events, err := kubeClient.CoreV1().Events("test-space").List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, events.Items)
+}
@@ -38,18 +38,47 @@ func (m *MockK6Client) EXPECT() *MockK6ClientMockRecorder {
 }
 
 // Start mocks base method.
-func (m *MockK6Client) Start(arg0 context.Context, arg1 string, arg2 bool, arg3 map[string]string, arg4 io.Writer) (k6.TestRun, error) {
+func (m *MockK6Client) Start(arg0 context.Context, arg1 k6.Script, arg2 bool, arg3 map[string]string, arg4 []string, arg5, arg6 io.Writer) (k6.TestRun, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Start", arg0, arg1, arg2, arg3, arg4)
+	ret := m.ctrl.Call(m, "Start", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
 	ret0, _ := ret[0].(k6.TestRun)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Start indicates an expected call of Start.
-func (mr *MockK6ClientMockRecorder) Start(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+func (mr *MockK6ClientMockRecorder) Start(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockK6Client)(nil).Start), arg0, arg1, arg2, arg3, arg4)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockK6Client)(nil).Start), arg0, arg1, arg2, arg3, arg4, arg5, arg6)
+}
+
+// Validate mocks base method.
+func (m *MockK6Client) Validate(arg0 context.Context, arg1 k6.Script, arg2 bool, arg3 map[string]string, arg4 io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Validate", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Validate indicates an expected call of Validate.
+func (mr *MockK6ClientMockRecorder) Validate(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Validate", reflect.TypeOf((*MockK6Client)(nil).Validate), arg0, arg1, arg2, arg3, arg4)
+}
+
+// Version mocks base method.
+func (m *MockK6Client) Version(arg0 context.Context) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Version", arg0)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Version indicates an expected call of Version.
+func (mr *MockK6ClientMockRecorder) Version(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Version", reflect.TypeOf((*MockK6Client)(nil).Version), arg0)
 }
 
 // MockK6TestRun is a mock of TestRun interface.
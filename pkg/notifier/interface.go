@@ -0,0 +1,40 @@
+package notifier
+
+// Notifier posts status messages about load tests to a set of channels.
+// SendMessages returns a map of channel to message identifier (the "thread")
+// which is then used to update the messages or to attach files to them.
+type Notifier interface {
+	SendMessages(channels []string, text, context string) (map[string]string, error)
+	UpdateMessages(threads map[string]string, text, context string) error
+	AddFileToThreads(threads map[string]string, fileName, content string) error
+}
+
+// Test describes the load test that notifications are sent about. It is filled
+// in by the handler as the test progresses.
+type Test struct {
+	Name      string
+	Namespace string
+	Phase     string
+	CloudURL  string
+
+	// Key identifies the canary and phase the test is for (the same test
+	// can't run twice at once for a key)
+	Key string
+
+	// SlackThreadTS is the timestamp of the Slack message that the messages
+	// are posted as replies to, if any
+	SlackThreadTS string
+
+	// Metrics is set once the test is done, if they could be parsed from
+	// the end-of-test summary
+	Metrics *Metrics
+}
+
+// Metrics are key metrics of a test, as formatted by k6. Metrics missing from
+// the summary are empty.
+type Metrics struct {
+	VUs                string
+	Iterations         string
+	HTTPReqDurationP95 string
+	HTTPReqFailedRate  string
+}
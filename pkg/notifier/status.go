@@ -0,0 +1,51 @@
+package notifier
+
+import "strings"
+
+// Status is the state of a load test as conveyed by a status message.
+type Status int
+
+const (
+	StatusUnknown Status = iota
+	StatusWarning
+	StatusSuccess
+	StatusFailure
+)
+
+// Status messages are formatted for Slack by the handlers. These are the
+// emojis they use along with their unicode counterparts.
+var statusEmojis = []struct {
+	emoji   string
+	unicode string
+	status  Status
+}{
+	{":large_green_circle:", "🟢", StatusSuccess},
+	{":warning:", "⚠️", StatusWarning},
+	{":red_circle:", "🔴", StatusFailure},
+}
+
+// ParseStatus replaces the Slack emojis of a status message by their unicode
+// counterparts and returns the status they represent.
+func ParseStatus(text string) (string, Status) {
+	status := StatusUnknown
+	for _, e := range statusEmojis {
+		if strings.Contains(text, e.emoji) {
+			text = strings.ReplaceAll(text, e.emoji, e.unicode)
+			status = e.status
+		}
+	}
+	return text, status
+}
+
+// StripStatus removes the Slack emojis from a status message and returns the
+// status they represent.
+func StripStatus(text string) (string, Status) {
+	status := StatusUnknown
+	for _, e := range statusEmojis {
+		if strings.Contains(text, e.emoji) {
+			text = strings.ReplaceAll(text, e.emoji, "")
+			status = e.status
+		}
+	}
+	return strings.TrimSpace(text), status
+}
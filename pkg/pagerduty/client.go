@@ -0,0 +1,147 @@
+package pagerduty
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+)
+
+const (
+	DefaultEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+	ActionTrigger = "trigger"
+	ActionResolve = "resolve"
+
+	source   = "flagger-k6-webhook"
+	severity = "critical"
+
+	// key of the single entry in the thread maps returned by this notifier
+	pagerDutyThread = "pagerduty"
+)
+
+// Event is an event of the PagerDuty Events API v2
+type Event struct {
+	RoutingKey  string        `json:"routing_key"`
+	EventAction string        `json:"event_action"`
+	DedupKey    string        `json:"dedup_key"`
+	Payload     *EventPayload `json:"payload,omitempty"`
+	Links       []Link        `json:"links,omitempty"`
+}
+
+// EventPayload describes the alert of trigger events
+type EventPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Group         string            `json:"group,omitempty"`
+	Component     string            `json:"component,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type Link struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+// Client triggers a PagerDuty alert when a test fails, and resolves it once a
+// test for the same canary and phase succeeds.
+type Client struct {
+	routingKey string
+	eventsURL  string
+	httpClient *http.Client
+}
+
+func NewClient(routingKey string) *Client {
+	return &Client{
+		routingKey: routingKey,
+		eventsURL:  DefaultEventsURL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ForTest returns a notifier alerting about the given test. The channels
+// passed to the notifier are ignored.
+func (c *Client) ForTest(test *notifier.Test) notifier.Notifier {
+	return &testNotifier{client: c, test: test}
+}
+
+type testNotifier struct {
+	client *Client
+	test   *notifier.Test
+}
+
+func (n *testNotifier) SendMessages(_ []string, text, _ string) (map[string]string, error) {
+	// Tests which didn't start are already done
+	if err := n.sendResult(text); err != nil {
+		return nil, err
+	}
+	return map[string]string{pagerDutyThread: ""}, nil
+}
+
+func (n *testNotifier) UpdateMessages(threads map[string]string, text, _ string) error {
+	if len(threads) == 0 {
+		return nil
+	}
+	return n.sendResult(text)
+}
+
+func (n *testNotifier) AddFileToThreads(map[string]string, string, string) error {
+	return nil
+}
+
+// sendResult triggers or resolves the alert if the status message is about a
+// finished test.
+func (n *testNotifier) sendResult(text string) error {
+	message, status := notifier.StripStatus(text)
+	event := Event{
+		RoutingKey: n.client.routingKey,
+		// Repeated failures update the same alert
+		DedupKey: fmt.Sprintf("%s/%s", source, n.test.Key),
+	}
+	switch status {
+	case notifier.StatusSuccess:
+		event.EventAction = ActionResolve
+	case notifier.StatusFailure:
+		event.EventAction = ActionTrigger
+		event.Payload = &EventPayload{
+			Summary:   message,
+			Source:    source,
+			Severity:  severity,
+			Group:     n.test.Namespace,
+			Component: n.test.Name,
+			CustomDetails: map[string]string{
+				"phase": n.test.Phase,
+			},
+		}
+		if n.test.CloudURL != "" {
+			event.Links = []Link{{Href: n.test.CloudURL, Text: "k6 Cloud run"}}
+		}
+	default:
+		return nil
+	}
+
+	if err := n.post(event); err != nil {
+		return fmt.Errorf("error sending %s event: %w", event.EventAction, err)
+	}
+	return nil
+}
+
+func (n *testNotifier) post(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.httpClient.Post(n.client.eventsURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
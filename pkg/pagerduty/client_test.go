@@ -0,0 +1,96 @@
+package pagerduty
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := NewClient("my-routing-key")
+	client.eventsURL = server.URL
+	return client
+}
+
+func TestTriggerAndResolve(t *testing.T) {
+	var bodies []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	// * A failed test triggers an alert
+	test := &notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout", Key: "test-space-test-name-pre-rollout", CloudURL: "https://app.k6.io/runs/1"}
+	n := client.ForTest(test)
+	threads, err := n.SendMessages(nil, ":warning: Load testing of `test-name` in namespace `test-space` has started", "context")
+	require.NoError(t, err)
+	require.NoError(t, n.AddFileToThreads(threads, "k6-results.txt", "the output"))
+	require.NoError(t, n.UpdateMessages(threads, ":red_circle: Load testing of `test-name` in namespace `test-space` has failed", "context"))
+
+	// * The next successful test resolves it
+	n = client.ForTest(&notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout", Key: "test-space-test-name-pre-rollout"})
+	threads, err = n.SendMessages(nil, ":warning: Load testing of `test-name` in namespace `test-space` has started", "context")
+	require.NoError(t, err)
+	require.NoError(t, n.UpdateMessages(threads, ":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded", "context"))
+
+	require.Len(t, bodies, 2)
+	assert.JSONEq(t, `{
+		"routing_key": "my-routing-key",
+		"event_action": "trigger",
+		"dedup_key": "flagger-k6-webhook/test-space-test-name-pre-rollout",
+		"payload": {
+			"summary": "Load testing of `+"`test-name`"+` in namespace `+"`test-space`"+` has failed",
+			"source": "flagger-k6-webhook",
+			"severity": "critical",
+			"group": "test-space",
+			"component": "test-name",
+			"custom_details": {"phase": "pre-rollout"}
+		},
+		"links": [{"href": "https://app.k6.io/runs/1", "text": "k6 Cloud run"}]
+	}`, bodies[0])
+	assert.JSONEq(t, `{
+		"routing_key": "my-routing-key",
+		"event_action": "resolve",
+		"dedup_key": "flagger-k6-webhook/test-space-test-name-pre-rollout"
+	}`, bodies[1])
+}
+
+func TestTriggerIfStartFailed(t *testing.T) {
+	var bodies []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	n := client.ForTest(&notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout", Key: "test-space-test-name-pre-rollout"})
+	_, err := n.SendMessages(nil, ":red_circle: Load testing of `test-name` in namespace `test-space` didn't start successfully", "")
+	require.NoError(t, err)
+
+	require.Len(t, bodies, 1)
+	assert.Contains(t, bodies[0], `"event_action":"trigger"`)
+	assert.Contains(t, bodies[0], `"summary":"Load testing of `+"`test-name`"+` in namespace `+"`test-space`"+` didn't start successfully"`)
+}
+
+func TestErrors(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	n := client.ForTest(&notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout", Key: "test-space-test-name-pre-rollout"})
+	threads, err := n.SendMessages(nil, ":warning: started", "")
+	require.NoError(t, err)
+	assert.EqualError(t, n.UpdateMessages(threads, ":red_circle: failed", ""), "error sending trigger event: unexpected status 400 Bad Request")
+}
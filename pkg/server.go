@@ -2,64 +2,178 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/grafana/flagger-k6-webhook/pkg/handlers"
 	"github.com/grafana/flagger-k6-webhook/pkg/k6"
 	"github.com/grafana/flagger-k6-webhook/pkg/slack"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"k8s.io/client-go/kubernetes"
 )
 
-func Listen(ctx context.Context, client k6.Client, kubeClient kubernetes.Interface, slackClient slack.Client, port int, maxProcessHandlers int) error {
-	launcherCtx, cancelLaunchCtx := context.WithCancel(ctx)
-	launchHandler, err := handlers.NewLaunchHandler(launcherCtx, client, kubeClient, slackClient, maxProcessHandlers)
+// ServerTimeouts are the timeouts of the HTTP server. 0 disables a timeout.
+type ServerTimeouts struct {
+	// Read is the maximum duration for reading a request, including its body
+	Read time.Duration
+	// Write is the maximum duration before timing out the writes of a
+	// response. As responses are written once the test is done when waiting
+	// for its results, it has to be longer than the tests.
+	Write time.Duration
+	// Idle is the maximum duration to wait for the next request on a
+	// keep-alive connection
+	Idle time.Duration
+}
+
+// ServerConfig are the settings of the HTTP server, as opposed to the ones of
+// the tests which are given as handlers.LaunchHandlerOption.
+type ServerConfig struct {
+	// The port to listen on
+	Port int
+	// If set, the requests to /launch-test, /tests/{key}, /history and
+	// /admin/concurrency must carry an `Authorization: Bearer <token>`
+	// header. /admin/concurrency is only served if set
+	AuthToken string
+	// /readyz fails while fewer test runs are available
+	ReadyMinAvailableTests int
+	// If true, /readyz fails if `k6 version` fails
+	HealthCheckK6 bool
+	// How long the in-flight requests are waited for on shutdown, 0 to kill
+	// the running tests right away
+	DrainTimeout time.Duration
+	Timeouts     ServerTimeouts
+	// If true, HTTP/2 over cleartext connections (h2c) is accepted along with
+	// HTTP/1.1
+	EnableH2C bool
+	// If set, all the routes are served under this path prefix
+	RoutePrefix string
+}
+
+// newServer returns the HTTP server. If enableH2C is true, it also accepts
+// HTTP/2 over cleartext connections (h2c), ex: from a service mesh, along with
+// HTTP/1.1.
+func newServer(addr string, handler http.Handler, timeouts ServerTimeouts, enableH2C bool) *http.Server {
+	if enableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: timeouts.Idle})
+	}
+	return &http.Server{
+		Handler:      handler,
+		Addr:         addr,
+		ReadTimeout:  timeouts.Read,
+		WriteTimeout: timeouts.Write,
+		IdleTimeout:  timeouts.Idle,
+	}
+}
+
+// withRoutePrefix serves the routes of the handler under the given prefix, ex:
+// `/launch-test` at `/k6/launch-test` with the `k6` prefix, for ingresses that
+// don't strip it. Leading and trailing slashes of the prefix don't matter.
+// Requests outside of the prefix get a 404.
+func withRoutePrefix(prefix string, handler http.Handler) http.Handler {
+	prefix = normalizeRoutePrefix(prefix)
+	if prefix == "" {
+		return handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, handler))
+	return mux
+}
+
+// normalizeRoutePrefix returns the prefix with a single leading slash and no
+// trailing one, or an empty string if there is no prefix.
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+func Listen(ctx context.Context, client k6.Client, kubeClient kubernetes.Interface, slackClient slack.Client, maxProcessHandlers int, config ServerConfig, launchOpts ...handlers.LaunchHandlerOption) error {
+	// The tests are only killed once the in-flight requests have been
+	// drained, not as soon as ctx is done
+	launcherCtx, cancelLaunchCtx := context.WithCancel(context.WithoutCancel(ctx))
+	launchHandler, err := handlers.NewLaunchHandler(launcherCtx, client, kubeClient, slackClient, maxProcessHandlers, launchOpts...)
+	if err != nil {
+		cancelLaunchCtx()
+		return err
+	}
 	defer func() {
 		logrus.Debug("shutting down launch handler")
 		cancelLaunchCtx()
 		launchHandler.Wait()
 	}()
-	if err != nil {
-		return err
-	}
 
-	serveAddress := fmt.Sprintf(":%d", port)
-	logrus.Info("starting server at " + serveAddress)
+	reportK6Version(ctx, client, prometheus.DefaultRegisterer)
+
+	serveAddress := fmt.Sprintf(":%d", config.Port)
+	logrus.Info("starting server at " + serveAddress + normalizeRoutePrefix(config.RoutePrefix))
 
 	mux := http.NewServeMux()
-	srv := http.Server{
-		Handler: mux,
-		Addr:    serveAddress,
-	}
+	srv := newServer(serveAddress, withRoutePrefix(config.RoutePrefix, mux), config.Timeouts, config.EnableH2C)
 
 	go func() {
 		<-ctx.Done()
+		if config.DrainTimeout > 0 {
+			// Let the tests whose results are waited for complete, so that
+			// Flagger gets their actual result
+			logrus.Infof("draining in-flight requests (waiting up to %s)", config.DrainTimeout)
+			drainCtx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+			if err := launchHandler.Drain(drainCtx); err != nil {
+				logrus.Warnf("killing the remaining tests: %v", err)
+			}
+			cancel()
+		}
 		cancelLaunchCtx()
 		timeoutCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 		defer cancel()
 		_ = srv.Shutdown(timeoutCtx)
 	}()
 
+	var readyK6Client k6.Client
+	if config.HealthCheckK6 {
+		readyK6Client = client
+	}
+	mux.HandleFunc("/livez", handlers.HandleHealth)
+	mux.Handle("/readyz", handlers.NewReadyHandler(launchHandler, config.ReadyMinAvailableTests, readyK6Client))
+	// Kept for backwards compatibility
 	mux.HandleFunc("/health", handlers.HandleHealth)
 	mux.Handle("/metrics", promhttp.Handler())
 
+	launchRequests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "launch_requests_total",
+			Help: "Total number of /launch-test requests by HTTP code.",
+		},
+		[]string{"code"},
+	)
+	if err := prometheus.Register(launchRequests); err != nil {
+		logrus.Warnf("Failed to register new metric: %s", err.Error())
+	}
 	mux.Handle("/launch-test",
 		promhttp.InstrumentHandlerCounter(
-			promauto.NewCounterVec(
-				prometheus.CounterOpts{
-					Name: "launch_requests_total",
-					Help: "Total number of /launch-test requests by HTTP code.",
-				},
-				[]string{"code"},
-			),
-			launchHandler,
+			launchRequests,
+			handlers.RequireBearerToken(config.AuthToken, launchHandler),
 		),
 	)
 
-	return srv.ListenAndServe()
+	mux.Handle("DELETE /tests/{key}", handlers.RequireBearerToken(config.AuthToken, handlers.NewCancelHandler(launchHandler)))
+	mux.Handle("GET /history", handlers.RequireBearerToken(config.AuthToken, handlers.NewHistoryHandler(launchHandler)))
+	// The admin routes are never served unauthenticated
+	if config.AuthToken != "" {
+		mux.Handle("POST /admin/concurrency", handlers.RequireBearerToken(config.AuthToken, handlers.NewConcurrencyHandler(launchHandler)))
+	}
+
+	// The server is closed on shutdown, which isn't a failure
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
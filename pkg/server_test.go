@@ -0,0 +1,209 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafana/flagger-k6-webhook/pkg/handlers"
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/grafana/flagger-k6-webhook/pkg/mocks"
+	"github.com/grafana/flagger-k6-webhook/pkg/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestNewServer(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := newServer(":8000", mux, ServerTimeouts{Read: time.Second, Write: time.Minute, Idle: time.Hour}, false)
+
+	assert.Equal(t, ":8000", srv.Addr)
+	assert.Equal(t, mux, srv.Handler)
+	assert.Equal(t, time.Second, srv.ReadTimeout)
+	assert.Equal(t, time.Minute, srv.WriteTimeout)
+	assert.Equal(t, time.Hour, srv.IdleTimeout)
+}
+
+func TestNewServerH2C(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handlers.HandleHealth)
+	server := httptest.NewServer(newServer("", mux, ServerTimeouts{}, true).Handler)
+	t.Cleanup(server.Close)
+
+	// HTTP/2 with prior knowledge, over a cleartext connection
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := h2cClient.Get(server.URL + "/health")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	// HTTP/1.1 still works
+	resp, err = server.Client().Get(server.URL + "/health")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, resp.ProtoMajor)
+}
+
+func TestWithRoutePrefix(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handlers.HandleHealth)
+	mux.HandleFunc("DELETE /tests/{key}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.PathValue("key")))
+	})
+
+	for _, tc := range []struct {
+		name       string
+		prefix     string
+		path       string
+		wantStatus int
+	}{
+		{name: "no prefix", prefix: "", path: "/health", wantStatus: http.StatusOK},
+		{name: "root prefix", prefix: "/", path: "/health", wantStatus: http.StatusOK},
+		{name: "prefix", prefix: "/k6", path: "/k6/health", wantStatus: http.StatusOK},
+		{name: "prefix without slashes", prefix: "k6", path: "/k6/health", wantStatus: http.StatusOK},
+		{name: "prefix with trailing slashes", prefix: "/load-tests/k6//", path: "/load-tests/k6/health", wantStatus: http.StatusOK},
+		{name: "route outside of the prefix", prefix: "/k6", path: "/health", wantStatus: http.StatusNotFound},
+		{name: "other prefix", prefix: "/k6", path: "/k6-other/health", wantStatus: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			withRoutePrefix(tc.prefix, mux).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			assert.Equal(t, tc.wantStatus, rr.Code)
+		})
+	}
+
+	t.Run("path values", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		withRoutePrefix("/k6", mux).ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/k6/tests/test-space-test-name-pre-rollout", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "test-space-test-name-pre-rollout", rr.Body.String())
+	})
+}
+
+// On shutdown, the tests whose results are waited for run to completion
+// within the drain timeout rather than being killed right away.
+func TestListenDrain(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	k6Client := mocks.NewMockK6Client(mockCtrl)
+	testRun := mocks.NewMockK6TestRun(mockCtrl)
+	k6Client.EXPECT().Version(gomock.Any()).Return("k6 v0.50.0 (go1.22.1, linux/amd64)", nil).AnyTimes()
+	testRun.EXPECT().ExecutionDuration().Return(time.Minute).AnyTimes()
+	testRun.EXPECT().ExitCode().Return(0).AnyTimes()
+	testRun.EXPECT().Exited().Return(false).AnyTimes()
+	testRun.EXPECT().PID().Return(-1).AnyTimes()
+	testRun.EXPECT().SetCancelFunc(gomock.Any()).AnyTimes()
+	testRun.EXPECT().CleanupContext().AnyTimes()
+
+	// The test runs until it is told to complete
+	processCtxs := make(chan context.Context, 1)
+	complete := make(chan struct{})
+	k6Client.EXPECT().Start(gomock.Any(), gomock.Any(), false, gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, script k6.Script, upload bool, envVars map[string]string, extraArgs []string, stdout, stderr io.Writer) (k6.TestRun, error) {
+		stdout.Write([]byte("     output: -\n"))
+		processCtxs <- ctx
+		return testRun, nil
+	})
+	testRun.EXPECT().Wait().DoAndReturn(func() error {
+		<-complete
+		return nil
+	})
+
+	port := freePort(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- Listen(ctx, k6Client, nil, slack.NewClient("", 0, false), 10, ServerConfig{Port: port, DrainTimeout: 10 * time.Second})
+	}()
+	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(url + "/livez")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	responseCode := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(url+"/launch-test", "application/json", strings.NewReader(`{"name": "test-name", "namespace": "test-space", "phase": "pre-rollout", "metadata": {"script": "my-script"}}`))
+		if err != nil {
+			responseCode <- 0
+			return
+		}
+		resp.Body.Close()
+		responseCode <- resp.StatusCode
+	}()
+	processCtx := <-processCtxs
+
+	// Shutting down doesn't kill the test
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, processCtx.Err())
+
+	// The request gets the result of the test once it completes
+	close(complete)
+	assert.Equal(t, http.StatusOK, <-responseCode)
+	select {
+	case err := <-listenErr:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server didn't shut down")
+	}
+}
+
+// freePort returns a port that was free when it was called.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Invalid launch handler options are reported as errors.
+func TestListenInvalidLaunchOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opt      handlers.LaunchHandlerOption
+		expected string
+	}{
+		{
+			name:     "test failure status",
+			opt:      handlers.WithTestFailureStatus(http.StatusOK),
+			expected: "invalid test failure status: 200 is not a 4xx or 5xx status",
+		},
+		{
+			name:     "wait time bounds",
+			opt:      handlers.WithWaitTime(60, 600, 10),
+			expected: "invalid wait time bounds: the minimum (600) must be between 0 and the maximum (10)",
+		},
+		{
+			name:     "k6 log output",
+			opt:      handlers.WithLogOutput("file=/tmp/k6.log"),
+			expected: `invalid k6 log output: "file=/tmp/k6.log" is not a supported k6 log output (none, stdout, stderr or loki)`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k6Client := mocks.NewMockK6Client(gomock.NewController(t))
+			err := Listen(context.Background(), k6Client, nil, slack.NewClient("", 0, false), 10, ServerConfig{Port: freePort(t)}, tc.opt)
+			assert.EqualError(t, err, tc.expected)
+		})
+	}
+}
@@ -1,31 +1,70 @@
 package slack
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	log "github.com/sirupsen/logrus"
 	"github.com/slack-go/slack"
 )
 
+const initialRetryBackoff = time.Second
+
+// slackAPI is the subset of the slack client used by the wrapper
+type slackAPI interface {
+	SendMessage(channel string, options ...slack.MsgOption) (string, string, string, error)
+	UpdateMessage(channelID, timestamp string, options ...slack.MsgOption) (string, string, string, error)
+	UploadFileV2(params slack.UploadFileV2Parameters) (*slack.FileSummary, error)
+	GetPermalink(params *slack.PermalinkParameters) (string, error)
+}
+
 type slackClientWrapper struct {
-	client *slack.Client
+	client       slackAPI
+	maxRetries   int
+	consolidated bool
+
+	// mockables
+	sleep func(time.Duration)
 }
 
-func NewClient(token string) Client {
+// NewClient returns a Slack client. Transient errors (rate limiting and server
+// errors) are retried up to maxRetries times with an exponential backoff.
+// In consolidated mode, the messages are only posted, updated and threaded in
+// the first channel, the other channels get a link to it.
+func NewClient(token string, maxRetries int, consolidated bool) Client {
 	if token == "" {
 		return &noopClient{}
 	}
 
 	return &slackClientWrapper{
-		client: slack.New(token),
+		client:       slack.New(token),
+		maxRetries:   maxRetries,
+		consolidated: consolidated,
+		sleep:        time.Sleep,
 	}
 }
 
 func (w *slackClientWrapper) SendMessages(channels []string, text, context string) (map[string]string, error) {
+	return w.sendMessages(channels, text, context, "")
+}
+
+// sendMessages posts the messages as replies to the threadTS message if set.
+func (w *slackClientWrapper) sendMessages(channels []string, text, context, threadTS string) (map[string]string, error) {
+	options := []slack.MsgOption{messageBlocks(text, context, nil)}
+	if threadTS != "" {
+		options = append(options, slack.MsgOptionTS(threadTS))
+	}
+	if w.consolidated && len(channels) > 1 {
+		return w.sendConsolidatedMessage(channels, text, context, options)
+	}
+
 	slackMessages := map[string]string{}
 	for _, channel := range channels {
-		channelID, ts, _, err := w.client.SendMessage(channel, messageBlocks(text, context))
+		channelID, ts, err := w.sendMessage(channel, options)
 		if err != nil {
-			return nil, fmt.Errorf("error sending message to %s: %w", channel, err)
+			return nil, err
 		}
 		slackMessages[channelID] = ts
 	}
@@ -33,9 +72,56 @@ func (w *slackClientWrapper) SendMessages(channels []string, text, context strin
 	return slackMessages, nil
 }
 
+// sendConsolidatedMessage posts the message to the first channel and a link to
+// it to the other ones. Only the first message is returned, so that it is the
+// only one updated and receiving the files.
+func (w *slackClientWrapper) sendConsolidatedMessage(channels []string, text, context string, options []slack.MsgOption) (map[string]string, error) {
+	channelID, ts, err := w.sendMessage(channels[0], options)
+	if err != nil {
+		return nil, err
+	}
+
+	var permalink string
+	err = w.retry(func() (err error) {
+		permalink, err = w.client.GetPermalink(&slack.PermalinkParameters{Channel: channelID, Ts: ts})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting the link of message %s in channel %s: %w", ts, channelID, err)
+	}
+
+	linkOptions := []slack.MsgOption{messageBlocks(fmt.Sprintf("%s\n<%s|Follow the test in %s>", text, permalink, channels[0]), context, nil)}
+	for _, channel := range channels[1:] {
+		if _, _, err := w.sendMessage(channel, linkOptions); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]string{channelID: ts}, nil
+}
+
+func (w *slackClientWrapper) sendMessage(channel string, options []slack.MsgOption) (channelID, ts string, err error) {
+	err = w.retry(func() (err error) {
+		channelID, ts, _, err = w.client.SendMessage(channel, options...)
+		return err
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error sending message to %s: %w", channel, err)
+	}
+	return channelID, ts, nil
+}
+
 func (w *slackClientWrapper) UpdateMessages(slackMessages map[string]string, text, context string) error {
+	return w.updateMessages(slackMessages, text, context, nil)
+}
+
+func (w *slackClientWrapper) updateMessages(slackMessages map[string]string, text, context string, metrics *notifier.Metrics) error {
 	for channelID, ts := range slackMessages {
-		if _, _, _, err := w.client.UpdateMessage(channelID, ts, messageBlocks(text, context)); err != nil {
+		err := w.retry(func() error {
+			_, _, _, err := w.client.UpdateMessage(channelID, ts, messageBlocks(text, context, metrics))
+			return err
+		})
+		if err != nil {
 			return fmt.Errorf("error updating message %s in channel %s: %w", ts, channelID, err)
 		}
 	}
@@ -44,14 +130,27 @@ func (w *slackClientWrapper) UpdateMessages(slackMessages map[string]string, tex
 }
 
 func (w *slackClientWrapper) AddFileToThreads(slackMessages map[string]string, fileName, content string) error {
+	return w.addFileToThreads(slackMessages, fileName, content, "")
+}
+
+// addFileToThreads uploads the files to the threadTS thread if set, instead
+// of the threads of the messages.
+func (w *slackClientWrapper) addFileToThreads(slackMessages map[string]string, fileName, content, threadTS string) error {
 	for channelID, ts := range slackMessages {
+		if threadTS != "" {
+			ts = threadTS
+		}
 		fileParams := slack.UploadFileV2Parameters{
 			Title:           fileName,
 			Content:         content,
 			Channel:         channelID,
 			ThreadTimestamp: ts,
 		}
-		if _, err := w.client.UploadFileV2(fileParams); err != nil {
+		err := w.retry(func() error {
+			_, err := w.client.UploadFileV2(fileParams)
+			return err
+		})
+		if err != nil {
 			return fmt.Errorf("error while uploading output to %s in slack channel %s: %w", ts, channelID, err)
 		}
 	}
@@ -59,12 +158,66 @@ func (w *slackClientWrapper) AddFileToThreads(slackMessages map[string]string, f
 	return nil
 }
 
-func messageBlocks(text, context string) slack.MsgOption {
+// ForTest returns a notifier which adds the metrics of the given test to the
+// messages once they are known, and posts them to the thread of the test if
+// any.
+func (w *slackClientWrapper) ForTest(test *notifier.Test) notifier.Notifier {
+	return &testClient{slackClientWrapper: w, test: test}
+}
+
+type testClient struct {
+	*slackClientWrapper
+	test *notifier.Test
+}
+
+func (c *testClient) SendMessages(channels []string, text, context string) (map[string]string, error) {
+	return c.sendMessages(channels, text, context, c.test.SlackThreadTS)
+}
+
+func (c *testClient) AddFileToThreads(slackMessages map[string]string, fileName, content string) error {
+	return c.addFileToThreads(slackMessages, fileName, content, c.test.SlackThreadTS)
+}
+
+func (c *testClient) UpdateMessages(slackMessages map[string]string, text, context string) error {
+	return c.updateMessages(slackMessages, text, context, c.test.Metrics)
+}
+
+// retry calls fn until it succeeds, returns an error that isn't transient or
+// the maximum number of retries is reached. Rate limiting errors are retried
+// after the delay given by Slack.
+func (w *slackClientWrapper) retry(fn func() error) error {
+	backoff := initialRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= w.maxRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := backoff
+		var rateLimitedErr *slack.RateLimitedError
+		if errors.As(err, &rateLimitedErr) && rateLimitedErr.RetryAfter > 0 {
+			delay = rateLimitedErr.RetryAfter
+		}
+		log.Debugf("transient slack error, retrying in %s: %s", delay, err)
+		w.sleep(delay)
+		backoff *= 2
+	}
+}
+
+func isRetryable(err error) bool {
+	var retryable interface{ Retryable() bool }
+	return errors.As(err, &retryable) && retryable.Retryable()
+}
+
+func messageBlocks(text, context string, metrics *notifier.Metrics) slack.MsgOption {
 	blocks := []slack.Block{
 		slack.NewSectionBlock(
 			slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil,
 		),
 	}
+	if fields := metricFields(metrics); len(fields) > 0 {
+		blocks = append(blocks, slack.NewSectionBlock(nil, fields, nil))
+	}
 	if context != "" {
 		blocks = append(blocks, slack.NewContextBlock("",
 			slack.NewTextBlockObject(slack.MarkdownType, context, false, false),
@@ -73,3 +226,21 @@ func messageBlocks(text, context string) slack.MsgOption {
 
 	return slack.MsgOptionBlocks(blocks...)
 }
+
+func metricFields(metrics *notifier.Metrics) []*slack.TextBlockObject {
+	if metrics == nil {
+		return nil
+	}
+	var fields []*slack.TextBlockObject
+	for _, m := range []struct{ name, value string }{
+		{"VUs", metrics.VUs},
+		{"Iterations", metrics.Iterations},
+		{"http_req_duration p(95)", metrics.HTTPReqDurationP95},
+		{"Error rate", metrics.HTTPReqFailedRate},
+	} {
+		if m.value != "" {
+			fields = append(fields, slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*%s*\n%s", m.name, m.value), false, false))
+		}
+	}
+	return fields
+}
@@ -0,0 +1,263 @@
+package slack
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubSlackAPI returns the given errors in order on each call, then succeeds
+type stubSlackAPI struct {
+	errs  []error
+	calls int
+
+	// options of the last message sent or updated
+	lastOptions []slack.MsgOption
+	// parameters of the last file uploaded
+	lastUpload slack.UploadFileV2Parameters
+	// channels of the messages sent, updated and files uploaded
+	sent, updated, uploads []string
+}
+
+func (s *stubSlackAPI) next() error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *stubSlackAPI) SendMessage(channel string, options ...slack.MsgOption) (string, string, string, error) {
+	s.lastOptions = options
+	s.sent = append(s.sent, channel)
+	return "C" + channel, "ts", "", s.next()
+}
+
+func (s *stubSlackAPI) UpdateMessage(channelID, timestamp string, options ...slack.MsgOption) (string, string, string, error) {
+	s.lastOptions = options
+	s.updated = append(s.updated, channelID)
+	return channelID, timestamp, "", s.next()
+}
+
+func (s *stubSlackAPI) UploadFileV2(params slack.UploadFileV2Parameters) (*slack.FileSummary, error) {
+	s.lastUpload = params
+	s.uploads = append(s.uploads, params.Channel)
+	return &slack.FileSummary{}, s.next()
+}
+
+func (s *stubSlackAPI) GetPermalink(params *slack.PermalinkParameters) (string, error) {
+	return "https://slack.example/archives/" + params.Channel + "/p" + params.Ts, s.next()
+}
+
+func newTestClient(api *stubSlackAPI, maxRetries int) (*slackClientWrapper, *[]time.Duration) {
+	var sleeps []time.Duration
+	return &slackClientWrapper{
+		client:     api,
+		maxRetries: maxRetries,
+		sleep:      func(d time.Duration) { sleeps = append(sleeps, d) },
+	}, &sleeps
+}
+
+func TestRetries(t *testing.T) {
+	t.Run("succeeds after transient failures", func(t *testing.T) {
+		api := &stubSlackAPI{errs: []error{
+			slack.StatusCodeError{Code: http.StatusBadGateway, Status: "502 Bad Gateway"},
+			&slack.RateLimitedError{RetryAfter: 5 * time.Second},
+		}}
+		client, sleeps := newTestClient(api, 3)
+
+		threads, err := client.SendMessages([]string{"test"}, "text", "")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"Ctest": "ts"}, threads)
+		assert.Equal(t, 3, api.calls)
+		// Exponential backoff, except for rate limiting where the delay given
+		// by Slack is honored
+		assert.Equal(t, []time.Duration{time.Second, 5 * time.Second}, *sleeps)
+	})
+
+	t.Run("gives up after the maximum number of retries", func(t *testing.T) {
+		api := &stubSlackAPI{errs: []error{
+			slack.StatusCodeError{Code: http.StatusInternalServerError, Status: "500 Internal Server Error"},
+			slack.StatusCodeError{Code: http.StatusInternalServerError, Status: "500 Internal Server Error"},
+			slack.StatusCodeError{Code: http.StatusInternalServerError, Status: "500 Internal Server Error"},
+		}}
+		client, sleeps := newTestClient(api, 2)
+
+		err := client.UpdateMessages(map[string]string{"C1234": "ts"}, "text", "")
+		assert.EqualError(t, err, "error updating message ts in channel C1234: slack server error: 500 Internal Server Error")
+		assert.Equal(t, 3, api.calls)
+		assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *sleeps)
+	})
+
+	t.Run("doesn't retry permanent errors", func(t *testing.T) {
+		api := &stubSlackAPI{errs: []error{errors.New("channel_not_found")}}
+		client, sleeps := newTestClient(api, 3)
+
+		err := client.AddFileToThreads(map[string]string{"C1234": "ts"}, "k6-results.txt", "content")
+		assert.EqualError(t, err, "error while uploading output to ts in slack channel C1234: channel_not_found")
+		assert.Equal(t, 1, api.calls)
+		assert.Empty(t, *sleeps)
+	})
+}
+
+// blocksJSON returns the JSON of the blocks set by the given message options
+func blocksJSON(t *testing.T, options ...slack.MsgOption) string {
+	t.Helper()
+
+	return messageValue(t, "blocks", options...)
+}
+
+// messageValue returns the value of the given parameter set by the message
+// options
+func messageValue(t *testing.T, key string, options ...slack.MsgOption) string {
+	t.Helper()
+
+	_, values, err := slack.UnsafeApplyMsgOptions("token", "channel", "https://slack.com/api/", options...)
+	require.NoError(t, err)
+	return values.Get(key)
+}
+
+func TestMessageBlocks(t *testing.T) {
+	t.Run("text and context", func(t *testing.T) {
+		assert.JSONEq(t, `[
+			{"type": "section", "text": {"type": "mrkdwn", "text": "text"}},
+			{"type": "context", "elements": [{"type": "mrkdwn", "text": "context"}]}
+		]`, blocksJSON(t, messageBlocks("text", "context", nil)))
+	})
+
+	t.Run("with metrics", func(t *testing.T) {
+		metrics := &notifier.Metrics{VUs: "2", Iterations: "582", HTTPReqDurationP95: "524.76µs", HTTPReqFailedRate: "0.00%"}
+		assert.JSONEq(t, `[
+			{"type": "section", "text": {"type": "mrkdwn", "text": "text"}},
+			{"type": "section", "fields": [
+				{"type": "mrkdwn", "text": "*VUs*\n2"},
+				{"type": "mrkdwn", "text": "*Iterations*\n582"},
+				{"type": "mrkdwn", "text": "*http_req_duration p(95)*\n524.76µs"},
+				{"type": "mrkdwn", "text": "*Error rate*\n0.00%"}
+			]}
+		]`, blocksJSON(t, messageBlocks("text", "", metrics)))
+	})
+
+	t.Run("with partial metrics", func(t *testing.T) {
+		metrics := &notifier.Metrics{Iterations: "582"}
+		assert.JSONEq(t, `[
+			{"type": "section", "text": {"type": "mrkdwn", "text": "text"}},
+			{"type": "section", "fields": [{"type": "mrkdwn", "text": "*Iterations*\n582"}]}
+		]`, blocksJSON(t, messageBlocks("text", "", metrics)))
+	})
+}
+
+func TestForTest(t *testing.T) {
+	api := &stubSlackAPI{}
+	client, _ := newTestClient(api, 0)
+	test := &notifier.Test{Name: "test-name", Namespace: "test-space", Phase: "pre-rollout"}
+	testClient := client.ForTest(test)
+
+	// Metrics aren't known yet
+	threads, err := testClient.SendMessages([]string{"test"}, "text", "")
+	require.NoError(t, err)
+	assert.NotContains(t, blocksJSON(t, api.lastOptions...), "fields")
+
+	// They are added once the test is done
+	test.Metrics = &notifier.Metrics{VUs: "2"}
+	require.NoError(t, testClient.UpdateMessages(threads, "text", ""))
+	assert.Contains(t, blocksJSON(t, api.lastOptions...), `"*VUs*\n2"`)
+}
+
+func TestThreadTimestamp(t *testing.T) {
+	t.Run("new thread", func(t *testing.T) {
+		api := &stubSlackAPI{}
+		client, _ := newTestClient(api, 0)
+		testClient := client.ForTest(&notifier.Test{Name: "test-name"})
+
+		threads, err := testClient.SendMessages([]string{"test"}, "text", "")
+		require.NoError(t, err)
+		assert.Empty(t, messageValue(t, "thread_ts", api.lastOptions...))
+
+		require.NoError(t, testClient.AddFileToThreads(threads, "k6-results.txt", "content"))
+		assert.Equal(t, "ts", api.lastUpload.ThreadTimestamp)
+	})
+
+	t.Run("existing thread", func(t *testing.T) {
+		api := &stubSlackAPI{}
+		client, _ := newTestClient(api, 0)
+		testClient := client.ForTest(&notifier.Test{Name: "test-name", SlackThreadTS: "1712345678.123456"})
+
+		threads, err := testClient.SendMessages([]string{"test"}, "text", "")
+		require.NoError(t, err)
+		assert.Equal(t, "1712345678.123456", messageValue(t, "thread_ts", api.lastOptions...))
+		// The reply is updated
+		assert.Equal(t, map[string]string{"Ctest": "ts"}, threads)
+
+		// The file is uploaded to the thread
+		require.NoError(t, testClient.AddFileToThreads(threads, "k6-results.txt", "content"))
+		assert.Equal(t, "1712345678.123456", api.lastUpload.ThreadTimestamp)
+	})
+}
+
+func TestConsolidated(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		consolidated bool
+		wantThreads  map[string]string
+		wantUploads  []string
+	}{
+		{
+			name:        "per channel",
+			wantThreads: map[string]string{"Cchannel1": "ts", "Cchannel2": "ts", "Cchannel3": "ts"},
+			wantUploads: []string{"Cchannel1", "Cchannel2", "Cchannel3"},
+		},
+		{
+			name:         "consolidated",
+			consolidated: true,
+			wantThreads:  map[string]string{"Cchannel1": "ts"},
+			wantUploads:  []string{"Cchannel1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &stubSlackAPI{}
+			client, _ := newTestClient(api, 0)
+			client.consolidated = tc.consolidated
+			testClient := client.ForTest(&notifier.Test{Name: "test-name"})
+
+			threads, err := testClient.SendMessages([]string{"channel1", "channel2", "channel3"}, "text", "")
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantThreads, threads)
+			assert.Equal(t, []string{"channel1", "channel2", "channel3"}, api.sent)
+
+			require.NoError(t, testClient.UpdateMessages(threads, "done", ""))
+			assert.ElementsMatch(t, tc.wantUploads, api.updated)
+			require.NoError(t, testClient.AddFileToThreads(threads, "k6-results.txt", "content"))
+			assert.ElementsMatch(t, tc.wantUploads, api.uploads)
+		})
+	}
+
+	t.Run("link to the first channel", func(t *testing.T) {
+		api := &stubSlackAPI{}
+		client, _ := newTestClient(api, 0)
+		client.consolidated = true
+
+		_, err := client.SendMessages([]string{"channel1", "channel2"}, "text", "")
+		require.NoError(t, err)
+		assert.Contains(t, blocksJSON(t, api.lastOptions...), "https://slack.example/archives/Cchannel1/pts|Follow the test in channel1")
+	})
+
+	t.Run("single channel", func(t *testing.T) {
+		api := &stubSlackAPI{}
+		client, _ := newTestClient(api, 0)
+		client.consolidated = true
+
+		threads, err := client.SendMessages([]string{"channel1"}, "text", "")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"Cchannel1": "ts"}, threads)
+		assert.Equal(t, 1, api.calls)
+	})
+}
@@ -0,0 +1,171 @@
+package teams
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/notifier"
+)
+
+const (
+	// Teams rejects messages larger than 28KB so files are truncated to keep
+	// some room for the rest of the card
+	maxFileContentLength = 20000
+	truncationMarker     = "...[output truncated]...\n"
+)
+
+var (
+	statusColors = map[notifier.Status]string{
+		notifier.StatusUnknown: "Default",
+		notifier.StatusWarning: "Warning",
+		notifier.StatusSuccess: "Good",
+		notifier.StatusFailure: "Attention",
+	}
+	slackLinkRegex = regexp.MustCompile(`<(https?://[^|>]+)>`)
+)
+
+type teamsClient struct {
+	webhookURLs map[string]string
+	httpClient  *http.Client
+}
+
+// NewClient returns a notifier posting adaptive cards to Teams incoming
+// webhooks. The given map contains the webhook URL of each channel.
+func NewClient(webhookURLs map[string]string) notifier.Notifier {
+	return &teamsClient{
+		webhookURLs: webhookURLs,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ParseWebhookURLs parses a list of `<channel>=<webhook URL>` entries.
+func ParseWebhookURLs(entries []string) (map[string]string, error) {
+	webhookURLs := map[string]string{}
+	for _, entry := range entries {
+		channel, url, ok := strings.Cut(entry, "=")
+		if !ok || channel == "" || url == "" {
+			return nil, fmt.Errorf("invalid Teams webhook %q, expected <channel>=<webhook URL>", entry)
+		}
+		webhookURLs[channel] = url
+	}
+	return webhookURLs, nil
+}
+
+// SendMessages posts a card to each channel. Incoming webhooks don't return a
+// message ID so the returned map only holds the channel names.
+func (c *teamsClient) SendMessages(channels []string, text, context string) (map[string]string, error) {
+	threads := map[string]string{}
+	for _, channel := range channels {
+		if err := c.post(channel, statusCard(text, context)); err != nil {
+			return nil, fmt.Errorf("error sending message to %s: %w", channel, err)
+		}
+		threads[channel] = ""
+	}
+	return threads, nil
+}
+
+// UpdateMessages posts a new card to each channel since messages sent through
+// incoming webhooks can't be edited.
+func (c *teamsClient) UpdateMessages(threads map[string]string, text, context string) error {
+	for channel := range threads {
+		if err := c.post(channel, statusCard(text, context)); err != nil {
+			return fmt.Errorf("error updating message in channel %s: %w", channel, err)
+		}
+	}
+	return nil
+}
+
+// AddFileToThreads posts the file content as a card since incoming webhooks
+// don't support attachments.
+func (c *teamsClient) AddFileToThreads(threads map[string]string, fileName, content string) error {
+	if len(content) > maxFileContentLength {
+		content = truncationMarker + content[len(content)-maxFileContentLength:]
+	}
+	for channel := range threads {
+		if err := c.post(channel, fileCard(fileName, content)); err != nil {
+			return fmt.Errorf("error while uploading output to channel %s: %w", channel, err)
+		}
+	}
+	return nil
+}
+
+func (c *teamsClient) post(channel string, card map[string]any) error {
+	url, ok := c.webhookURLs[channel]
+	if !ok {
+		return fmt.Errorf("no webhook URL configured for channel %s", channel)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content":     card,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func statusCard(text, context string) map[string]any {
+	text, status := notifier.ParseStatus(text)
+
+	body := []map[string]any{{
+		"type":   "TextBlock",
+		"text":   text,
+		"color":  statusColors[status],
+		"weight": "Bolder",
+		"wrap":   true,
+	}}
+	if context != "" {
+		body = append(body, map[string]any{
+			"type":     "TextBlock",
+			"text":     slackLinkRegex.ReplaceAllString(context, "[$1]($1)"),
+			"isSubtle": true,
+			"size":     "Small",
+			"wrap":     true,
+		})
+	}
+	return adaptiveCard(body)
+}
+
+func fileCard(fileName, content string) map[string]any {
+	return adaptiveCard([]map[string]any{
+		{
+			"type":   "TextBlock",
+			"text":   fileName,
+			"weight": "Bolder",
+		},
+		{
+			"type":     "TextBlock",
+			"text":     content,
+			"fontType": "Monospace",
+			"size":     "Small",
+			"wrap":     true,
+		},
+	})
+}
+
+func adaptiveCard(body []map[string]any) map[string]any {
+	return map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+}
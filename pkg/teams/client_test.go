@@ -0,0 +1,100 @@
+package teams
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCards(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{
+			name:     "start",
+			text:     ":warning: Load testing of `test-name` in namespace `test-space` has started",
+			expected: `{"attachments":[{"content":{"$schema":"http://adaptivecards.io/schemas/adaptive-card.json","body":[{"color":"Warning","text":"⚠️ Load testing of ` + "`test-name`" + ` in namespace ` + "`test-space`" + ` has started","type":"TextBlock","weight":"Bolder","wrap":true},{"isSubtle":true,"size":"Small","text":"extra context\nCloud URL: [https://app.k6.io/runs/1](https://app.k6.io/runs/1)","type":"TextBlock","wrap":true}],"type":"AdaptiveCard","version":"1.4"},"contentType":"application/vnd.microsoft.card.adaptive"}],"type":"message"}`,
+		},
+		{
+			name:     "success",
+			text:     ":large_green_circle: Load testing of `test-name` in namespace `test-space` has succeeded",
+			expected: `{"attachments":[{"content":{"$schema":"http://adaptivecards.io/schemas/adaptive-card.json","body":[{"color":"Good","text":"🟢 Load testing of ` + "`test-name`" + ` in namespace ` + "`test-space`" + ` has succeeded","type":"TextBlock","weight":"Bolder","wrap":true},{"isSubtle":true,"size":"Small","text":"extra context\nCloud URL: [https://app.k6.io/runs/1](https://app.k6.io/runs/1)","type":"TextBlock","wrap":true}],"type":"AdaptiveCard","version":"1.4"},"contentType":"application/vnd.microsoft.card.adaptive"}],"type":"message"}`,
+		},
+		{
+			name:     "failure",
+			text:     ":red_circle: Load testing of `test-name` in namespace `test-space` has failed",
+			expected: `{"attachments":[{"content":{"$schema":"http://adaptivecards.io/schemas/adaptive-card.json","body":[{"color":"Attention","text":"🔴 Load testing of ` + "`test-name`" + ` in namespace ` + "`test-space`" + ` has failed","type":"TextBlock","weight":"Bolder","wrap":true},{"isSubtle":true,"size":"Small","text":"extra context\nCloud URL: [https://app.k6.io/runs/1](https://app.k6.io/runs/1)","type":"TextBlock","wrap":true}],"type":"AdaptiveCard","version":"1.4"},"contentType":"application/vnd.microsoft.card.adaptive"}],"type":"message"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var bodies []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				body, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				bodies = append(bodies, string(body))
+			}))
+			t.Cleanup(server.Close)
+
+			client := NewClient(map[string]string{"test": server.URL})
+			threads, err := client.SendMessages([]string{"test"}, tc.text, "extra context\nCloud URL: <https://app.k6.io/runs/1>")
+			require.NoError(t, err)
+			require.NoError(t, client.UpdateMessages(threads, tc.text, "extra context\nCloud URL: <https://app.k6.io/runs/1>"))
+
+			require.Len(t, bodies, 2)
+			assert.JSONEq(t, tc.expected, bodies[0])
+			assert.JSONEq(t, tc.expected, bodies[1])
+		})
+	}
+}
+
+func TestAddFileToThreads(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(map[string]string{"test": server.URL})
+	content := strings.Repeat("a", maxFileContentLength) + "end of output"
+	require.NoError(t, client.AddFileToThreads(map[string]string{"test": ""}, "k6-results.txt", content))
+
+	assert.Contains(t, body, `"text":"k6-results.txt"`)
+	assert.Contains(t, body, `"text":"...[output truncated]...\n`)
+	assert.Contains(t, body, `end of output"`)
+}
+
+func TestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(map[string]string{"test": server.URL})
+	_, err := client.SendMessages([]string{"test"}, "text", "")
+	assert.EqualError(t, err, "error sending message to test: unexpected status 400 Bad Request")
+
+	_, err = client.SendMessages([]string{"unknown"}, "text", "")
+	assert.EqualError(t, err, "error sending message to unknown: no webhook URL configured for channel unknown")
+}
+
+func TestParseWebhookURLs(t *testing.T) {
+	urls, err := ParseWebhookURLs([]string{"deploys=https://example.webhook.office.com/a", "alerts=https://example.webhook.office.com/b?x=y"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"deploys": "https://example.webhook.office.com/a",
+		"alerts":  "https://example.webhook.office.com/b?x=y",
+	}, urls)
+
+	_, err = ParseWebhookURLs([]string{"https://example.webhook.office.com/a"})
+	assert.EqualError(t, err, `invalid Teams webhook "https://example.webhook.office.com/a", expected <channel>=<webhook URL>`)
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/grafana/flagger-k6-webhook/pkg/k6"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// Matches the version in the output of `k6 version`, ex: `k6 v0.55.0 (go1.23.4, linux/amd64)`
+var k6VersionRegex = regexp.MustCompile(`k6 (v\d+\.\d+\.\d+\S*)`)
+
+func parseK6Version(output string) (string, error) {
+	matches := k6VersionRegex.FindStringSubmatch(output)
+	if len(matches) < 2 {
+		return "", fmt.Errorf("couldn't find the k6 version in %q", output)
+	}
+	return matches[1], nil
+}
+
+// reportK6Version logs the version of k6 and exposes it as the version label
+// of the launch_k6_version_info metric. Failures are only logged, the
+// readiness probe reports whether k6 can be run.
+func reportK6Version(ctx context.Context, client k6.Client, registerer prometheus.Registerer) {
+	output, err := client.Version(ctx)
+	if err != nil {
+		logrus.Warnf("could not get the k6 version: %v", err)
+		return
+	}
+	version, err := parseK6Version(output)
+	if err != nil {
+		logrus.Warnf("could not get the k6 version: %v", err)
+		return
+	}
+	logrus.Infof("using k6 %s", version)
+
+	versionInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "launch_k6_version_info",
+		Help: "Version of the k6 binary running the tests. The value is always 1",
+	}, []string{"version"})
+	versionInfo.With(prometheus.Labels{"version": version}).Set(1)
+	if err := registerer.Register(versionInfo); err != nil {
+		logrus.Warnf("Failed to register new metric: %s", err.Error())
+	}
+}
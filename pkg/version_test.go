@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafana/flagger-k6-webhook/pkg/mocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseK6Version(t *testing.T) {
+	for _, tc := range []struct {
+		output      string
+		expected    string
+		expectedErr string
+	}{
+		{
+			output:   "k6 v0.55.0 (go1.23.4, linux/amd64)",
+			expected: "v0.55.0",
+		},
+		{
+			output:   "k6 v1.0.0-rc1 (commit/b8d2c5f, go1.24.2, linux/amd64)\nExtensions:\n  github.com/grafana/xk6-sql v1.0.0, k6/x/sql [js]",
+			expected: "v1.0.0-rc1",
+		},
+		{
+			output:      "command not found",
+			expectedErr: `couldn't find the k6 version in "command not found"`,
+		},
+	} {
+		t.Run(tc.output, func(t *testing.T) {
+			version, err := parseK6Version(tc.output)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, version)
+		})
+	}
+}
+
+func TestReportK6Version(t *testing.T) {
+	t.Run("reports the version", func(t *testing.T) {
+		k6Client := mocks.NewMockK6Client(gomock.NewController(t))
+		k6Client.EXPECT().Version(gomock.Any()).Return("k6 v0.55.0 (go1.23.4, linux/amd64)", nil)
+
+		registry := prometheus.NewRegistry()
+		reportK6Version(context.Background(), k6Client, registry)
+
+		expected := `
+# HELP launch_k6_version_info Version of the k6 binary running the tests. The value is always 1
+# TYPE launch_k6_version_info gauge
+launch_k6_version_info{version="v0.55.0"} 1
+`
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "launch_k6_version_info"))
+	})
+
+	t.Run("k6 fails", func(t *testing.T) {
+		k6Client := mocks.NewMockK6Client(gomock.NewController(t))
+		k6Client.EXPECT().Version(gomock.Any()).Return("", errors.New("broken"))
+
+		registry := prometheus.NewRegistry()
+		reportK6Version(context.Background(), k6Client, registry)
+
+		count, err := testutil.GatherAndCount(registry)
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+}